@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stevemurr/simple-sync-server/store"
+)
+
+// apiKeyPrefix starts every generated key: ssk_<id>_<secret>.
+const apiKeyPrefix = "ssk"
+
+// KeyRecord is the stored form of an API key. It holds a SHA-256 hash of the
+// secret, never the secret itself.
+type KeyRecord struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Tenant    string   `json:"tenant,omitempty"`
+	Hash      string   `json:"hash,omitempty"`
+	Grants    []Grant  `json:"grants"`
+	Groups    []string `json:"groups,omitempty"`
+	CreatedAt string   `json:"createdAt"`
+}
+
+// NewAPIKey generates a key with the given grants, confined to a tenant
+// unless tenant is empty. It returns the key to hand to the client, which
+// cannot be recovered later, and the record to store.
+func NewAPIKey(name, tenant string, grants []Grant) (string, KeyRecord, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", KeyRecord{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", KeyRecord{}, err
+	}
+	rec := KeyRecord{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Tenant:    tenant,
+		Grants:    grants,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	s := base64.RawURLEncoding.EncodeToString(secret)
+	rec.Hash = hashSecret(s)
+	return apiKeyPrefix + "_" + rec.ID + "_" + s, rec, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// ToMap converts a record to the form kept by store.Store.
+func (k KeyRecord) ToMap() map[string]any {
+	b, _ := json.Marshal(k)
+	var m map[string]any
+	json.Unmarshal(b, &m)
+	return m
+}
+
+// KeyRecordFromMap converts a record read from store.Store.
+func KeyRecordFromMap(m map[string]any) (KeyRecord, error) {
+	var k KeyRecord
+	b, err := json.Marshal(m)
+	if err != nil {
+		return k, err
+	}
+	err = json.Unmarshal(b, &k)
+	return k, err
+}
+
+// APIKeys authenticates requests carrying an API key, either as
+// "Authorization: Bearer <key>" or in an X-API-Key header.
+type APIKeys struct {
+	Store store.Store
+
+	// Admin, if set, is a bootstrap key granting admin on every collection.
+	// It is compared directly and never stored.
+	Admin string
+}
+
+func (a *APIKeys) Authenticate(r *http.Request) (*Principal, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+	if a.Admin != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.Admin)) == 1 {
+		return &Principal{
+			Subject: "key:admin",
+			Grants:  []Grant{{Collections: AllCollections, Scopes: []Scope{ScopeAdmin}}},
+		}, nil
+	}
+
+	if !strings.HasPrefix(token, apiKeyPrefix+"_") {
+		return nil, ErrNoCredentials
+	}
+	parts := strings.SplitN(token, "_", 3)
+	if len(parts) != 3 {
+		return nil, ErrInvalidCredentials
+	}
+	raw, err := a.Store.GetAPIKey(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, ErrInvalidCredentials
+	}
+	rec, err := KeyRecordFromMap(raw)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(parts[2])), []byte(rec.Hash)) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Subject: "key:" + rec.ID, Tenant: rec.Tenant, Grants: rec.Grants, Groups: rec.Groups}, nil
+}
@@ -0,0 +1,235 @@
+// Package auth authenticates requests and authorizes them against
+// per-collection permissions.
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Scope is a level of access to a collection. Each scope includes the ones
+// below it: admin > write > read.
+type Scope string
+
+const (
+	ScopeRead  Scope = "read"
+	ScopeWrite Scope = "write"
+	ScopeAdmin Scope = "admin"
+)
+
+func (s Scope) rank() int {
+	switch s {
+	case ScopeRead:
+		return 1
+	case ScopeWrite:
+		return 2
+	case ScopeAdmin:
+		return 3
+	}
+	return 0
+}
+
+// Includes reports whether s grants at least need.
+func (s Scope) Includes(need Scope) bool {
+	return s.rank() > 0 && s.rank() >= need.rank()
+}
+
+// Grant allows scopes on every collection whose name matches a pattern in
+// path.Match syntax ("*" matches all collections).
+type Grant struct {
+	Collections string  `json:"collections"`
+	Scopes      []Scope `json:"scopes"`
+}
+
+// Validate checks that the pattern is well formed and the scopes are known.
+func (g Grant) Validate() error {
+	if g.Collections == "" {
+		return errors.New("grant needs a collections pattern")
+	}
+	if _, err := path.Match(g.Collections, ""); err != nil {
+		return fmt.Errorf("invalid collections pattern %q", g.Collections)
+	}
+	if len(g.Scopes) == 0 {
+		return errors.New("grant needs at least one scope")
+	}
+	for _, s := range g.Scopes {
+		if s.rank() == 0 {
+			return fmt.Errorf("unknown scope %q (supported: read, write, admin)", s)
+		}
+	}
+	return nil
+}
+
+// Principal is an authenticated caller.
+type Principal struct {
+	// Subject identifies the caller: "key:<id>" for API keys, the sub
+	// claim for tokens.
+	Subject string
+
+	// Tenant, if set, confines the principal to one tenant's namespace;
+	// its grants apply to that tenant's collections only. Without a tenant
+	// the grants apply to the default namespace, and other tenants are
+	// only reachable with admin on all collections (see CrossTenant).
+	Tenant string
+
+	Grants []Grant
+
+	// Groups the principal belongs to, used by per-document ACLs.
+	Groups []string
+}
+
+// CrossTenant reports whether p may reach every tenant's namespace: it is
+// not bound to a tenant and holds admin on all collections.
+func (p *Principal) CrossTenant() bool {
+	return p.Tenant == "" && p.Allows(AllCollections, ScopeAdmin)
+}
+
+// Allows reports whether p holds scope need on collection. The collection
+// "*" stands for all collections and is only matched by the pattern "*".
+func (p *Principal) Allows(collection string, need Scope) bool {
+	for _, g := range p.Grants {
+		if ok, _ := path.Match(g.Collections, collection); !ok {
+			continue
+		}
+		for _, s := range g.Scopes {
+			if s.Includes(need) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying p.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal of an authenticated request, or nil when
+// authentication is disabled.
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+type refusalKey struct{}
+
+// WithRefusals returns a context in which Middleware notes that it refused
+// the request, for Refused to report once the request is served.
+func WithRefusals(ctx context.Context) context.Context {
+	return context.WithValue(ctx, refusalKey{}, new(bool))
+}
+
+// Refused reports whether Middleware refused a request served with a
+// context from WithRefusals, as opposed to a handler behind it answering
+// 401 or 403.
+func Refused(ctx context.Context) bool {
+	refused, _ := ctx.Value(refusalKey{}).(*bool)
+	return refused != nil && *refused
+}
+
+// refuse notes in r's context that Middleware refused it.
+func refuse(r *http.Request) {
+	if refused, ok := r.Context().Value(refusalKey{}).(*bool); ok {
+		*refused = true
+	}
+}
+
+// Errors returned by Authenticators.
+var (
+	ErrNoCredentials      = errors.New("no credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Authenticator identifies the caller of a request. It returns
+// ErrNoCredentials if the request carries none it recognizes.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Chain tries each Authenticator in turn until one recognizes the request's
+// credentials.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (*Principal, error) {
+	for _, a := range c {
+		p, err := a.Authenticate(r)
+		if !errors.Is(err, ErrNoCredentials) {
+			return p, err
+		}
+	}
+	return nil, ErrNoCredentials
+}
+
+// bearerToken returns the credential from an "Authorization: Bearer" or
+// "X-API-Key" header.
+func bearerToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); h != "" {
+		if scheme, token, ok := strings.Cut(h, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="simple-sync-server"`)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"detail": msg})
+}
+
+// Middleware authenticates every request that is not public, rejecting it
+// with 401 when credentials are missing or invalid and with 403 when the
+// principal lacks the scope the route requires (see Target).
+func Middleware(next http.Handler, authn Authenticator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := Target(r)
+		if t.Public {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := authn.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) && bearerToken(r) != "" {
+			err = ErrInvalidCredentials
+		}
+		switch {
+		case errors.Is(err, ErrNoCredentials):
+			refuse(r)
+			writeError(w, http.StatusUnauthorized, "authentication required")
+			return
+		case errors.Is(err, ErrInvalidCredentials):
+			refuse(r)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if p.Tenant != "" && (t.Global || (t.Tenant != "" && t.Tenant != p.Tenant)) {
+			refuse(r)
+			writeError(w, http.StatusForbidden, fmt.Sprintf("access outside tenant %q denied", p.Tenant))
+			return
+		}
+		if p.Tenant == "" && t.Tenant != "" && !p.CrossTenant() {
+			refuse(r)
+			writeError(w, http.StatusForbidden, fmt.Sprintf("access to tenant %q denied", t.Tenant))
+			return
+		}
+		if t.Scope != "" && !p.Allows(t.Collection, t.Scope) {
+			refuse(r)
+			writeError(w, http.StatusForbidden, fmt.Sprintf("%s access to %q denied", t.Scope, t.Collection))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+	})
+}
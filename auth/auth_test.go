@@ -0,0 +1,92 @@
+package auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stevemurr/simple-sync-server/auth"
+)
+
+func TestAllows(t *testing.T) {
+	p := &auth.Principal{Grants: []auth.Grant{
+		{Collections: "tasks-*", Scopes: []auth.Scope{auth.ScopeRead}},
+		{Collections: "notes", Scopes: []auth.Scope{auth.ScopeAdmin}},
+	}}
+	tests := []struct {
+		collection string
+		scope      auth.Scope
+		want       bool
+	}{
+		{"tasks-a", auth.ScopeRead, true},
+		{"tasks-a", auth.ScopeWrite, false},
+		{"tasks", auth.ScopeRead, false},
+		{"notes", auth.ScopeWrite, true},
+		{"notes", auth.ScopeAdmin, true},
+		{auth.AllCollections, auth.ScopeRead, false},
+	}
+	for _, tt := range tests {
+		if got := p.Allows(tt.collection, tt.scope); got != tt.want {
+			t.Errorf("Allows(%q, %s) = %v, want %v", tt.collection, tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestTarget(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         auth.RouteTarget
+	}{
+		{"GET", "/", auth.RouteTarget{Public: true}},
+		{"GET", "/health", auth.RouteTarget{Public: true}},
+		{"GET", "/notes", auth.RouteTarget{Collection: "notes", Scope: auth.ScopeRead}},
+		{"POST", "/sync", auth.RouteTarget{Collection: "notes", Scope: auth.ScopeWrite}},
+		{"GET", "/collections", auth.RouteTarget{}},
+		{"PUT", "/collections/tasks/items/1", auth.RouteTarget{Collection: "tasks", Scope: auth.ScopeWrite}},
+		{"GET", "/collections/tasks/search", auth.RouteTarget{Collection: "tasks", Scope: auth.ScopeRead}},
+		{"PUT", "/collections/tasks/search/fields", auth.RouteTarget{Collection: "tasks", Scope: auth.ScopeAdmin}},
+		{"GET", "/collections/tasks/validate", auth.RouteTarget{Collection: "tasks", Scope: auth.ScopeAdmin}},
+		{"POST", "/collections/tasks/migrate", auth.RouteTarget{Collection: "tasks", Scope: auth.ScopeAdmin}},
+		{"DELETE", "/collections/tasks/indexes/a", auth.RouteTarget{Collection: "tasks", Scope: auth.ScopeAdmin}},
+		{"GET", "/schemas/tasks", auth.RouteTarget{Collection: "tasks", Scope: auth.ScopeRead}},
+		{"PUT", "/schemas/tasks", auth.RouteTarget{Collection: "tasks", Scope: auth.ScopeAdmin}},
+		{"GET", "/admin/keys", auth.RouteTarget{Global: true, Collection: auth.AllCollections, Scope: auth.ScopeAdmin}},
+		{"GET", "/admin/export", auth.RouteTarget{Collection: auth.AllCollections, Scope: auth.ScopeAdmin}},
+		{"GET", "/t/acme/notes", auth.RouteTarget{Tenant: "acme", Collection: "notes", Scope: auth.ScopeRead}},
+		{"PUT", "/t/acme/schemas/tasks", auth.RouteTarget{Tenant: "acme", Collection: "tasks", Scope: auth.ScopeAdmin}},
+		{"POST", "/t/acme/admin/purge", auth.RouteTarget{Tenant: "acme", Collection: auth.AllCollections, Scope: auth.ScopeAdmin}},
+		{"GET", "/t/acme/health", auth.RouteTarget{Tenant: "acme"}},
+		{"GET", "/collections/a%2Fb/items/secret", auth.RouteTarget{Collection: "a/b", Scope: auth.ScopeRead}},
+		{"GET", "/t/ac%2Fme/collections/a%2Fb/items", auth.RouteTarget{Tenant: "ac/me", Collection: "a/b", Scope: auth.ScopeRead}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := auth.Target(r); got != tt.want {
+			t.Errorf("%s %s: got %+v, want %+v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestGrantValidate(t *testing.T) {
+	valid := auth.Grant{Collections: "*", Scopes: []auth.Scope{auth.ScopeRead}}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range []auth.Grant{
+		{Scopes: []auth.Scope{auth.ScopeRead}},
+		{Collections: "[", Scopes: []auth.Scope{auth.ScopeRead}},
+		{Collections: "x"},
+		{Collections: "x", Scopes: []auth.Scope{"owner"}},
+	} {
+		if err := g.Validate(); err == nil {
+			t.Errorf("expected error for %+v", g)
+		}
+	}
+}
+
+// httpHandler returns a handler reporting the request's principal to seen.
+func httpHandler(seen func(*auth.Principal)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen(auth.FromContext(r.Context()))
+	})
+}
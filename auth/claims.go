@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ClaimMapping turns token claims into grants. Grants come from the roles
+// listed in a claim and from defaults given to every token. Collection
+// patterns may refer to string claims as {name}, so
+//
+//	{"collections": "user-{sub}-*", "scopes": ["write"]}
+//
+// gives each subject its own collections. A grant referring to a claim the
+// token lacks is dropped.
+type ClaimMapping struct {
+	// RolesClaim names the claim holding the token's roles, as an array of
+	// strings or a space-separated string. Defaults to "roles".
+	RolesClaim string `json:"rolesClaim"`
+
+	// TenantClaim, if set, names the claim holding the tenant a token is
+	// confined to. Tokens without it are rejected.
+	TenantClaim string `json:"tenantClaim"`
+
+	// GroupsClaim names the claim listing the groups a token's subject
+	// belongs to, in the same forms as RolesClaim. Defaults to "groups".
+	GroupsClaim string `json:"groupsClaim"`
+
+	Roles   map[string][]Grant `json:"roles"`
+	Default []Grant            `json:"default"`
+}
+
+// LoadClaimMapping reads a ClaimMapping from a JSON file.
+func LoadClaimMapping(path string) (ClaimMapping, error) {
+	var m ClaimMapping
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, grants := range append([][]Grant{m.Default}, mapValues(m.Roles)...) {
+		for _, g := range grants {
+			if err := g.Validate(); err != nil {
+				return m, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	return m, nil
+}
+
+func mapValues(m map[string][]Grant) [][]Grant {
+	values := make([][]Grant, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
+
+// Grants returns the grants for a set of verified claims.
+func (m ClaimMapping) Grants(claims map[string]any) []Grant {
+	var grants []Grant
+	add := func(gs []Grant) {
+		for _, g := range gs {
+			if pattern, ok := expandClaims(g.Collections, claims); ok {
+				grants = append(grants, Grant{Collections: pattern, Scopes: g.Scopes})
+			}
+		}
+	}
+	add(m.Default)
+	for _, role := range m.roles(claims) {
+		add(m.Roles[role])
+	}
+	return grants
+}
+
+func (m ClaimMapping) roles(claims map[string]any) []string {
+	name := m.RolesClaim
+	if name == "" {
+		name = "roles"
+	}
+	return stringsClaim(claims, name)
+}
+
+// Groups returns the groups listed in a set of verified claims.
+func (m ClaimMapping) Groups(claims map[string]any) []string {
+	name := m.GroupsClaim
+	if name == "" {
+		name = "groups"
+	}
+	return stringsClaim(claims, name)
+}
+
+// stringsClaim reads a claim holding an array of strings or a
+// space-separated string.
+func stringsClaim(claims map[string]any, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		var values []string
+		for _, r := range v {
+			if s, ok := r.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// expandClaims replaces {name} references in a pattern with the matching
+// string claims, escaped so they match literally.
+func expandClaims(pattern string, claims map[string]any) (string, bool) {
+	var b strings.Builder
+	for {
+		open := strings.IndexByte(pattern, '{')
+		if open < 0 {
+			b.WriteString(pattern)
+			return b.String(), true
+		}
+		end := strings.IndexByte(pattern[open:], '}')
+		if end < 0 {
+			b.WriteString(pattern)
+			return b.String(), true
+		}
+		v, ok := claims[pattern[open+1:open+end]].(string)
+		if !ok || v == "" {
+			return "", false
+		}
+		b.WriteString(pattern[:open])
+		for _, r := range v {
+			if strings.ContainsRune(`*?[\`, r) {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		pattern = pattern[open+end+1:]
+	}
+}
@@ -0,0 +1,326 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/stevemurr/simple-sync-server/store"
+)
+
+// Supported JWT signature algorithms.
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+// VerifyKey is a key that can verify token signatures. Key is a []byte
+// secret for HS256, an *rsa.PublicKey for RS256 or an *ecdsa.PublicKey on
+// P-256 for ES256.
+type VerifyKey struct {
+	// ID matches the "kid" token header. Keys without an ID are tried for
+	// every token.
+	ID  string
+	Key any
+}
+
+// alg returns the algorithm the key verifies. Tying each key to a single
+// algorithm prevents tokens from choosing how they are checked.
+func (k VerifyKey) alg() string {
+	switch key := k.Key.(type) {
+	case []byte:
+		return AlgHS256
+	case *rsa.PublicKey:
+		return AlgRS256
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return AlgES256
+		}
+	}
+	return ""
+}
+
+// LoadPEM reads a PEM-encoded RSA or ECDSA public key or certificate.
+func LoadPEM(path string) (VerifyKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return VerifyKey{}, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return VerifyKey{}, fmt.Errorf("%s: no PEM data", path)
+	}
+	var key any
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return VerifyKey{}, fmt.Errorf("%s: %w", path, err)
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return VerifyKey{}, fmt.Errorf("%s: %w", path, err)
+	}
+	k := VerifyKey{Key: key}
+	if k.alg() == "" {
+		return VerifyKey{}, fmt.Errorf("%s: unsupported key type %T", path, key)
+	}
+	return k, nil
+}
+
+// jwk is a JSON Web Key as found in a JWKS document.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// LoadJWKS reads the RSA, P-256 and symmetric keys of a JWKS document,
+// skipping keys it does not support or that are not for signatures.
+func LoadJWKS(path string) ([]VerifyKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var keys []VerifyKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %q: %w", path, k.Kid, err)
+		}
+		if key != nil {
+			keys = append(keys, VerifyKey{ID: k.Kid, Key: key})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no usable keys", path)
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (any, error) {
+	b64 := func(s string) ([]byte, error) { return base64.RawURLEncoding.DecodeString(s) }
+	switch k.Kty {
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := b64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("point not on curve")
+		}
+		return pub, nil
+	case "oct":
+		return b64(k.K)
+	}
+	return nil, nil
+}
+
+// JWT authenticates requests carrying a signed JSON Web Token as
+// "Authorization: Bearer <token>".
+type JWT struct {
+	Keys []VerifyKey
+
+	// Issuer and Audience, if set, must match the iss and aud claims.
+	Issuer   string
+	Audience string
+
+	// Claims maps the verified claims to grants.
+	Claims ClaimMapping
+
+	// Leeway tolerates clock skew when checking exp and nbf.
+	Leeway time.Duration
+
+	// Now returns the current time; nil means time.Now.
+	Now func() time.Time
+}
+
+func (j *JWT) Authenticate(r *http.Request) (*Principal, error) {
+	token := bearerToken(r)
+	if strings.Count(token, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+	claims, err := j.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	p := &Principal{
+		Subject: claims["sub"].(string),
+		Grants:  j.Claims.Grants(claims),
+		Groups:  j.Claims.Groups(claims),
+	}
+	if j.Claims.TenantClaim != "" {
+		tenant, _ := claims[j.Claims.TenantClaim].(string)
+		if !store.ValidTenant(tenant) {
+			return nil, fmt.Errorf("%w: missing or invalid %s claim", ErrInvalidCredentials, j.Claims.TenantClaim)
+		}
+		p.Tenant = tenant
+	}
+	return p, nil
+}
+
+// Verify checks a token's signature and registered claims and returns its
+// claims. Errors wrap ErrInvalidCredentials.
+func (j *JWT) Verify(token string) (map[string]any, error) {
+	invalid := func(msg string) error { return fmt.Errorf("%w: %s", ErrInvalidCredentials, msg) }
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalid("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, invalid("malformed header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalid("malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	verified := false
+	for _, k := range j.Keys {
+		if (k.ID != "" && k.ID != header.Kid) || k.alg() != header.Alg {
+			continue
+		}
+		if verifySignature(k, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, invalid("signature verification failed")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, invalid("malformed claims")
+	}
+	now := time.Now
+	if j.Now != nil {
+		now = j.Now
+	}
+	t := now()
+	if exp, ok := claims["exp"].(float64); ok && t.After(time.Unix(int64(exp), 0).Add(j.Leeway)) {
+		return nil, invalid("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && t.Before(time.Unix(int64(nbf), 0).Add(-j.Leeway)) {
+		return nil, invalid("token not yet valid")
+	}
+	if j.Issuer != "" && claims["iss"] != j.Issuer {
+		return nil, invalid("unexpected issuer")
+	}
+	if j.Audience != "" && !hasAudience(claims["aud"], j.Audience) {
+		return nil, invalid("unexpected audience")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, invalid("missing subject")
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifySignature(k VerifyKey, signed, sig []byte) bool {
+	switch key := k.Key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case *rsa.PublicKey:
+		sum := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) == nil
+	case *ecdsa.PublicKey:
+		// ES256 signatures are the fixed-width concatenation r || s.
+		if len(sig) != 64 {
+			return false
+		}
+		sum := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key, sum[:], r, s)
+	}
+	return false
+}
+
+// hasAudience reports whether an aud claim (a string or array of strings)
+// names want.
+func hasAudience(aud any, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []any:
+		for _, a := range aud {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,242 @@
+package auth_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stevemurr/simple-sync-server/auth"
+)
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+// sign builds a token signed with key (a []byte secret, *rsa.PrivateKey or
+// *ecdsa.PrivateKey).
+func sign(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	header := map[string]any{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := b64(h) + "." + b64(c)
+	sum := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestJWTVerify(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	secret := []byte("s3cret")
+	now := time.Unix(1700000000, 0)
+
+	j := &auth.JWT{
+		Keys: []auth.VerifyKey{
+			{Key: secret},
+			{ID: "rsa1", Key: &rsaKey.PublicKey},
+			{ID: "ec1", Key: &ecKey.PublicKey},
+		},
+		Issuer:   "https://idp.example",
+		Audience: "sync",
+		Now:      func() time.Time { return now },
+	}
+	claims := func(extra map[string]any) map[string]any {
+		c := map[string]any{"sub": "alice", "iss": "https://idp.example", "aud": []any{"sync"}, "exp": float64(now.Unix() + 60)}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+
+	valid := map[string]string{
+		"HS256": sign(t, auth.AlgHS256, "", secret, claims(nil)),
+		"RS256": sign(t, auth.AlgRS256, "rsa1", rsaKey, claims(nil)),
+		"ES256": sign(t, auth.AlgES256, "ec1", ecKey, claims(nil)),
+	}
+	for name, token := range valid {
+		got, err := j.Verify(token)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got["sub"] != "alice" {
+			t.Errorf("%s: expected sub=alice, got %v", name, got["sub"])
+		}
+	}
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	invalid := map[string]string{
+		"wrong secret":   sign(t, auth.AlgHS256, "", []byte("nope"), claims(nil)),
+		"wrong key":      sign(t, auth.AlgRS256, "rsa1", otherKey, claims(nil)),
+		"unknown kid":    sign(t, auth.AlgRS256, "rsa2", rsaKey, claims(nil)),
+		"alg confusion":  sign(t, auth.AlgHS256, "rsa1", x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey), claims(nil)),
+		"no signature":   valid["HS256"][:len(valid["HS256"])-43],
+		"expired":        sign(t, auth.AlgHS256, "", secret, claims(map[string]any{"exp": float64(now.Unix() - 1)})),
+		"not yet valid":  sign(t, auth.AlgHS256, "", secret, claims(map[string]any{"nbf": float64(now.Unix() + 60)})),
+		"wrong issuer":   sign(t, auth.AlgHS256, "", secret, claims(map[string]any{"iss": "evil"})),
+		"wrong audience": sign(t, auth.AlgHS256, "", secret, claims(map[string]any{"aud": "other"})),
+		"no subject":     sign(t, auth.AlgHS256, "", secret, claims(map[string]any{"sub": ""})),
+		"malformed":      "a.b.c",
+		"alg none":       b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"sub":"alice"}`)) + ".",
+	}
+	for name, token := range invalid {
+		if _, err := j.Verify(token); !errors.Is(err, auth.ErrInvalidCredentials) {
+			t.Errorf("%s: expected ErrInvalidCredentials, got %v", name, err)
+		}
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	der, _ := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	pemPath := filepath.Join(dir, "key.pem")
+	os.WriteFile(pemPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644)
+	k, err := auth.LoadPEM(pemPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &auth.JWT{Keys: []auth.VerifyKey{k}}
+	if _, err := j.Verify(sign(t, auth.AlgES256, "any", ecKey, map[string]any{"sub": "a"})); err != nil {
+		t.Fatalf("PEM key: %v", err)
+	}
+
+	x, y := make([]byte, 32), make([]byte, 32)
+	ecKey.X.FillBytes(x)
+	ecKey.Y.FillBytes(y)
+	jwks, _ := json.Marshal(map[string]any{"keys": []any{
+		map[string]any{"kty": "RSA", "kid": "r", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+		map[string]any{"kty": "EC", "kid": "e", "crv": "P-256", "x": b64(x), "y": b64(y)},
+		map[string]any{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AA", "e": "AQAB"},
+	}})
+	jwksPath := filepath.Join(dir, "jwks.json")
+	os.WriteFile(jwksPath, jwks, 0o644)
+	keys, err := auth.LoadJWKS(jwksPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 signing keys, got %d", len(keys))
+	}
+	j = &auth.JWT{Keys: keys}
+	if _, err := j.Verify(sign(t, auth.AlgRS256, "r", rsaKey, map[string]any{"sub": "a"})); err != nil {
+		t.Fatalf("JWKS RSA key: %v", err)
+	}
+	if _, err := j.Verify(sign(t, auth.AlgES256, "e", ecKey, map[string]any{"sub": "a"})); err != nil {
+		t.Fatalf("JWKS EC key: %v", err)
+	}
+}
+
+func TestClaimMapping(t *testing.T) {
+	m := auth.ClaimMapping{
+		Roles: map[string][]auth.Grant{
+			"editor": {{Collections: "*", Scopes: []auth.Scope{auth.ScopeWrite}}},
+		},
+		Default: []auth.Grant{
+			{Collections: "user-{sub}", Scopes: []auth.Scope{auth.ScopeAdmin}},
+			{Collections: "team-{team}", Scopes: []auth.Scope{auth.ScopeRead}},
+		},
+	}
+	got := m.Grants(map[string]any{"sub": "a*", "roles": []any{"editor", "viewer"}})
+	want := []auth.Grant{
+		{Collections: `user-a\*`, Scopes: []auth.Scope{auth.ScopeAdmin}},
+		{Collections: "*", Scopes: []auth.Scope{auth.ScopeWrite}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	p := &auth.Principal{Grants: got}
+	if p.Allows("user-ab", auth.ScopeAdmin) || !p.Allows("user-a*", auth.ScopeAdmin) {
+		t.Fatal("claim values must match literally")
+	}
+
+	m.RolesClaim = "scope"
+	if got := m.Grants(map[string]any{"sub": "b", "team": "x", "scope": "editor other"}); len(got) != 3 {
+		t.Fatalf("expected 3 grants, got %+v", got)
+	}
+
+	if got := m.Groups(map[string]any{"groups": []any{"team", 1.0}}); !reflect.DeepEqual(got, []string{"team"}) {
+		t.Fatalf("expected [team], got %v", got)
+	}
+	m.GroupsClaim = "grp"
+	if got := m.Groups(map[string]any{"grp": "a b"}); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("expected [a b], got %v", got)
+	}
+}
+
+func TestJWTMiddleware(t *testing.T) {
+	secret := []byte("s3cret")
+	j := &auth.JWT{
+		Keys:   []auth.VerifyKey{{Key: secret}},
+		Claims: auth.ClaimMapping{Default: []auth.Grant{{Collections: "notes", Scopes: []auth.Scope{auth.ScopeRead}}}},
+	}
+	var seen *auth.Principal
+	h := auth.Middleware(httpHandler(func(p *auth.Principal) { seen = p }), auth.Chain{&auth.APIKeys{}, j})
+
+	for _, tt := range []struct {
+		token string
+		want  int
+	}{
+		{sign(t, auth.AlgHS256, "", secret, map[string]any{"sub": "bob"}), 200},
+		{sign(t, auth.AlgHS256, "", []byte("x"), map[string]any{"sub": "bob"}), 401},
+		{"garbage", 401},
+	} {
+		r := httptest.NewRequest("GET", "/notes", nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Fatalf("token %q: expected %d, got %d", tt.token, tt.want, w.Code)
+		}
+	}
+	if seen == nil || seen.Subject != "bob" {
+		t.Fatalf("expected subject bob, got %+v", seen)
+	}
+
+	r := httptest.NewRequest("PUT", "/notes/1", nil)
+	r.Header.Set("Authorization", "Bearer "+sign(t, auth.AlgHS256, "", secret, map[string]any{"sub": "bob"}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 403 {
+		t.Fatalf("expected 403 for write with read grant, got %d", w.Code)
+	}
+}
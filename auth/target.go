@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AllCollections is the collection name used for operations that are not
+// specific to one collection, such as key management.
+const AllCollections = "*"
+
+// RouteTarget is the permission a request needs.
+type RouteTarget struct {
+	// Public requests need no authentication.
+	Public bool
+
+	// Tenant is the tenant named in a /t/{tenant} path prefix. Global
+	// routes manage the whole server and are closed to tenant-bound
+	// principals.
+	Tenant string
+	Global bool
+
+	// Collection and Scope name the access required. An empty Scope means
+	// any authenticated principal may proceed; the handler narrows results
+	// itself (e.g. collection listings).
+	Collection string
+	Scope      Scope
+}
+
+// Target maps a request onto the permission it needs, following the routes
+// registered by the handler package. Routes other than /, /health and the
+// global admin routes may be prefixed with /t/{tenant}.
+//
+//	/, /health                          public
+//	/notes..., /sync                    read (GET) or write on "notes"
+//	/collections                        any principal
+//	/collections/{c}/indexes...         read (GET) or admin on c
+//	/collections/{c}/search/fields      read (GET) or admin on c
+//	/collections/{c}/validate           admin on c
+//	/collections/{c}/migrate            read (GET) or admin on c
+//	/collections/{c}/...                read (GET) or write on c
+//	/schemas                            any principal
+//	/schemas/{c}                        read (GET) or admin on c
+//	/batch                              any principal; checked per operation
+//	/admin/keys..., /admin/tenants...   admin on "*", global
+//	/admin/...                          admin on "*"
+//
+// Segments are split on the escaped path and unescaped one by one, as the
+// handler's routes bind them, so an escaped "/" stays within a collection
+// name ("a%2Fb" is collection "a/b", not collection "a").
+func Target(r *http.Request) RouteTarget {
+	segs := segments(r)
+	if len(segs) == 0 || len(segs) == 1 && segs[0] == "health" {
+		return RouteTarget{Public: true}
+	}
+	if len(segs) >= 2 && segs[0] == "t" {
+		t := target(r, segs[2:])
+		t.Tenant = segs[1]
+		return t
+	}
+	t := target(r, segs)
+	if len(segs) >= 2 && segs[0] == "admin" && (segs[1] == "keys" || segs[1] == "tenants") {
+		t.Global = true
+	}
+	return t
+}
+
+// segments splits the escaped path of a request and unescapes each segment.
+func segments(r *http.Request) []string {
+	p := strings.Trim(r.URL.EscapedPath(), "/")
+	if p == "" {
+		return nil
+	}
+	segs := strings.Split(p, "/")
+	for i, seg := range segs {
+		if u, err := url.PathUnescape(seg); err == nil {
+			segs[i] = u
+		}
+	}
+	return segs
+}
+
+// target classifies the path segments following any tenant prefix.
+func target(r *http.Request, segs []string) RouteTarget {
+	if len(segs) == 0 {
+		return RouteTarget{}
+	}
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	access := func(collection string, mutate Scope) RouteTarget {
+		if read {
+			return RouteTarget{Collection: collection, Scope: ScopeRead}
+		}
+		return RouteTarget{Collection: collection, Scope: mutate}
+	}
+
+	switch segs[0] {
+	case "notes", "sync":
+		return access("notes", ScopeWrite)
+	case "collections":
+		if len(segs) == 1 {
+			return RouteTarget{}
+		}
+		if len(segs) == 3 && segs[2] == "validate" {
+			// An audit reads every document, whoever owns it.
+			return RouteTarget{Collection: segs[1], Scope: ScopeAdmin}
+		}
+		if len(segs) >= 3 && (segs[2] == "indexes" || segs[2] == "migrate" || (segs[2] == "search" && len(segs) > 3)) {
+			return access(segs[1], ScopeAdmin)
+		}
+		return access(segs[1], ScopeWrite)
+	case "schemas":
+		if len(segs) == 1 {
+			return RouteTarget{}
+		}
+		return access(segs[1], ScopeAdmin)
+	case "admin":
+		return RouteTarget{Collection: AllCollections, Scope: ScopeAdmin}
+	case "batch":
+		// Each operation is authorized by the handler.
+		return RouteTarget{}
+	}
+	return RouteTarget{}
+}
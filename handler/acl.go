@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/stevemurr/simple-sync-server/auth"
+)
+
+// groupPrefix marks ACL entries naming a group rather than a subject.
+const groupPrefix = "group:"
+
+// acl shares one document of an x-owner collection with other users.
+// Entries name a subject or, as "group:<name>", every member of a group.
+// Write access implies read access.
+type acl struct {
+	Read      []string `json:"read"`
+	Write     []string `json:"write"`
+	UpdatedAt string   `json:"updatedAt,omitempty"`
+}
+
+func aclFromMap(m map[string]any) acl {
+	var a acl
+	b, _ := json.Marshal(m)
+	json.Unmarshal(b, &a)
+	return a
+}
+
+func (a acl) toMap() map[string]any {
+	b, _ := json.Marshal(a)
+	var m map[string]any
+	json.Unmarshal(b, &m)
+	return m
+}
+
+func (a acl) validate() error {
+	for _, entry := range append(slices.Clone(a.Read), a.Write...) {
+		if entry == "" || entry == groupPrefix {
+			return fmt.Errorf("invalid ACL entry %q", entry)
+		}
+	}
+	return nil
+}
+
+// allows reports whether the ACL lets p read and write the document.
+func (a acl) allows(p *auth.Principal) (read, write bool) {
+	names := func(entries []string) bool {
+		for _, entry := range entries {
+			if group, ok := strings.CutPrefix(entry, groupPrefix); ok {
+				if slices.Contains(p.Groups, group) {
+					return true
+				}
+			} else if entry == p.Subject {
+				return true
+			}
+		}
+		return false
+	}
+	write = names(a.Write)
+	return write || names(a.Read), write
+}
+
+// ---------- ACL endpoints ----------
+
+// aclTarget loads the document whose ACL a request addresses, writing an
+// error response and returning ok=false if it cannot be managed.
+func (h *Handler) aclTarget(w http.ResponseWriter, r *http.Request) (o *ownership, doc map[string]any, ok bool) {
+	collection, key := r.PathValue("collection"), r.PathValue("key")
+	c, err := h.collectionSchema(r, collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return nil, nil, false
+	}
+	if c == nil || c.owner == nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("collection %q has no x-owner field; ACLs need document ownership", collection))
+		return nil, nil, false
+	}
+	o, err = h.ownership(r, collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return nil, nil, false
+	}
+	doc, err = h.storeFor(r).Get(collection, key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return nil, nil, false
+	}
+	if doc == nil || !o.visible(key, doc) {
+		writeError(w, http.StatusNotFound, "not found")
+		return nil, nil, false
+	}
+	return o, doc, true
+}
+
+func (h *Handler) getACL(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := h.aclTarget(w, r); !ok {
+		return
+	}
+	m, err := h.storeFor(r).GetACL(r.PathValue("collection"), r.PathValue("key"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a := aclFromMap(m)
+	if a.Read == nil {
+		a.Read = []string{}
+	}
+	if a.Write == nil {
+		a.Write = []string{}
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+func (h *Handler) putACL(w http.ResponseWriter, r *http.Request) {
+	var a acl
+	if err := h.readJSON(w, r, &a); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if err := a.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	o, doc, ok := h.aclTarget(w, r)
+	if !ok {
+		return
+	}
+	if !o.owns(doc) {
+		writeError(w, http.StatusForbidden, "only the document's owner may change its ACL")
+		return
+	}
+	a.Read, a.Write = append([]string{}, a.Read...), append([]string{}, a.Write...)
+	a.UpdatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	if err := h.storeFor(r).PutACL(r.PathValue("collection"), r.PathValue("key"), a.toMap()); err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+func (h *Handler) deleteACL(w http.ResponseWriter, r *http.Request) {
+	o, doc, ok := h.aclTarget(w, r)
+	if !ok {
+		return
+	}
+	if !o.owns(doc) {
+		writeError(w, http.StatusForbidden, "only the document's owner may change its ACL")
+		return
+	}
+	key := r.PathValue("key")
+	if err := h.storeFor(r).PutACL(r.PathValue("collection"), key, nil); err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted", "key": key})
+}
@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/stevemurr/simple-sync-server/auth"
+	"github.com/stevemurr/simple-sync-server/patch"
+	"github.com/stevemurr/simple-sync-server/store"
+)
+
+// batchOp is one operation of a POST /batch request.
+type batchOp struct {
+	Op         string          `json:"op"` // get, put, patch or delete
+	Collection string          `json:"collection"`
+	Key        string          `json:"key"`
+	Body       json.RawMessage `json:"body,omitempty"`
+
+	// ContentType selects the patch format; merge patch by default.
+	ContentType string `json:"contentType,omitempty"`
+	IfMatch     string `json:"ifMatch,omitempty"`
+}
+
+// batchResult is the outcome of one operation.
+type batchResult struct {
+	Status int    `json:"status"`
+	ETag   string `json:"etag,omitempty"`
+	Body   any    `json:"body,omitempty"`
+}
+
+var batchMethods = map[string]string{
+	"get":    http.MethodGet,
+	"put":    http.MethodPut,
+	"patch":  http.MethodPatch,
+	"delete": http.MethodDelete,
+}
+
+// txKey carries the store of an atomic batch in a request context.
+type txKey struct{}
+
+// errBatchFailed aborts an atomic batch.
+var errBatchFailed = errors.New("batch operation failed")
+
+// batchEnvelope is how deeply operation bodies nest within a batch request:
+// {"operations": [{"body": ...}]}.
+const batchEnvelope = 3
+
+// batch runs a list of item operations in order, each exactly as its own
+// request would, and reports a status and body for each. An atomic batch
+// stops at the first failing operation and undoes the ones before it.
+func (h *Handler) batch(w http.ResponseWriter, r *http.Request) {
+	// Nesting is checked before decoding; operation bodies are checked
+	// against the document limits by the item handlers.
+	var req struct {
+		Atomic     bool      `json:"atomic"`
+		Operations []batchOp `json:"operations"`
+	}
+	body, err := h.readBody(w, r)
+	if err == nil {
+		err = h.checkDepthWithin(body, batchEnvelope)
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		bodyError(w, err)
+		return
+	}
+	if max := h.limits.MaxBatchOperations; max > 0 && len(req.Operations) > max {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("batch has %d operations, over the limit of %d", len(req.Operations), max))
+		return
+	}
+
+	results := make([]batchResult, len(req.Operations))
+	run := func(ctx context.Context) error {
+		for i, op := range req.Operations {
+			results[i] = h.runBatchOp(r.WithContext(ctx), op)
+			if req.Atomic && results[i].Status >= 400 {
+				for j := i + 1; j < len(results); j++ {
+					results[j] = batchResult{
+						Status: http.StatusFailedDependency,
+						Body:   map[string]string{"detail": fmt.Sprintf("not executed: operation %d failed", i)},
+					}
+				}
+				return errBatchFailed
+			}
+		}
+		return nil
+	}
+
+	if req.Atomic {
+		err = store.Atomically(h.store, func(tx store.Store) error {
+			return run(context.WithValue(r.Context(), txKey{}, tx))
+		})
+		if err != nil {
+			// The writes counted against the quotas were rolled back.
+			h.usageCache.forget(tenantOf(r))
+		}
+	} else {
+		err = run(r.Context())
+	}
+	if err != nil && !errors.Is(err, errBatchFailed) {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"committed": err == nil, "results": results})
+}
+
+// runBatchOp runs one operation through the item handlers.
+func (h *Handler) runBatchOp(r *http.Request, op batchOp) batchResult {
+	fail := func(status int, msg string) batchResult {
+		return batchResult{Status: status, Body: map[string]string{"detail": msg}}
+	}
+	method, ok := batchMethods[op.Op]
+	if !ok {
+		return fail(http.StatusBadRequest, fmt.Sprintf("unknown op %q (supported: get, put, patch, delete)", op.Op))
+	}
+	if op.Collection == "" || op.Key == "" {
+		return fail(http.StatusBadRequest, "operations need a collection and a key")
+	}
+	if p := auth.FromContext(r.Context()); p != nil {
+		need := auth.ScopeWrite
+		if method == http.MethodGet {
+			need = auth.ScopeRead
+		}
+		if !p.Allows(op.Collection, need) {
+			return fail(http.StatusForbidden, fmt.Sprintf("%s access to %q denied", need, op.Collection))
+		}
+	}
+
+	path := "/collections/" + url.PathEscape(op.Collection) + "/items/" + url.PathEscape(op.Key)
+	if t := r.PathValue("tenant"); t != "" {
+		path = "/t/" + t + path
+	}
+	sub, err := http.NewRequestWithContext(r.Context(), method, path, bytes.NewReader(op.Body))
+	if err != nil {
+		return fail(http.StatusBadRequest, err.Error())
+	}
+	if method == http.MethodPatch {
+		sub.Header.Set("Content-Type", patch.MergePatchType)
+		if op.ContentType != "" {
+			sub.Header.Set("Content-Type", op.ContentType)
+		}
+	}
+	if op.IfMatch != "" {
+		sub.Header.Set("If-Match", op.IfMatch)
+	}
+
+	rec := &recorder{header: http.Header{}, status: http.StatusOK}
+	h.mux.ServeHTTP(rec, sub)
+	res := batchResult{Status: rec.status, ETag: rec.header.Get("ETag")}
+	if body := bytes.TrimSpace(rec.body.Bytes()); len(body) > 0 && strings.HasPrefix(rec.header.Get("Content-Type"), "application/json") {
+		res.Body = json.RawMessage(body)
+	}
+	return res
+}
+
+// recorder captures the response to an operation of a batch.
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) Header() http.Header         { return rec.header }
+func (rec *recorder) Write(b []byte) (int, error) { return rec.body.Write(b) }
+func (rec *recorder) WriteHeader(status int)      { rec.status = status }
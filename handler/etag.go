@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/stevemurr/simple-sync-server/store"
+)
+
+// errPreconditionFailed rejects conditional writes whose If-Match or
+// If-None-Match header does not hold.
+var errPreconditionFailed = errors.New("precondition failed: the document has changed")
+
+// etag formats the revision of a document as a strong entity tag.
+func etag(doc map[string]any) string {
+	return `"` + store.Revision(doc) + `"`
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header lists the
+// tag of doc, a nil doc matching nothing. "*" matches any document. Weak
+// tags (W/"...") only match when weak is set, as for If-None-Match.
+func etagMatches(header string, doc map[string]any, weak bool) bool {
+	if doc == nil {
+		return false
+	}
+	tag := etag(doc)
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" {
+			return true
+		}
+		if weak {
+			t = strings.TrimPrefix(t, "W/")
+		}
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// conditionalWrite performs a PUT or DELETE carrying If-Match or
+// If-None-Match: doc (nil to delete) replaces the current document only if
+// the headers hold for it, atomically. It returns ok=false without writing
+// if the request has neither header.
+func (h *Handler) conditionalWrite(r *http.Request, collection, key string, doc map[string]any, pre []store.Precondition) (ok bool, err error) {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return false, nil
+	}
+	s := h.storeFor(r)
+	current, err := s.Get(collection, key)
+	if err != nil {
+		return true, err
+	}
+	if (ifMatch != "" && !etagMatches(ifMatch, current, false)) || (ifNoneMatch != "" && etagMatches(ifNoneMatch, current, true)) {
+		return true, errPreconditionFailed
+	}
+	swapped, err := s.CompareAndSwap(collection, key, store.Revision(current), doc, pre...)
+	if err == nil && !swapped {
+		err = errPreconditionFailed
+	}
+	return true, err
+}
@@ -3,23 +3,41 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/stevemurr/simple-sync-server/auth"
+	"github.com/stevemurr/simple-sync-server/patch"
 	"github.com/stevemurr/simple-sync-server/schema"
 	"github.com/stevemurr/simple-sync-server/store"
 )
 
 // Handler holds the server dependencies and registers routes.
 type Handler struct {
-	store store.Store
-	mux   *http.ServeMux
+	store  store.Store
+	mux    *http.ServeMux
+	quotas Quotas
+	limits Limits
+
+	schemas    *schemaCache
+	migrations *migrationJobs
+	usageCache *usageCache
 }
 
 // New creates a Handler and wires up all routes.
-func New(s store.Store) *Handler {
-	h := &Handler{store: s, mux: http.NewServeMux()}
+func New(s store.Store, opts ...Option) *Handler {
+	h := &Handler{store: s, mux: http.NewServeMux(), limits: DefaultLimits, schemas: newSchemaCache(), migrations: newMigrationJobs(), usageCache: newUsageCache()}
+	for _, opt := range opts {
+		opt(h)
+	}
 	h.routes()
 	return h
 }
@@ -34,28 +52,71 @@ func (h *Handler) routes() {
 	h.mux.HandleFunc("GET /", h.root)
 	h.mux.HandleFunc("GET /health", h.health)
 
+	// Data endpoints serve the default namespace (or the caller's own
+	// tenant) at the root, and any tenant under /t/{tenant}.
+	h.tenantRoutes("")
+	h.tenantRoutes("/t/{tenant}")
+
+	// --- Admin endpoints ---
+	h.mux.HandleFunc("GET /admin/keys", h.listKeys)
+	h.mux.HandleFunc("POST /admin/keys", h.createKey)
+	h.mux.HandleFunc("DELETE /admin/keys/{id}", h.deleteKey)
+	h.mux.HandleFunc("GET /admin/tenants", h.listTenants)
+}
+
+func (h *Handler) tenantRoutes(prefix string) {
+	handle := func(method, path string, fn http.HandlerFunc) {
+		h.mux.HandleFunc(method+" "+prefix+path, scoped(fn))
+	}
+
 	// --- Backward-compatible notes endpoints ---
-	h.mux.HandleFunc("GET /notes", h.getAllItems("notes"))
-	h.mux.HandleFunc("GET /notes/since/{timestamp}", h.getItemsSince("notes"))
-	h.mux.HandleFunc("GET /notes/{key}", h.getItem("notes"))
-	h.mux.HandleFunc("PUT /notes/{key}", h.upsertItem("notes"))
-	h.mux.HandleFunc("DELETE /notes/{key}", h.deleteItem("notes"))
-	h.mux.HandleFunc("POST /sync", h.syncCollection("notes"))
+	handle("GET", "/notes", h.getAllItems("notes"))
+	handle("GET", "/notes/since/{timestamp}", h.getItemsSince("notes"))
+	handle("GET", "/notes/{key}", h.getItem("notes"))
+	handle("PUT", "/notes/{key}", h.upsertItem("notes"))
+	handle("PATCH", "/notes/{key}", h.patchItem("notes"))
+	handle("DELETE", "/notes/{key}", h.deleteItem("notes"))
+	handle("POST", "/sync", h.syncCollection("notes"))
 
 	// --- Generic collection endpoints ---
-	h.mux.HandleFunc("GET /collections", h.listCollections)
-	h.mux.HandleFunc("GET /collections/{collection}/items", h.getAllItemsDynamic)
-	h.mux.HandleFunc("GET /collections/{collection}/items/since/{timestamp}", h.getItemsSinceDynamic)
-	h.mux.HandleFunc("GET /collections/{collection}/items/{key}", h.getItemDynamic)
-	h.mux.HandleFunc("PUT /collections/{collection}/items/{key}", h.upsertItemDynamic)
-	h.mux.HandleFunc("DELETE /collections/{collection}/items/{key}", h.deleteItemDynamic)
-	h.mux.HandleFunc("POST /collections/{collection}/sync", h.syncCollectionDynamic)
+	handle("GET", "/collections", h.listCollections)
+	handle("GET", "/collections/{collection}/items", h.getAllItemsDynamic)
+	handle("GET", "/collections/{collection}/items/{key}/{sub}", h.getItemSubresource)
+	handle("GET", "/collections/{collection}/aggregate", h.aggregate)
+	handle("GET", "/collections/{collection}/items/{key}", h.getItemDynamic)
+	handle("PUT", "/collections/{collection}/items/{key}", h.upsertItemDynamic)
+	handle("PATCH", "/collections/{collection}/items/{key}", h.patchItemDynamic)
+	handle("DELETE", "/collections/{collection}/items/{key}", h.deleteItemDynamic)
+	handle("POST", "/collections/{collection}/sync", h.syncCollectionDynamic)
+	handle("POST", "/batch", h.batch)
+
+	// --- Document ACL endpoints ---
+	handle("PUT", "/collections/{collection}/items/{key}/acl", h.putACL)
+	handle("DELETE", "/collections/{collection}/items/{key}/acl", h.deleteACL)
+
+	// --- Index endpoints ---
+	handle("GET", "/collections/{collection}/indexes", h.listIndexes)
+	handle("PUT", "/collections/{collection}/indexes/{field}", h.putIndex)
+	handle("DELETE", "/collections/{collection}/indexes/{field}", h.deleteIndex)
+
+	// --- Search endpoints ---
+	handle("GET", "/collections/{collection}/search", h.search)
+	handle("GET", "/collections/{collection}/search/fields", h.getSearchFields)
+	handle("PUT", "/collections/{collection}/search/fields", h.putSearchFields)
 
 	// --- Schema endpoints ---
-	h.mux.HandleFunc("GET /schemas", h.listSchemas)
-	h.mux.HandleFunc("GET /schemas/{collection}", h.getSchema)
-	h.mux.HandleFunc("PUT /schemas/{collection}", h.putSchema)
-	h.mux.HandleFunc("DELETE /schemas/{collection}", h.deleteSchema)
+	handle("GET", "/schemas", h.listSchemas)
+	handle("GET", "/schemas/{collection}", h.getSchema)
+	handle("PUT", "/schemas/{collection}", h.putSchema)
+	handle("DELETE", "/schemas/{collection}", h.deleteSchema)
+	handle("GET", "/collections/{collection}/validate", h.validateCollection)
+	handle("GET", "/schemas/{collection}/versions", h.schemaVersions)
+	handle("POST", "/collections/{collection}/migrate", h.startMigration)
+	handle("GET", "/collections/{collection}/migrate", h.migrationStatus)
+
+	// --- Tenant admin endpoints ---
+	handle("GET", "/admin/export", h.exportTenant)
+	handle("POST", "/admin/purge", h.purgeTenant)
 }
 
 // ---------- helpers ----------
@@ -70,15 +131,151 @@ func writeError(w http.ResponseWriter, status int, msg string) {
 	writeJSON(w, status, map[string]string{"detail": msg})
 }
 
-func readJSON(r *http.Request, v any) error {
-	defer r.Body.Close()
-	return json.NewDecoder(r.Body).Decode(v)
-}
-
 func parseISO(s string) (time.Time, error) {
 	return store.ParseTimestamp(s)
 }
 
+// maxPageSize caps the limit a client may request for a single page.
+const maxPageSize = 1000
+
+// storeError writes the response for an error returned by the store.
+func storeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, store.ErrInvalidQuery) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, errNotOwner) {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		writeError(w, http.StatusInsufficientStorage, err.Error())
+		return
+	}
+	if errors.Is(err, errPreconditionFailed) {
+		writeError(w, http.StatusPreconditionFailed, err.Error())
+		return
+	}
+	if errors.Is(err, errUnmigrated) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+// parseQuery builds a store.Query from the limit, cursor, orderBy, filter
+// and fields query parameters.
+func parseQuery(r *http.Request) (store.Query, error) {
+	params := r.URL.Query()
+	q := store.Query{
+		Cursor:  params.Get("cursor"),
+		OrderBy: params.Get("orderBy"),
+	}
+	f, err := parseFilter(r)
+	if err != nil {
+		return q, err
+	}
+	q.Filter = f
+	if v := params.Get("fields"); v != "" {
+		q.Fields = strings.Split(v, ",")
+	}
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("invalid limit %q", v)
+		}
+		q.Limit = min(n, maxPageSize)
+	}
+	return q, nil
+}
+
+// parseFilter parses the filter query parameter, returning nil if absent.
+func parseFilter(r *http.Request) (*store.Filter, error) {
+	v := r.URL.Query().Get("filter")
+	if v == "" {
+		return nil, nil
+	}
+	return store.ParseFilter(v)
+}
+
+// docsOf returns the documents of a page, never nil.
+func docsOf(page *store.Page) []map[string]any {
+	docs := make([]map[string]any, len(page.Items))
+	for i, item := range page.Items {
+		docs[i] = item.Data
+	}
+	return docs
+}
+
+// scoped rejects requests naming a tenant or collection that cannot be
+// stored before they reach fn.
+func scoped(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if t := r.PathValue("tenant"); t != "" && !store.ValidTenant(t) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid tenant %q (use up to 64 letters, digits, '-' or '_')", t))
+			return
+		}
+		if strings.Contains(r.PathValue("collection"), store.TenantSeparator) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("collection names may not contain %q", store.TenantSeparator))
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// tenantOf returns the namespace of a request: the tenant named in its
+// path, else the authenticated caller's tenant, else the default ("").
+func tenantOf(r *http.Request) string {
+	if t := r.PathValue("tenant"); t != "" {
+		return t
+	}
+	if p := auth.FromContext(r.Context()); p != nil {
+		return p.Tenant
+	}
+	return ""
+}
+
+// storeFor returns the store confined to the request's tenant, within the
+// transaction of an atomic batch if there is one.
+func (h *Handler) storeFor(r *http.Request) store.Store {
+	s := h.store
+	if tx, ok := r.Context().Value(txKey{}).(store.Store); ok {
+		s = tx
+	}
+	return store.ForTenant(s, tenantOf(r))
+}
+
+// canRead reports whether the caller may read a collection. Without
+// authentication every collection is readable.
+func canRead(r *http.Request, collection string) bool {
+	p := auth.FromContext(r.Context())
+	return p == nil || p.Allows(collection, auth.ScopeRead)
+}
+
+// attribute records the authenticated caller in a document's updatedBy
+// field, replacing any value sent by the client. It runs after schema
+// validation since the field is managed by the server.
+func attribute(r *http.Request, doc map[string]any) {
+	if p := auth.FromContext(r.Context()); p != nil {
+		doc["updatedBy"] = p.Subject
+	}
+}
+
+// writePage writes a page of documents as a JSON array. When more documents
+// remain, the continuation is advertised in a Link header (rel="next") and
+// in X-Next-Cursor.
+func writePage(w http.ResponseWriter, r *http.Request, page *store.Page) {
+	if page.NextCursor != "" {
+		next := *r.URL
+		params := next.Query()
+		params.Set("cursor", page.NextCursor)
+		next.RawQuery = params.Encode()
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
+	writeJSON(w, http.StatusOK, docsOf(page))
+}
+
 // ---------- status endpoints ----------
 
 func (h *Handler) root(w http.ResponseWriter, r *http.Request) {
@@ -100,15 +297,18 @@ func (h *Handler) health(w http.ResponseWriter, r *http.Request) {
 // ---------- collection list ----------
 
 func (h *Handler) listCollections(w http.ResponseWriter, r *http.Request) {
-	names, err := h.store.ListCollections()
+	names, err := h.storeFor(r).ListCollections()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	if names == nil {
-		names = []string{}
+	readable := []string{}
+	for _, name := range names {
+		if canRead(r, name) {
+			readable = append(readable, name)
+		}
 	}
-	writeJSON(w, http.StatusOK, names)
+	writeJSON(w, http.StatusOK, readable)
 }
 
 // ---------- item CRUD (fixed collection) ----------
@@ -131,6 +331,12 @@ func (h *Handler) upsertItem(collection string) http.HandlerFunc {
 	}
 }
 
+func (h *Handler) patchItem(collection string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.doPatchItem(w, r, collection, r.PathValue("key"))
+	}
+}
+
 func (h *Handler) deleteItem(collection string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		h.doDeleteItem(w, r, collection, r.PathValue("key"))
@@ -163,6 +369,10 @@ func (h *Handler) upsertItemDynamic(w http.ResponseWriter, r *http.Request) {
 	h.doUpsertItem(w, r, r.PathValue("collection"), r.PathValue("key"))
 }
 
+func (h *Handler) patchItemDynamic(w http.ResponseWriter, r *http.Request) {
+	h.doPatchItem(w, r, r.PathValue("collection"), r.PathValue("key"))
+}
+
 func (h *Handler) deleteItemDynamic(w http.ResponseWriter, r *http.Request) {
 	h.doDeleteItem(w, r, r.PathValue("collection"), r.PathValue("key"))
 }
@@ -171,250 +381,1229 @@ func (h *Handler) getItemsSinceDynamic(w http.ResponseWriter, r *http.Request) {
 	h.doGetItemsSince(w, r, r.PathValue("collection"), r.PathValue("timestamp"))
 }
 
+// getItemSubresource serves both GET /collections/{collection}/items/since/{timestamp}
+// and GET /collections/{collection}/items/{key}/acl, which net/http cannot
+// register side by side. The ACL route is matched first, so that a document
+// keyed "since" can have its ACL read.
+func (h *Handler) getItemSubresource(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.PathValue("sub") == "acl":
+		h.getACL(w, r)
+	case r.PathValue("key") == "since":
+		r.SetPathValue("timestamp", r.PathValue("sub"))
+		h.getItemsSinceDynamic(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
 func (h *Handler) syncCollectionDynamic(w http.ResponseWriter, r *http.Request) {
 	h.doSync(w, r, r.PathValue("collection"))
 }
 
 // ---------- core logic ----------
 
-func (h *Handler) doGetAllItems(w http.ResponseWriter, _ *http.Request, collection string) {
-	docs, err := h.store.GetAll(collection)
+func (h *Handler) doGetAllItems(w http.ResponseWriter, r *http.Request, collection string) {
+	q, err := parseQuery(r)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, err := h.readPage(r, collection, q)
+	if err != nil {
+		storeError(w, err)
 		return
 	}
-	items := make([]map[string]any, 0, len(docs))
-	for _, doc := range docs {
-		items = append(items, doc)
+	writePage(w, r, page)
+}
+
+// readPage runs a query of the list endpoints for the caller of r.
+// Documents are migrated to the current schema version before the fields
+// parameter projects them, so that projections name current fields and
+// partial documents are not stamped with a version. Filters are evaluated
+// by the store on stored documents, so they are refused while documents
+// remain that migrations would change.
+func (h *Handler) readPage(r *http.Request, collection string, q store.Query) (*store.Page, error) {
+	c, err := h.collectionSchema(r, collection)
+	if err != nil {
+		return nil, err
+	}
+	if q.Filter != nil {
+		if err := h.checkMigrated(r, collection, c); err != nil {
+			return nil, err
+		}
+	}
+	o, err := h.ownership(r, collection)
+	if err != nil {
+		return nil, err
+	}
+	q.Filter = store.And(q.Filter, o.filter())
+	fields := q.Fields
+	if c != nil {
+		q.Fields = nil
+	}
+	page, err := h.storeFor(r).Query(collection, q)
+	if err != nil {
+		return nil, err
+	}
+	c.upgradeAll(page.Items)
+	if c != nil && fields != nil {
+		if err := page.Project(fields); err != nil {
+			return nil, err
+		}
 	}
-	writeJSON(w, http.StatusOK, items)
+	return page, nil
 }
 
-func (h *Handler) doGetItem(w http.ResponseWriter, _ *http.Request, collection, key string) {
-	doc, err := h.store.Get(collection, key)
+func (h *Handler) doGetItem(w http.ResponseWriter, r *http.Request, collection, key string) {
+	o, err := h.ownership(r, collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	doc, err := h.storeFor(r).Get(collection, key)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	if doc == nil {
+	if doc == nil || !o.visible(key, doc) {
 		writeError(w, http.StatusNotFound, "not found")
 		return
 	}
+	w.Header().Set("ETag", etag(doc))
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, doc, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	// The ETag is that of the stored document, so that it can be used in
+	// If-Match before the document is migrated.
+	c, err := h.collectionSchema(r, collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.upgrade(doc)
 	writeJSON(w, http.StatusOK, doc)
 }
 
 func (h *Handler) doUpsertItem(w http.ResponseWriter, r *http.Request, collection, key string) {
+	body, err := h.readBody(w, r)
+	if err == nil {
+		err = h.checkDocument(body)
+	}
+	if err != nil {
+		bodyError(w, err)
+		return
+	}
 	var incoming map[string]any
-	if err := readJSON(r, &incoming); err != nil {
+	if err := json.Unmarshal(body, &incoming); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
 		return
 	}
 
 	// Validate against schema if one exists
-	if err := h.validateAgainstSchema(collection, incoming); err != nil {
-		writeError(w, http.StatusUnprocessableEntity, "schema validation failed: "+err.Error())
+	if err := h.conform(r, collection, key, incoming); err != nil {
+		schemaError(w, err)
 		return
 	}
-
-	// Atomic last-write-wins: only update if incoming is newer
-	stored, _, err := h.store.PutIfNewer(collection, key, incoming)
+	o, err := h.ownership(r, collection)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	writeJSON(w, http.StatusOK, stored)
-}
-
-func (h *Handler) doDeleteItem(w http.ResponseWriter, _ *http.Request, collection, key string) {
-	if _, err := h.store.Delete(collection, key); err != nil {
+	attribute(r, incoming)
+	if err := o.stamp(key, incoming); err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted", "key": key})
-}
-
-func (h *Handler) doGetItemsSince(w http.ResponseWriter, _ *http.Request, collection, timestamp string) {
-	since, err := parseISO(timestamp)
+	u, err := h.usage(r, collection)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, "invalid timestamp format")
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := u.admit(key, incoming); err != nil {
+		storeError(w, err)
 		return
 	}
-	docs, err := h.store.GetAll(collection)
+
+	// With If-Match or If-None-Match the write is a compare-and-swap;
+	// otherwise it is an atomic last-write-wins: only update if incoming is
+	// newer.
+	measure, counted := u.measure(incoming)
+	pre := append(o.preconditions(key, incoming), measure)
+	stored := incoming
+	conditional, err := h.conditionalWrite(r, collection, key, incoming, pre)
+	written := conditional
+	if !conditional {
+		stored, written, err = h.storeFor(r).PutIfNewer(collection, key, incoming, pre...)
+	}
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		storeError(w, err)
 		return
 	}
-	var result []map[string]any
-	for _, doc := range docs {
-		if ts, ok := doc["updatedAt"].(string); ok {
-			t, err := parseISO(ts)
-			if err == nil && t.After(since) {
-				result = append(result, doc)
-			}
-		}
+	if written {
+		counted()
 	}
-	if result == nil {
-		result = []map[string]any{}
+	w.Header().Set("ETag", etag(stored))
+	if c, err := h.collectionSchema(r, collection); err == nil {
+		c.upgrade(stored) // a newer document that was kept may predate the schema
 	}
-	writeJSON(w, http.StatusOK, result)
+	writeJSON(w, http.StatusOK, stored)
 }
 
-func (h *Handler) doSync(w http.ResponseWriter, r *http.Request, collection string) {
-	var req struct {
-		Items        []map[string]any `json:"items"`
-		Notes        []map[string]any `json:"notes"` // backward compat
-		LastSyncTime *string          `json:"lastSyncTime"`
-	}
-	if err := readJSON(r, &req); err != nil {
-		writeError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+// maxPatchAttempts bounds how often a PATCH is reapplied when the document
+// changes between reading it and writing the result.
+const maxPatchAttempts = 10
+
+func (h *Handler) doPatchItem(w http.ResponseWriter, r *http.Request, collection, key string) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != patch.MergePatchType && mediaType != patch.JSONPatchType {
+		w.Header().Set("Accept-Patch", patch.MergePatchType+", "+patch.JSONPatchType)
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported patch type %q (use %s or %s)", mediaType, patch.MergePatchType, patch.JSONPatchType))
 		return
 	}
-
-	// Support both "items" and "notes" fields for backward compatibility
-	incoming := req.Items
-	if len(incoming) == 0 && len(req.Notes) > 0 {
-		incoming = req.Notes
+	body, err := h.readBody(w, r)
+	if err == nil {
+		err = h.checkDepth(body)
 	}
-
-	serverTime := time.Now().UTC().Format(time.RFC3339Nano)
-
-	var lastSync *time.Time
-	if req.LastSyncTime != nil && *req.LastSyncTime != "" {
-		t, err := parseISO(*req.LastSyncTime)
-		if err == nil {
-			lastSync = &t
+	if err != nil {
+		bodyError(w, err)
+		return
+	}
+	var apply func(doc map[string]any) (any, error)
+	if mediaType == patch.MergePatchType {
+		var p any
+		if err := json.Unmarshal(body, &p); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+			return
+		}
+		apply = func(doc map[string]any) (any, error) { return patch.Merge(doc, p), nil }
+	} else {
+		ops, err := patch.Parse(body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
 		}
+		apply = func(doc map[string]any) (any, error) { return patch.Apply(doc, ops) }
+	}
+	o, err := h.ownership(r, collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
 
-	// Determine the key field: use "dateKey" if present (backward compat), else "key", else "id"
-	keyOf := func(doc map[string]any) string {
-		for _, field := range []string{"dateKey", "key", "id"} {
-			if v, ok := doc[field].(string); ok && v != "" {
-				return v
-			}
-		}
-		return ""
+	c, err := h.collectionSchema(r, collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
 
-	// Merge incoming using atomic PutIfNewer per item
-	for _, doc := range incoming {
-		key := keyOf(doc)
-		if key == "" {
-			continue
+	// Apply the patch to the current document and swap in the result,
+	// starting over if the document changed in between.
+	s := h.storeFor(r)
+	for attempt := 0; attempt < maxPatchAttempts; attempt++ {
+		current, err := s.Get(collection, key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
 		}
-
-		// Validate against schema
-		if err := h.validateAgainstSchema(collection, doc); err != nil {
-			writeError(w, http.StatusUnprocessableEntity, "schema validation failed: "+err.Error())
+		if current == nil || !o.visible(key, current) {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if im := r.Header.Get("If-Match"); im != "" && !etagMatches(im, current, false) {
+			storeError(w, errPreconditionFailed)
+			return
+		}
+		// The patch applies to the document as a read would return it.
+		rev, tag := store.Revision(current), etag(current)
+		c.upgrade(current)
+		result, err := apply(current)
+		if errors.Is(err, patch.ErrInvalid) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		doc, ok := result.(map[string]any)
+		if !ok {
+			writeError(w, http.StatusUnprocessableEntity, "the patched document is not a JSON object")
+			return
+		}
+		// A patch that leaves updatedAt alone is an edit made now.
+		stamped := reflect.DeepEqual(doc["updatedAt"], current["updatedAt"])
+		if stamped {
+			doc["updatedAt"] = time.Now().UTC().Format(time.RFC3339Nano)
+		}
+		raw, _ := json.Marshal(doc)
+		if err := h.checkDocument(raw); err != nil {
+			bodyError(w, err)
+			return
+		}
+		if err := h.conform(r, collection, key, doc); err != nil {
+			schemaError(w, err)
 			return
 		}
 
-		if _, _, err := h.store.PutIfNewer(collection, key, doc); err != nil {
+		// Last-write-wins as for PUT: a result that is not newer than the
+		// stored document leaves it unchanged. That is only expected when
+		// the patch sets updatedAt; otherwise the stored one is ahead of
+		// the server's clock.
+		if stamped && !store.IsNewer(doc, current) {
+			writeError(w, http.StatusConflict, fmt.Sprintf("the stored document's updatedAt %v is ahead of the server's clock; set a later updatedAt in the patch", current["updatedAt"]))
+			return
+		}
+		if !store.IsNewer(doc, current) {
+			w.Header().Set("ETag", tag)
+			writeJSON(w, http.StatusOK, current)
+			return
+		}
+		attribute(r, doc)
+		if err := o.stamp(key, doc); err != nil {
 			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		u, err := h.usage(r, collection)
+		if err == nil {
+			err = u.admit(key, doc)
+		}
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		measure, counted := u.measure(doc)
+		swapped, err := s.CompareAndSwap(collection, key, rev, doc, append(o.preconditions(key, doc), measure)...)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if swapped {
+			counted()
+			w.Header().Set("ETag", etag(doc))
+			writeJSON(w, http.StatusOK, doc)
+			return
+		}
 	}
+	writeError(w, http.StatusConflict, "the document kept changing while the patch was applied; retry")
+}
 
-	// Get all documents after merging for the response
-	serverDocs, err := h.store.GetAll(collection)
+func (h *Handler) doDeleteItem(w http.ResponseWriter, r *http.Request, collection, key string) {
+	o, err := h.ownership(r, collection)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-
-	// Build response: items newer than lastSyncTime
-	var toReturn []map[string]any
-	for _, doc := range serverDocs {
-		if lastSync == nil {
-			toReturn = append(toReturn, doc)
-		} else {
-			ts, _ := doc["updatedAt"].(string)
-			t, err := parseISO(ts)
-			if err == nil && t.After(*lastSync) {
-				toReturn = append(toReturn, doc)
-			}
-		}
+	u, err := h.usage(r, collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
-	if toReturn == nil {
-		toReturn = []map[string]any{}
+	measure, counted := u.measure(nil)
+	pre := append(o.preconditions(key, nil), measure)
+	conditional, err := h.conditionalWrite(r, collection, key, nil, pre)
+	deleted := conditional
+	if !conditional {
+		deleted, err = h.storeFor(r).Delete(collection, key, pre...)
 	}
-
-	// Return using both field names for backward compat with notes
-	resp := map[string]any{
-		"items":      toReturn,
-		"serverTime": serverTime,
+	if err != nil {
+		storeError(w, err)
+		return
 	}
-	if collection == "notes" {
-		resp["notes"] = toReturn
+	if deleted {
+		counted()
 	}
-	writeJSON(w, http.StatusOK, resp)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted", "key": key})
 }
 
-// ---------- schema endpoints ----------
-
-func (h *Handler) listSchemas(w http.ResponseWriter, r *http.Request) {
-	schemas, err := h.store.ListSchemas()
+func (h *Handler) doGetItemsSince(w http.ResponseWriter, r *http.Request, collection, timestamp string) {
+	since, err := parseISO(timestamp)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		writeError(w, http.StatusBadRequest, "invalid timestamp format")
 		return
 	}
-	if schemas == nil {
-		schemas = map[string]map[string]any{}
-	}
-	writeJSON(w, http.StatusOK, schemas)
-}
-
-func (h *Handler) getSchema(w http.ResponseWriter, r *http.Request) {
-	collection := r.PathValue("collection")
-	s, err := h.store.GetSchema(collection)
+	q, err := parseQuery(r)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	if s == nil {
-		writeError(w, http.StatusNotFound, fmt.Sprintf("no schema for collection %q", collection))
+	q.Since = &since
+	page, err := h.readPage(r, collection, q)
+	if err != nil {
+		storeError(w, err)
 		return
 	}
-	writeJSON(w, http.StatusOK, s)
+	writePage(w, r, page)
 }
 
-func (h *Handler) putSchema(w http.ResponseWriter, r *http.Request) {
-	collection := r.PathValue("collection")
-	var s map[string]any
-	if err := readJSON(r, &s); err != nil {
-		writeError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
-		return
+// syncItemName names a sync item that is rejected before it is decoded by
+// its key, decoding only the key fields, or else by its position.
+func syncItemName(i int, item json.RawMessage) string {
+	var keys struct {
+		DateKey string `json:"dateKey"`
+		Key     string `json:"key"`
+		ID      string `json:"id"`
 	}
-	if err := h.store.PutSchema(collection, s); err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
-		return
+	json.Unmarshal(item, &keys) // fields of other types stay empty
+	for _, key := range []string{keys.DateKey, keys.Key, keys.ID} {
+		if key != "" {
+			return fmt.Sprintf("item %q", key)
+		}
 	}
-	writeJSON(w, http.StatusOK, s)
+	return fmt.Sprintf("item %d", i)
 }
 
-func (h *Handler) deleteSchema(w http.ResponseWriter, r *http.Request) {
-	collection := r.PathValue("collection")
-	existed, err := h.store.DeleteSchema(collection)
+func (h *Handler) doSync(w http.ResponseWriter, r *http.Request, collection string) {
+	// Items stay raw until the batch and each item are checked against the
+	// limits, so that errors can name the offending item.
+	var req struct {
+		Items        []json.RawMessage `json:"items"`
+		Notes        []json.RawMessage `json:"notes"` // backward compat
+		LastSyncTime *string           `json:"lastSyncTime"`
+		Limit        int               `json:"limit"`
+		Cursor       string            `json:"cursor"`
+	}
+	body, err := h.readBody(w, r)
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		bodyError(w, err)
 		return
 	}
-	if !existed {
-		writeError(w, http.StatusNotFound, fmt.Sprintf("no schema for collection %q", collection))
+
+	// Support both "items" and "notes" fields for backward compatibility
+	raw := req.Items
+	if len(raw) == 0 && len(req.Notes) > 0 {
+		raw = req.Notes
+	}
+	if max := h.limits.MaxSyncItems; max > 0 && len(raw) > max {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("sync batch has %d items, over the limit of %d", len(raw), max))
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted", "collection": collection})
-}
-
-// ---------- schema validation helper ----------
 
-func (h *Handler) validateAgainstSchema(collection string, doc map[string]any) error {
-	s, err := h.store.GetSchema(collection)
-	if err != nil {
-		return err
-	}
+	// Determine the key field: use "dateKey" if present (backward compat), else "key", else "id"
+	keyOf := func(doc map[string]any) string {
+		for _, field := range []string{"dateKey", "key", "id"} {
+			if v, ok := doc[field].(string); ok && v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	// Each item is checked against the limits before it is decoded.
+	incoming := make([]map[string]any, len(raw))
+	for i, item := range raw {
+		if err := h.checkDocument(item); err != nil {
+			bodyError(w, fmt.Errorf("%s: %w", syncItemName(i, item), err))
+			return
+		}
+		if err := json.Unmarshal(item, &incoming[i]); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid JSON: item %d: %v", i, err))
+			return
+		}
+	}
+
+	serverTime := time.Now().UTC().Format(time.RFC3339Nano)
+
+	var lastSync *time.Time
+	if req.LastSyncTime != nil && *req.LastSyncTime != "" {
+		t, err := parseISO(*req.LastSyncTime)
+		if err == nil {
+			lastSync = &t
+		}
+	}
+
+	o, err := h.ownership(r, collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u, err := h.usage(r, collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// The response holds the items newer than lastSyncTime, optionally one
+	// page at a time so a first sync of a large collection can be fetched
+	// in pieces. Pages follow updatedAt, so that documents changed while a
+	// client pages through move past its cursor and are sent again. The
+	// query is checked now, as a client refused after its writes were
+	// merged would retry them.
+	q := store.Query{
+		Filter:  o.filter(),
+		Since:   lastSync,
+		OrderBy: store.OrderByUpdatedAt,
+		Limit:   min(req.Limit, maxPageSize),
+		Cursor:  req.Cursor,
+	}
+	if err := q.Validate(); err != nil {
+		storeError(w, err)
+		return
+	}
+
+	// Validate every item before writing any, so that all the violations
+	// are reported at once. Their paths point into the request body.
+	field := "items"
+	if len(req.Items) == 0 && len(req.Notes) > 0 {
+		field = "notes"
+	}
+	var violations []validationError
+	var invalid []string
+	for i, doc := range incoming {
+		key := keyOf(doc)
+		if key == "" {
+			continue
+		}
+		err := h.conform(r, collection, key, doc)
+		var errs schema.Errors
+		if err != nil && !errors.As(err, &errs) {
+			schemaError(w, fmt.Errorf("item %q: %w", key, err))
+			return
+		}
+		for _, e := range errs {
+			e.Path = fmt.Sprintf("/%s/%d%s", field, i, e.Path)
+			violations = append(violations, validationError{Error: e, Key: key})
+		}
+		if errs != nil {
+			invalid = append(invalid, strconv.Quote(key))
+		}
+	}
+	if len(violations) > 0 {
+		noun := "item"
+		if len(invalid) > 1 {
+			noun = "items"
+		}
+		writeJSON(w, http.StatusUnprocessableEntity, validationFailure{
+			Detail: fmt.Sprintf("schema validation failed for %s %s", noun, strings.Join(invalid, ", ")),
+			Errors: violations,
+		})
+		return
+	}
+
+	// Merge incoming using atomic PutIfNewer per item
+	for _, doc := range incoming {
+		key := keyOf(doc)
+		if key == "" {
+			continue
+		}
+		attribute(r, doc)
+		if err := o.stamp(key, doc); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		measure, counted := u.measure(doc)
+		err := u.admit(key, doc)
+		written := false
+		if err == nil {
+			_, written, err = h.storeFor(r).PutIfNewer(collection, key, doc, append(o.preconditions(key, doc), measure)...)
+		}
+		if written {
+			counted()
+		}
+		if err != nil {
+			if errors.Is(err, errNotOwner) || errors.Is(err, errQuotaExceeded) {
+				err = fmt.Errorf("item %q: %w", key, err)
+			}
+			storeError(w, err)
+			return
+		}
+	}
+
+	page, err := h.storeFor(r).Query(collection, q)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	toReturn := docsOf(page)
+
+	// Documents shared with the caller since their last sync are new to
+	// them even if unchanged; send them with the first page.
+	if lastSync != nil && req.Cursor == "" {
+		sent := make(map[string]bool, len(page.Items))
+		for _, item := range page.Items {
+			sent[item.Key] = true
+		}
+		for _, key := range o.sharedSince(*lastSync) {
+			if sent[key] {
+				continue
+			}
+			doc, err := h.storeFor(r).Get(collection, key)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if doc != nil {
+				toReturn = append(toReturn, doc)
+			}
+		}
+	}
+
+	c, err := h.collectionSchema(r, collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, doc := range toReturn {
+		c.upgrade(doc)
+	}
+
+	// Return using both field names for backward compat with notes
+	resp := map[string]any{
+		"items":      toReturn,
+		"serverTime": serverTime,
+	}
+	if collection == "notes" {
+		resp["notes"] = toReturn
+	}
+	if page.NextCursor != "" {
+		resp["nextCursor"] = page.NextCursor
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// ---------- aggregation ----------
+
+func (h *Handler) aggregate(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	f, err := parseFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	a := store.Aggregation{Filter: f}
+	if v := params.Get("groupBy"); v != "" {
+		a.GroupBy = strings.Split(v, ",")
+	}
+	metrics := params.Get("metrics")
+	if metrics == "" {
+		metrics = store.AggCount
+	}
+	for _, name := range strings.Split(metrics, ",") {
+		m, err := store.ParseMetric(strings.TrimSpace(name))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		a.Metrics = append(a.Metrics, m)
+	}
+	collection := r.PathValue("collection")
+	// Aggregates read the fields of stored documents, which must not wait
+	// for migrations.
+	c, err := h.collectionSchema(r, collection)
+	if err == nil {
+		err = h.checkMigrated(r, collection, c)
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	o, err := h.ownership(r, collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.Filter = store.And(a.Filter, o.filter())
+	groups, err := h.storeFor(r).Aggregate(collection, a)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"groups": groups})
+}
+
+// ---------- schema endpoints ----------
+
+func (h *Handler) listSchemas(w http.ResponseWriter, r *http.Request) {
+	schemas, err := h.storeFor(r).ListSchemas()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	readable := map[string]map[string]any{}
+	for name, sch := range schemas {
+		if canRead(r, name) {
+			readable[name] = sch
+		}
+	}
+	writeJSON(w, http.StatusOK, readable)
+}
+
+func (h *Handler) getSchema(w http.ResponseWriter, r *http.Request) {
+	collection := r.PathValue("collection")
+	s, err := h.storeFor(r).GetSchema(collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 	if s == nil {
-		return nil // no schema = no validation
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no schema for collection %q", collection))
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+// schemaVersions lists every version of a collection's schema, oldest
+// first.
+func (h *Handler) schemaVersions(w http.ResponseWriter, r *http.Request) {
+	collection := r.PathValue("collection")
+	first, versions, err := h.storeFor(r).SchemaVersions(collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(versions) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no schema for collection %q", collection))
+		return
+	}
+	result := make([]map[string]any, len(versions))
+	for i, v := range versions {
+		result[i] = map[string]any{"version": first + i, "schema": v}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (h *Handler) putSchema(w http.ResponseWriter, r *http.Request) {
+	collection := r.PathValue("collection")
+	var s map[string]any
+	if err := h.readJSON(w, r, &s); err != nil {
+		bodyError(w, err)
+		return
+	}
+	// ?strict=false stores schemas with unknown keywords, for instance
+	// ones written for other validators.
+	if r.URL.Query().Get("strict") != "false" {
+		if err := schema.Check(s); err != nil {
+			invalidSchema(w, err)
+			return
+		}
+	}
+	indexes, err := schemaFields(s, "x-indexes")
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	searchable, err := schemaFields(s, "x-search")
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if _, err := parseOwner(s); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if _, err := compatibilityOf(s); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err := checkServerFields(s, ""); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	// The schema becomes the collection's next version. It may refer to
+	// itself as schemas://<collection> too.
+	first, versions, err := h.storeFor(r).SchemaVersions(collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	load := h.schemaLoader(r)
+	next, err := newCollectionSchema(first, append(versions, s), func(name string) (map[string]any, error) {
+		if name == collection {
+			return s, nil
+		}
+		return load(name)
+	})
+	if err == nil {
+		err = next.err
+	}
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	// Changes must keep to the compatibility policy of the current version,
+	// unless ?compatibility= sets another for this change.
+	if len(versions) > 0 {
+		current := versions[len(versions)-1]
+		policy, _ := compatibilityOf(current)
+		if v := r.URL.Query().Get("compatibility"); v != "" {
+			if policy, err = schema.ParseCompatibility(v); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		if err := schema.CheckCompatibility(current, s, policy); err != nil {
+			validationFailed(w, http.StatusConflict, fmt.Sprintf("schema change is not %s compatible: ", policy), err)
+			return
+		}
+	}
+	// ?dryRun=true reports the documents the schema would reject without
+	// saving it; ?enforce=true refuses it if there are any.
+	dryRun, enforce := r.URL.Query().Get("dryRun") == "true", r.URL.Query().Get("enforce") == "true"
+	if dryRun || enforce {
+		limit, err := auditLimit(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		report, err := h.audit(r, collection, next, limit)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if dryRun {
+			writeJSON(w, http.StatusOK, report)
+			return
+		}
+		if report.Invalid > 0 {
+			writeJSON(w, http.StatusConflict, auditFailure{
+				Detail:      fmt.Sprintf("%d of %d documents would fail the schema", report.Invalid, report.Checked),
+				auditReport: *report,
+			})
+			return
+		}
+	}
+	if err := h.schemas.change(schemaKey{tenantOf(r), collection}, func() (*collectionSchema, error) {
+		if err := h.storeFor(r).PutSchema(collection, s); err != nil {
+			return nil, err
+		}
+		return h.loadSchema(r, collection)
+	}); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, field := range indexes {
+		if err := h.storeFor(r).EnsureIndex(collection, field); err != nil {
+			storeError(w, err)
+			return
+		}
+	}
+	if searchable != nil {
+		if err := h.storeFor(r).SetSearchFields(collection, searchable); err != nil {
+			storeError(w, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (h *Handler) deleteSchema(w http.ResponseWriter, r *http.Request) {
+	collection := r.PathValue("collection")
+	var existed bool
+	err := h.schemas.change(schemaKey{tenantOf(r), collection}, func() (_ *collectionSchema, err error) {
+		existed, err = h.storeFor(r).DeleteSchema(collection)
+		return nil, err
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !existed {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no schema for collection %q", collection))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted", "collection": collection})
+}
+
+// schemaFields returns the field paths listed under a schema extension
+// keyword such as x-indexes, or nil if the keyword is absent.
+func schemaFields(s map[string]any, keyword string) ([]string, error) {
+	raw, ok := s[keyword]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := raw.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s must be an array of field paths", keyword)
+	}
+	fields := make([]string, 0, len(list))
+	for _, v := range list {
+		field, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be an array of field paths", keyword)
+		}
+		if _, err := store.ParsePath(field); err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// ---------- index endpoints ----------
+
+func (h *Handler) listIndexes(w http.ResponseWriter, r *http.Request) {
+	indexes, err := h.storeFor(r).ListIndexes(r.PathValue("collection"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if indexes == nil {
+		indexes = []store.Index{}
+	}
+	writeJSON(w, http.StatusOK, indexes)
+}
+
+func (h *Handler) putIndex(w http.ResponseWriter, r *http.Request) {
+	collection, field := r.PathValue("collection"), r.PathValue("field")
+	if err := h.storeFor(r).EnsureIndex(collection, field); err != nil {
+		storeError(w, err)
+		return
+	}
+	indexes, err := h.storeFor(r).ListIndexes(collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, ix := range indexes {
+		if ix.Field != field {
+			continue
+		}
+		status := http.StatusOK
+		if ix.State == store.IndexBuilding {
+			status = http.StatusAccepted
+		}
+		writeJSON(w, status, ix)
+		return
+	}
+	// Dropped concurrently.
+	writeError(w, http.StatusConflict, fmt.Sprintf("index on %q was removed", field))
+}
+
+func (h *Handler) deleteIndex(w http.ResponseWriter, r *http.Request) {
+	collection, field := r.PathValue("collection"), r.PathValue("field")
+	existed, err := h.storeFor(r).DropIndex(collection, field)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !existed {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no index on %q", field))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted", "field": field})
+}
+
+// ---------- search endpoints ----------
+
+// defaultSearchLimit is the number of hits returned when no limit is given.
+const defaultSearchLimit = 20
+
+func (h *Handler) search(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		writeError(w, http.StatusBadRequest, "missing search query parameter q")
+		return
+	}
+	limit := defaultSearchLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit %q", v))
+			return
+		}
+		limit = min(n, maxPageSize)
+	}
+	collection := r.PathValue("collection")
+	o, err := h.ownership(r, collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c, err := h.collectionSchema(r, collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if f := o.filter(); f != nil {
+		// Rank every match, then keep the caller's best ones.
+		all, err := h.storeFor(r).Search(collection, query, 0)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		hits := []store.SearchHit{}
+		for _, hit := range all {
+			if len(hits) < limit && f.Match(hit.Key, hit.Data) {
+				c.upgrade(hit.Data)
+				hits = append(hits, hit)
+			}
+		}
+		writeJSON(w, http.StatusOK, hits)
+		return
+	}
+	hits, err := h.storeFor(r).Search(collection, query, limit)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if hits == nil {
+		hits = []store.SearchHit{}
+	}
+	for _, hit := range hits {
+		c.upgrade(hit.Data)
+	}
+	writeJSON(w, http.StatusOK, hits)
+}
+
+func (h *Handler) getSearchFields(w http.ResponseWriter, r *http.Request) {
+	fields, err := h.storeFor(r).SearchFields(r.PathValue("collection"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, fields)
+}
+
+func (h *Handler) putSearchFields(w http.ResponseWriter, r *http.Request) {
+	var fields []string
+	if err := h.readJSON(w, r, &fields); err != nil {
+		if errors.Is(err, errTooLarge) {
+			bodyError(w, err)
+		} else {
+			writeError(w, http.StatusBadRequest, "invalid JSON: expected an array of field paths")
+		}
+		return
+	}
+	if err := h.storeFor(r).SetSearchFields(r.PathValue("collection"), fields); err != nil {
+		storeError(w, err)
+		return
+	}
+	if fields == nil {
+		fields = []string{}
+	}
+	writeJSON(w, http.StatusOK, fields)
+}
+
+// ---------- schema validation helper ----------
+
+// conform prepares a document to be written under key in a collection. A
+// document that records an earlier schema version is migrated to the
+// current one first, and one that records anything but a version is
+// rejected. Its readOnly properties are then reset to their stored
+// values and its missing properties given their defaults (see manage),
+// before it is validated, without its version field, and stamped with the
+// current version. conform returns a schema.Errors listing every violation
+// if the document is invalid.
+func (h *Handler) conform(r *http.Request, collection, key string, doc map[string]any) error {
+	c, err := h.collectionSchema(r, collection)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion(doc, c); err != nil {
+		return err
+	}
+	if _, ok := doc[versionField]; ok {
+		c.migrate(doc)
+		delete(doc, versionField)
+	}
+	if err := h.manage(r, collection, key, c, doc); err != nil {
+		return err
+	}
+	if err := c.validate(doc); err != nil {
+		return err
+	}
+	c.upgrade(doc)
+	return nil
+}
+
+// validateDoc checks doc against a collection's compiled schema (nil if it
+// has none) and the updatedAt format every document must have.
+func validateDoc(compiled *schema.Schema, doc map[string]any) error {
+	var errs schema.Errors
+	for _, s := range []*schema.Schema{updatedAtSchema, compiled} {
+		var e schema.Errors
+		if errors.As(s.Validate(doc), &e) { // a nil schema accepts anything
+			errs = append(errs, e...)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ---------- API keys ----------
+
+// listKeys returns every API key without its secret hash.
+func (h *Handler) listKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.store.ListAPIKeys()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	result := []auth.KeyRecord{}
+	for _, raw := range keys {
+		rec, err := auth.KeyRecordFromMap(raw)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		rec.Hash = ""
+		result = append(result, rec)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	writeJSON(w, http.StatusOK, result)
+}
+
+// createKey generates an API key. The key itself is only returned here.
+func (h *Handler) createKey(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name   string       `json:"name"`
+		Tenant string       `json:"tenant"`
+		Grants []auth.Grant `json:"grants"`
+		Groups []string     `json:"groups"`
+	}
+	if err := h.readJSON(w, r, &body); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if len(body.Grants) == 0 {
+		writeError(w, http.StatusBadRequest, "at least one grant is required")
+		return
+	}
+	if body.Tenant != "" && !store.ValidTenant(body.Tenant) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid tenant %q", body.Tenant))
+		return
+	}
+	for _, g := range body.Grants {
+		if err := g.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	key, rec, err := auth.NewAPIKey(body.Name, body.Tenant, body.Grants)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rec.Groups = body.Groups
+	if err := h.store.PutAPIKey(rec.ID, rec.ToMap()); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rec.Hash = ""
+	writeJSON(w, http.StatusCreated, map[string]any{"key": key, "apiKey": rec})
+}
+
+func (h *Handler) deleteKey(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	existed, err := h.store.DeleteAPIKey(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !existed {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no API key %q", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted", "id": id})
+}
+
+// ---------- tenants ----------
+
+func (h *Handler) listTenants(w http.ResponseWriter, r *http.Request) {
+	tenants, err := store.Tenants(h.store)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, tenants)
+}
+
+// tenantCollections returns every collection of the request's tenant that
+// holds data or has a schema, along with the schemas.
+func (h *Handler) tenantCollections(r *http.Request) ([]string, map[string]map[string]any, error) {
+	st := h.storeFor(r)
+	names, err := st.ListCollections()
+	if err != nil {
+		return nil, nil, err
+	}
+	schemas, err := st.ListSchemas()
+	if err != nil {
+		return nil, nil, err
+	}
+	for name := range schemas {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, schemas, nil
+}
+
+// exportTenant returns the documents, schemas, indexes and search fields of
+// the request's tenant as one JSON object.
+func (h *Handler) exportTenant(w http.ResponseWriter, r *http.Request) {
+	st := h.storeFor(r)
+	names, schemas, err := h.tenantCollections(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	collections := map[string]map[string]map[string]any{}
+	indexes := map[string][]string{}
+	searchFields := map[string][]string{}
+	for _, name := range names {
+		docs, err := st.GetAll(name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(docs) > 0 {
+			collections[name] = docs
+		}
+		declared, err := st.ListIndexes(name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, ix := range declared {
+			indexes[name] = append(indexes[name], ix.Field)
+		}
+		fields, err := st.SearchFields(name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(fields) > 0 {
+			searchFields[name] = fields
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"tenant":       tenantOf(r),
+		"collections":  collections,
+		"schemas":      schemas,
+		"indexes":      indexes,
+		"searchFields": searchFields,
+	})
+}
+
+// purgeTenant removes every collection and schema of the request's tenant.
+func (h *Handler) purgeTenant(w http.ResponseWriter, r *http.Request) {
+	st := h.storeFor(r)
+	names, schemas, err := h.tenantCollections(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, name := range names {
+		if _, err := st.DropCollection(name); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if _, ok := schemas[name]; ok {
+			if _, err := st.DeleteSchema(name); err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
 	}
-	return schema.Validate(s, doc)
+	h.schemas.dropTenant(tenantOf(r))
+	h.usageCache.forget(tenantOf(r))
+	writeJSON(w, http.StatusOK, map[string]any{"status": "purged", "tenant": tenantOf(r), "collections": names})
 }
@@ -3,13 +3,22 @@ package handler_test
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/stevemurr/simple-sync-server/auth"
 	"github.com/stevemurr/simple-sync-server/handler"
 	"github.com/stevemurr/simple-sync-server/store"
+
+	_ "github.com/mattn/go-sqlite3"
 )
 
 func setup() (*httptest.Server, store.Store) {
@@ -366,6 +375,585 @@ func TestSchemaValidationOnPut(t *testing.T) {
 	}
 }
 
+func TestTimestampFormat(t *testing.T) {
+	ts, s := setup()
+	defer ts.Close()
+	s.PutSchema("events", map[string]any{
+		"properties": map[string]any{"at": map[string]any{"format": "date-time"}},
+	})
+
+	put := func(path string, doc any) int {
+		t.Helper()
+		req, _ := http.NewRequest("PUT", ts.URL+path, bytes.NewReader(mustJSON(t, doc)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	// updatedAt is checked even without a schema.
+	if got := put("/collections/plain/items/a", map[string]any{"updatedAt": "yesterday"}); got != 422 {
+		t.Fatalf("expected 422 for a malformed updatedAt, got %d", got)
+	}
+	if got := put("/collections/plain/items/a", map[string]any{"updatedAt": 5}); got != 422 {
+		t.Fatalf("expected 422 for a numeric updatedAt, got %d", got)
+	}
+	if got := put("/collections/plain/items/a", map[string]any{"updatedAt": "2024-01-15T10:30:00"}); got != 200 {
+		t.Fatalf("expected 200 for a timestamp without zone, got %d", got)
+	}
+	if got := put("/collections/events/items/e", map[string]any{"at": "2024-01-15"}); got != 422 {
+		t.Fatalf("expected 422 for a date in a date-time field, got %d", got)
+	}
+
+	resp, _ := http.Post(ts.URL+"/collections/plain/sync", "application/json", bytes.NewReader(mustJSON(t, map[string]any{
+		"items": []any{map[string]any{"key": "b", "updatedAt": "2024-02-30T00:00:00Z"}},
+	})))
+	if resp.StatusCode != 422 {
+		t.Fatalf("expected 422 from sync, got %d", resp.StatusCode)
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	ts, s := setup()
+	defer ts.Close()
+	s.PutSchema("tasks", map[string]any{
+		"type":     "object",
+		"required": []any{"title"},
+		"properties": map[string]any{
+			"title":    map[string]any{"type": "string"},
+			"priority": map[string]any{"type": "integer", "minimum": float64(1)},
+		},
+	})
+
+	req, _ := http.NewRequest("PUT", ts.URL+"/collections/tasks/items/t1", bytes.NewReader(mustJSON(t, map[string]any{
+		"priority":  0,
+		"updatedAt": "soon",
+	})))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 422 {
+		t.Fatalf("expected 422, got %d", resp.StatusCode)
+	}
+	body := decodeJSON(t, resp.Body)
+	want := []any{
+		map[string]any{"path": "/updatedAt", "keyword": "format", "message": `"soon" is not a valid timestamp`},
+		map[string]any{"path": "/title", "keyword": "required", "message": `missing required field "title"`},
+		map[string]any{"path": "/priority", "keyword": "minimum", "message": "0 is less than minimum 1"},
+	}
+	if !reflect.DeepEqual(body["errors"], want) {
+		t.Fatalf("unexpected errors %v", body["errors"])
+	}
+
+	// A sync reports the violations of every item and writes none of them.
+	resp, _ = http.Post(ts.URL+"/collections/tasks/sync", "application/json", bytes.NewReader(mustJSON(t, map[string]any{
+		"items": []any{
+			map[string]any{"key": "a", "title": "ok"},
+			map[string]any{"key": "b", "title": 1},
+			map[string]any{"key": "c"},
+		},
+	})))
+	if resp.StatusCode != 422 {
+		t.Fatalf("expected 422, got %d", resp.StatusCode)
+	}
+	body = decodeJSON(t, resp.Body)
+	want = []any{
+		map[string]any{"path": "/items/1/title", "keyword": "type", "message": `expected type "string", got "number"`, "key": "b"},
+		map[string]any{"path": "/items/2/title", "keyword": "required", "message": `missing required field "title"`, "key": "c"},
+	}
+	if !reflect.DeepEqual(body["errors"], want) {
+		t.Fatalf("unexpected errors %v", body["errors"])
+	}
+	if body["detail"] != `schema validation failed for items "b", "c"` {
+		t.Fatalf("unexpected detail %v", body["detail"])
+	}
+	if doc, _ := s.Get("tasks", "a"); doc != nil {
+		t.Fatal("expected no item of an invalid sync to be written")
+	}
+}
+
+func TestSchemaCheck(t *testing.T) {
+	ts, s := setup()
+	defer ts.Close()
+	typo := map[string]any{
+		"type":       "object",
+		"properties": map[string]any{
+			"title": map[string]any{"type": "strng", "minLenght": 1},
+			"due":   map[string]any{"type": "string", "format": "timestmap"},
+		},
+	}
+
+	req, _ := http.NewRequest("PUT", ts.URL+"/schemas/tasks", bytes.NewReader(mustJSON(t, typo)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 422 {
+		t.Fatalf("expected 422, got %d", resp.StatusCode)
+	}
+	body := decodeJSON(t, resp.Body)
+	want := []any{
+		map[string]any{"path": "/properties/due/format", "keyword": "format", "message": `unknown format "timestmap" (did you mean "timestamp"?)`},
+		map[string]any{"path": "/properties/title/minLenght", "keyword": "minLenght", "message": `unknown keyword "minLenght" (did you mean "minLength"?)`},
+		map[string]any{"path": "/properties/title/type", "keyword": "type", "message": `unknown type "strng"`},
+	}
+	if !reflect.DeepEqual(body["errors"], want) {
+		t.Fatalf("unexpected errors %v", body["errors"])
+	}
+	if got, _ := s.GetSchema("tasks"); got != nil {
+		t.Fatal("expected an invalid schema not to be stored")
+	}
+
+	// ?strict=false skips the check, but the schema must still compile.
+	unknown := map[string]any{"type": "object", "discriminator": "kind"}
+	req, _ = http.NewRequest("PUT", ts.URL+"/schemas/tasks?strict=false", bytes.NewReader(mustJSON(t, unknown)))
+	resp, _ = http.DefaultClient.Do(req)
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	req, _ = http.NewRequest("PUT", ts.URL+"/schemas/tasks?strict=false", bytes.NewReader(mustJSON(t, map[string]any{"pattern": "("})))
+	resp, _ = http.DefaultClient.Do(req)
+	if resp.StatusCode != 422 {
+		t.Fatalf("expected 422 for an invalid pattern, got %d", resp.StatusCode)
+	}
+}
+
+func TestSchemaAudit(t *testing.T) {
+	ts, s := setup()
+	defer ts.Close()
+	for key, title := range map[string]any{"a": "ok", "b": 1, "c": nil} {
+		doc := map[string]any{"updatedAt": "2024-01-01T00:00:00Z"}
+		if title != nil {
+			doc["title"] = title
+		}
+		s.Put("tasks", key, doc)
+	}
+	strict := mustJSON(t, map[string]any{
+		"type":       "object",
+		"required":   []any{"title"},
+		"properties": map[string]any{"title": map[string]any{"type": "string"}},
+	})
+	wantDocs := []any{
+		map[string]any{"key": "b", "errors": []any{
+			map[string]any{"path": "/title", "keyword": "type", "message": `expected type "string", got "number"`},
+		}},
+		map[string]any{"key": "c", "errors": []any{
+			map[string]any{"path": "/title", "keyword": "required", "message": `missing required field "title"`},
+		}},
+	}
+
+	// A dry run reports the documents that would fail, without saving.
+	req, _ := http.NewRequest("PUT", ts.URL+"/schemas/tasks?dryRun=true", bytes.NewReader(strict))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	body := decodeJSON(t, resp.Body)
+	if body["checked"] != 3.0 || body["invalid"] != 2.0 || !reflect.DeepEqual(body["documents"], wantDocs) {
+		t.Fatalf("unexpected dry run report %v", body)
+	}
+	if got, _ := s.GetSchema("tasks"); got != nil {
+		t.Fatal("expected a dry run not to save the schema")
+	}
+
+	// Enforcement refuses the schema while documents would fail it.
+	req, _ = http.NewRequest("PUT", ts.URL+"/schemas/tasks?enforce=true&limit=1", bytes.NewReader(strict))
+	resp, _ = http.DefaultClient.Do(req)
+	if resp.StatusCode != 409 {
+		t.Fatalf("expected 409, got %d", resp.StatusCode)
+	}
+	body = decodeJSON(t, resp.Body)
+	if body["detail"] != "2 of 3 documents would fail the schema" || !reflect.DeepEqual(body["documents"], wantDocs[:1]) {
+		t.Fatalf("unexpected refusal %v", body)
+	}
+	if got, _ := s.GetSchema("tasks"); got != nil {
+		t.Fatal("expected an enforced schema not to be saved")
+	}
+
+	// Without enforcement the schema is saved, and audits find the
+	// documents that violate it.
+	req, _ = http.NewRequest("PUT", ts.URL+"/schemas/tasks", bytes.NewReader(strict))
+	resp, _ = http.DefaultClient.Do(req)
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	resp, _ = http.Get(ts.URL + "/collections/tasks/validate")
+	body = decodeJSON(t, resp.Body)
+	if body["invalid"] != 2.0 || !reflect.DeepEqual(body["documents"], wantDocs) {
+		t.Fatalf("unexpected audit %v", body)
+	}
+
+	s.Put("tasks", "b", map[string]any{"title": "fixed", "updatedAt": "2024-01-02T00:00:00Z"})
+	s.Delete("tasks", "c")
+	req, _ = http.NewRequest("PUT", ts.URL+"/schemas/tasks?enforce=true", bytes.NewReader(strict))
+	resp, _ = http.DefaultClient.Do(req)
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200 once every document is valid, got %d", resp.StatusCode)
+	}
+}
+
+func TestSchemaMigrations(t *testing.T) {
+	ts, s := setup()
+	defer ts.Close()
+	put := func(path string, body any) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("PUT", ts.URL+path, bytes.NewReader(mustJSON(t, body)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	s.Put("tasks", "old", map[string]any{"name": "Legacy", "street": "Main St", "updatedAt": "2024-01-01T00:00:00Z"})
+
+	if resp := put("/schemas/tasks", map[string]any{"type": "object"}); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	v2 := map[string]any{
+		"type":     "object",
+		"required": []any{"title"},
+		"x-migrations": []any{
+			map[string]any{"op": "rename", "from": "name", "to": "title"},
+			map[string]any{"op": "move", "from": "street", "to": "address.street"},
+			map[string]any{"op": "default", "field": "priority", "value": 3},
+		},
+	}
+	if resp := put("/schemas/tasks", v2); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	resp, _ := http.Get(ts.URL + "/schemas/tasks/versions")
+	if versions := decodeJSONArray(t, resp.Body); len(versions) != 2 || versions[1].(map[string]any)["version"] != 2.0 {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+
+	// Reads migrate documents written under earlier versions.
+	want := map[string]any{
+		"title":          "Legacy",
+		"address":        map[string]any{"street": "Main St"},
+		"priority":       3.0,
+		"updatedAt":      "2024-01-01T00:00:00Z",
+		"_schemaVersion": 2.0,
+	}
+	resp, _ = http.Get(ts.URL + "/collections/tasks/items/old")
+	if got := decodeJSON(t, resp.Body); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected migrated document %v, got %v", want, got)
+	}
+	if doc, _ := s.Get("tasks", "old"); doc["name"] != "Legacy" {
+		t.Fatalf("expected a read not to rewrite the document, got %v", doc)
+	}
+
+	// Writes that record an earlier version are migrated before validation.
+	resp = put("/collections/tasks/items/offline", map[string]any{"name": "From v1", "_schemaVersion": 1, "updatedAt": "2024-01-02T00:00:00Z"})
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if doc, _ := s.Get("tasks", "offline"); doc["title"] != "From v1" || doc["_schemaVersion"] != 2.0 {
+		t.Fatalf("expected a migrated, stamped document, got %v", doc)
+	}
+
+	// The version field is reserved; other fields are the client's own.
+	for _, v := range []any{"mine", 1.5, 3} {
+		resp = put("/collections/tasks/items/reserved", map[string]any{"title": "x", "_schemaVersion": v, "updatedAt": "2024-01-02T00:00:00Z"})
+		if resp.StatusCode != 422 {
+			t.Fatalf("_schemaVersion %v: expected 422, got %d", v, resp.StatusCode)
+		}
+	}
+	resp = put("/collections/tasks/items/own", map[string]any{"title": "x", "schemaVersion": "mine", "updatedAt": "2024-01-02T00:00:00Z"})
+	if got := decodeJSON(t, resp.Body); got["schemaVersion"] != "mine" {
+		t.Fatalf("expected the client's schemaVersion to be kept, got %v", got)
+	}
+	s.Delete("tasks", "own")
+
+	// Projections apply to migrated documents, and partial documents are
+	// not stamped with a version.
+	resp, _ = http.Get(ts.URL + "/collections/tasks/items?fields=title")
+	if got := decodeJSONArray(t, resp.Body); !reflect.DeepEqual(got, []any{map[string]any{"title": "From v1"}, map[string]any{"title": "Legacy"}}) {
+		t.Fatalf("unexpected projection %v", got)
+	}
+	// Filters and aggregates, which see stored documents, wait for the
+	// migration.
+	filter := "/collections/tasks/items?filter=" + url.QueryEscape(`{"title": "Legacy"}`)
+	if resp, _ := http.Get(ts.URL + filter); resp.StatusCode != 409 {
+		t.Fatalf("expected 409 for a filter before migrating, got %d", resp.StatusCode)
+	}
+	aggregate := "/collections/tasks/aggregate?groupBy=title"
+	if resp, _ := http.Get(ts.URL + aggregate); resp.StatusCode != 409 {
+		t.Fatalf("expected 409 for an aggregate before migrating, got %d", resp.StatusCode)
+	}
+
+	// A background job rewrites the stored documents.
+	resp, _ = http.Post(ts.URL+"/collections/tasks/migrate", "application/json", nil)
+	if resp.StatusCode != 202 {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	var status map[string]any
+	for range 100 {
+		resp, _ = http.Get(ts.URL + "/collections/tasks/migrate")
+		if status = decodeJSON(t, resp.Body); status["state"] != "running" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status["state"] != "done" || status["checked"] != 2.0 || status["migrated"] != 1.0 {
+		t.Fatalf("unexpected job status %v", status)
+	}
+	if doc, _ := s.Get("tasks", "old"); !reflect.DeepEqual(doc, want) {
+		t.Fatalf("expected the stored document to be migrated, got %v", doc)
+	}
+	resp, _ = http.Get(ts.URL + filter)
+	if got := decodeJSONArray(t, resp.Body); len(got) != 1 {
+		t.Fatalf("expected the filter to find the migrated document, got %v", got)
+	}
+	resp, _ = http.Get(ts.URL + aggregate)
+	if groups := decodeJSON(t, resp.Body)["groups"].([]any); len(groups) != 2 {
+		t.Fatalf("expected a group per title, got %v", groups)
+	}
+
+	bad := map[string]any{"x-migrations": []any{map[string]any{"op": "rename", "from": "a", "to": "b.c"}}}
+	if resp := put("/schemas/tasks", bad); resp.StatusCode != 422 {
+		t.Fatalf("expected 422 for an invalid migration, got %d", resp.StatusCode)
+	}
+
+	// After the schema is deleted, version numbers continue, so documents
+	// of the deleted versions get the migrations of the new ones.
+	req, _ := http.NewRequest("DELETE", ts.URL+"/schemas/tasks", nil)
+	if resp, _ := http.DefaultClient.Do(req); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	v3 := map[string]any{"x-migrations": []any{map[string]any{"op": "rename", "from": "title", "to": "name"}}}
+	if resp := put("/schemas/tasks", v3); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	resp, _ = http.Get(ts.URL + "/collections/tasks/items/old")
+	if got := decodeJSON(t, resp.Body); got["name"] != "Legacy" || got["_schemaVersion"] != 3.0 {
+		t.Fatalf("expected the document to be migrated to version 3, got %v", got)
+	}
+}
+
+func TestSchemaCompatibility(t *testing.T) {
+	ts, s := setup()
+	defer ts.Close()
+	put := func(path string, body any) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("PUT", ts.URL+path, bytes.NewReader(mustJSON(t, body)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	v1 := map[string]any{
+		"type":            "object",
+		"x-compatibility": "backward",
+		"properties":      map[string]any{"title": map[string]any{"type": "string"}},
+	}
+	if resp := put("/schemas/tasks", v1); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	breaking := map[string]any{
+		"type":            "object",
+		"x-compatibility": "backward",
+		"required":        []any{"title"},
+		"properties":      map[string]any{"title": map[string]any{"type": "string", "maxLength": 10}},
+	}
+	resp := put("/schemas/tasks", breaking)
+	if resp.StatusCode != 409 {
+		t.Fatalf("expected 409, got %d", resp.StatusCode)
+	}
+	body := decodeJSON(t, resp.Body)
+	want := []any{
+		map[string]any{"path": "/required", "keyword": "required", "message": `the new schema requires "title"`},
+		map[string]any{"path": "/properties/title/maxLength", "keyword": "maxLength", "message": "the new schema lowers maxLength to 10"},
+	}
+	if !reflect.DeepEqual(body["errors"], want) {
+		t.Fatalf("unexpected errors %v", body["errors"])
+	}
+	if _, versions, _ := s.SchemaVersions("tasks"); len(versions) != 1 {
+		t.Fatalf("expected the change to be refused, got %d versions", len(versions))
+	}
+
+	// Compatible changes are accepted, and ?compatibility= overrides the
+	// policy for a deliberate break.
+	compatible := map[string]any{
+		"type":            "object",
+		"x-compatibility": "backward",
+		"properties": map[string]any{
+			"title": map[string]any{"type": "string"},
+			"done":  map[string]any{},
+		},
+	}
+	if resp := put("/schemas/tasks", compatible); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if resp := put("/schemas/tasks?compatibility=none", breaking); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if resp := put("/schemas/tasks?compatibility=sideways", breaking); resp.StatusCode != 400 {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+	if resp := put("/schemas/other", map[string]any{"x-compatibility": "sideways"}); resp.StatusCode != 422 {
+		t.Fatalf("expected 422, got %d", resp.StatusCode)
+	}
+}
+
+func TestSchemaDefaultsAndReadOnly(t *testing.T) {
+	s := store.NewMemoryStore()
+	ts := httptest.NewServer(auth.Middleware(handler.New(s), &auth.APIKeys{Store: s, Admin: "root"}))
+	defer ts.Close()
+	alice, aliceID := newKey(t, s, "")
+
+	do := func(method, path string, body any) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, bytes.NewReader(mustJSON(t, body)))
+		req.Header.Set("X-API-Key", alice)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	bad := map[string]any{"properties": map[string]any{"createdAt": map[string]any{"x-server": "createdAt"}}}
+	req, _ := http.NewRequest("PUT", ts.URL+"/schemas/tasks", bytes.NewReader(mustJSON(t, bad)))
+	req.Header.Set("X-API-Key", "root")
+	if resp, _ := http.DefaultClient.Do(req); resp.StatusCode != 422 {
+		t.Fatalf("expected 422 for x-server on a property that is not readOnly, got %d", resp.StatusCode)
+	}
+	tasks := map[string]any{
+		"type":     "object",
+		"required": []any{"title", "priority", "createdAt"},
+		"properties": map[string]any{
+			"title":     map[string]any{"type": "string"},
+			"priority":  map[string]any{"type": "integer", "default": 3},
+			"meta":      map[string]any{"type": "object", "default": map[string]any{}, "properties": map[string]any{"tags": map[string]any{"type": "array", "default": []any{}}}},
+			"createdAt": map[string]any{"type": "string", "format": "date-time", "readOnly": true, "x-server": "createdAt"},
+			"createdBy": map[string]any{"type": "string", "readOnly": true, "x-server": "createdBy"},
+			"status":    map[string]any{"type": "string", "readOnly": true, "default": "new"},
+		},
+	}
+	req, _ = http.NewRequest("PUT", ts.URL+"/schemas/tasks", bytes.NewReader(mustJSON(t, tasks)))
+	req.Header.Set("X-API-Key", "root")
+	if resp, _ := http.DefaultClient.Do(req); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	// Creating a document fills in defaults and stamps the server-managed
+	// fields, ignoring the values the client sent.
+	resp := do("PUT", "/collections/tasks/items/a", map[string]any{
+		"title":     "Write docs",
+		"createdAt": "2000-01-01T00:00:00Z",
+		"createdBy": "mallory",
+		"status":    "done",
+		"updatedAt": "2024-01-01T00:00:00Z",
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d: %v", resp.StatusCode, decodeJSON(t, resp.Body))
+	}
+	created, _ := s.Get("tasks", "a")
+	if created["priority"] != 3.0 || created["status"] != "new" || created["createdBy"] != aliceID {
+		t.Fatalf("expected defaults and stamps, got %v", created)
+	}
+	if tags := created["meta"].(map[string]any)["tags"]; !reflect.DeepEqual(tags, []any{}) {
+		t.Fatalf("expected nested defaults, got %v", created["meta"])
+	}
+	if created["createdAt"] == "2000-01-01T00:00:00Z" {
+		t.Fatalf("expected createdAt to be stamped by the server, got %v", created["createdAt"])
+	}
+
+	// Updates, by PUT or sync, keep the stored readOnly values.
+	resp = do("PUT", "/collections/tasks/items/a", map[string]any{
+		"title":     "Write more docs",
+		"priority":  1,
+		"createdAt": "2000-01-01T00:00:00Z",
+		"updatedAt": "2024-01-02T00:00:00Z",
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	updated, _ := s.Get("tasks", "a")
+	if updated["createdAt"] != created["createdAt"] || updated["createdBy"] != aliceID || updated["status"] != "new" || updated["priority"] != 1.0 {
+		t.Fatalf("expected readOnly fields to be kept, got %v", updated)
+	}
+	resp = do("POST", "/collections/tasks/sync", map[string]any{"items": []any{
+		map[string]any{"id": "a", "title": "Synced", "status": "done", "updatedAt": "2024-01-03T00:00:00Z"},
+		map[string]any{"id": "b", "title": "New", "updatedAt": "2024-01-03T00:00:00Z"},
+	}})
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d: %v", resp.StatusCode, decodeJSON(t, resp.Body))
+	}
+	synced, _ := s.Get("tasks", "a")
+	if synced["title"] != "Synced" || synced["status"] != "new" || synced["createdAt"] != created["createdAt"] || synced["priority"] != 3.0 {
+		t.Fatalf("unexpected synced document %v", synced)
+	}
+	if b, _ := s.Get("tasks", "b"); b["createdBy"] != aliceID || b["createdAt"] == nil {
+		t.Fatalf("expected a synced new document to be stamped, got %v", b)
+	}
+}
+
+func TestSchemaRefs(t *testing.T) {
+	ts, _ := setup()
+	defer ts.Close()
+
+	put := func(path string, body any) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("PUT", ts.URL+path, bytes.NewReader(mustJSON(t, body)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	users := map[string]any{
+		"type":       "object",
+		"required":   []any{"name"},
+		"properties": map[string]any{"name": map[string]any{"type": "string"}},
+	}
+	tasks := map[string]any{
+		"properties": map[string]any{
+			"assignee": map[string]any{"$ref": "schemas://users"},
+			"subtasks": map[string]any{"type": "array", "items": map[string]any{"$ref": "schemas://tasks"}},
+		},
+	}
+
+	// References must resolve when the schema is saved.
+	if resp := put("/schemas/tasks", tasks); resp.StatusCode != 422 {
+		t.Fatalf("expected 422 for a reference to a missing schema, got %d", resp.StatusCode)
+	}
+	if resp := put("/schemas/users", users); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if resp := put("/schemas/tasks", tasks); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	doc := map[string]any{
+		"assignee":  map[string]any{"name": "Ann"},
+		"subtasks":  []any{map[string]any{"assignee": map[string]any{}}},
+		"updatedAt": "2024-01-01T00:00:00Z",
+	}
+	resp := put("/collections/tasks/items/t1", doc)
+	if resp.StatusCode != 422 {
+		t.Fatalf("expected 422, got %d", resp.StatusCode)
+	}
+	if got := decodeJSON(t, resp.Body)["detail"]; !strings.Contains(got.(string), `/subtasks/0/assignee/name: missing required field "name"`) {
+		t.Fatalf("unexpected detail %v", got)
+	}
+
+	// Changing a referenced schema applies to the referring collection.
+	delete(users, "required")
+	if resp := put("/schemas/users", users); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if resp := put("/collections/tasks/items/t1", doc); resp.StatusCode != 200 {
+		t.Fatalf("expected 200 after relaxing users, got %d", resp.StatusCode)
+	}
+}
+
 func TestGetNotesSince(t *testing.T) {
 	ts, _ := setup()
 	defer ts.Close()
@@ -389,3 +977,1266 @@ func TestGetNotesSince(t *testing.T) {
 		t.Fatalf("expected 1 item since March, got %d", len(items))
 	}
 }
+
+func TestPagination(t *testing.T) {
+	ts, s := setup()
+	defer ts.Close()
+
+	for _, k := range []string{"c", "a", "b"} {
+		s.Put("tasks", k, map[string]any{"id": k, "updatedAt": "2024-06-01T12:00:00Z"})
+	}
+
+	resp, _ := http.Get(ts.URL + "/collections/tasks/items?limit=2")
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	items := decodeJSONArray(t, resp.Body)
+	if len(items) != 2 || items[0].(map[string]any)["id"] != "a" {
+		t.Fatalf("expected first page [a b], got %v", items)
+	}
+	link := resp.Header.Get("Link")
+	if !strings.HasSuffix(link, `>; rel="next"`) || resp.Header.Get("X-Next-Cursor") == "" {
+		t.Fatalf("expected next link, got %q", link)
+	}
+
+	next := strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+	resp, _ = http.Get(ts.URL + next)
+	items = decodeJSONArray(t, resp.Body)
+	if len(items) != 1 || items[0].(map[string]any)["id"] != "c" {
+		t.Fatalf("expected last page [c], got %v", items)
+	}
+	if resp.Header.Get("Link") != "" {
+		t.Fatalf("expected no Link on last page, got %q", resp.Header.Get("Link"))
+	}
+
+	for _, q := range []string{"limit=0", "limit=x", "orderBy=size", "cursor=bogus"} {
+		resp, _ = http.Get(ts.URL + "/collections/tasks/items?" + q)
+		if resp.StatusCode != 400 {
+			t.Fatalf("%s: expected 400, got %d", q, resp.StatusCode)
+		}
+	}
+}
+
+func TestSyncPagination(t *testing.T) {
+	ts, s := setup()
+	defer ts.Close()
+
+	for _, k := range []string{"t1", "t2", "t3"} {
+		s.Put("tasks", k, map[string]any{"id": k, "updatedAt": "2024-06-01T12:00:00Z"})
+	}
+
+	var got []any
+	cursor := ""
+	for range 3 {
+		syncReq := map[string]any{"items": []any{}, "lastSyncTime": nil, "limit": 2, "cursor": cursor}
+		resp, _ := http.Post(ts.URL+"/collections/tasks/sync", "application/json", bytes.NewReader(mustJSON(t, syncReq)))
+		syncResp := decodeJSON(t, resp.Body)
+		got = append(got, syncResp["items"].([]any)...)
+		next, _ := syncResp["nextCursor"].(string)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected 3 items across pages, got %d", len(got))
+	}
+
+	// A document changed between pages moves past the cursor, although its
+	// key sorts before it.
+	keysOf := func(items []any) string {
+		var keys []string
+		for _, item := range items {
+			keys = append(keys, item.(map[string]any)["id"].(string))
+		}
+		return strings.Join(keys, ",")
+	}
+	sync := func(body map[string]any) map[string]any {
+		t.Helper()
+		resp, _ := http.Post(ts.URL+"/collections/tasks/sync", "application/json", bytes.NewReader(mustJSON(t, body)))
+		if resp.StatusCode != 200 {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		return decodeJSON(t, resp.Body)
+	}
+	first := sync(map[string]any{"items": []any{}, "limit": 2})
+	if got := keysOf(first["items"].([]any)); got != "t1,t2" {
+		t.Fatalf("expected t1,t2, got %s", got)
+	}
+	s.Put("tasks", "t1", map[string]any{"id": "t1", "updatedAt": "2024-06-02T12:00:00Z"})
+	rest := sync(map[string]any{"items": []any{}, "limit": 2, "cursor": first["nextCursor"]})
+	if got := keysOf(rest["items"].([]any)); got != "t3,t1" {
+		t.Fatalf("expected t3,t1, got %s", got)
+	}
+
+	// An invalid page request is refused before the items are merged.
+	for _, body := range []map[string]any{
+		{"limit": -1},
+		{"cursor": "not a cursor"},
+	} {
+		body["items"] = []any{map[string]any{"id": "t9", "updatedAt": "2024-06-01T12:00:00Z"}}
+		resp, _ := http.Post(ts.URL+"/collections/tasks/sync", "application/json", bytes.NewReader(mustJSON(t, body)))
+		if resp.StatusCode != 400 {
+			t.Fatalf("%v: expected 400, got %d", body, resp.StatusCode)
+		}
+		if doc, _ := s.Get("tasks", "t9"); doc != nil {
+			t.Fatalf("%v: expected the item not to be written", body)
+		}
+	}
+}
+
+func TestFilterAndFields(t *testing.T) {
+	ts, s := setup()
+	defer ts.Close()
+
+	s.Put("tasks", "t1", map[string]any{"title": "a", "done": false, "priority": float64(1)})
+	s.Put("tasks", "t2", map[string]any{"title": "b", "done": true, "priority": float64(4)})
+	s.Put("tasks", "t3", map[string]any{"title": "c", "done": false, "priority": float64(5)})
+
+	params := url.Values{}
+	params.Set("filter", `{"done": false, "priority": {"$gte": 2}}`)
+	params.Set("fields", "title,done")
+	resp, _ := http.Get(ts.URL + "/collections/tasks/items?" + params.Encode())
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	items := decodeJSONArray(t, resp.Body)
+	if len(items) != 1 {
+		t.Fatalf("expected 1 item, got %v", items)
+	}
+	got := items[0].(map[string]any)
+	if got["title"] != "c" || len(got) != 2 {
+		t.Fatalf("expected projected t3, got %v", got)
+	}
+
+	for _, f := range []string{`not json`, `{"a": {"$regex": "x"}}`, `{"a..b": 1}`} {
+		resp, _ = http.Get(ts.URL + "/collections/tasks/items?filter=" + url.QueryEscape(f))
+		if resp.StatusCode != 400 {
+			t.Fatalf("%s: expected 400, got %d", f, resp.StatusCode)
+		}
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	ts, s := setup()
+	defer ts.Close()
+
+	s.Put("tasks", "t1", map[string]any{"status": "open"})
+
+	schema := map[string]any{"type": "object", "x-indexes": []any{"status"}}
+	req, _ := http.NewRequest("PUT", ts.URL+"/schemas/tasks", bytes.NewReader(mustJSON(t, schema)))
+	resp, _ := http.DefaultClient.Do(req)
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest("PUT", ts.URL+"/collections/tasks/indexes/owner.id", nil)
+	resp, _ = http.DefaultClient.Do(req)
+	if resp.StatusCode != 200 && resp.StatusCode != 202 {
+		t.Fatalf("expected 200 or 202, got %d", resp.StatusCode)
+	}
+
+	resp, _ = http.Get(ts.URL + "/collections/tasks/indexes")
+	indexes := decodeJSONArray(t, resp.Body)
+	if len(indexes) != 2 || indexes[0].(map[string]any)["field"] != "owner.id" || indexes[1].(map[string]any)["field"] != "status" {
+		t.Fatalf("expected owner.id and status indexes, got %v", indexes)
+	}
+
+	req, _ = http.NewRequest("DELETE", ts.URL+"/collections/tasks/indexes/owner.id", nil)
+	resp, _ = http.DefaultClient.Do(req)
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	resp, _ = http.DefaultClient.Do(req)
+	if resp.StatusCode != 404 {
+		t.Fatalf("expected 404 on second delete, got %d", resp.StatusCode)
+	}
+
+	bad := map[string]any{"type": "object", "x-indexes": "status"}
+	req, _ = http.NewRequest("PUT", ts.URL+"/schemas/tasks", bytes.NewReader(mustJSON(t, bad)))
+	resp, _ = http.DefaultClient.Do(req)
+	if resp.StatusCode != 422 {
+		t.Fatalf("expected 422 for malformed x-indexes, got %d", resp.StatusCode)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	ts, s := setup()
+	defer ts.Close()
+
+	s.Put("notes", "n1", map[string]any{"title": "Shopping", "body": "milk and bread"})
+	s.Put("notes", "n2", map[string]any{"title": "Work", "body": "quarterly report"})
+
+	resp, _ := http.Get(ts.URL + "/collections/notes/search?q=milk")
+	if resp.StatusCode != 400 {
+		t.Fatalf("expected 400 before fields are configured, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("PUT", ts.URL+"/collections/notes/search/fields", bytes.NewReader(mustJSON(t, []string{"title", "body"})))
+	resp, _ = http.DefaultClient.Do(req)
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	resp, _ = http.Get(ts.URL + "/collections/notes/search?q=milk")
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	hits := decodeJSONArray(t, resp.Body)
+	if len(hits) != 1 {
+		t.Fatalf("expected 1 hit, got %v", hits)
+	}
+	hit := hits[0].(map[string]any)
+	if hit["key"] != "n1" || hit["snippet"] != "<mark>milk</mark> and bread" || hit["item"].(map[string]any)["title"] != "Shopping" {
+		t.Fatalf("unexpected hit %v", hit)
+	}
+
+	resp, _ = http.Get(ts.URL + "/collections/notes/search")
+	if resp.StatusCode != 400 {
+		t.Fatalf("expected 400 without q, got %d", resp.StatusCode)
+	}
+
+	schema := map[string]any{"type": "object", "x-search": []any{"title"}}
+	req, _ = http.NewRequest("PUT", ts.URL+"/schemas/notes", bytes.NewReader(mustJSON(t, schema)))
+	http.DefaultClient.Do(req)
+	resp, _ = http.Get(ts.URL + "/collections/notes/search/fields")
+	fields := decodeJSONArray(t, resp.Body)
+	if len(fields) != 1 || fields[0] != "title" {
+		t.Fatalf("expected x-search to set fields, got %v", fields)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	ts, s := setup()
+	defer ts.Close()
+
+	s.Put("orders", "o1", map[string]any{"status": "paid", "total": float64(30)})
+	s.Put("orders", "o2", map[string]any{"status": "paid", "total": float64(12)})
+	s.Put("orders", "o3", map[string]any{"status": "open", "total": float64(8)})
+
+	params := url.Values{}
+	params.Set("groupBy", "status")
+	params.Set("metrics", "count,sum(total),avg(total)")
+	params.Set("filter", `{"total": {"$gt": 10}}`)
+	resp, _ := http.Get(ts.URL + "/collections/orders/aggregate?" + params.Encode())
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	body := decodeJSON(t, resp.Body)
+	groups := body["groups"].([]any)
+	if len(groups) != 1 {
+		t.Fatalf("expected 1 group, got %v", groups)
+	}
+	values := groups[0].(map[string]any)["values"].(map[string]any)
+	if values["count"] != float64(2) || values["sum(total)"] != float64(42) || values["avg(total)"] != float64(21) {
+		t.Fatalf("unexpected values %v", values)
+	}
+
+	resp, _ = http.Get(ts.URL + "/collections/orders/aggregate")
+	body = decodeJSON(t, resp.Body)
+	values = body["groups"].([]any)[0].(map[string]any)["values"].(map[string]any)
+	if values["count"] != float64(3) {
+		t.Fatalf("expected count metric by default, got %v", values)
+	}
+
+	for _, m := range []string{"median(total)", "sum", "sum()"} {
+		resp, _ = http.Get(ts.URL + "/collections/orders/aggregate?metrics=" + url.QueryEscape(m))
+		if resp.StatusCode != 400 {
+			t.Fatalf("%s: expected 400, got %d", m, resp.StatusCode)
+		}
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	s := store.NewMemoryStore()
+	h := auth.Middleware(handler.New(s), &auth.APIKeys{Store: s, Admin: "bootstrap"})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	do := func(method, path, key string, body any) *http.Response {
+		t.Helper()
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(mustJSON(t, body))
+		}
+		req, _ := http.NewRequest(method, ts.URL+path, r)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Health stays public; everything else needs credentials.
+	if resp := do("GET", "/health", "", nil); resp.StatusCode != 200 {
+		t.Fatalf("expected 200 for /health, got %d", resp.StatusCode)
+	}
+	resp := do("GET", "/notes", "", nil)
+	if resp.StatusCode != 401 || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("expected 401 with challenge, got %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/notes", "ssk_nope_nope", nil); resp.StatusCode != 401 {
+		t.Fatalf("expected 401 for unknown key, got %d", resp.StatusCode)
+	}
+
+	// The bootstrap key issues a key that can read tasks-* and write tasks-a.
+	resp = do("POST", "/admin/keys", "bootstrap", map[string]any{
+		"name": "client",
+		"grants": []any{
+			map[string]any{"collections": "tasks-*", "scopes": []any{"read"}},
+			map[string]any{"collections": "tasks-a", "scopes": []any{"write"}},
+		},
+	})
+	if resp.StatusCode != 201 {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	created := decodeJSON(t, resp.Body)
+	key := created["key"].(string)
+	id := created["apiKey"].(map[string]any)["id"].(string)
+	if _, ok := created["apiKey"].(map[string]any)["hash"]; ok {
+		t.Fatal("hash must not be returned")
+	}
+
+	if resp := do("PUT", "/collections/tasks-a/items/1", key, map[string]any{"updatedAt": "2024-01-01T00:00:00Z"}); resp.StatusCode != 200 {
+		t.Fatalf("expected 200 for write to tasks-a, got %d", resp.StatusCode)
+	}
+	resp = do("GET", "/collections/tasks-a/items/1", key, nil)
+	if got := decodeJSON(t, resp.Body)["updatedBy"]; got != "key:"+id {
+		t.Fatalf("expected updatedBy=key:%s, got %v", id, got)
+	}
+	if resp := do("PUT", "/collections/tasks-b/items/1", key, map[string]any{"updatedAt": "2024-01-01T00:00:00Z"}); resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for write to tasks-b, got %d", resp.StatusCode)
+	}
+	// An escaped "/" is part of the collection name, as the routes bind it.
+	if resp := do("PUT", "/collections/tasks-a%2Fb/items/1", key, map[string]any{"updatedAt": "2024-01-01T00:00:00Z"}); resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for write to tasks-a/b, got %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/collections/tasks-b/items", key, nil); resp.StatusCode != 200 {
+		t.Fatalf("expected 200 for read of tasks-b, got %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/notes", key, nil); resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for notes, got %d", resp.StatusCode)
+	}
+	if resp := do("PUT", "/schemas/tasks-a", key, map[string]any{"type": "object"}); resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for schema write without admin, got %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/admin/keys", key, nil); resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for key management, got %d", resp.StatusCode)
+	}
+
+	// Listings only include readable collections.
+	s.Put("other", "1", map[string]any{"x": 1.0})
+	resp = do("GET", "/collections", key, nil)
+	names := decodeJSONArray(t, resp.Body)
+	if len(names) != 1 || names[0] != "tasks-a" {
+		t.Fatalf("expected [tasks-a], got %v", names)
+	}
+
+	// X-API-Key works too, until the key is revoked.
+	req, _ := http.NewRequest("GET", ts.URL+"/collections/tasks-a/items", nil)
+	req.Header.Set("X-API-Key", key)
+	if resp, _ := http.DefaultClient.Do(req); resp.StatusCode != 200 {
+		t.Fatalf("expected 200 with X-API-Key, got %d", resp.StatusCode)
+	}
+	if resp := do("DELETE", "/admin/keys/"+id, "bootstrap", nil); resp.StatusCode != 200 {
+		t.Fatalf("expected 200 for revoke, got %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/collections/tasks-a/items", key, nil); resp.StatusCode != 401 {
+		t.Fatalf("expected 401 after revoke, got %d", resp.StatusCode)
+	}
+
+	if resp := do("POST", "/admin/keys", "bootstrap", map[string]any{
+		"grants": []any{map[string]any{"collections": "x", "scopes": []any{"owner"}}},
+	}); resp.StatusCode != 400 {
+		t.Fatalf("expected 400 for unknown scope, got %d", resp.StatusCode)
+	}
+}
+
+// newKey stores an API key with a write grant on every collection of a
+// tenant ("" for an unconfined key).
+func newKey(t *testing.T, s store.Store, tenant string) (key, subject string) {
+	t.Helper()
+	key, rec, err := auth.NewAPIKey("test", tenant, []auth.Grant{{Collections: "*", Scopes: []auth.Scope{auth.ScopeWrite}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutAPIKey(rec.ID, rec.ToMap()); err != nil {
+		t.Fatal(err)
+	}
+	return key, "key:" + rec.ID
+}
+
+// schemaReads counts the schema reads that reach a store.
+type schemaReads struct {
+	store.Store
+	n atomic.Int64
+}
+
+func (s *schemaReads) GetSchema(collection string) (map[string]any, error) {
+	s.n.Add(1)
+	return s.Store.GetSchema(collection)
+}
+
+func (s *schemaReads) SchemaVersions(collection string) (int, []map[string]any, error) {
+	s.n.Add(1)
+	return s.Store.SchemaVersions(collection)
+}
+
+func TestOwnership(t *testing.T) {
+	s := store.NewMemoryStore()
+	reads := &schemaReads{Store: s}
+	ts := httptest.NewServer(auth.Middleware(handler.New(reads), &auth.APIKeys{Store: s, Admin: "root"}))
+	defer ts.Close()
+	alice, aliceID := newKey(t, s, "")
+	bob, _ := newKey(t, s, "")
+
+	do := func(method, path, key string, body any) *http.Response {
+		t.Helper()
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(mustJSON(t, body))
+		}
+		req, _ := http.NewRequest(method, ts.URL+path, r)
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	keysOf := func(resp *http.Response) string {
+		t.Helper()
+		var keys []string
+		for _, item := range decodeJSONArray(t, resp.Body) {
+			keys = append(keys, item.(map[string]any)["id"].(string))
+		}
+		return strings.Join(keys, ",")
+	}
+
+	if resp := do("PUT", "/schemas/tasks", "root", map[string]any{"x-owner": map[string]any{"field": "owner", "shared": "public"}}); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if resp := do("PUT", "/schemas/bad", "root", map[string]any{"x-owner": "a.b"}); resp.StatusCode != 422 {
+		t.Fatalf("expected 422 for nested owner field, got %d", resp.StatusCode)
+	}
+	reads.n.Store(0)
+
+	// The owner is stamped from the caller, whatever the client sends.
+	resp := do("PUT", "/collections/tasks/items/a1", alice, map[string]any{"id": "a1", "owner": "bob", "updatedAt": "2024-01-01T00:00:00Z"})
+	if got := decodeJSON(t, resp.Body)["owner"]; got != aliceID {
+		t.Fatalf("expected owner %s, got %v", aliceID, got)
+	}
+	do("PUT", "/collections/tasks/items/a2", alice, map[string]any{"id": "a2", "public": true, "updatedAt": "2024-01-01T00:00:00Z"})
+	do("PUT", "/collections/tasks/items/b1", bob, map[string]any{"id": "b1", "updatedAt": "2024-01-01T00:00:00Z"})
+
+	if got := keysOf(do("GET", "/collections/tasks/items", bob, nil)); got != "a2,b1" {
+		t.Fatalf("expected bob to see a2,b1, got %s", got)
+	}
+	if got := keysOf(do("GET", "/collections/tasks/items/since/2000-01-01T00:00:00Z", alice, nil)); got != "a1,a2" {
+		t.Fatalf("expected alice to see a1,a2, got %s", got)
+	}
+	if got := keysOf(do("GET", "/collections/tasks/items", "root", nil)); got != "a1,a2,b1" {
+		t.Fatalf("expected admin to see everything, got %s", got)
+	}
+	if resp := do("GET", "/collections/tasks/items/a1", bob, nil); resp.StatusCode != 404 {
+		t.Fatalf("expected 404 for another user's document, got %d", resp.StatusCode)
+	}
+	if n := reads.n.Load(); n != 0 {
+		t.Fatalf("expected the owner field to come from the schema cache, got %d schema reads", n)
+	}
+
+	// Shared documents are readable but not writable by others.
+	if resp := do("PUT", "/collections/tasks/items/a2", bob, map[string]any{"id": "a2", "updatedAt": "2025-01-01T00:00:00Z"}); resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for cross-user overwrite, got %d", resp.StatusCode)
+	}
+	if resp := do("DELETE", "/collections/tasks/items/a1", bob, nil); resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for cross-user delete, got %d", resp.StatusCode)
+	}
+	resp = do("POST", "/collections/tasks/sync", bob, map[string]any{"items": []any{
+		map[string]any{"id": "a1", "updatedAt": "2025-01-01T00:00:00Z"},
+	}})
+	if resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for cross-user sync, got %d", resp.StatusCode)
+	}
+
+	resp = do("POST", "/collections/tasks/sync", bob, map[string]any{"items": []any{}})
+	items := decodeJSON(t, resp.Body)["items"].([]any)
+	if len(items) != 2 {
+		t.Fatalf("expected bob's sync to return 2 items, got %v", items)
+	}
+
+	resp = do("GET", "/collections/tasks/aggregate", alice, nil)
+	values := decodeJSON(t, resp.Body)["groups"].([]any)[0].(map[string]any)["values"].(map[string]any)
+	if values["count"] != float64(2) {
+		t.Fatalf("expected alice to aggregate 2 documents, got %v", values)
+	}
+
+	// An admin overwriting a document without naming an owner leaves it
+	// with its owner; new documents are the admin's.
+	resp = do("PUT", "/collections/tasks/items/a1", "root", map[string]any{"id": "a1", "title": "fixed", "updatedAt": "2026-01-01T00:00:00Z"})
+	if got := decodeJSON(t, resp.Body)["owner"]; got != aliceID {
+		t.Fatalf("expected the admin's write to keep owner %s, got %v", aliceID, got)
+	}
+	resp = do("PUT", "/collections/tasks/items/r1", "root", map[string]any{"id": "r1", "updatedAt": "2026-01-01T00:00:00Z"})
+	if got := decodeJSON(t, resp.Body)["owner"]; got != "key:admin" {
+		t.Fatalf("expected a new document to be the admin's, got %v", got)
+	}
+}
+
+func TestACL(t *testing.T) {
+	s := store.NewMemoryStore()
+	ts := httptest.NewServer(auth.Middleware(handler.New(s), &auth.APIKeys{Store: s, Admin: "root"}))
+	defer ts.Close()
+	alice, aliceID := newKey(t, s, "")
+	bob, bobID := newKey(t, s, "")
+	carol, _ := newKey(t, s, "")
+
+	do := func(method, path, key string, body any) *http.Response {
+		t.Helper()
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(mustJSON(t, body))
+		}
+		req, _ := http.NewRequest(method, ts.URL+path, r)
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	keysOf := func(items []any) string {
+		var keys []string
+		for _, item := range items {
+			keys = append(keys, item.(map[string]any)["id"].(string))
+		}
+		return strings.Join(keys, ",")
+	}
+
+	do("PUT", "/schemas/notes-x", "root", map[string]any{"x-owner": "owner"})
+	do("PUT", "/collections/notes-x/items/n1", alice, map[string]any{"id": "n1", "updatedAt": "2024-01-01T00:00:00Z"})
+	do("PUT", "/collections/notes-x/items/n2", alice, map[string]any{"id": "n2", "updatedAt": "2024-01-01T00:00:00Z"})
+	do("PUT", "/collections/notes-x/items/b1", bob, map[string]any{"id": "b1", "updatedAt": "2024-01-01T00:00:00Z"})
+
+	resp := do("POST", "/collections/notes-x/sync", bob, map[string]any{"items": []any{}})
+	body := decodeJSON(t, resp.Body)
+	lastSync := body["serverTime"]
+	if got := keysOf(body["items"].([]any)); got != "b1" {
+		t.Fatalf("expected bob to sync b1, got %s", got)
+	}
+
+	// Only the owner manages a document's ACL.
+	if resp := do("PUT", "/collections/notes-x/items/n1/acl", bob, map[string]any{"read": []any{bobID}}); resp.StatusCode != 404 {
+		t.Fatalf("expected 404 for an invisible document, got %d", resp.StatusCode)
+	}
+	if resp := do("PUT", "/collections/notes-x/items/n1/acl", alice, map[string]any{"write": []any{bobID}}); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if resp := do("PUT", "/collections/notes-x/items/n2/acl", alice, map[string]any{"read": []any{""}}); resp.StatusCode != 400 {
+		t.Fatalf("expected 400 for an empty entry, got %d", resp.StatusCode)
+	}
+	if resp := do("PUT", "/collections/notes-x/items/n1/acl", bob, map[string]any{"read": []any{"x"}}); resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for a collaborator changing the ACL, got %d", resp.StatusCode)
+	}
+	resp = do("GET", "/collections/notes-x/items/n1/acl", bob, nil)
+	if got := decodeJSON(t, resp.Body)["write"].([]any); len(got) != 1 || got[0] != bobID {
+		t.Fatalf("expected write=[%s], got %v", bobID, got)
+	}
+
+	// The shared document reaches bob's next sync although it has not
+	// changed since his last one.
+	resp = do("POST", "/collections/notes-x/sync", bob, map[string]any{"items": []any{}, "lastSyncTime": lastSync})
+	if got := keysOf(decodeJSON(t, resp.Body)["items"].([]any)); got != "n1" {
+		t.Fatalf("expected bob to sync n1, got %s", got)
+	}
+	resp = do("GET", "/collections/notes-x/items", bob, nil)
+	if got := keysOf(decodeJSONArray(t, resp.Body)); got != "b1,n1" {
+		t.Fatalf("expected bob to see b1,n1, got %s", got)
+	}
+
+	// A collaborator's edit keeps the document's owner; deleting stays
+	// with the owner.
+	resp = do("PUT", "/collections/notes-x/items/n1", bob, map[string]any{"id": "n1", "text": "hi", "updatedAt": "2025-01-01T00:00:00Z"})
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200 for a collaborator's write, got %d", resp.StatusCode)
+	}
+	if got := decodeJSON(t, resp.Body)["owner"]; got != aliceID {
+		t.Fatalf("expected owner %s, got %v", aliceID, got)
+	}
+	if resp := do("DELETE", "/collections/notes-x/items/n1", bob, nil); resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for a collaborator's delete, got %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/collections/notes-x/items/n1", carol, nil); resp.StatusCode != 404 {
+		t.Fatalf("expected 404 for an unshared user, got %d", resp.StatusCode)
+	}
+
+	// Revoking the ACL hides the document again.
+	if resp := do("DELETE", "/collections/notes-x/items/n1/acl", alice, nil); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/collections/notes-x/items/n1", bob, nil); resp.StatusCode != 404 {
+		t.Fatalf("expected 404 after revoking, got %d", resp.StatusCode)
+	}
+
+	// Groups come from the API key.
+	resp = do("POST", "/admin/keys", "root", map[string]any{
+		"grants": []any{map[string]any{"collections": "*", "scopes": []any{"read"}}},
+		"groups": []any{"team"},
+	})
+	member := decodeJSON(t, resp.Body)["key"].(string)
+	do("PUT", "/collections/notes-x/items/n2/acl", alice, map[string]any{"read": []any{"group:team"}})
+	if resp := do("GET", "/collections/notes-x/items/n2", member, nil); resp.StatusCode != 200 {
+		t.Fatalf("expected 200 for a group member, got %d", resp.StatusCode)
+	}
+
+	// A document keyed "since" has its ACL at the since route's path.
+	do("PUT", "/collections/notes-x/items/since", alice, map[string]any{"id": "since", "updatedAt": "2024-01-01T00:00:00Z"})
+	do("PUT", "/collections/notes-x/items/since/acl", alice, map[string]any{"read": []any{bobID}})
+	resp = do("GET", "/collections/notes-x/items/since/acl", alice, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200 for the ACL of a document keyed since, got %d", resp.StatusCode)
+	}
+	if got := decodeJSON(t, resp.Body)["read"].([]any); len(got) != 1 || got[0] != bobID {
+		t.Fatalf("expected read=[%s], got %v", bobID, got)
+	}
+
+	if resp := do("GET", "/collections/plain/items/x/acl", "root", nil); resp.StatusCode != 400 {
+		t.Fatalf("expected 400 without x-owner, got %d", resp.StatusCode)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	s := store.NewMemoryStore()
+	ts := httptest.NewServer(handler.New(s, handler.WithQuotas(handler.Quotas{
+		CollectionDocuments: 2,
+		TenantBytes:         200,
+	})))
+	defer ts.Close()
+
+	put := func(path string, body any) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("PUT", ts.URL+path, bytes.NewReader(mustJSON(t, body)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	put("/collections/tasks/items/a", map[string]any{"id": "a", "updatedAt": "2024-01-01T00:00:00Z"})
+	put("/collections/tasks/items/b", map[string]any{"id": "b", "updatedAt": "2024-01-01T00:00:00Z"})
+	if resp := put("/collections/tasks/items/c", map[string]any{"id": "c"}); resp.StatusCode != 507 {
+		t.Fatalf("expected 507 over the document quota, got %d", resp.StatusCode)
+	}
+	// Updating an existing document adds no documents.
+	if resp := put("/collections/tasks/items/a", map[string]any{"id": "a", "updatedAt": "2025-01-01T00:00:00Z"}); resp.StatusCode != 200 {
+		t.Fatalf("expected 200 for an update, got %d", resp.StatusCode)
+	}
+
+	resp := put("/collections/other/items/big", map[string]any{"text": strings.Repeat("x", 200)})
+	if resp.StatusCode != 507 {
+		t.Fatalf("expected 507 over the tenant byte quota, got %d", resp.StatusCode)
+	}
+	if msg := decodeJSON(t, resp.Body)["detail"].(string); !strings.Contains(msg, "200 bytes") {
+		t.Fatalf("expected the limit in the error, got %q", msg)
+	}
+
+	resp, _ = http.Post(ts.URL+"/collections/tasks/sync", "application/json", bytes.NewReader(mustJSON(t, map[string]any{
+		"items": []any{map[string]any{"id": "d", "updatedAt": "2024-01-01T00:00:00Z"}},
+	})))
+	if resp.StatusCode != 507 {
+		t.Fatalf("expected 507 for sync, got %d", resp.StatusCode)
+	}
+	if msg := decodeJSON(t, resp.Body)["detail"].(string); !strings.Contains(msg, `item "d"`) {
+		t.Fatalf("expected the item to be named, got %q", msg)
+	}
+}
+
+func TestQuotaCountsWrites(t *testing.T) {
+	s := store.NewMemoryStore()
+	ts := httptest.NewServer(handler.New(s, handler.WithQuotas(handler.Quotas{
+		CollectionDocuments: 2,
+		CollectionBytes:     400,
+	})))
+	defer ts.Close()
+
+	do := func(method, path string, body any) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, bytes.NewReader(mustJSON(t, body)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	do("PUT", "/collections/tasks/items/a", map[string]any{"id": "a", "updatedAt": "2025-01-01T00:00:00Z"})
+	// The stale copy of "a" is not written, so its size must not count
+	// against the room left for "b".
+	status := do("POST", "/collections/tasks/sync", map[string]any{"items": []any{
+		map[string]any{"id": "a", "updatedAt": "2024-01-01T00:00:00Z", "text": strings.Repeat("x", 200)},
+		map[string]any{"id": "b", "updatedAt": "2024-01-01T00:00:00Z", "text": strings.Repeat("x", 200)},
+	}})
+	if status != 200 {
+		t.Fatalf("expected 200 for a sync that fits once stale items are skipped, got %d", status)
+	}
+
+	if status := do("PUT", "/collections/tasks/items/c", map[string]any{"id": "c"}); status != 507 {
+		t.Fatalf("expected 507 over the document quota, got %d", status)
+	}
+	// Deletes free their room.
+	do("DELETE", "/collections/tasks/items/b", nil)
+	if status := do("PUT", "/collections/tasks/items/c", map[string]any{"id": "c"}); status != 200 {
+		t.Fatalf("expected 200 after a delete, got %d", status)
+	}
+}
+
+func TestETags(t *testing.T) {
+	ts, _ := setup()
+	defer ts.Close()
+
+	do := func(method, path string, header map[string]string, body any) *http.Response {
+		t.Helper()
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(mustJSON(t, body))
+		}
+		req, _ := http.NewRequest(method, ts.URL+path, r)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// If-None-Match: * creates only.
+	resp := do("PUT", "/collections/docs/items/a", map[string]string{"If-None-Match": "*"}, map[string]any{"v": 1})
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	tag := resp.Header.Get("ETag")
+	if tag == "" {
+		t.Fatal("expected an ETag")
+	}
+	if resp := do("PUT", "/collections/docs/items/a", map[string]string{"If-None-Match": "*"}, map[string]any{"v": 9}); resp.StatusCode != 412 {
+		t.Fatalf("expected 412 creating an existing document, got %d", resp.StatusCode)
+	}
+
+	resp = do("GET", "/collections/docs/items/a", nil, nil)
+	if got := resp.Header.Get("ETag"); got != tag {
+		t.Fatalf("expected ETag %s, got %s", tag, got)
+	}
+	if resp := do("GET", "/collections/docs/items/a", map[string]string{"If-None-Match": "W/" + tag}, nil); resp.StatusCode != 304 {
+		t.Fatalf("expected 304, got %d", resp.StatusCode)
+	}
+
+	// If-Match updates regardless of timestamps, but only from the
+	// revision read.
+	resp = do("PUT", "/collections/docs/items/a", map[string]string{"If-Match": tag}, map[string]any{"v": 2, "updatedAt": "2000-01-01T00:00:00Z"})
+	if resp.StatusCode != 200 || resp.Header.Get("ETag") == tag {
+		t.Fatalf("expected 200 with a new ETag, got %d %s", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	newTag := resp.Header.Get("ETag")
+	if resp := do("PUT", "/collections/docs/items/a", map[string]string{"If-Match": tag}, map[string]any{"v": 3}); resp.StatusCode != 412 {
+		t.Fatalf("expected 412 for a stale ETag, got %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/collections/docs/items/a", map[string]string{"If-None-Match": tag}, nil); resp.StatusCode != 200 {
+		t.Fatalf("expected 200 after a change, got %d", resp.StatusCode)
+	}
+	if resp := do("DELETE", "/collections/docs/items/a", map[string]string{"If-Match": tag}, nil); resp.StatusCode != 412 {
+		t.Fatalf("expected 412 deleting with a stale ETag, got %d", resp.StatusCode)
+	}
+	if resp := do("DELETE", "/collections/docs/items/a", map[string]string{"If-Match": `"x", ` + newTag}, nil); resp.StatusCode != 200 {
+		t.Fatalf("expected 200 deleting with a current ETag, got %d", resp.StatusCode)
+	}
+	if resp := do("PUT", "/collections/docs/items/a", map[string]string{"If-Match": "*"}, map[string]any{"v": 4}); resp.StatusCode != 412 {
+		t.Fatalf("expected 412 for If-Match: * on a missing document, got %d", resp.StatusCode)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	ts, s := setup()
+	defer ts.Close()
+
+	patchItem := func(path, contentType, body string, header ...string) (*http.Response, map[string]any) {
+		t.Helper()
+		req, _ := http.NewRequest("PATCH", ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, decodeJSON(t, resp.Body)
+	}
+
+	s.PutSchema("tasks", map[string]any{
+		"type":       "object",
+		"properties": map[string]any{"title": map[string]any{"type": "string"}},
+		"required":   []any{"title"},
+	})
+	s.Put("tasks", "t1", map[string]any{
+		"title": "Write", "tags": []any{"a"}, "meta": map[string]any{"x": 1.0, "y": 2.0},
+		"updatedAt": "2024-01-01T00:00:00Z",
+	})
+
+	resp, doc := patchItem("/collections/tasks/items/t1", "application/merge-patch+json",
+		`{"title": "Edit", "meta": {"x": null}, "updatedAt": "2024-01-02T00:00:00Z"}`)
+	if resp.StatusCode != 200 || doc["title"] != "Edit" || !reflect.DeepEqual(doc["meta"], map[string]any{"y": 2.0}) {
+		t.Fatalf("unexpected merge result %d %v", resp.StatusCode, doc)
+	}
+	tag := resp.Header.Get("ETag")
+
+	resp, doc = patchItem("/collections/tasks/items/t1", "application/json-patch+json",
+		`[{"op": "test", "path": "/title", "value": "Edit"},
+		  {"op": "add", "path": "/tags/-", "value": "b"},
+		  {"op": "replace", "path": "/updatedAt", "value": "2024-01-03T00:00:00Z"}]`, "If-Match", tag)
+	if resp.StatusCode != 200 || !reflect.DeepEqual(doc["tags"], []any{"a", "b"}) {
+		t.Fatalf("unexpected JSON Patch result %d %v", resp.StatusCode, doc)
+	}
+	if stored, _ := s.Get("tasks", "t1"); !reflect.DeepEqual(stored["tags"], []any{"a", "b"}) {
+		t.Fatalf("patch was not stored: %v", stored)
+	}
+
+	// A patch that leaves updatedAt alone is stamped with the current time.
+	resp, doc = patchItem("/collections/tasks/items/t1", "application/merge-patch+json", `{"title": "Again"}`)
+	if resp.StatusCode != 200 || doc["title"] != "Again" || doc["updatedAt"] == "2024-01-03T00:00:00Z" {
+		t.Fatalf("expected the patch to apply with a new updatedAt, got %d %v", resp.StatusCode, doc)
+	}
+	if stored, _ := s.Get("tasks", "t1"); stored["title"] != "Again" {
+		t.Fatalf("patch was not stored: %v", stored)
+	}
+	s.Put("tasks", "future", map[string]any{"title": "Later", "updatedAt": "2999-01-01T00:00:00Z"})
+	if resp, _ := patchItem("/collections/tasks/items/future", "application/merge-patch+json", `{"title": "Now"}`); resp.StatusCode != 409 {
+		t.Fatalf("expected 409 for a document ahead of the clock, got %d", resp.StatusCode)
+	}
+
+	// An older updatedAt loses, as for PUT.
+	resp, doc = patchItem("/collections/tasks/items/t1", "application/merge-patch+json",
+		`{"title": "Stale", "updatedAt": "2023-01-01T00:00:00Z"}`)
+	if resp.StatusCode != 200 || doc["title"] != "Again" {
+		t.Fatalf("expected the stored document to win, got %d %v", resp.StatusCode, doc)
+	}
+
+	tests := []struct {
+		name, path, contentType, body string
+		status                        int
+	}{
+		{"failed test", "/collections/tasks/items/t1", "application/json-patch+json", `[{"op": "test", "path": "/title", "value": "x"}]`, 409},
+		{"missing path", "/collections/tasks/items/t1", "application/json-patch+json", `[{"op": "remove", "path": "/nope"}]`, 409},
+		{"malformed", "/collections/tasks/items/t1", "application/json-patch+json", `[{"op": "add", "path": "/a"}]`, 400},
+		{"schema", "/collections/tasks/items/t1", "application/merge-patch+json", `{"title": null, "updatedAt": "2030-01-01T00:00:00Z"}`, 422},
+		{"not an object", "/collections/tasks/items/t1", "application/merge-patch+json", `[1]`, 422},
+		{"missing document", "/collections/tasks/items/nope", "application/merge-patch+json", `{}`, 404},
+		{"media type", "/collections/tasks/items/t1", "application/json", `{}`, 415},
+		{"notes", "/notes/nope", "application/merge-patch+json", `{}`, 404},
+	}
+	for _, tt := range tests {
+		if resp, _ := patchItem(tt.path, tt.contentType, tt.body); resp.StatusCode != tt.status {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.status, resp.StatusCode)
+		}
+	}
+	if resp, _ := patchItem("/collections/tasks/items/t1", "application/merge-patch+json", `{}`, "If-Match", tag); resp.StatusCode != 412 {
+		t.Fatalf("expected 412 for a stale ETag, got %d", resp.StatusCode)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	ts, s := setup()
+	defer ts.Close()
+	s.PutSchema("typed", map[string]any{"type": "object", "required": []any{"name"}})
+	s.Put("tasks", "old", map[string]any{"v": 0.0})
+
+	batch := func(body any) map[string]any {
+		t.Helper()
+		resp, err := http.Post(ts.URL+"/batch", "application/json", bytes.NewReader(mustJSON(t, body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		return decodeJSON(t, resp.Body)
+	}
+	statuses := func(out map[string]any) []float64 {
+		var got []float64
+		for _, r := range out["results"].([]any) {
+			got = append(got, r.(map[string]any)["status"].(float64))
+		}
+		return got
+	}
+
+	out := batch(map[string]any{"operations": []any{
+		map[string]any{"op": "put", "collection": "tasks", "key": "a", "body": map[string]any{"v": 1}},
+		map[string]any{"op": "patch", "collection": "tasks", "key": "a", "body": map[string]any{"w": 2}},
+		map[string]any{"op": "get", "collection": "tasks", "key": "a"},
+		map[string]any{"op": "put", "collection": "typed", "key": "x", "body": map[string]any{}},
+		map[string]any{"op": "delete", "collection": "tasks", "key": "old"},
+		map[string]any{"op": "frob", "collection": "tasks", "key": "a"},
+	}})
+	if got := statuses(out); !reflect.DeepEqual(got, []float64{200, 200, 200, 422, 200, 400}) {
+		t.Fatalf("unexpected statuses %v", got)
+	}
+	get := out["results"].([]any)[2].(map[string]any)
+	if body := get["body"].(map[string]any); body["v"] != 1.0 || body["w"] != 2.0 || get["etag"] == "" {
+		t.Fatalf("unexpected get result %v", get)
+	}
+	if doc, _ := s.Get("tasks", "old"); doc != nil {
+		t.Fatal("expected the non-atomic batch to keep its successful writes")
+	}
+
+	// An atomic batch stops at the first failure and undoes the rest.
+	out = batch(map[string]any{"atomic": true, "operations": []any{
+		map[string]any{"op": "put", "collection": "tasks", "key": "b", "body": map[string]any{"v": 1}},
+		map[string]any{"op": "delete", "collection": "tasks", "key": "a"},
+		map[string]any{"op": "put", "collection": "typed", "key": "y", "body": map[string]any{}},
+		map[string]any{"op": "put", "collection": "tasks", "key": "c", "body": map[string]any{"v": 1}},
+	}})
+	if out["committed"] != false || !reflect.DeepEqual(statuses(out), []float64{200, 200, 422, 424}) {
+		t.Fatalf("unexpected atomic result %v", out)
+	}
+	if doc, _ := s.Get("tasks", "b"); doc != nil {
+		t.Fatal("expected the put to be undone")
+	}
+	if doc, _ := s.Get("tasks", "a"); doc == nil {
+		t.Fatal("expected the delete to be undone")
+	}
+
+	out = batch(map[string]any{"atomic": true, "operations": []any{
+		map[string]any{"op": "put", "collection": "tasks", "key": "b", "body": map[string]any{"v": 1}},
+		map[string]any{"op": "delete", "collection": "tasks", "key": "a", "ifMatch": get["etag"]},
+	}})
+	if out["committed"] != true || !reflect.DeepEqual(statuses(out), []float64{200, 200}) {
+		t.Fatalf("unexpected atomic result %v", out)
+	}
+}
+
+// pausedSchema holds a schema write back until a transaction has started,
+// so that the write waits for the transaction to end.
+type pausedSchema struct {
+	*store.SqliteStore
+	putting, inTx chan struct{}
+}
+
+func (s *pausedSchema) Atomically(fn func(tx store.Store) error) error {
+	return s.SqliteStore.Atomically(func(tx store.Store) error {
+		close(s.inTx)
+		return fn(tx)
+	})
+}
+
+func (s *pausedSchema) PutSchema(collection string, schema map[string]any) error {
+	close(s.putting)
+	<-s.inTx
+	return s.SqliteStore.PutSchema(collection, schema)
+}
+
+// TestBatchSchemaChange starts an atomic batch, which holds the SQLite
+// store's lock while it reads schemas, while a schema change is writing,
+// which must not hold the schema cache's lock while it waits for the store.
+func TestBatchSchemaChange(t *testing.T) {
+	sqlite, err := store.NewSqliteStore(t.TempDir() + "/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &pausedSchema{SqliteStore: sqlite, putting: make(chan struct{}), inTx: make(chan struct{})}
+	ts := httptest.NewServer(handler.New(s))
+
+	send := func(method, path string, body any, done chan<- int) {
+		req, _ := http.NewRequest(method, ts.URL+path, bytes.NewReader(mustJSON(t, body)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}
+	done := make(chan int, 2)
+	go send("PUT", "/schemas/typed", map[string]any{"type": "object"}, done)
+	<-s.putting
+	go send("POST", "/batch", map[string]any{"atomic": true, "operations": []any{
+		map[string]any{"op": "put", "collection": "typed", "key": "1", "body": map[string]any{"name": "x"}},
+	}}, done)
+	for range 2 {
+		select {
+		case status := <-done:
+			if status != 200 {
+				t.Fatalf("expected 200, got %d", status)
+			}
+		case <-time.After(10 * time.Second):
+			// The server's handlers are stuck, so it cannot be closed.
+			t.Fatal("the batch and the schema change deadlocked")
+		}
+	}
+	ts.Close()
+	sqlite.Close()
+}
+
+func TestBatchAuth(t *testing.T) {
+	s := store.NewMemoryStore()
+	ts := httptest.NewServer(auth.Middleware(handler.New(s), &auth.APIKeys{Store: s, Admin: "root"}))
+	defer ts.Close()
+	key, rec, err := auth.NewAPIKey("tasks", "", []auth.Grant{
+		{Collections: "tasks", Scopes: []auth.Scope{auth.ScopeWrite}},
+		{Collections: "ref", Scopes: []auth.Scope{auth.ScopeRead}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.PutAPIKey(rec.ID, rec.ToMap())
+
+	req, _ := http.NewRequest("POST", ts.URL+"/batch", bytes.NewReader(mustJSON(t, map[string]any{"operations": []any{
+		map[string]any{"op": "put", "collection": "tasks", "key": "a", "body": map[string]any{}},
+		map[string]any{"op": "get", "collection": "ref", "key": "a"},
+		map[string]any{"op": "put", "collection": "ref", "key": "a", "body": map[string]any{}},
+	}})))
+	req.Header.Set("X-API-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []float64
+	for _, r := range decodeJSON(t, resp.Body)["results"].([]any) {
+		got = append(got, r.(map[string]any)["status"].(float64))
+	}
+	if !reflect.DeepEqual(got, []float64{200, 404, 403}) {
+		t.Fatalf("unexpected statuses %v", got)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	s := store.NewMemoryStore()
+	ts := httptest.NewServer(handler.New(s, handler.WithLimits(handler.Limits{
+		MaxBodyBytes:     1000,
+		MaxDocumentBytes: 100,
+		MaxSyncItems:     2,
+		MaxDepth:         3,
+	})))
+	defer ts.Close()
+
+	send := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		detail, _ := decodeJSON(t, resp.Body)["detail"].(string)
+		return resp.StatusCode, detail
+	}
+
+	tests := []struct {
+		name, method, path, body string
+		status                   int
+		detail                   string
+	}{
+		{"body", "PUT", "/schemas/x", `{"a": "` + strings.Repeat("x", 1000) + `"}`, 413, "body exceeds 1000 bytes"},
+		{"document", "PUT", "/collections/c/items/a", `{"a": "` + strings.Repeat("x", 100) + `"}`, 413, "document is 109 bytes"},
+		{"depth", "PUT", "/collections/c/items/a", `{"a": [{"b": {"c": 1}}]}`, 413, "depth of 3"},
+		{"brackets in strings", "PUT", "/collections/c/items/a", `{"a": "[[[[{{{{", "b": {"c": 1}}`, 200, ""},
+		{"batch", "POST", "/sync", `{"items": [{}, {}, {}]}`, 413, "3 items"},
+		{"sync item by key", "POST", "/sync", `{"items": [{"id": "ok"}, {"id": "big", "a": "` + strings.Repeat("x", 100) + `"}]}`, 413, `item "big"`},
+		{"sync item by position", "POST", "/sync", `{"items": [{"a": [[[1]]]}]}`, 413, "item 0"},
+		{"malformed", "PUT", "/collections/c/items/a", `{"a": `, 400, "invalid JSON"},
+		{"batch depth", "POST", "/batch", `{"operations": [{"op": "put", "collection": "c", "key": "b", "body": {"a": [{"b": {"c": 1}}]}}]}`, 413, "depth of 3"},
+		{"batch body at the limit", "POST", "/batch", `{"operations": [{"op": "put", "collection": "c", "key": "b", "body": {"a": {"b": [1]}}}]}`, 200, ""},
+	}
+	for _, tt := range tests {
+		status, detail := send(tt.method, tt.path, tt.body)
+		if status != tt.status || !strings.Contains(detail, tt.detail) {
+			t.Errorf("%s: got %d %q, want %d containing %q", tt.name, status, detail, tt.status, tt.detail)
+		}
+	}
+	if doc, _ := s.Get("notes", "ok"); doc != nil {
+		t.Fatal("a rejected sync batch must not store any item")
+	}
+}
+
+func TestTenants(t *testing.T) {
+	s := store.NewMemoryStore()
+	ts := httptest.NewServer(auth.Middleware(handler.New(s), &auth.APIKeys{Store: s, Admin: "root"}))
+	defer ts.Close()
+	acme, _ := newKey(t, s, "acme")
+
+	do := func(method, path, key string, body any) *http.Response {
+		t.Helper()
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(mustJSON(t, body))
+		}
+		req, _ := http.NewRequest(method, ts.URL+path, r)
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	doc := map[string]any{"id": "1", "updatedAt": "2024-01-01T00:00:00Z"}
+
+	// The same collection name in two tenants and the default namespace.
+	do("PUT", "/t/acme/collections/tasks/items/1", "root", map[string]any{"id": "1", "who": "acme", "updatedAt": "2024-01-01T00:00:00Z"})
+	do("PUT", "/t/globex/collections/tasks/items/1", "root", map[string]any{"id": "1", "who": "globex", "updatedAt": "2024-01-01T00:00:00Z"})
+	do("PUT", "/collections/tasks/items/1", "root", map[string]any{"id": "1", "who": "default", "updatedAt": "2024-01-01T00:00:00Z"})
+	do("PUT", "/t/acme/schemas/tasks", "root", map[string]any{"type": "object", "x-indexes": []any{"who"}})
+
+	for path, want := range map[string]string{
+		"/t/acme/collections/tasks/items/1":   "acme",
+		"/t/globex/collections/tasks/items/1": "globex",
+		"/collections/tasks/items/1":          "default",
+	} {
+		if got := decodeJSON(t, do("GET", path, "root", nil).Body)["who"]; got != want {
+			t.Fatalf("%s: expected %s, got %v", path, want, got)
+		}
+	}
+	if names := decodeJSONArray(t, do("GET", "/collections", "root", nil).Body); len(names) != 1 {
+		t.Fatalf("expected only the default namespace's collection, got %v", names)
+	}
+	if schemas := decodeJSON(t, do("GET", "/schemas", "root", nil).Body); len(schemas) != 0 {
+		t.Fatalf("expected no default schemas, got %v", schemas)
+	}
+	tenants := decodeJSONArray(t, do("GET", "/admin/tenants", "root", nil).Body)
+	if len(tenants) != 2 || tenants[0] != "acme" || tenants[1] != "globex" {
+		t.Fatalf("expected [acme globex], got %v", tenants)
+	}
+
+	// A tenant-bound key works in its tenant, with or without the prefix.
+	if got := decodeJSON(t, do("GET", "/collections/tasks/items/1", acme, nil).Body)["who"]; got != "acme" {
+		t.Fatalf("expected acme's document, got %v", got)
+	}
+	if resp := do("GET", "/t/acme/collections/tasks/items/1", acme, nil); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/t/globex/collections/tasks/items/1", acme, nil); resp.StatusCode != 403 {
+		t.Fatalf("expected 403 across tenants, got %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/admin/tenants", acme, nil); resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for a global route, got %d", resp.StatusCode)
+	}
+
+	// A key without a tenant stays in the default namespace unless it is
+	// an admin of all collections.
+	plain, _ := newKey(t, s, "")
+	if resp := do("GET", "/collections/tasks/items/1", plain, nil); resp.StatusCode != 200 {
+		t.Fatalf("expected 200 in the default namespace, got %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/t/acme/collections/tasks/items", plain, nil); resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for a tenantless key in a tenant, got %d", resp.StatusCode)
+	}
+
+	if resp := do("PUT", "/t/bad.name/collections/tasks/items/1", "root", doc); resp.StatusCode != 400 {
+		t.Fatalf("expected 400 for an invalid tenant, got %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/collections/acme~tasks/items", "root", nil); resp.StatusCode != 400 {
+		t.Fatalf("expected 400 for a prefixed collection name, got %d", resp.StatusCode)
+	}
+
+	export := decodeJSON(t, do("GET", "/t/acme/admin/export", "root", nil).Body)
+	if export["tenant"] != "acme" {
+		t.Fatalf("unexpected export %v", export)
+	}
+	docs := export["collections"].(map[string]any)["tasks"].(map[string]any)
+	if len(docs) != 1 || docs["1"].(map[string]any)["who"] != "acme" {
+		t.Fatalf("unexpected exported documents %v", docs)
+	}
+	if _, ok := export["schemas"].(map[string]any)["tasks"]; !ok {
+		t.Fatalf("expected the schema in the export, got %v", export["schemas"])
+	}
+	if ix := export["indexes"].(map[string]any)["tasks"].([]any); len(ix) != 1 || ix[0] != "who" {
+		t.Fatalf("expected the index in the export, got %v", ix)
+	}
+
+	if resp := do("POST", "/t/acme/admin/purge", "root", nil); resp.StatusCode != 200 {
+		t.Fatalf("expected 200 for purge, got %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/t/acme/collections/tasks/items/1", "root", nil); resp.StatusCode != 404 {
+		t.Fatalf("expected 404 after purge, got %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/t/acme/schemas/tasks", "root", nil); resp.StatusCode != 404 {
+		t.Fatalf("expected schema removed by purge, got %d", resp.StatusCode)
+	}
+	if got := decodeJSON(t, do("GET", "/t/globex/collections/tasks/items/1", "root", nil).Body)["who"]; got != "globex" {
+		t.Fatalf("purge touched another tenant: %v", got)
+	}
+}
+
+// benchSchema is a typical collection schema for the sync benchmarks.
+var benchSchema = map[string]any{
+	"type":     "object",
+	"required": []any{"key", "title", "updatedAt"},
+	"properties": map[string]any{
+		"key":       map[string]any{"type": "string", "pattern": "^task-[0-9]+$"},
+		"title":     map[string]any{"type": "string", "minLength": 1, "maxLength": 200},
+		"done":      map[string]any{"type": "boolean"},
+		"priority":  map[string]any{"type": "integer", "minimum": 1, "maximum": 5},
+		"tags":      map[string]any{"type": "array", "maxItems": 10, "items": map[string]any{"type": "string"}},
+		"assignee":  map[string]any{"$ref": "#/$defs/user"},
+		"updatedAt": map[string]any{"type": "string", "format": "date-time"},
+	},
+	"$defs": map[string]any{
+		"user": map[string]any{
+			"type":     "object",
+			"required": []any{"name"},
+			"properties": map[string]any{
+				"name":  map[string]any{"type": "string"},
+				"email": map[string]any{"type": "string", "format": "email"},
+			},
+		},
+	},
+}
+
+// benchmarkSync syncs a batch of items that are already stored, so the
+// time goes to decoding and validating them rather than to writing.
+func benchmarkSync(b *testing.B, s store.Store, items int) {
+	h := handler.New(s)
+	schemaBody, _ := json.Marshal(benchSchema)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/schemas/tasks", bytes.NewReader(schemaBody)))
+
+	batch := make([]any, items)
+	for i := range batch {
+		batch[i] = map[string]any{
+			"key":       fmt.Sprintf("task-%d", i),
+			"title":     "Write the benchmark",
+			"priority":  3,
+			"tags":      []any{"perf", "schema"},
+			"assignee":  map[string]any{"name": "Ann", "email": "ann@example.com"},
+			"updatedAt": "2024-01-15T10:30:00Z",
+		}
+	}
+	body, _ := json.Marshal(map[string]any{"items": batch, "lastSyncTime": "2100-01-01T00:00:00Z"})
+
+	sync := func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/collections/tasks/sync", bytes.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			b.Fatalf("sync: %d %s", rec.Code, rec.Body)
+		}
+	}
+	sync()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sync()
+	}
+}
+
+func BenchmarkSyncMemory(b *testing.B) {
+	benchmarkSync(b, store.NewMemoryStore(), 1000)
+}
+
+func BenchmarkSyncJSONFile(b *testing.B) {
+	s, err := store.NewJsonFileStore(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkSync(b, s, 200)
+}
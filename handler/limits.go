@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Limits bound the size and shape of request bodies. Zero fields are
+// unlimited.
+type Limits struct {
+	// MaxBodyBytes caps every request body.
+	MaxBodyBytes int64
+
+	// MaxDocumentBytes caps each document written, whether alone or as an
+	// item of a sync batch.
+	MaxDocumentBytes int64
+
+	// MaxSyncItems caps the number of items in a sync request.
+	MaxSyncItems int
+
+	// MaxBatchOperations caps the number of operations in a batch request.
+	MaxBatchOperations int
+
+	// MaxDepth caps how deeply objects and arrays nest in a document or
+	// other request body; a flat object has depth 1.
+	MaxDepth int
+}
+
+// DefaultLimits apply unless WithLimits says otherwise.
+var DefaultLimits = Limits{
+	MaxBodyBytes:       8 << 20,
+	MaxDocumentBytes:   1 << 20,
+	MaxSyncItems:       1000,
+	MaxBatchOperations: 1000,
+	MaxDepth:           64,
+}
+
+// WithLimits replaces DefaultLimits. Requests over a limit are rejected
+// with 413 Content Too Large.
+func WithLimits(l Limits) Option {
+	return func(h *Handler) { h.limits = l }
+}
+
+// errTooLarge rejects requests over one of the Limits.
+var errTooLarge = errors.New("request too large")
+
+// readBody reads a request body of at most MaxBodyBytes.
+func (h *Handler) readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	defer r.Body.Close()
+	body := r.Body
+	if h.limits.MaxBodyBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, h.limits.MaxBodyBytes)
+	}
+	b, err := io.ReadAll(body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, fmt.Errorf("%w: body exceeds %d bytes", errTooLarge, tooLarge.Limit)
+	}
+	return b, err
+}
+
+// readJSON decodes a request body into v after checking it against the
+// body size and nesting limits.
+func (h *Handler) readJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	b, err := h.readBody(w, r)
+	if err != nil {
+		return err
+	}
+	if err := h.checkDepth(b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// checkDocument checks the encoding of a document against the document
+// size and nesting limits.
+func (h *Handler) checkDocument(raw []byte) error {
+	if max := h.limits.MaxDocumentBytes; max > 0 && int64(len(raw)) > max {
+		return fmt.Errorf("%w: document is %d bytes, over the limit of %d", errTooLarge, len(raw), max)
+	}
+	return h.checkDepth(raw)
+}
+
+// checkDepth rejects JSON nesting objects and arrays deeper than MaxDepth.
+// It only scans brackets; syntax errors are left to the decoder.
+func (h *Handler) checkDepth(raw []byte) error {
+	return h.checkDepthWithin(raw, 0)
+}
+
+// checkDepthWithin is checkDepth for a body that wraps documents in
+// envelope levels of nesting of its own, which do not count.
+func (h *Handler) checkDepthWithin(raw []byte, envelope int) error {
+	max := h.limits.MaxDepth
+	if max <= 0 {
+		return nil
+	}
+	max += envelope
+	depth := 0
+	inString, escaped := false, false
+	for _, c := range raw {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			switch c {
+			case '\\':
+				escaped = true
+			case '"':
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			if depth++; depth > max {
+				return fmt.Errorf("%w: nesting exceeds a depth of %d", errTooLarge, max-envelope)
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return nil
+}
+
+// bodyError writes the response for an error returned by readJSON.
+func bodyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errTooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	writeError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/stevemurr/simple-sync-server/auth"
+)
+
+// The values of the x-server keyword, which names what the server stamps in
+// a readOnly property when a document is created:
+//
+//	"createdAt": {"type": "string", "format": "date-time", "readOnly": true, "x-server": "createdAt"}
+//	"createdBy": {"type": "string", "readOnly": true, "x-server": "createdBy"}
+const (
+	serverCreatedAt = "createdAt" // the server's clock
+	serverCreatedBy = "createdBy" // the authenticated caller's subject
+)
+
+// checkServerFields checks the x-server keywords of a schema and its
+// subschemas.
+func checkServerFields(v any, path string) error {
+	s, ok := v.(map[string]any)
+	if !ok {
+		return nil
+	}
+	if raw, ok := s["x-server"]; ok {
+		switch raw {
+		case serverCreatedAt, serverCreatedBy:
+		default:
+			return fmt.Errorf(`%s/x-server: unknown value %v (use "createdAt" or "createdBy")`, path, raw)
+		}
+		if s["readOnly"] != true {
+			return fmt.Errorf("%s/x-server: the property must be readOnly", path)
+		}
+	}
+	for _, keyword := range []string{"items", "not", "if", "then", "else"} {
+		if err := checkServerFields(s[keyword], path+"/"+keyword); err != nil {
+			return err
+		}
+	}
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		list, _ := s[keyword].([]any)
+		for i, sub := range list {
+			if err := checkServerFields(sub, fmt.Sprintf("%s/%s/%d", path, keyword, i)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, keyword := range []string{"properties", "$defs", "definitions"} {
+		subs, _ := s[keyword].(map[string]any)
+		for name, sub := range subs {
+			if err := checkServerFields(sub, path+"/"+keyword+"/"+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// serverStamp returns the x-server values of readOnly properties for
+// documents the caller of r creates. createdBy is left out when
+// authentication is disabled.
+func serverStamp(r *http.Request) func(property map[string]any) (any, bool) {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	return func(property map[string]any) (any, bool) {
+		switch property["x-server"] {
+		case serverCreatedAt:
+			return now, true
+		case serverCreatedBy:
+			if p := auth.FromContext(r.Context()); p != nil {
+				return p.Subject, true
+			}
+		}
+		return nil, false
+	}
+}
+
+// manage applies the readOnly properties and defaults of a collection's
+// schema to a document being written under key: readOnly properties keep
+// their stored values, or are stamped if the document is new, and missing
+// properties get their defaults.
+func (h *Handler) manage(r *http.Request, collection, key string, c *collectionSchema, doc map[string]any) error {
+	if c == nil || c.compiled == nil {
+		return nil
+	}
+	if c.compiled.HasReadOnly() {
+		previous, err := h.storeFor(r).Get(collection, key)
+		if err != nil {
+			return err
+		}
+		if previous != nil {
+			c.migrate(previous)
+		}
+		c.compiled.KeepReadOnly(doc, previous, serverStamp(r))
+	}
+	c.compiled.ApplyDefaults(doc)
+	return nil
+}
@@ -0,0 +1,441 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/stevemurr/simple-sync-server/internal/jsonvalue"
+	"github.com/stevemurr/simple-sync-server/schema"
+	"github.com/stevemurr/simple-sync-server/store"
+)
+
+// versionField is the field in which documents record the version of their
+// collection's schema they were written or migrated under. Stored
+// documents without it predate the collection's schema: version 0. The
+// name is reserved: clients may only send it back with a version number
+// (see checkVersion), so it cannot hold their own data.
+const versionField = "_schemaVersion"
+
+// migration is one step of the x-migrations of a schema version, which
+// upgrade documents written under the previous version.
+type migration struct {
+	op   string   // "rename", "move" or "default"
+	from []string // the field moved by rename and move
+	to   []string // where rename and move put it, or the field default sets
+	val  any      // the value default sets
+}
+
+// parseMigrations returns the x-migrations of a schema version, which list
+// steps such as:
+//
+//	{"op": "rename", "from": "name", "to": "title"}
+//	{"op": "move", "from": "street", "to": "address.street"}
+//	{"op": "default", "field": "priority", "value": 3}
+//
+// rename gives a field a new name in the same object; move puts it at any
+// field path, creating objects on the way. Both replace a value already
+// there. default sets a field that is missing.
+func parseMigrations(s map[string]any) ([]migration, error) {
+	raw, ok := s["x-migrations"]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := raw.([]any)
+	if !ok {
+		return nil, errors.New("x-migrations must be an array of migration steps")
+	}
+	var steps []migration
+	for i, item := range list {
+		m, err := parseMigration(item)
+		if err != nil {
+			return nil, fmt.Errorf("x-migrations[%d]: %w", i, err)
+		}
+		steps = append(steps, m)
+	}
+	return steps, nil
+}
+
+func parseMigration(item any) (migration, error) {
+	spec, ok := item.(map[string]any)
+	if !ok {
+		return migration{}, errors.New("a migration step must be an object")
+	}
+	path := func(name string) ([]string, error) {
+		field, _ := spec[name].(string)
+		p, err := store.ParsePath(field)
+		if err != nil || field == "" {
+			return nil, fmt.Errorf("%s must be a field path", name)
+		}
+		return p, nil
+	}
+	m := migration{}
+	m.op, _ = spec["op"].(string)
+	var err error
+	switch m.op {
+	case "rename", "move":
+		if m.from, err = path("from"); err != nil {
+			return m, err
+		}
+		if m.to, err = path("to"); err != nil {
+			return m, err
+		}
+		if m.op == "rename" {
+			if len(m.to) != 1 {
+				return m, errors.New(`rename gives a field a new name; use "move" to change its object`)
+			}
+			m.to = append(m.from[:len(m.from)-1:len(m.from)-1], m.to[0])
+		}
+	case "default":
+		if m.to, err = path("field"); err != nil {
+			return m, err
+		}
+		if m.val, ok = spec["value"]; !ok {
+			return m, errors.New("default needs a value")
+		}
+	default:
+		return m, fmt.Errorf(`unknown op %q (use "rename", "move" or "default")`, m.op)
+	}
+	return m, nil
+}
+
+// apply performs the step on a document. Steps that do not apply, such as
+// moving a missing field or into a value that is not an object, change
+// nothing.
+func (m migration) apply(doc map[string]any) {
+	switch m.op {
+	case "rename", "move":
+		parent, ok := objectAt(doc, m.from[:len(m.from)-1], false)
+		if !ok {
+			return
+		}
+		v, ok := parent[m.from[len(m.from)-1]]
+		if !ok {
+			return
+		}
+		dest, ok := objectAt(doc, m.to[:len(m.to)-1], true)
+		if !ok {
+			return
+		}
+		delete(parent, m.from[len(m.from)-1])
+		dest[m.to[len(m.to)-1]] = v
+	case "default":
+		dest, ok := objectAt(doc, m.to[:len(m.to)-1], true)
+		if !ok {
+			return
+		}
+		if _, exists := dest[m.to[len(m.to)-1]]; !exists {
+			dest[m.to[len(m.to)-1]] = jsonvalue.Copy(m.val)
+		}
+	}
+}
+
+// objectAt returns the object at a field path of doc, creating missing
+// objects on the way if create is set.
+func objectAt(doc map[string]any, path []string, create bool) (map[string]any, bool) {
+	obj := doc
+	for _, seg := range path {
+		v, exists := obj[seg]
+		if !exists && create {
+			v = map[string]any{}
+			obj[seg] = v
+		}
+		next, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		obj = next
+	}
+	return obj, true
+}
+
+// collectionSchema is what reads and writes of a collection need from its
+// schema history: the current version, compiled, with its x-owner
+// configuration, and the migrations that upgrade documents written under
+// earlier versions. A nil *collectionSchema stands for a collection without
+// a schema.
+type collectionSchema struct {
+	version    int
+	first      int // the oldest version kept; earlier ones were deleted
+	compiled   *schema.Schema
+	err        error         // why the current version does not compile
+	owner      *ownerConfig  // nil without x-owner
+	migrations [][]migration // migrations[i] upgrade documents to version first+i
+}
+
+// newCollectionSchema builds the collectionSchema of a schema history whose
+// oldest version is first. The migrations of every version must parse, but
+// a current version that fails to compile (because a schema it references
+// was deleted) only fails writes.
+func newCollectionSchema(first int, versions []map[string]any, load schema.Loader) (*collectionSchema, error) {
+	if len(versions) == 0 {
+		return nil, nil
+	}
+	c := &collectionSchema{version: first + len(versions) - 1, first: first}
+	for i, v := range versions {
+		steps, err := parseMigrations(v)
+		if err != nil {
+			return nil, fmt.Errorf("schema version %d: %w", first+i, err)
+		}
+		c.migrations = append(c.migrations, steps)
+	}
+	current := versions[len(versions)-1]
+	owner, err := parseOwner(current)
+	if err != nil {
+		return nil, err
+	}
+	c.owner = owner
+	c.compiled, c.err = schema.Compile(current, load)
+	return c, nil
+}
+
+// references returns the collections whose schemas the current version
+// refers to.
+func (c *collectionSchema) references() []string {
+	if c == nil {
+		return nil
+	}
+	return c.compiled.References()
+}
+
+// hasMigrations reports whether any version has migrations, which reads
+// apply to documents written under earlier versions.
+func (c *collectionSchema) hasMigrations() bool {
+	if c == nil {
+		return false
+	}
+	for _, steps := range c.migrations {
+		if len(steps) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVersion checks the versionField a client sent in a document: a
+// whole number no greater than the current version of the collection's
+// schema (0 if it has none).
+func checkVersion(doc map[string]any, c *collectionSchema) error {
+	v, ok := doc[versionField]
+	if !ok {
+		return nil
+	}
+	current := 0
+	if c != nil {
+		current = c.version
+	}
+	if f, ok := v.(float64); !ok || f != float64(int(f)) || f < 0 || int(f) > current {
+		return schema.Errors{{
+			Path:    "/" + versionField,
+			Keyword: "reserved",
+			Message: fmt.Sprintf("%s is reserved for the schema version of the document (0 to %d)", versionField, current),
+		}}
+	}
+	return nil
+}
+
+// docVersion returns the schema version a document records.
+func docVersion(doc map[string]any) int {
+	f, _ := doc[versionField].(float64)
+	return int(f)
+}
+
+// migrate upgrades a document from the schema version it records to the
+// current one, without recording the new version. Documents that record a
+// deleted version get the migrations of every version kept.
+func (c *collectionSchema) migrate(doc map[string]any) {
+	if c == nil {
+		return
+	}
+	for v := max(docVersion(doc), c.first-1, 0); v < c.version; v++ {
+		for _, m := range c.migrations[v+1-c.first] {
+			m.apply(doc)
+		}
+	}
+}
+
+// upgrade migrates a stored document for a response and records the
+// current version in it.
+func (c *collectionSchema) upgrade(doc map[string]any) {
+	if c == nil || doc == nil {
+		return
+	}
+	c.migrate(doc)
+	doc[versionField] = float64(c.version)
+}
+
+// upgradeAll upgrades the documents of a page.
+func (c *collectionSchema) upgradeAll(items []store.Item) {
+	for _, item := range items {
+		c.upgrade(item.Data)
+	}
+}
+
+// validate checks a document without its version field against the
+// current version and the updatedAt format.
+func (c *collectionSchema) validate(doc map[string]any) error {
+	if c == nil {
+		return validateDoc(nil, doc)
+	}
+	if c.err != nil {
+		return c.err
+	}
+	return validateDoc(c.compiled, doc)
+}
+
+// errUnmigrated refuses queries the store cannot answer on stored
+// documents because migrations would change some of them.
+var errUnmigrated = errors.New("documents predate the current schema version")
+
+// checkMigrated fails with errUnmigrated if a collection holds documents
+// that its migrations would change, that is, documents recorded under an
+// earlier schema version.
+func (h *Handler) checkMigrated(r *http.Request, collection string, c *collectionSchema) error {
+	if !c.hasMigrations() {
+		return nil
+	}
+	page, err := h.storeFor(r).Query(collection, store.Query{
+		Filter: &store.Filter{Conditions: []store.Condition{{Path: []string{versionField}, Op: store.OpNe, Value: float64(c.version)}}},
+		Limit:  1,
+	})
+	if err != nil {
+		return err
+	}
+	if len(page.Items) > 0 {
+		return fmt.Errorf("%w %d of %q; filters and aggregates see stored documents, so migrate them first with POST /collections/%s/migrate", errUnmigrated, c.version, collection, collection)
+	}
+	return nil
+}
+
+// migrationJob is a background migration of the stored documents of a
+// collection to its current schema version.
+type migrationJob struct {
+	mu     sync.Mutex
+	status migrationStatus
+}
+
+// migrationStatus reports the progress of a migration job.
+type migrationStatus struct {
+	Collection string `json:"collection"`
+	Version    int    `json:"version"`
+	State      string `json:"state"` // "running", "done" or "failed"
+	Checked    int    `json:"checked"`
+	Migrated   int    `json:"migrated"`
+	Error      string `json:"error,omitempty"`
+}
+
+func (j *migrationJob) snapshot() migrationStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// migrationJobs holds the latest migration job of each collection.
+type migrationJobs struct {
+	mu   sync.Mutex
+	jobs map[schemaKey]*migrationJob
+}
+
+func newMigrationJobs() *migrationJobs {
+	return &migrationJobs{jobs: make(map[schemaKey]*migrationJob)}
+}
+
+// start registers a new job for a collection, unless one is running.
+func (js *migrationJobs) start(key schemaKey, version int) (*migrationJob, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if j, ok := js.jobs[key]; ok && j.snapshot().State == "running" {
+		return j, false
+	}
+	j := &migrationJob{status: migrationStatus{Collection: key.collection, Version: version, State: "running"}}
+	js.jobs[key] = j
+	return j, true
+}
+
+func (js *migrationJobs) get(key schemaKey) *migrationJob {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return js.jobs[key]
+}
+
+// run rewrites every document of a collection recorded under an earlier
+// schema version. Documents that change while it runs are skipped, since
+// they were written under the current version. updatedAt is left alone, so
+// a migration is not an edit that wins over others.
+func (j *migrationJob) run(st store.Store, collection string, c *collectionSchema) {
+	err := func() error {
+		q := store.Query{Limit: maxPageSize}
+		for {
+			page, err := st.Query(collection, q)
+			if err != nil {
+				return err
+			}
+			for _, item := range page.Items {
+				migrated := false
+				if docVersion(item.Data) != c.version {
+					rev := store.Revision(item.Data)
+					c.upgrade(item.Data)
+					if migrated, err = st.CompareAndSwap(collection, item.Key, rev, item.Data); err != nil {
+						return err
+					}
+				}
+				j.mu.Lock()
+				j.status.Checked++
+				if migrated {
+					j.status.Migrated++
+				}
+				j.mu.Unlock()
+			}
+			if page.NextCursor == "" {
+				return nil
+			}
+			q.Cursor = page.NextCursor
+		}
+	}()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.State = "done"
+	if err != nil {
+		j.status.State, j.status.Error = "failed", err.Error()
+	}
+}
+
+// startMigration serves POST /collections/{collection}/migrate, which
+// starts migrating the stored documents of a collection to its current
+// schema version in the background.
+func (h *Handler) startMigration(w http.ResponseWriter, r *http.Request) {
+	collection := r.PathValue("collection")
+	c, err := h.collectionSchema(r, collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if c == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no schema for collection %q", collection))
+		return
+	}
+	j, started := h.migrations.start(schemaKey{tenantOf(r), collection}, c.version)
+	if !started {
+		writeError(w, http.StatusConflict, fmt.Sprintf("a migration of %q is already running", collection))
+		return
+	}
+	tenant := tenantOf(r)
+	go func() {
+		j.run(h.storeFor(r), collection, c)
+		h.usageCache.forget(tenant) // migrated documents change size
+	}()
+	writeJSON(w, http.StatusAccepted, j.snapshot())
+}
+
+// migrationStatus serves GET /collections/{collection}/migrate, which
+// reports the progress of the latest migration of a collection.
+func (h *Handler) migrationStatus(w http.ResponseWriter, r *http.Request) {
+	collection := r.PathValue("collection")
+	j := h.migrations.get(schemaKey{tenantOf(r), collection})
+	if j == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no migration of %q has been started", collection))
+		return
+	}
+	writeJSON(w, http.StatusOK, j.snapshot())
+}
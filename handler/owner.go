@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/stevemurr/simple-sync-server/auth"
+	"github.com/stevemurr/simple-sync-server/store"
+)
+
+// errNotOwner rejects writes to documents owned by another user.
+var errNotOwner = errors.New("document belongs to another user")
+
+// ownerConfig is the x-owner schema keyword, either a top-level field name
+// or an object naming the owner field and an optional boolean field that
+// shares a document with everyone:
+//
+//	"x-owner": "owner"
+//	"x-owner": {"field": "owner", "shared": "public"}
+type ownerConfig struct {
+	field  string
+	shared string
+}
+
+// parseOwner reads the x-owner keyword of a schema, returning nil if it is
+// absent.
+func parseOwner(s map[string]any) (*ownerConfig, error) {
+	raw, ok := s["x-owner"]
+	if !ok {
+		return nil, nil
+	}
+	var c ownerConfig
+	switch v := raw.(type) {
+	case string:
+		c.field = v
+	case map[string]any:
+		c.field, _ = v["field"].(string)
+		if shared, ok := v["shared"]; ok {
+			if c.shared, ok = shared.(string); !ok {
+				return nil, errors.New("x-owner shared must be a field name")
+			}
+		}
+	default:
+		return nil, errors.New(`x-owner must be a field name or {"field": ..., "shared": ...}`)
+	}
+	if c.field == "" {
+		return nil, errors.New("x-owner needs an owner field")
+	}
+	for _, field := range []string{c.field, c.shared} {
+		if path, err := store.ParsePath(field); field != "" && (err != nil || len(path) != 1) {
+			return nil, fmt.Errorf("x-owner: %q is not a top-level field name", field)
+		}
+	}
+	return &c, nil
+}
+
+// ownership applies a collection's x-owner rules and the ACLs of its
+// documents to the caller. A nil *ownership, used when the collection has
+// no owner field or authentication is disabled, imposes nothing.
+type ownership struct {
+	ownerConfig
+	subject string
+
+	// admin callers see and may overwrite every document.
+	admin bool
+
+	// granted maps the keys of documents others have shared with the
+	// caller to when they were shared; writable holds those the caller
+	// may also modify.
+	granted  map[string]time.Time
+	writable map[string]bool
+
+	store      store.Store
+	collection string
+}
+
+// ownership returns the rules for the caller of r on a collection.
+func (h *Handler) ownership(r *http.Request, collection string) (*ownership, error) {
+	p := auth.FromContext(r.Context())
+	if p == nil {
+		return nil, nil
+	}
+	cs, err := h.collectionSchema(r, collection)
+	if err != nil || cs == nil || cs.owner == nil {
+		return nil, err
+	}
+	s := h.storeFor(r)
+	o := &ownership{
+		ownerConfig: *cs.owner,
+		subject:     p.Subject,
+		admin:       p.Allows(collection, auth.ScopeAdmin),
+		granted:     map[string]time.Time{},
+		writable:    map[string]bool{},
+		store:       s,
+		collection:  collection,
+	}
+	if o.admin {
+		return o, nil
+	}
+	names := []string{p.Subject}
+	for _, group := range p.Groups {
+		names = append(names, groupPrefix+group)
+	}
+	acls, err := s.ListACLsFor(collection, names)
+	if err != nil {
+		return nil, err
+	}
+	for key, m := range acls {
+		a := aclFromMap(m)
+		read, write := a.allows(p)
+		if !read {
+			continue
+		}
+		o.granted[key], _ = time.Parse(time.RFC3339Nano, a.UpdatedAt)
+		if write {
+			o.writable[key] = true
+		}
+	}
+	return o, nil
+}
+
+// filter selects the documents the caller may read: their own, shared
+// ones and those whose ACL grants the caller access.
+func (o *ownership) filter() *store.Filter {
+	if o == nil || o.admin {
+		return nil
+	}
+	mine := &store.Filter{Conditions: []store.Condition{{Path: []string{o.field}, Op: store.OpEq, Value: o.subject}}}
+	alternatives := []*store.Filter{mine}
+	if o.shared != "" {
+		alternatives = append(alternatives, &store.Filter{Conditions: []store.Condition{{Path: []string{o.shared}, Op: store.OpEq, Value: true}}})
+	}
+	if len(o.granted) > 0 {
+		keys := make([]any, 0, len(o.granted))
+		for _, key := range slices.Sorted(maps.Keys(o.granted)) {
+			keys = append(keys, key)
+		}
+		alternatives = append(alternatives, &store.Filter{Conditions: []store.Condition{{Path: []string{store.KeyField}, Op: store.OpIn, Value: keys}}})
+	}
+	if len(alternatives) == 1 {
+		return mine
+	}
+	return &store.Filter{Or: [][]*store.Filter{alternatives}}
+}
+
+// visible reports whether the caller may read the document stored under
+// key.
+func (o *ownership) visible(key string, doc map[string]any) bool {
+	return o.filter().Match(key, doc)
+}
+
+// owns reports whether the caller may manage the document's ACL.
+func (o *ownership) owns(doc map[string]any) bool {
+	return o == nil || o.admin || doc[o.field] == o.subject
+}
+
+// sharedSince returns the keys of documents shared with the caller after t,
+// in key order.
+func (o *ownership) sharedSince(t time.Time) []string {
+	if o == nil {
+		return nil
+	}
+	var keys []string
+	for key, at := range o.granted {
+		if at.After(t) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// stamp records the owner of a document being written: the caller, unless
+// the document is shared with them for writing, in which case it keeps its
+// owner. Admins may write documents on behalf of others by naming the
+// owner; without one, a document an admin overwrites keeps its owner too.
+func (o *ownership) stamp(key string, doc map[string]any) error {
+	if o == nil {
+		return nil
+	}
+	if _, ok := doc[o.field]; ok && o.admin {
+		return nil
+	}
+	doc[o.field] = o.subject
+	if !o.admin && !o.writable[key] {
+		return nil
+	}
+	existing, err := o.store.Get(o.collection, key)
+	if err != nil || existing == nil {
+		return err
+	}
+	if owner, ok := existing[o.field]; ok || !o.admin {
+		doc[o.field] = owner
+	}
+	return nil
+}
+
+// preconditions prevent writing documents owned by someone else unless
+// their ACL allows it, and deleting them at all (doc is nil for deletes).
+// They run atomically with the write.
+func (o *ownership) preconditions(key string, doc map[string]any) []store.Precondition {
+	if o == nil || o.admin {
+		return nil
+	}
+	return []store.Precondition{func(existing map[string]any) error {
+		switch {
+		case existing == nil || existing[o.field] == o.subject:
+		case doc != nil && o.writable[key] && existing[o.field] == doc[o.field]:
+		default:
+			return errNotOwner
+		}
+		return nil
+	}}
+}
@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/stevemurr/simple-sync-server/store"
+)
+
+// Option configures a Handler.
+type Option func(*Handler)
+
+// Quotas cap how much can be stored per collection and per tenant (the
+// default namespace counts as a tenant). Zero fields are unlimited.
+type Quotas struct {
+	CollectionDocuments int
+	CollectionBytes     int64
+	TenantDocuments     int
+	TenantBytes         int64
+}
+
+func (q Quotas) tenantLimited() bool {
+	return q.TenantDocuments > 0 || q.TenantBytes > 0
+}
+
+// WithQuotas enforces storage quotas on every write. Writes that would
+// exceed one are rejected with 507 Insufficient Storage; writes that do not
+// grow a document count or size are always allowed.
+func WithQuotas(q Quotas) Option {
+	return func(h *Handler) { h.quotas = q }
+}
+
+// errQuotaExceeded rejects writes that would exceed a storage quota.
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// usageTTL bounds how long cached usage is trusted, so that changes the
+// handler does not see, such as writes by other processes, are picked up.
+const usageTTL = time.Minute
+
+// usageCache holds the storage of each tenant's collections, so that
+// writes need not recount it. Writes that happen through a usage update
+// it; deletes of collections, failed atomic batches and migrations forget
+// the tenant, whose usage is then reloaded by the next write.
+type usageCache struct {
+	mu      sync.Mutex
+	tenants map[string]*tenantUsage
+	gen     int // incremented whenever usage changes that is not cached
+}
+
+type tenantUsage struct {
+	loaded      time.Time
+	collections map[string]store.Stats
+	total       store.Stats
+}
+
+func newUsageCache() *usageCache {
+	return &usageCache{tenants: make(map[string]*tenantUsage)}
+}
+
+// get returns the cached storage of a collection and its tenant, and the
+// generation to pass to add if there is none.
+func (c *usageCache) get(tenant, collection string) (coll, total store.Stats, ok bool, gen int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.tenants[tenant]
+	if !ok || time.Since(t.loaded) > usageTTL {
+		return store.Stats{}, store.Stats{}, false, c.gen
+	}
+	return t.collections[collection], t.total, true, c.gen
+}
+
+// add caches the usage of a tenant loaded from the store, unless usage
+// changed since gen, in which case it may be out of date.
+func (c *usageCache) add(tenant string, t *tenantUsage, gen int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen == gen {
+		c.tenants[tenant] = t
+	}
+}
+
+// count records a write that changed a collection's storage by docs and
+// bytes.
+func (c *usageCache) count(tenant, collection string, docs int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.tenants[tenant]
+	if !ok {
+		c.gen++
+		return
+	}
+	st := t.collections[collection]
+	st.Documents += docs
+	st.Bytes += bytes
+	t.collections[collection] = st
+	t.total.Documents += docs
+	t.total.Bytes += bytes
+}
+
+// forget drops the usage of a tenant.
+func (c *usageCache) forget(tenant string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	delete(c.tenants, tenant)
+}
+
+// usage checks writes to a collection against the quotas and counts the
+// ones that happen. A nil *usage, used when no quotas are set, admits
+// everything. Checks are not atomic with the writes, so concurrent writers
+// can overshoot a quota slightly.
+type usage struct {
+	quotas             Quotas
+	store              store.Store
+	cache              *usageCache
+	tenant, collection string
+
+	coll, tenantTotal store.Stats
+}
+
+// usage loads the current storage of a collection and its tenant for the
+// caller of r, from the cache unless it has expired.
+func (h *Handler) usage(r *http.Request, collection string) (*usage, error) {
+	if h.quotas == (Quotas{}) {
+		return nil, nil
+	}
+	s, tenant := h.storeFor(r), tenantOf(r)
+	u := &usage{quotas: h.quotas, store: s, cache: h.usageCache, tenant: tenant, collection: collection}
+	coll, total, ok, gen := h.usageCache.get(tenant, collection)
+	if ok {
+		u.coll, u.tenantTotal = coll, total
+		return u, nil
+	}
+	names, err := s.ListCollections()
+	if err != nil {
+		return nil, err
+	}
+	t := &tenantUsage{loaded: time.Now(), collections: make(map[string]store.Stats, len(names))}
+	for _, name := range names {
+		st, err := s.Stats(name)
+		if err != nil {
+			return nil, err
+		}
+		t.collections[name] = st
+		t.total.Documents += st.Documents
+		t.total.Bytes += st.Bytes
+	}
+	h.usageCache.add(tenant, t, gen)
+	u.coll, u.tenantTotal = t.collections[collection], t.total
+	return u, nil
+}
+
+// admit checks that writing doc under key stays within the quotas.
+func (u *usage) admit(key string, doc map[string]any) error {
+	if u == nil {
+		return nil
+	}
+	existing, err := u.store.Get(u.collection, key)
+	if err != nil {
+		return err
+	}
+	docs, bytes := 0, store.DocSize(doc)
+	if existing == nil {
+		docs = 1
+	} else {
+		bytes -= store.DocSize(existing)
+	}
+	q := u.quotas
+	switch {
+	case docs > 0 && q.CollectionDocuments > 0 && u.coll.Documents+docs > q.CollectionDocuments:
+		return fmt.Errorf("%w: collection %q is limited to %d documents", errQuotaExceeded, u.collection, q.CollectionDocuments)
+	case bytes > 0 && q.CollectionBytes > 0 && u.coll.Bytes+bytes > q.CollectionBytes:
+		return fmt.Errorf("%w: collection %q is limited to %d bytes", errQuotaExceeded, u.collection, q.CollectionBytes)
+	case docs > 0 && q.TenantDocuments > 0 && u.tenantTotal.Documents+docs > q.TenantDocuments:
+		return fmt.Errorf("%w: tenant is limited to %d documents", errQuotaExceeded, q.TenantDocuments)
+	case bytes > 0 && q.TenantBytes > 0 && u.tenantTotal.Bytes+bytes > q.TenantBytes:
+		return fmt.Errorf("%w: tenant is limited to %d bytes", errQuotaExceeded, q.TenantBytes)
+	}
+	return nil
+}
+
+// measure prepares to count a write of doc (nil for a delete). The
+// precondition it returns, added to the write's, records the document the
+// write replaces; done counts the write once it has happened.
+func (u *usage) measure(doc map[string]any) (pre store.Precondition, done func()) {
+	replaced, replacedBytes := false, int64(0)
+	pre = func(existing map[string]any) error {
+		replaced = existing != nil
+		if replaced {
+			replacedBytes = store.DocSize(existing)
+		}
+		return nil
+	}
+	done = func() {
+		if u == nil {
+			return
+		}
+		docs, bytes := 0, int64(0)
+		if doc != nil {
+			docs, bytes = 1, store.DocSize(doc)
+		}
+		if replaced {
+			docs, bytes = docs-1, bytes-replacedBytes
+		}
+		u.coll.Documents += docs
+		u.coll.Bytes += bytes
+		u.tenantTotal.Documents += docs
+		u.tenantTotal.Bytes += bytes
+		u.cache.count(u.tenant, u.collection, docs, bytes)
+	}
+	return pre, done
+}
@@ -0,0 +1,288 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/stevemurr/simple-sync-server/schema"
+	"github.com/stevemurr/simple-sync-server/store"
+)
+
+// timestampFormat is the format of updatedAt: any timestamp that
+// store.ParseTimestamp accepts. Collection schemas can use it too.
+const timestampFormat = "timestamp"
+
+func init() {
+	schema.RegisterFormat(timestampFormat, func(s string) bool {
+		_, err := store.ParseTimestamp(s)
+		return err == nil
+	})
+}
+
+// updatedAtSchema applies to every document written, with or without a
+// collection schema, so that last-write-wins only compares valid timestamps.
+var updatedAtSchema, _ = schema.Compile(map[string]any{
+	"properties": map[string]any{
+		"updatedAt": map[string]any{"type": "string", "format": timestampFormat},
+	},
+}, nil)
+
+// schemaCache holds the collectionSchema of each collection, including the
+// absence of a schema, so that reads and writes neither fetch nor compile
+// schemas. Entries are added when a schema is put through the API or first
+// used, and dropped when the schema, or one it references, is replaced or
+// deleted through the API. The handler must therefore be the only writer
+// of schemas in its store.
+type schemaCache struct {
+	mu      sync.RWMutex
+	entries map[schemaKey]*collectionSchema
+	gen     int // incremented whenever entries are dropped
+}
+
+type schemaKey struct{ tenant, collection string }
+
+func newSchemaCache() *schemaCache {
+	return &schemaCache{entries: make(map[schemaKey]*collectionSchema)}
+}
+
+// get returns the cached entry for key, and the generation to pass to add
+// if there is none.
+func (c *schemaCache) get(key schemaKey) (s *collectionSchema, ok bool, gen int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	s, ok = c.entries[key]
+	return s, ok, c.gen
+}
+
+// add caches an entry loaded from the store, unless entries were dropped
+// since gen, in which case it may be out of date.
+func (c *schemaCache) add(key schemaKey, s *collectionSchema, gen int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen == gen {
+		c.entries[key] = s
+	}
+}
+
+// change runs write, which changes the schema of a collection in the
+// store and returns the collection's new entry, and drops the entries it
+// affects. write runs without the lock, as stores lock themselves and may
+// be in a transaction that reads schemas; the new entry is only cached if
+// no other change happened meanwhile, since it might then be out of date.
+func (c *schemaCache) change(key schemaKey, write func() (*collectionSchema, error)) error {
+	_, _, gen := c.get(key)
+	s, err := write()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	unchanged := c.gen == gen
+	c.gen++
+	for k, e := range c.entries {
+		if k.tenant == key.tenant && (k.collection == key.collection || slices.Contains(e.references(), key.collection)) {
+			delete(c.entries, k)
+		}
+	}
+	if unchanged && s != nil && s.err == nil {
+		c.entries[key] = s
+	}
+	return nil
+}
+
+// dropTenant drops every entry of a tenant.
+func (c *schemaCache) dropTenant(tenant string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for k := range c.entries {
+		if k.tenant == tenant {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// schemaLoader resolves "schemas://" references against the schemas of the
+// caller's tenant.
+func (h *Handler) schemaLoader(r *http.Request) schema.Loader {
+	return h.storeFor(r).GetSchema
+}
+
+// loadSchema reads the schema history of a collection from the store.
+func (h *Handler) loadSchema(r *http.Request, collection string) (*collectionSchema, error) {
+	first, versions, err := h.storeFor(r).SchemaVersions(collection)
+	if err != nil {
+		return nil, err
+	}
+	return newCollectionSchema(first, versions, h.schemaLoader(r))
+}
+
+// collectionSchema returns the schema of a collection, or nil if it has
+// none. Schemas that fail to compile are not cached, as the references
+// that would invalidate them are unknown.
+func (h *Handler) collectionSchema(r *http.Request, collection string) (*collectionSchema, error) {
+	key := schemaKey{tenantOf(r), collection}
+	s, ok, gen := h.schemas.get(key)
+	if ok {
+		return s, nil
+	}
+	s, err := h.loadSchema(r, collection)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil || s.err == nil {
+		h.schemas.add(key, s, gen)
+	}
+	return s, nil
+}
+
+// validationError is one schema violation in a 422 response.
+type validationError struct {
+	schema.Error
+	Key string `json:"key,omitempty"` // the sync item it is about
+}
+
+// validationFailure is the body of a 422 response to an invalid document.
+type validationFailure struct {
+	Detail string            `json:"detail"`
+	Errors []validationError `json:"errors,omitempty"`
+}
+
+// schemaError writes the response for an error returned by
+// collectionSchema.validate or conform, listing the violations if there
+// are any.
+func schemaError(w http.ResponseWriter, err error) {
+	validationFailed(w, http.StatusUnprocessableEntity, "schema validation failed: ", err)
+}
+
+// invalidSchema writes the response for a schema rejected by schema.Check,
+// listing its mistakes with paths into the schema.
+func invalidSchema(w http.ResponseWriter, err error) {
+	validationFailed(w, http.StatusUnprocessableEntity, "invalid schema: ", err)
+}
+
+func validationFailed(w http.ResponseWriter, status int, prefix string, err error) {
+	f := validationFailure{Detail: prefix + err.Error()}
+	var errs schema.Errors
+	if errors.As(err, &errs) {
+		for _, e := range errs {
+			f.Errors = append(f.Errors, validationError{Error: e})
+		}
+	}
+	writeJSON(w, status, f)
+}
+
+// defaultAuditLimit is the number of invalid documents an audit lists when
+// no limit is given.
+const defaultAuditLimit = 100
+
+// auditReport describes which documents of a collection fail a schema.
+type auditReport struct {
+	Collection string `json:"collection"`
+	Checked    int    `json:"checked"`
+	Invalid    int    `json:"invalid"`
+
+	// Documents lists the first invalid documents, up to the audit's limit.
+	Documents []invalidDocument `json:"documents"`
+}
+
+type invalidDocument struct {
+	Key    string         `json:"key"`
+	Errors []schema.Error `json:"errors"`
+}
+
+// auditFailure is the response to a schema change refused because
+// existing documents fail the new schema.
+type auditFailure struct {
+	Detail string `json:"detail"`
+	auditReport
+}
+
+// auditLimit parses the limit query parameter of an audit.
+func auditLimit(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return defaultAuditLimit, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid limit %q", v)
+	}
+	return min(n, maxPageSize), nil
+}
+
+// audit validates every document of a collection against c, as writes
+// would be, after migrating it to c's version. It reads the collection a
+// page at a time.
+func (h *Handler) audit(r *http.Request, collection string, c *collectionSchema, limit int) (*auditReport, error) {
+	report := &auditReport{Collection: collection, Documents: []invalidDocument{}}
+	q := store.Query{Limit: maxPageSize}
+	for {
+		page, err := h.storeFor(r).Query(collection, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			report.Checked++
+			c.migrate(item.Data)
+			delete(item.Data, versionField)
+			var errs schema.Errors
+			if err := c.validate(item.Data); !errors.As(err, &errs) {
+				continue
+			}
+			report.Invalid++
+			if len(report.Documents) < limit {
+				report.Documents = append(report.Documents, invalidDocument{Key: item.Key, Errors: errs})
+			}
+		}
+		if page.NextCursor == "" {
+			return report, nil
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+// validateCollection serves GET /collections/{collection}/validate, which
+// audits the documents of a collection against its current schema.
+func (h *Handler) validateCollection(w http.ResponseWriter, r *http.Request) {
+	collection := r.PathValue("collection")
+	limit, err := auditLimit(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	c, err := h.collectionSchema(r, collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if c != nil && c.err != nil {
+		schemaError(w, c.err)
+		return
+	}
+	report, err := h.audit(r, collection, c, limit)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// compatibilityOf returns the compatibility policy a schema declares in
+// x-compatibility, which governs changes to it.
+func compatibilityOf(s map[string]any) (schema.Compatibility, error) {
+	raw, ok := s["x-compatibility"]
+	if !ok {
+		return schema.CompatibilityNone, nil
+	}
+	name, _ := raw.(string)
+	c, err := schema.ParseCompatibility(name)
+	if err != nil {
+		return "", fmt.Errorf("x-compatibility: %w", err)
+	}
+	return c, nil
+}
@@ -0,0 +1,29 @@
+// Package jsonvalue works with decoded JSON values: the maps, slices and
+// scalars encoding/json produces when decoding into an any.
+package jsonvalue
+
+// Copy copies a decoded JSON value, so that the copy shares no maps or
+// slices with v. Nil maps and slices stay nil.
+func Copy(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		if v == nil {
+			return v
+		}
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[k] = Copy(e)
+		}
+		return m
+	case []any:
+		if v == nil {
+			return v
+		}
+		s := make([]any, len(v))
+		for i, e := range v {
+			s[i] = Copy(e)
+		}
+		return s
+	}
+	return v
+}
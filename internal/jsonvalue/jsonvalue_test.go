@@ -0,0 +1,19 @@
+package jsonvalue_test
+
+import (
+	"testing"
+
+	"github.com/stevemurr/simple-sync-server/internal/jsonvalue"
+)
+
+func TestCopy(t *testing.T) {
+	v := map[string]any{"a": []any{map[string]any{"b": 1.0}}, "none": map[string]any(nil)}
+	c := jsonvalue.Copy(v).(map[string]any)
+	c["a"].([]any)[0].(map[string]any)["b"] = 2.0
+	if got := v["a"].([]any)[0].(map[string]any)["b"]; got != 1.0 {
+		t.Fatalf("expected the original to keep b=1, got %v", got)
+	}
+	if m, ok := c["none"].(map[string]any); !ok || m != nil {
+		t.Fatalf("expected a nil map to stay nil, got %#v", c["none"])
+	}
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3" // SQLite driver
 
+	"github.com/stevemurr/simple-sync-server/auth"
 	"github.com/stevemurr/simple-sync-server/handler"
+	"github.com/stevemurr/simple-sync-server/ratelimit"
 	"github.com/stevemurr/simple-sync-server/store"
 )
 
@@ -24,8 +29,9 @@ func env(key, fallback string) string {
 func corsMiddleware(next http.Handler, origins string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", origins)
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, If-Match, If-None-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Retry-After")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		if r.Method == http.MethodOptions {
@@ -36,6 +42,121 @@ func corsMiddleware(next http.Handler, origins string) http.Handler {
 	})
 }
 
+// jwtFromEnv configures JWT verification from the JWT_* variables, or
+// returns nil if no verification keys are configured.
+func jwtFromEnv() (*auth.JWT, error) {
+	var keys []auth.VerifyKey
+	if secret := os.Getenv("JWT_HS256_SECRET"); secret != "" {
+		keys = append(keys, auth.VerifyKey{Key: []byte(secret)})
+	}
+	if path := os.Getenv("JWT_PUBLIC_KEY_FILE"); path != "" {
+		k, err := auth.LoadPEM(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if path := os.Getenv("JWT_JWKS_FILE"); path != "" {
+		ks, err := auth.LoadJWKS(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, ks...)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	jwt := &auth.JWT{
+		Keys:     keys,
+		Issuer:   os.Getenv("JWT_ISSUER"),
+		Audience: os.Getenv("JWT_AUDIENCE"),
+		Leeway:   time.Minute,
+	}
+	if path := os.Getenv("JWT_CLAIMS_FILE"); path != "" {
+		m, err := auth.LoadClaimMapping(path)
+		if err != nil {
+			return nil, err
+		}
+		jwt.Claims = m
+	}
+	return jwt, nil
+}
+
+// limiterFromEnv configures rate limits from the RATE_LIMIT_* variables, or
+// returns nil if none are set.
+func limiterFromEnv() (*ratelimit.Limiter, error) {
+	rates := map[ratelimit.Class]ratelimit.Rate{}
+	for class, name := range map[ratelimit.Class]string{
+		ratelimit.ClassRead:  "RATE_LIMIT_READ",
+		ratelimit.ClassWrite: "RATE_LIMIT_WRITE",
+		ratelimit.ClassSync:  "RATE_LIMIT_SYNC",
+	} {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		rate, err := ratelimit.ParseRate(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		rates[class] = rate
+	}
+	if len(rates) == 0 {
+		return nil, nil
+	}
+	return &ratelimit.Limiter{Rates: rates}, nil
+}
+
+// envInt64 sets *dst from a non-negative integer variable, if it is set.
+func envInt64(name string, dst *int64) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("%s: invalid number %q", name, v)
+	}
+	*dst = n
+	return nil
+}
+
+// envInt is envInt64 for int variables.
+func envInt(name string, dst *int) error {
+	n := int64(*dst)
+	if err := envInt64(name, &n); err != nil {
+		return err
+	}
+	*dst = int(n)
+	return nil
+}
+
+// quotasFromEnv reads storage quotas from the QUOTA_* variables.
+func quotasFromEnv() (handler.Quotas, error) {
+	var q handler.Quotas
+	err := errors.Join(
+		envInt("QUOTA_COLLECTION_DOCUMENTS", &q.CollectionDocuments),
+		envInt64("QUOTA_COLLECTION_BYTES", &q.CollectionBytes),
+		envInt("QUOTA_TENANT_DOCUMENTS", &q.TenantDocuments),
+		envInt64("QUOTA_TENANT_BYTES", &q.TenantBytes),
+	)
+	return q, err
+}
+
+// limitsFromEnv reads request limits from the MAX_* variables, falling back
+// to handler.DefaultLimits; 0 lifts a limit.
+func limitsFromEnv() (handler.Limits, error) {
+	l := handler.DefaultLimits
+	err := errors.Join(
+		envInt64("MAX_BODY_BYTES", &l.MaxBodyBytes),
+		envInt64("MAX_DOCUMENT_BYTES", &l.MaxDocumentBytes),
+		envInt("MAX_SYNC_ITEMS", &l.MaxSyncItems),
+		envInt("MAX_BATCH_OPERATIONS", &l.MaxBatchOperations),
+		envInt("MAX_JSON_DEPTH", &l.MaxDepth),
+	)
+	return l, err
+}
+
 func main() {
 	host := env("HOST", "0.0.0.0")
 	port := env("PORT", "8080")
@@ -52,7 +173,43 @@ func main() {
 		log.Fatalf("failed to create store (backend=%s): %v", backend, err)
 	}
 
-	h := handler.New(s)
+	quotas, err := quotasFromEnv()
+	if err != nil {
+		log.Fatalf("failed to configure quotas: %v", err)
+	}
+	limits, err := limitsFromEnv()
+	if err != nil {
+		log.Fatalf("failed to configure request limits: %v", err)
+	}
+	var h http.Handler = handler.New(s, handler.WithQuotas(quotas), handler.WithLimits(limits))
+	limiter, err := limiterFromEnv()
+	if err != nil {
+		log.Fatalf("failed to configure rate limits: %v", err)
+	}
+	if limiter != nil {
+		h = ratelimit.Middleware(h, limiter)
+	}
+	authEnabled := env("AUTH_ENABLED", "false") == "true"
+	if authEnabled {
+		adminKey := os.Getenv("ADMIN_API_KEY")
+		if adminKey == "" {
+			log.Printf("warning: AUTH_ENABLED without ADMIN_API_KEY; only stored API keys are accepted")
+		}
+		authn := auth.Chain{&auth.APIKeys{Store: s, Admin: adminKey}}
+		jwt, err := jwtFromEnv()
+		if err != nil {
+			log.Fatalf("failed to configure JWT verification: %v", err)
+		}
+		if jwt != nil {
+			authn = append(authn, jwt)
+		}
+		h = auth.Middleware(h, authn)
+		// Requests auth refuses never reach the limiter above; limit them
+		// by address.
+		if limiter != nil {
+			h = ratelimit.Denied(h, limiter)
+		}
+	}
 	wrapped := corsMiddleware(h, origin)
 
 	addr := fmt.Sprintf("%s:%s", host, port)
@@ -0,0 +1,209 @@
+// Package ratelimit throttles clients with token buckets, one per client and
+// class of endpoint.
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stevemurr/simple-sync-server/auth"
+)
+
+// Class groups endpoints that share a limit.
+type Class string
+
+const (
+	ClassRead  Class = "read"
+	ClassWrite Class = "write"
+	ClassSync  Class = "sync"
+)
+
+// ClassOf returns the class of a request: sync for POSTs to a sync
+// endpoint, read for GET and HEAD, write for everything else.
+func ClassOf(r *http.Request) Class {
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/sync"):
+		return ClassSync
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return ClassRead
+	}
+	return ClassWrite
+}
+
+// Rate is a sustained number of requests per second with a burst allowance.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// ParseRate parses a rate written as "<n>/<unit>" with unit s, m or h, such
+// as "10/s" or "600/m". The burst is n.
+func ParseRate(s string) (Rate, error) {
+	n, unit, ok := strings.Cut(s, "/")
+	count, err := strconv.Atoi(n)
+	if !ok || err != nil || count < 1 {
+		return Rate{}, fmt.Errorf("invalid rate %q (want e.g. 10/s or 600/m)", s)
+	}
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return Rate{}, fmt.Errorf("invalid rate %q: unit must be s, m or h", s)
+	}
+	return Rate{PerSecond: float64(count) / per.Seconds(), Burst: count}, nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// maxBuckets bounds the number of buckets kept before full ones are
+// discarded; a full bucket is indistinguishable from a new one.
+const maxBuckets = 10000
+
+// Limiter keeps a token bucket per client and class. Classes without a
+// Rate are not limited. Safe for concurrent use.
+type Limiter struct {
+	Rates map[Class]Rate
+
+	// Now returns the current time; defaults to time.Now.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// Allow takes a token from the bucket of client for class. If none is
+// left it returns false and how long until one will be.
+func (l *Limiter) Allow(client string, class Class) (bool, time.Duration) {
+	return l.take(client, class, true)
+}
+
+// take reports whether the bucket of client for class has a token left,
+// taking it if consume is set.
+func (l *Limiter) take(client string, class Class, consume bool) (bool, time.Duration) {
+	rate, ok := l.Rates[class]
+	if !ok || rate.PerSecond <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+	if l.Now != nil {
+		now = l.Now()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+	if len(l.buckets) >= maxBuckets {
+		l.sweep(now)
+	}
+	id := string(class) + " " + client
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &bucket{tokens: float64(rate.Burst), last: now}
+		l.buckets[id] = b
+	}
+	b.tokens = min(float64(rate.Burst), b.tokens+now.Sub(b.last).Seconds()*rate.PerSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		if consume {
+			b.tokens--
+		}
+		return true, 0
+	}
+	wait := (1 - b.tokens) / rate.PerSecond
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// sweep drops the buckets that have refilled completely.
+func (l *Limiter) sweep(now time.Time) {
+	for id, b := range l.buckets {
+		class, _, _ := strings.Cut(id, " ")
+		rate := l.Rates[Class(class)]
+		if b.tokens+now.Sub(b.last).Seconds()*rate.PerSecond >= float64(rate.Burst) {
+			delete(l.buckets, id)
+		}
+	}
+}
+
+// ClientOf identifies the client of a request: the authenticated principal
+// if there is one, else the remote IP address.
+func ClientOf(r *http.Request) string {
+	if p := auth.FromContext(r.Context()); p != nil {
+		return p.Subject
+	}
+	return addressOf(r)
+}
+
+func addressOf(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Middleware rejects requests over their client's limit with 429 Too Many
+// Requests and a Retry-After header in seconds. Public routes such as
+// /health are not limited. Placed inside auth.Middleware it limits each
+// principal separately; requests auth.Middleware rejects need Denied.
+func Middleware(next http.Handler, l *Limiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth.Target(r).Public {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := l.Allow(ClientOf(r), ClassOf(r)); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Denied limits the requests of each IP address that auth.Middleware refuses
+// with 401 Unauthorized or 403 Forbidden, so that guessing keys and flooding
+// the server with unauthenticated requests are throttled too. Placed outside
+// auth.Middleware, it answers 429 before checking the credentials of an
+// address whose bucket is empty, and takes a token for every refusal.
+// Requests that are let through cost the address nothing, even when a
+// handler refuses them.
+func Denied(next http.Handler, l *Limiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth.Target(r).Public {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client, class := addressOf(r), ClassOf(r)
+		if ok, wait := l.take(client, class, false); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+		r = r.WithContext(auth.WithRefusals(r.Context()))
+		next.ServeHTTP(w, r)
+		if auth.Refused(r.Context()) {
+			l.Allow(client, class)
+		}
+	})
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]string{"detail": "rate limit exceeded"})
+}
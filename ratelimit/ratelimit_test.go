@@ -0,0 +1,151 @@
+package ratelimit_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stevemurr/simple-sync-server/auth"
+	"github.com/stevemurr/simple-sync-server/ratelimit"
+)
+
+func TestParseRate(t *testing.T) {
+	r, err := ratelimit.ParseRate("120/m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.PerSecond != 2 || r.Burst != 120 {
+		t.Fatalf("unexpected rate %+v", r)
+	}
+	for _, bad := range []string{"", "10", "0/s", "x/s", "10/d"} {
+		if _, err := ratelimit.ParseRate(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestClassOf(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         ratelimit.Class
+	}{
+		{"GET", "/collections/tasks/items", ratelimit.ClassRead},
+		{"PUT", "/collections/tasks/items/a", ratelimit.ClassWrite},
+		{"POST", "/sync", ratelimit.ClassSync},
+		{"POST", "/t/acme/collections/tasks/sync", ratelimit.ClassSync},
+		{"POST", "/admin/keys", ratelimit.ClassWrite},
+	}
+	for _, tt := range tests {
+		if got := ratelimit.ClassOf(httptest.NewRequest(tt.method, tt.path, nil)); got != tt.want {
+			t.Errorf("%s %s: got %s, want %s", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := &ratelimit.Limiter{
+		Rates: map[ratelimit.Class]ratelimit.Rate{ratelimit.ClassSync: {PerSecond: 1, Burst: 2}},
+		Now:   func() time.Time { return now },
+	}
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a", ratelimit.ClassSync); !ok {
+			t.Fatalf("request %d within the burst was refused", i)
+		}
+	}
+	ok, wait := l.Allow("a", ratelimit.ClassSync)
+	if ok || wait != time.Second {
+		t.Fatalf("expected refusal with 1s wait, got %v %v", ok, wait)
+	}
+	if ok, _ := l.Allow("b", ratelimit.ClassSync); !ok {
+		t.Fatal("clients must have separate buckets")
+	}
+	if ok, _ := l.Allow("a", ratelimit.ClassRead); !ok {
+		t.Fatal("classes without a rate must not be limited")
+	}
+	now = now.Add(time.Second)
+	if ok, _ := l.Allow("a", ratelimit.ClassSync); !ok {
+		t.Fatal("expected a token after refilling")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	l := &ratelimit.Limiter{Rates: map[ratelimit.Class]ratelimit.Rate{ratelimit.ClassRead: {PerSecond: 0.1, Burst: 1}}}
+	h := ratelimit.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), l)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	if w := get("/collections"); w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	w := get("/collections")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "10" {
+		t.Fatalf("expected Retry-After 10, got %q", got)
+	}
+	if w := get("/health"); w.Code != 200 {
+		t.Fatalf("expected /health to be exempt, got %d", w.Code)
+	}
+}
+
+func TestDenied(t *testing.T) {
+	l := &ratelimit.Limiter{Rates: map[ratelimit.Class]ratelimit.Rate{ratelimit.ClassRead: {PerSecond: 0.1, Burst: 2}}}
+	h := ratelimit.Denied(auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/collections/secret" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}), keyAuth{}), l)
+
+	get := func(key string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/collections", nil)
+		r.Header.Set("X-API-Key", key)
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	// Requests that are let through cost nothing, even when the handler
+	// refuses them.
+	for range 5 {
+		if code := get("good"); code != 200 {
+			t.Fatalf("expected 200, got %d", code)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/collections/secret", nil)
+		r.Header.Set("X-API-Key", "good")
+		if h.ServeHTTP(w, r); w.Code != http.StatusForbidden {
+			t.Fatalf("expected the handler's 403, got %d", w.Code)
+		}
+	}
+	// Refused ones use up the address's bucket, after which it is limited
+	// before its credentials are checked.
+	for range 2 {
+		if code := get("guess"); code != 401 {
+			t.Fatalf("expected 401, got %d", code)
+		}
+	}
+	if code := get("guess"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", code)
+	}
+	if code := get("good"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 for the limited address, got %d", code)
+	}
+}
+
+// keyAuth accepts the API key "good" with admin access to everything.
+type keyAuth struct{}
+
+func (keyAuth) Authenticate(r *http.Request) (*auth.Principal, error) {
+	switch r.Header.Get("X-API-Key") {
+	case "":
+		return nil, auth.ErrNoCredentials
+	case "good":
+		return &auth.Principal{Subject: "key:good", Grants: []auth.Grant{{Collections: "*", Scopes: []auth.Scope{auth.ScopeAdmin}}}}, nil
+	}
+	return nil, auth.ErrInvalidCredentials
+}
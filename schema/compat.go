@@ -0,0 +1,285 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Compatibility is a policy for changing a schema, as in schema
+// registries.
+type Compatibility string
+
+const (
+	// CompatibilityNone allows any change.
+	CompatibilityNone Compatibility = "none"
+
+	// CompatibilityBackward allows changes after which every document the
+	// current schema accepts is still accepted, so clients that write
+	// against the current schema keep working.
+	CompatibilityBackward Compatibility = "backward"
+
+	// CompatibilityForward allows changes after which every document the
+	// new schema accepts was already accepted by the current one, so
+	// clients that validate against the current schema can read documents
+	// written against the new one.
+	CompatibilityForward Compatibility = "forward"
+
+	// CompatibilityFull is both backward and forward compatibility.
+	CompatibilityFull Compatibility = "full"
+)
+
+// ParseCompatibility checks the name of a compatibility policy.
+func ParseCompatibility(s string) (Compatibility, error) {
+	switch c := Compatibility(s); c {
+	case CompatibilityNone, CompatibilityBackward, CompatibilityForward, CompatibilityFull:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown compatibility %q (use none, backward, forward or full)", s)
+}
+
+// CheckCompatibility reports the changes from the current schema to next
+// that break a compatibility policy, as an Errors whose Paths point into
+// the schemas. The check compares keywords rather than the sets of values
+// the schemas accept, so it is conservative: changes to composition
+// keywords (allOf, anyOf, oneOf, not, if) and to patterns are always
+// reported, even if they happen to be compatible. A nil schema accepts
+// anything.
+func CheckCompatibility(current, next map[string]any, c Compatibility) error {
+	var errs Errors
+	if c == CompatibilityBackward || c == CompatibilityFull {
+		n := &narrowing{narrow: "new", wide: "current", rootNarrow: orTrue(next), rootWide: orTrue(current), seen: map[[2]string]bool{}}
+		n.compare(n.rootWide, n.rootNarrow, "", "", "", &errs)
+	}
+	if c == CompatibilityForward || c == CompatibilityFull {
+		n := &narrowing{narrow: "current", wide: "new", rootNarrow: orTrue(current), rootWide: orTrue(next), seen: map[[2]string]bool{}}
+		n.compare(n.rootWide, n.rootNarrow, "", "", "", &errs)
+	}
+	return errs.err()
+}
+
+func orTrue(s map[string]any) any {
+	if s == nil {
+		return true
+	}
+	return s
+}
+
+// narrowing finds where one schema (the narrow one) rejects values another
+// (the wide one) accepts.
+type narrowing struct {
+	narrow, wide         string // how messages name the schemas
+	rootNarrow, rootWide any    // for resolving local references
+	seen                 map[[2]string]bool
+}
+
+// compare reports the keywords of narrow at path that reject values wide
+// accepts. locWide and locNarrow are the JSON Pointers of the subschemas,
+// which differ once references are followed.
+func (n *narrowing) compare(wide, narrow any, path, locWide, locNarrow string, errs *Errors) {
+	// Follow local references, once per pair of locations.
+	var ok bool
+	if wide, locWide, ok = n.deref(wide, locWide, n.rootWide); !ok {
+		errs.add(path, "$ref", "the %s schema has a $ref that cannot be followed", n.wide)
+		return
+	}
+	if narrow, locNarrow, ok = n.deref(narrow, locNarrow, n.rootNarrow); !ok {
+		errs.add(path, "$ref", "the %s schema has a $ref that cannot be followed", n.narrow)
+		return
+	}
+	pair := [2]string{locWide, locNarrow}
+	if n.seen[pair] {
+		return
+	}
+	n.seen[pair] = true
+
+	w, _ := wide.(map[string]any)
+	nm, _ := narrow.(map[string]any)
+	switch {
+	case narrow == true || wide == false:
+		return
+	case narrow == false:
+		errs.add(path, "false", "the %s schema accepts no value here", n.narrow)
+		return
+	case nm == nil:
+		return
+	case w == nil:
+		w = map[string]any{} // true accepts what {} accepts
+	}
+
+	// Keywords whose effect cannot be compared must be unchanged.
+	for _, k := range []string{"$ref", "allOf", "anyOf", "oneOf", "not", "if", "then", "else", "pattern"} {
+		if v, ok := nm[k]; ok && !reflect.DeepEqual(v, w[k]) {
+			errs.add(pointer(path, k), k, "%s differs in the %s schema, so compatibility cannot be checked", k, n.narrow)
+		}
+	}
+
+	n.compareType(w, nm, path, errs)
+	if v, ok := nm["enum"].([]any); ok {
+		if wv, ok := w["enum"].([]any); !ok {
+			errs.add(pointer(path, "enum"), "enum", "the %s schema restricts values to an enum", n.narrow)
+		} else {
+			for _, e := range wv {
+				if !containsValue(v, e) {
+					errs.add(pointer(path, "enum"), "enum", "the %s schema does not allow %s", n.narrow, literal(e))
+				}
+			}
+		}
+	}
+	if v, ok := nm["const"]; ok {
+		if wv, ok := w["const"]; !ok || !reflect.DeepEqual(v, wv) {
+			errs.add(pointer(path, "const"), "const", "the %s schema requires the value %s", n.narrow, literal(v))
+		}
+	}
+	if f, ok := nm["format"].(string); ok && f != w["format"] {
+		errs.add(pointer(path, "format"), "format", "the %s schema requires the format %q", n.narrow, f)
+	}
+	for _, k := range []string{"minimum", "exclusiveMinimum", "minLength", "minItems"} {
+		if v, ok := toFloat(nm[k]); ok {
+			if wv, ok := toFloat(w[k]); !ok || v > wv {
+				errs.add(pointer(path, k), k, "the %s schema raises %s to %v", n.narrow, k, v)
+			}
+		}
+	}
+	for _, k := range []string{"maximum", "exclusiveMaximum", "maxLength", "maxItems"} {
+		if v, ok := toFloat(nm[k]); ok {
+			if wv, ok := toFloat(w[k]); !ok || v < wv {
+				errs.add(pointer(path, k), k, "the %s schema lowers %s to %v", n.narrow, k, v)
+			}
+		}
+	}
+
+	n.compareObject(w, nm, path, locWide, locNarrow, errs)
+	if items, ok := nm["items"]; ok {
+		wi, ok := w["items"]
+		if !ok {
+			wi = true
+		}
+		n.compare(wi, items, pointer(path, "items"), pointer(locWide, "items"), pointer(locNarrow, "items"), errs)
+	}
+}
+
+func (n *narrowing) compareType(w, nm map[string]any, path string, errs *Errors) {
+	t, ok := nm["type"].(string)
+	if !ok {
+		return
+	}
+	wt, _ := w["type"].(string)
+	if t == wt || t == "number" && wt == "integer" {
+		return
+	}
+	if wt == "" {
+		errs.add(pointer(path, "type"), "type", "the %s schema requires type %q", n.narrow, t)
+	} else {
+		errs.add(pointer(path, "type"), "type", "the %s schema requires type %q instead of %q", n.narrow, t, wt)
+	}
+}
+
+func (n *narrowing) compareObject(w, nm map[string]any, path, locWide, locNarrow string, errs *Errors) {
+	wRequired := map[string]bool{}
+	if req, ok := w["required"].([]any); ok {
+		for _, r := range req {
+			if f, ok := r.(string); ok {
+				wRequired[f] = true
+			}
+		}
+	}
+	if req, ok := nm["required"].([]any); ok {
+		for _, r := range req {
+			if f, ok := r.(string); ok && !wRequired[f] {
+				errs.add(pointer(path, "required"), "required", "the %s schema requires %q", n.narrow, f)
+			}
+		}
+	}
+
+	wProps, _ := w["properties"].(map[string]any)
+	nProps, _ := nm["properties"].(map[string]any)
+	wClosed := w["additionalProperties"] == false
+	nClosed := nm["additionalProperties"] == false
+	names := map[string]bool{}
+	for f := range wProps {
+		names[f] = true
+	}
+	for f := range nProps {
+		names[f] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for f := range names {
+		sorted = append(sorted, f)
+	}
+	sort.Strings(sorted)
+	for _, f := range sorted {
+		p := pointer(pointer(path, "properties"), f)
+		ws, inWide := wProps[f]
+		ns, inNarrow := nProps[f]
+		switch {
+		case inWide && inNarrow:
+			n.compare(ws, ns, p, pointer(pointer(locWide, "properties"), f), pointer(pointer(locNarrow, "properties"), f), errs)
+		case inWide && nClosed:
+			errs.add(p, "additionalProperties", "the %s schema does not allow the property %q", n.narrow, f)
+		case inNarrow && wClosed:
+			// The wide schema rejects the property anyway.
+		case inNarrow:
+			n.compare(true, ns, p, pointer(pointer(locWide, "properties"), f), pointer(pointer(locNarrow, "properties"), f), errs)
+		}
+	}
+	if nClosed && !wClosed {
+		errs.add(pointer(path, "additionalProperties"), "additionalProperties", "the %s schema does not allow additional properties", n.narrow)
+	}
+}
+
+// deref follows a local reference ("#...") from a subschema, returning the
+// target and its location. References to other collections' schemas are
+// compared as written.
+func (n *narrowing) deref(s any, loc string, root any) (any, string, bool) {
+	for range 32 {
+		m, ok := s.(map[string]any)
+		if !ok {
+			return s, loc, true
+		}
+		ref, ok := m["$ref"].(string)
+		if !ok || !strings.HasPrefix(ref, "#") {
+			return s, loc, true
+		}
+		target, err := resolvePointer(root, ref[1:])
+		if err != nil {
+			return nil, "", false
+		}
+		s, loc = target, ref[1:]
+	}
+	return nil, "", false
+}
+
+// resolvePointer returns the value at a JSON Pointer within v.
+func resolvePointer(v any, p string) (any, error) {
+	if p == "" {
+		return v, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("%q is not a JSON Pointer", p)
+	}
+	for _, token := range strings.Split(p[1:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		var err error
+		if v, err = child(v, token); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+func literal(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func containsValue(list []any, v any) bool {
+	for _, e := range list {
+		if reflect.DeepEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
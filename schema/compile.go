@@ -0,0 +1,431 @@
+package schema
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RegistryScheme prefixes references to the schema registered for another
+// collection, as in "schemas://users" or "schemas://users#/$defs/address".
+const RegistryScheme = "schemas://"
+
+// Loader returns the schema registered for a collection, or nil if it has
+// none. Compile calls it for every collection a schema references.
+type Loader func(collection string) (map[string]any, error)
+
+// Schema is a compiled schema: a tree of validators built once from the
+// source, with references resolved and patterns compiled, so validating
+// against it needs no further lookups. It is safe for concurrent use.
+type Schema struct {
+	root     *node
+	refs     []string
+	readOnly bool // whether any subschema is readOnly
+}
+
+// node is a compiled schema or subschema. A nil node constrains nothing.
+type node struct {
+	// A boolean schema accepts any value (true) or none (false).
+	isBool, allow bool
+
+	// A reference replaces every other keyword, as in draft-07.
+	ref    *node
+	refURI string
+
+	typ      string
+	enum     []any
+	hasEnum  bool
+	constant any
+	hasConst bool
+
+	allOf, anyOf, oneOf []*node
+	not                 *node
+	hasNot              bool
+	cond, then, els     *node
+	hasIf               bool
+
+	required      []string
+	properties    map[string]*node
+	propertyNames []string // sorted, so that errors come in a stable order
+	noAdditional  bool
+
+	items              *node
+	minItems, maxItems limit
+
+	minLength, maxLength limit
+	pattern              *regexp.Regexp
+	format               string
+
+	minimum, maximum, exclusiveMinimum, exclusiveMaximum limit
+
+	// Annotations applied to documents being written.
+	def        any
+	hasDefault bool
+	readOnly   bool
+	source     map[string]any // the subschema as written, for readOnly ones
+}
+
+// limit is an optional numeric keyword.
+type limit struct {
+	value float64
+	set   bool
+}
+
+func limitOf(v any) limit {
+	f, ok := toFloat(v)
+	return limit{f, ok}
+}
+
+// Compile builds a validator from a schema and resolves its "$ref"s.
+// References may point into the schema itself ("#", "#/$defs/name",
+// "#/definitions/name" or any other JSON Pointer) or, through load, into
+// the schema of another collection ("schemas://users"). As in draft-07, the
+// other keywords of an object with a "$ref" are ignored. load may be nil if
+// only local references are allowed. A nil schema compiles to a nil
+// *Schema, which accepts anything.
+//
+// Compile fails on invalid patterns (which use Go's RE2 syntax), on
+// references that cannot be resolved and on reference cycles that would
+// never reach a value, such as two definitions that only refer to each
+// other. Recursion through properties or items is fine.
+func Compile(schema map[string]any, load Loader) (*Schema, error) {
+	if schema == nil {
+		return nil, nil
+	}
+	return compile(schema, load)
+}
+
+// Validate checks a document against the schema, returning an Errors that
+// lists every violation if it is invalid.
+func (s *Schema) Validate(doc map[string]any) error {
+	return s.ValidateValue(doc)
+}
+
+// ValidateValue checks any JSON value against the schema.
+func (s *Schema) ValidateValue(value any) error {
+	if s == nil {
+		return nil
+	}
+	var errs Errors
+	s.root.validate(value, "", &errs)
+	return errs.err()
+}
+
+// References returns the collections whose schemas the schema refers to,
+// directly or indirectly, in the order they were first referenced.
+func (s *Schema) References() []string {
+	if s == nil {
+		return nil
+	}
+	return s.refs
+}
+
+func compile(schema any, load Loader) (*Schema, error) {
+	c := &compiler{
+		load:      load,
+		resources: map[string]any{"": schema},
+		nodes:     map[location]*node{},
+	}
+	root, err := c.compile(schema, location{})
+	if err != nil {
+		return nil, err
+	}
+	// Resolving a reference to another collection can add more references.
+	for i := 0; i < len(c.refs); i++ {
+		if err := c.resolve(c.refs[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkCycles(c.refs); err != nil {
+		return nil, err
+	}
+	s := &Schema{root: root, refs: c.loaded}
+	for _, n := range c.nodes {
+		s.readOnly = s.readOnly || n.readOnly
+	}
+	return s, nil
+}
+
+// location identifies a subschema by the collection whose schema holds it
+// ("" for the one being compiled) and a JSON Pointer within that schema.
+type location struct {
+	resource, pointer string
+}
+
+type compiler struct {
+	load      Loader
+	resources map[string]any // source schemas by collection
+	loaded    []string       // the collections loaded, in order
+	nodes     map[location]*node
+	refs      []pendingRef // resolved after compiling
+}
+
+// pendingRef is a node with a $ref and the collection whose schema holds it.
+type pendingRef struct {
+	n    *node
+	base string
+}
+
+// compile builds the node for the subschema at loc, reusing it if it was
+// already built.
+func (c *compiler) compile(raw any, loc location) (*node, error) {
+	if n, ok := c.nodes[loc]; ok {
+		return n, nil
+	}
+	var m map[string]any
+	switch v := raw.(type) {
+	case bool:
+		n := &node{isBool: true, allow: v}
+		c.nodes[loc] = n
+		return n, nil
+	case map[string]any:
+		m = v
+	default:
+		return nil, nil
+	}
+	n := &node{}
+	c.nodes[loc] = n
+	if uri, ok := m["$ref"].(string); ok {
+		n.refURI = uri
+		c.refs = append(c.refs, pendingRef{n, loc.resource})
+		return n, nil
+	}
+
+	sub := func(raw any, tokens ...any) (*node, error) {
+		p := loc.pointer
+		for _, t := range tokens {
+			p = pointer(p, t)
+		}
+		return c.compile(raw, location{loc.resource, p})
+	}
+	list := func(keyword string) ([]*node, error) {
+		items, ok := m[keyword].([]any)
+		if !ok {
+			return nil, nil
+		}
+		nodes := make([]*node, len(items))
+		for i, item := range items {
+			var err error
+			if nodes[i], err = sub(item, keyword, i); err != nil {
+				return nil, err
+			}
+		}
+		return nodes, nil
+	}
+	var err error
+
+	n.typ, _ = m["type"].(string)
+	n.enum, n.hasEnum = m["enum"].([]any)
+	n.constant, n.hasConst = m["const"]
+
+	if n.allOf, err = list("allOf"); err != nil {
+		return nil, err
+	}
+	if n.anyOf, err = list("anyOf"); err != nil {
+		return nil, err
+	}
+	if n.oneOf, err = list("oneOf"); err != nil {
+		return nil, err
+	}
+	if raw, ok := m["not"]; ok {
+		n.hasNot = true
+		if n.not, err = sub(raw, "not"); err != nil {
+			return nil, err
+		}
+	}
+	// then and else only apply alongside if
+	if raw, ok := m["if"]; ok {
+		n.hasIf = true
+		if n.cond, err = sub(raw, "if"); err != nil {
+			return nil, err
+		}
+		if n.then, err = sub(m["then"], "then"); err != nil {
+			return nil, err
+		}
+		if n.els, err = sub(m["else"], "else"); err != nil {
+			return nil, err
+		}
+	}
+
+	if req, ok := m["required"].([]any); ok {
+		for _, r := range req {
+			if field, ok := r.(string); ok {
+				n.required = append(n.required, field)
+			}
+		}
+	}
+	if props, ok := m["properties"].(map[string]any); ok {
+		n.properties = make(map[string]*node, len(props))
+		for field, raw := range props {
+			if n.properties[field], err = sub(raw, "properties", field); err != nil {
+				return nil, err
+			}
+			n.propertyNames = append(n.propertyNames, field)
+		}
+		sort.Strings(n.propertyNames)
+	}
+	if ap, ok := m["additionalProperties"].(bool); ok && !ap {
+		n.noAdditional = true
+	}
+
+	if items, ok := m["items"]; ok {
+		if _, tuple := items.([]any); !tuple {
+			if n.items, err = sub(items, "items"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	n.minItems, n.maxItems = limitOf(m["minItems"]), limitOf(m["maxItems"])
+
+	n.minLength, n.maxLength = limitOf(m["minLength"]), limitOf(m["maxLength"])
+	if p, ok := m["pattern"].(string); ok {
+		if n.pattern, err = regexp.Compile(p); err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", p, err)
+		}
+	}
+	n.format, _ = m["format"].(string)
+
+	// Definitions are compiled even if unused, so that they are checked.
+	for _, keyword := range []string{"$defs", "definitions"} {
+		defs, _ := m[keyword].(map[string]any)
+		for name, raw := range defs {
+			if _, err := sub(raw, keyword, name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	n.minimum, n.maximum = limitOf(m["minimum"]), limitOf(m["maximum"])
+	n.exclusiveMinimum, n.exclusiveMaximum = limitOf(m["exclusiveMinimum"]), limitOf(m["exclusiveMaximum"])
+
+	n.def, n.hasDefault = m["default"]
+	if n.readOnly, _ = m["readOnly"].(bool); n.readOnly {
+		n.source = m
+	}
+	return n, nil
+}
+
+// resource returns the source schema of a collection, loading it on first
+// use.
+func (c *compiler) resource(name string) (any, error) {
+	if r, ok := c.resources[name]; ok {
+		return r, nil
+	}
+	if c.load == nil {
+		return nil, fmt.Errorf("references to other schemas are not available")
+	}
+	s, err := c.load(name)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, fmt.Errorf("no schema is registered for collection %q", name)
+	}
+	c.resources[name] = s
+	c.loaded = append(c.loaded, name)
+	return s, nil
+}
+
+// resolve points a $ref node at the node of its target.
+func (c *compiler) resolve(r pendingRef) error {
+	n, uri := r.n, r.n.refURI
+	name, fragment, _ := strings.Cut(uri, "#")
+	switch {
+	case name == "":
+		name = r.base
+	case strings.HasPrefix(name, RegistryScheme):
+		name = strings.TrimPrefix(name, RegistryScheme)
+	default:
+		return fmt.Errorf("$ref %q: only local (#...) and %s references are supported", uri, RegistryScheme)
+	}
+	target, err := c.resource(name)
+	if err != nil {
+		return fmt.Errorf("$ref %q: %w", uri, err)
+	}
+	p := ""
+	if fragment != "" {
+		if !strings.HasPrefix(fragment, "/") {
+			return fmt.Errorf("$ref %q: fragment must be a JSON Pointer", uri)
+		}
+		for _, token := range strings.Split(fragment[1:], "/") {
+			if token, err = url.PathUnescape(token); err != nil {
+				return fmt.Errorf("$ref %q: %w", uri, err)
+			}
+			token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+			if target, err = child(target, token); err != nil {
+				return fmt.Errorf("$ref %q: %w", uri, err)
+			}
+			p = pointer(p, token)
+		}
+	}
+	switch target.(type) {
+	case map[string]any, bool:
+	default:
+		return fmt.Errorf("$ref %q does not point to a schema", uri)
+	}
+	n.ref, err = c.compile(target, location{name, p})
+	return err
+}
+
+func child(v any, token string) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		if e, ok := v[token]; ok {
+			return e, nil
+		}
+	case []any:
+		if i, err := strconv.Atoi(token); err == nil && i >= 0 && i < len(v) {
+			return v[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%q not found", token)
+}
+
+// checkCycles rejects references that lead back to themselves while
+// validating the same value, which would recurse forever. Every such cycle
+// passes through a reference, so searching from each one finds them all.
+func checkCycles(refs []pendingRef) error {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[*node]int{}
+	var visit func(n *node, chain []string) error
+	visit = func(n *node, chain []string) error {
+		if n == nil {
+			return nil
+		}
+		switch state[n] {
+		case visiting:
+			return fmt.Errorf("$ref cycle: %s", strings.Join(chain, " -> "))
+		case done:
+			return nil
+		}
+		state[n] = visiting
+		var next []*node
+		if n.ref != nil {
+			next = []*node{n.ref}
+			chain = append(chain, n.refURI)
+		}
+		next = append(next, n.allOf...)
+		next = append(next, n.anyOf...)
+		next = append(next, n.oneOf...)
+		next = append(next, n.not, n.cond, n.then, n.els)
+		for _, m := range next {
+			if err := visit(m, chain); err != nil {
+				return err
+			}
+		}
+		state[n] = done
+		return nil
+	}
+	for _, r := range refs {
+		if err := visit(r.n, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package schema
+
+import "github.com/stevemurr/simple-sync-server/internal/jsonvalue"
+
+// ApplyDefaults gives every property missing from doc the default its
+// schema declares, in doc and in the objects and arrays of objects nested
+// in it. Defaults are found through properties, items, allOf and $ref; the
+// branches of anyOf, oneOf and if are not followed, as which of them applies
+// depends on the document. Objects that are missing are not created, unless
+// they have a default themselves. Defaults are copied, so documents do not
+// share them.
+func (s *Schema) ApplyDefaults(doc map[string]any) {
+	if s == nil {
+		return
+	}
+	s.root.applyDefaults(doc)
+}
+
+func (n *node) applyDefaults(v any) {
+	if n == nil || n.isBool {
+		return
+	}
+	if n.ref != nil {
+		n.ref.applyDefaults(v)
+		return
+	}
+	for _, s := range n.allOf {
+		s.applyDefaults(v)
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for _, name := range n.propertyNames {
+			p := n.properties[name]
+			if _, ok := v[name]; !ok {
+				if def, ok := p.resolve().defaultValue(); ok {
+					v[name] = jsonvalue.Copy(def)
+				}
+			}
+			if e, ok := v[name]; ok {
+				p.applyDefaults(e)
+			}
+		}
+	case []any:
+		for _, e := range v {
+			n.items.applyDefaults(e)
+		}
+	}
+}
+
+func (n *node) defaultValue() (any, bool) {
+	if n == nil || !n.hasDefault {
+		return nil, false
+	}
+	return n.def, true
+}
+
+// resolve follows the references of a node to the subschema they lead to.
+// Compile rejects reference cycles, so there is one.
+func (n *node) resolve() *node {
+	for n != nil && n.ref != nil {
+		n = n.ref
+	}
+	return n
+}
+
+// HasReadOnly reports whether the schema, or one it refers to, marks any
+// property readOnly, in which case writes need KeepReadOnly.
+func (s *Schema) HasReadOnly() bool {
+	return s != nil && s.readOnly
+}
+
+// KeepReadOnly prevents clients from setting readOnly properties: in doc,
+// a document being written, every readOnly property takes its value in
+// previous, the stored document (nil if there is none). A readOnly property
+// that previous does not have is given the value stamp returns for its
+// schema, if stamp is not nil and returns true, and is removed otherwise,
+// so that its default applies. Properties are found as for ApplyDefaults,
+// except that array items are skipped, since there is no telling which
+// stored item an item written corresponds to.
+func (s *Schema) KeepReadOnly(doc, previous map[string]any, stamp func(property map[string]any) (any, bool)) {
+	if s == nil {
+		return
+	}
+	s.root.keepReadOnly(doc, previous, stamp)
+}
+
+func (n *node) keepReadOnly(doc, previous map[string]any, stamp func(map[string]any) (any, bool)) {
+	if n == nil || n.isBool {
+		return
+	}
+	if n.ref != nil {
+		n.ref.keepReadOnly(doc, previous, stamp)
+		return
+	}
+	for _, s := range n.allOf {
+		s.keepReadOnly(doc, previous, stamp)
+	}
+	for _, name := range n.propertyNames {
+		p := n.properties[name]
+		if t := p.resolve(); t != nil && t.readOnly {
+			if v, ok := previous[name]; ok {
+				doc[name] = jsonvalue.Copy(v)
+			} else if v, ok := stampValue(stamp, t.source); ok {
+				doc[name] = v
+			} else {
+				delete(doc, name)
+			}
+			continue
+		}
+		if obj, ok := doc[name].(map[string]any); ok {
+			prev, _ := previous[name].(map[string]any)
+			p.keepReadOnly(obj, prev, stamp)
+		}
+	}
+}
+
+func stampValue(stamp func(map[string]any) (any, bool), property map[string]any) (any, bool) {
+	if stamp == nil {
+		return nil, false
+	}
+	return stamp(property)
+}
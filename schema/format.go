@@ -0,0 +1,105 @@
+package schema
+
+import (
+	"maps"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	formatsMu sync.RWMutex
+	formats   = map[string]func(string) bool{
+		"date-time": isDateTime,
+		"date":      isDate,
+		"email":     isEmail,
+		"uri":       isURI,
+		"uuid":      uuidPattern.MatchString,
+		"ipv4":      isIPv4,
+		"ipv6":      isIPv6,
+		"hostname":  isHostname,
+	}
+)
+
+// RegisterFormat adds a "format" that string values can be checked
+// against, or replaces a built-in one. valid reports whether a string has
+// the format. Check rejects schemas naming formats that are not
+// registered; validation ignores them.
+func RegisterFormat(name string, valid func(string) bool) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	formats[name] = valid
+}
+
+func lookupFormat(name string) func(string) bool {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	return formats[name]
+}
+
+// formatNames returns the names of the registered formats.
+func formatNames() []string {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	return slices.Collect(maps.Keys(formats))
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// isDateTime checks an RFC 3339 date-time such as 2024-01-15T10:30:00Z.
+func isDateTime(s string) bool {
+	_, err := time.Parse(time.RFC3339Nano, strings.ToUpper(s))
+	return err == nil
+}
+
+func isDate(s string) bool {
+	_, err := time.Parse(time.DateOnly, s)
+	return err == nil
+}
+
+// isEmail checks a bare address, without a display name or angle brackets.
+func isEmail(s string) bool {
+	a, err := mail.ParseAddress(s)
+	return err == nil && a.Address == s
+}
+
+// isURI checks an absolute URI, which has a scheme.
+func isURI(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme != ""
+}
+
+func isIPv4(s string) bool {
+	a, err := netip.ParseAddr(s)
+	return err == nil && a.Is4()
+}
+
+func isIPv6(s string) bool {
+	a, err := netip.ParseAddr(s)
+	return err == nil && a.Is6() && a.Zone() == ""
+}
+
+// isHostname checks an RFC 1123 host name: dot-separated labels of up to
+// 63 letters, digits and hyphens that do not start or end with a hyphen.
+func isHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,313 @@
+package schema
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// keywordCheck checks the value of one keyword at path.
+type keywordCheck func(c *checker, v any, path string)
+
+// keywords lists every keyword Check accepts, with how its value is checked.
+// It is filled in init because the checks of subschemas refer back to it.
+var keywords map[string]keywordCheck
+
+func init() {
+	keywords = map[string]keywordCheck{
+		"type":                 checkTypeName,
+		"enum":                 checkArray,
+		"const":                checkAny,
+		"allOf":                checkSchemaList,
+		"anyOf":                checkSchemaList,
+		"oneOf":                checkSchemaList,
+		"not":                  checkSubschema,
+		"if":                   checkSubschema,
+		"then":                 checkSubschema,
+		"else":                 checkSubschema,
+		"properties":           checkSchemaMap,
+		"required":             checkStringList,
+		"additionalProperties": checkBool,
+		"items":                checkSubschema,
+		"minItems":             checkCount,
+		"maxItems":             checkCount,
+		"minLength":            checkCount,
+		"maxLength":            checkCount,
+		"pattern":              checkPattern,
+		"format":               checkFormat,
+		"minimum":              checkNumber,
+		"maximum":              checkNumber,
+		"exclusiveMinimum":     checkNumber,
+		"exclusiveMaximum":     checkNumber,
+		"$ref":                 checkString,
+		"$defs":                checkSchemaMap,
+		"definitions":          checkSchemaMap,
+
+		// Annotations, which do not affect validation.
+		"$schema":     checkString,
+		"$id":         checkString,
+		"$comment":    checkString,
+		"title":       checkString,
+		"description": checkString,
+		"default":     checkAny,
+		"examples":    checkArray,
+		"readOnly":    checkBool,
+		"writeOnly":   checkBool,
+		"deprecated":  checkBool,
+	}
+}
+
+// unsupported lists draft-07 keywords that validation would ignore.
+var unsupported = map[string]bool{
+	"additionalItems":   true,
+	"contains":          true,
+	"contentEncoding":   true,
+	"contentMediaType":  true,
+	"dependencies":      true,
+	"maxProperties":     true,
+	"minProperties":     true,
+	"multipleOf":        true,
+	"patternProperties": true,
+	"propertyNames":     true,
+	"uniqueItems":       true,
+}
+
+var typeNames = map[string]bool{
+	"string": true, "number": true, "integer": true, "boolean": true,
+	"object": true, "array": true, "null": true,
+}
+
+// Check validates a schema itself, so that mistakes are reported instead
+// of silently constraining nothing. It reports unknown keywords (suggesting
+// the supported keyword a typo was meant to be), draft-07 keywords this
+// package does not support, keyword values of the wrong type, patterns
+// that do not compile and formats that are not registered. Keywords starting with "x-" are extensions and are
+// not checked. Check returns an Errors whose Paths point into the schema,
+// or nil if it found nothing wrong.
+func Check(schema map[string]any) error {
+	c := &checker{}
+	c.schema(schema, "")
+	return c.errs.err()
+}
+
+type checker struct {
+	errs Errors
+}
+
+func (c *checker) schema(v any, path string) {
+	var m map[string]any
+	switch s := v.(type) {
+	case bool:
+		return
+	case map[string]any:
+		m = s
+	default:
+		c.errs.add(path, "", "must be a schema (an object or a boolean), got %s", jsonType(v))
+		return
+	}
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		p := pointer(path, k)
+		switch check, ok := keywords[k]; {
+		case ok:
+			check(c, m[k], p)
+		case strings.HasPrefix(k, "x-"):
+		case unsupported[k]:
+			c.errs.add(p, k, "keyword %q is not supported", k)
+		default:
+			if s := suggest(k); s != "" {
+				c.errs.add(p, k, "unknown keyword %q (did you mean %q?)", k, s)
+			} else {
+				c.errs.add(p, k, "unknown keyword %q", k)
+			}
+		}
+	}
+}
+
+// keyword returns the keyword a path ends in.
+func keyword(path string) string {
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i] == '/' {
+			return path[i+1:]
+		}
+	}
+	return path
+}
+
+func (c *checker) wrongType(v any, path, want string) {
+	c.errs.add(path, keyword(path), "%s must be %s, got %s", keyword(path), want, jsonType(v))
+}
+
+func checkAny(*checker, any, string) {}
+
+func checkSubschema(c *checker, v any, path string) {
+	c.schema(v, path)
+}
+
+func checkSchemaList(c *checker, v any, path string) {
+	list, ok := v.([]any)
+	if !ok || len(list) == 0 {
+		c.wrongType(v, path, "a non-empty array of schemas")
+		return
+	}
+	for i, s := range list {
+		c.schema(s, pointer(path, i))
+	}
+}
+
+func checkSchemaMap(c *checker, v any, path string) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		c.wrongType(v, path, "an object of schemas")
+		return
+	}
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.schema(m[name], pointer(path, name))
+	}
+}
+
+func checkTypeName(c *checker, v any, path string) {
+	name, ok := v.(string)
+	if !ok {
+		c.wrongType(v, path, "a string")
+		return
+	}
+	if !typeNames[name] {
+		c.errs.add(path, "type", "unknown type %q", name)
+	}
+}
+
+func checkArray(c *checker, v any, path string) {
+	if _, ok := v.([]any); !ok {
+		c.wrongType(v, path, "an array")
+	}
+}
+
+func checkStringList(c *checker, v any, path string) {
+	list, ok := v.([]any)
+	if !ok {
+		c.wrongType(v, path, "an array of strings")
+		return
+	}
+	for i, s := range list {
+		if _, ok := s.(string); !ok {
+			c.errs.add(pointer(path, i), keyword(path), "%s must be an array of strings, got %s", keyword(path), jsonType(s))
+		}
+	}
+}
+
+func checkString(c *checker, v any, path string) {
+	if _, ok := v.(string); !ok {
+		c.wrongType(v, path, "a string")
+	}
+}
+
+func checkBool(c *checker, v any, path string) {
+	if _, ok := v.(bool); !ok {
+		c.wrongType(v, path, "a boolean")
+	}
+}
+
+func checkNumber(c *checker, v any, path string) {
+	if _, ok := toFloat(v); !ok {
+		c.wrongType(v, path, "a number")
+	}
+}
+
+func checkCount(c *checker, v any, path string) {
+	if f, ok := toFloat(v); !ok || f < 0 || f != float64(int64(f)) {
+		c.errs.add(path, keyword(path), "%s must be a non-negative integer, got %s", keyword(path), describe(v))
+	}
+}
+
+func checkFormat(c *checker, v any, path string) {
+	name, ok := v.(string)
+	if !ok {
+		c.wrongType(v, path, "a string")
+		return
+	}
+	if lookupFormat(name) != nil {
+		return
+	}
+	if s := closest(name, formatNames()); s != "" {
+		c.errs.add(path, "format", "unknown format %q (did you mean %q?)", name, s)
+	} else {
+		c.errs.add(path, "format", "unknown format %q", name)
+	}
+}
+
+func checkPattern(c *checker, v any, path string) {
+	p, ok := v.(string)
+	if !ok {
+		c.wrongType(v, path, "a string")
+		return
+	}
+	if _, err := regexp.Compile(p); err != nil {
+		c.errs.add(path, "pattern", "invalid pattern %q: %v", p, err)
+	}
+}
+
+// describe names a value for an error message: numbers by value, anything
+// else by type.
+func describe(v any) string {
+	if f, ok := toFloat(v); ok {
+		return fmt.Sprint(f)
+	}
+	return jsonType(v)
+}
+
+// suggest returns the supported keyword closest to an unknown one, if it is
+// close enough to be a typo.
+func suggest(name string) string {
+	return closest(name, slices.Collect(maps.Keys(keywords)))
+}
+
+// closest returns the one of names closest to name, if it is close enough
+// to be a typo.
+func closest(name string, names []string) string {
+	best, bestDist := "", 3
+	for _, k := range names {
+		if d := editDistance(name, k); d < bestDist || d == bestDist && k < best {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Damerau-Levenshtein (optimal string alignment)
+// distance between two strings, counting adjacent transpositions as one edit.
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
@@ -5,9 +5,47 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 )
 
+// Error is one way in which a value fails a schema.
+type Error struct {
+	// Path is a JSON Pointer (RFC 6901) to the offending part of the
+	// validated value, "" for the value itself. For required and
+	// additionalProperties it points to the missing or extra member.
+	Path string `json:"path"`
+
+	// Keyword is the schema keyword that failed, such as "minLength".
+	Keyword string `json:"keyword"`
+
+	Message string `json:"message"`
+}
+
+func (e Error) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// Errors lists every way in which a value fails a schema. Validation
+// returns an Errors whenever the value is invalid; other errors mean the
+// schema itself could not be compiled.
+type Errors []Error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *Errors) add(path, keyword, format string, args ...any) {
+	*e = append(*e, Error{Path: path, Keyword: keyword, Message: fmt.Sprintf(format, args...)})
+}
+
 // Validate checks a document against a JSON Schema (draft-07 subset).
 // Returns nil if validation passes or the schema is nil.
 //
@@ -16,76 +54,123 @@ import (
 //   - properties, required, additionalProperties
 //   - items (for arrays)
 //   - minimum, maximum, exclusiveMinimum, exclusiveMaximum
-//   - minLength, maxLength
+//   - minLength, maxLength, pattern, format
 //   - minItems, maxItems
-//   - enum
+//   - enum, const
+//   - allOf, anyOf, oneOf, not
+//   - if, then, else
+//   - $ref, $defs, definitions
+//
+// Subschemas may be boolean schemas: true accepts any value, false none.
+// Validate compiles the schema on every call and only resolves references
+// within it; use Compile to validate repeatedly or to reference the schemas
+// of other collections.
 func Validate(schema map[string]any, doc map[string]any) error {
-	if schema == nil {
+	s, err := Compile(schema, nil)
+	if err != nil {
+		return err
+	}
+	return s.Validate(doc)
+}
+
+// ValidateValue checks any JSON value (as decoded by encoding/json) against
+// a schema, which may be an object or a boolean schema.
+func ValidateValue(schema any, value any) error {
+	s, err := compile(schema, nil)
+	if err != nil {
+		return err
+	}
+	return s.ValidateValue(value)
+}
+
+// err returns e as an error, or nil if it is empty.
+func (e Errors) err() error {
+	if len(e) == 0 {
 		return nil
 	}
-	return validateValue(schema, doc, "")
+	return e
+}
+
+// pointer appends a reference token to a JSON Pointer.
+func pointer(path string, token any) string {
+	s := fmt.Sprint(token)
+	return path + "/" + strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
 }
 
-func validateValue(schema map[string]any, value any, path string) error {
-	if path == "" {
-		path = "$"
+// valid reports whether value matches a subschema, and why not.
+func (n *node) valid(value any, path string) (bool, Errors) {
+	var errs Errors
+	n.validate(value, path, &errs)
+	return len(errs) == 0, errs
+}
+
+func (n *node) validate(value any, path string, errs *Errors) {
+	switch {
+	case n == nil:
+		return
+	case n.isBool:
+		if !n.allow {
+			errs.add(path, "false", "no value is allowed here")
+		}
+		return
+	case n.ref != nil:
+		// A reference replaces the schema it appears in
+		n.ref.validate(value, path, errs)
+		return
 	}
 
 	// Check type constraint
-	if t, ok := schema["type"]; ok {
-		if ts, ok := t.(string); ok {
-			if err := checkType(ts, value, path); err != nil {
-				return err
-			}
-		}
+	if n.typ != "" {
+		checkType(n.typ, value, path, errs)
 	}
 
 	// Check enum
-	if enumRaw, ok := schema["enum"]; ok {
-		if enumList, ok := enumRaw.([]any); ok {
-			if err := checkEnum(enumList, value, path); err != nil {
-				return err
-			}
-		}
+	if n.hasEnum {
+		checkEnum(n.enum, value, path, errs)
+	}
+
+	// Check const
+	if n.hasConst && !reflect.DeepEqual(n.constant, value) {
+		b, _ := json.Marshal(n.constant)
+		errs.add(path, "const", "value must be %s", b)
 	}
 
+	n.validateComposition(value, path, errs)
+
 	switch v := value.(type) {
 	case map[string]any:
-		return validateObject(schema, v, path)
+		n.validateObject(v, path, errs)
 	case []any:
-		return validateArray(schema, v, path)
+		n.validateArray(v, path, errs)
 	case string:
-		return validateString(schema, v, path)
+		n.validateString(v, path, errs)
 	case float64:
-		return validateNumber(schema, v, path)
+		n.validateNumber(v, path, errs)
 	case json.Number:
 		f, _ := v.Float64()
-		return validateNumber(schema, f, path)
+		n.validateNumber(f, path, errs)
 	}
-
-	return nil
 }
 
-func checkType(expected string, value any, path string) error {
+func checkType(expected string, value any, path string, errs *Errors) {
 	actual := jsonType(value)
 	if expected == "integer" {
 		// Accept float64 values that are whole numbers
 		if f, ok := value.(float64); ok && f == float64(int64(f)) {
-			return nil
+			return
 		}
 		if actual != "integer" {
-			return fmt.Errorf("%s: expected type %q, got %q", path, expected, actual)
+			errs.add(path, "type", "expected type %q, got %q", expected, actual)
 		}
-		return nil
+		return
 	}
 	if actual != expected {
 		// "number" should also accept integer
 		if expected == "number" && actual == "integer" {
-			return nil
+			return
 		}
-		return fmt.Errorf("%s: expected type %q, got %q", path, expected, actual)
+		errs.add(path, "type", "expected type %q, got %q", expected, actual)
 	}
-	return nil
 }
 
 func jsonType(v any) string {
@@ -112,134 +197,141 @@ func jsonType(v any) string {
 	}
 }
 
-func checkEnum(allowed []any, value any, path string) error {
+func checkEnum(allowed []any, value any, path string, errs *Errors) {
 	for _, a := range allowed {
 		if reflect.DeepEqual(a, value) {
-			return nil
+			return
 		}
 	}
-	return fmt.Errorf("%s: value not in enum %v", path, allowed)
+	errs.add(path, "enum", "value not in enum %v", allowed)
 }
 
-func validateObject(schema map[string]any, obj map[string]any, path string) error {
-	// Check required fields
-	if req, ok := schema["required"]; ok {
-		if reqList, ok := req.([]any); ok {
-			for _, r := range reqList {
-				if field, ok := r.(string); ok {
-					if _, exists := obj[field]; !exists {
-						return fmt.Errorf("%s: missing required field %q", path, field)
-					}
-				}
-			}
+// validateComposition applies the keywords combining subschemas: allOf,
+// anyOf, oneOf, not and if/then/else.
+func (n *node) validateComposition(value any, path string, errs *Errors) {
+	for _, s := range n.allOf {
+		s.validate(value, path, errs)
+	}
+
+	if n.anyOf != nil {
+		matched, failures := matches(n.anyOf, value, path)
+		if len(matched) == 0 {
+			errs.add(path, "anyOf", "value matches none of the anyOf schemas: %s", strings.Join(failures, "; "))
 		}
 	}
 
-	// Validate properties
-	if props, ok := schema["properties"]; ok {
-		if propsMap, ok := props.(map[string]any); ok {
-			for field, propSchema := range propsMap {
-				val, exists := obj[field]
-				if !exists {
-					continue
-				}
-				ps, ok := propSchema.(map[string]any)
-				if !ok {
-					continue
-				}
-				if err := validateValue(ps, val, path+"."+field); err != nil {
-					return err
-				}
-			}
+	if n.oneOf != nil {
+		matched, failures := matches(n.oneOf, value, path)
+		switch {
+		case len(matched) == 0:
+			errs.add(path, "oneOf", "value matches none of the oneOf schemas: %s", strings.Join(failures, "; "))
+		case len(matched) > 1:
+			errs.add(path, "oneOf", "value matches oneOf schemas %d and %d but must match exactly one", matched[0], matched[1])
 		}
 	}
 
-	// Check additionalProperties
-	if ap, ok := schema["additionalProperties"]; ok {
-		if apBool, ok := ap.(bool); ok && !apBool {
-			propsMap := map[string]any{}
-			if props, ok := schema["properties"]; ok {
-				if pm, ok := props.(map[string]any); ok {
-					propsMap = pm
-				}
-			}
-			var extra []string
-			for field := range obj {
-				if _, defined := propsMap[field]; !defined {
-					extra = append(extra, field)
-				}
-			}
-			if len(extra) > 0 {
-				return fmt.Errorf("%s: additional properties not allowed: %s", path, strings.Join(extra, ", "))
-			}
+	if n.hasNot {
+		if ok, _ := n.not.valid(value, path); ok {
+			errs.add(path, "not", "value must not match the not schema")
 		}
 	}
 
-	return nil
+	if n.hasIf {
+		if ok, _ := n.cond.valid(value, path); ok {
+			n.then.validate(value, path, errs)
+		} else {
+			n.els.validate(value, path, errs)
+		}
+	}
 }
 
-func validateArray(schema map[string]any, arr []any, path string) error {
-	// minItems
-	if v, ok := toFloat(schema["minItems"]); ok {
-		if float64(len(arr)) < v {
-			return fmt.Errorf("%s: array length %d is less than minItems %v", path, len(arr), v)
+// matches validates value against each of schemas, returning the indexes
+// of the schemas it matches and why the others failed.
+func matches(schemas []*node, value any, path string) (matched []int, failures []string) {
+	for i, s := range schemas {
+		if ok, errs := s.valid(value, path); ok {
+			matched = append(matched, i)
+		} else {
+			failures = append(failures, fmt.Sprintf("[%d] %v", i, errs))
 		}
 	}
-	// maxItems
-	if v, ok := toFloat(schema["maxItems"]); ok {
-		if float64(len(arr)) > v {
-			return fmt.Errorf("%s: array length %d is greater than maxItems %v", path, len(arr), v)
+	return matched, failures
+}
+
+func (n *node) validateObject(obj map[string]any, path string, errs *Errors) {
+	// Check required fields
+	for _, field := range n.required {
+		if _, exists := obj[field]; !exists {
+			errs.add(pointer(path, field), "required", "missing required field %q", field)
 		}
 	}
-	// Validate items
-	if items, ok := schema["items"]; ok {
-		if itemSchema, ok := items.(map[string]any); ok {
-			for i, elem := range arr {
-				if err := validateValue(itemSchema, elem, fmt.Sprintf("%s[%d]", path, i)); err != nil {
-					return err
-				}
+
+	// Validate properties
+	for _, field := range n.propertyNames {
+		if val, exists := obj[field]; exists {
+			n.properties[field].validate(val, pointer(path, field), errs)
+		}
+	}
+
+	// Check additionalProperties
+	if n.noAdditional {
+		var extra []string
+		for field := range obj {
+			if _, defined := n.properties[field]; !defined {
+				extra = append(extra, field)
 			}
 		}
+		sort.Strings(extra)
+		for _, field := range extra {
+			errs.add(pointer(path, field), "additionalProperties", "additional property %q is not allowed", field)
+		}
 	}
-	return nil
 }
 
-func validateString(schema map[string]any, s string, path string) error {
-	if v, ok := toFloat(schema["minLength"]); ok {
-		if float64(len(s)) < v {
-			return fmt.Errorf("%s: string length %d is less than minLength %v", path, len(s), v)
-		}
+func (n *node) validateArray(arr []any, path string, errs *Errors) {
+	if n.minItems.set && float64(len(arr)) < n.minItems.value {
+		errs.add(path, "minItems", "array length %d is less than minItems %v", len(arr), n.minItems.value)
 	}
-	if v, ok := toFloat(schema["maxLength"]); ok {
-		if float64(len(s)) > v {
-			return fmt.Errorf("%s: string length %d is greater than maxLength %v", path, len(s), v)
+	if n.maxItems.set && float64(len(arr)) > n.maxItems.value {
+		errs.add(path, "maxItems", "array length %d is greater than maxItems %v", len(arr), n.maxItems.value)
+	}
+	if n.items != nil {
+		for i, elem := range arr {
+			n.items.validate(elem, pointer(path, i), errs)
 		}
 	}
-	return nil
 }
 
-func validateNumber(schema map[string]any, n float64, path string) error {
-	if v, ok := toFloat(schema["minimum"]); ok {
-		if n < v {
-			return fmt.Errorf("%s: %v is less than minimum %v", path, n, v)
-		}
+func (n *node) validateString(s string, path string, errs *Errors) {
+	if n.minLength.set && float64(len(s)) < n.minLength.value {
+		errs.add(path, "minLength", "string length %d is less than minLength %v", len(s), n.minLength.value)
 	}
-	if v, ok := toFloat(schema["maximum"]); ok {
-		if n > v {
-			return fmt.Errorf("%s: %v is greater than maximum %v", path, n, v)
-		}
+	if n.maxLength.set && float64(len(s)) > n.maxLength.value {
+		errs.add(path, "maxLength", "string length %d is greater than maxLength %v", len(s), n.maxLength.value)
 	}
-	if v, ok := toFloat(schema["exclusiveMinimum"]); ok {
-		if n <= v {
-			return fmt.Errorf("%s: %v is not greater than exclusiveMinimum %v", path, n, v)
-		}
+	if n.pattern != nil && !n.pattern.MatchString(s) {
+		errs.add(path, "pattern", "%q does not match pattern %q", s, n.pattern.String())
 	}
-	if v, ok := toFloat(schema["exclusiveMaximum"]); ok {
-		if n >= v {
-			return fmt.Errorf("%s: %v is not less than exclusiveMaximum %v", path, n, v)
+	if n.format != "" {
+		if valid := lookupFormat(n.format); valid != nil && !valid(s) {
+			errs.add(path, "format", "%q is not a valid %s", s, n.format)
 		}
 	}
-	return nil
+}
+
+func (n *node) validateNumber(f float64, path string, errs *Errors) {
+	if n.minimum.set && f < n.minimum.value {
+		errs.add(path, "minimum", "%v is less than minimum %v", f, n.minimum.value)
+	}
+	if n.maximum.set && f > n.maximum.value {
+		errs.add(path, "maximum", "%v is greater than maximum %v", f, n.maximum.value)
+	}
+	if n.exclusiveMinimum.set && f <= n.exclusiveMinimum.value {
+		errs.add(path, "exclusiveMinimum", "%v is not greater than exclusiveMinimum %v", f, n.exclusiveMinimum.value)
+	}
+	if n.exclusiveMaximum.set && f >= n.exclusiveMaximum.value {
+		errs.add(path, "exclusiveMaximum", "%v is not less than exclusiveMaximum %v", f, n.exclusiveMaximum.value)
+	}
 }
 
 func toFloat(v any) (float64, bool) {
@@ -1,6 +1,12 @@
 package schema_test
 
 import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/stevemurr/simple-sync-server/schema"
@@ -253,3 +259,570 @@ func TestValidateIntegerType(t *testing.T) {
 		t.Fatal("expected error for fractional number as integer")
 	}
 }
+
+func TestValidateComposition(t *testing.T) {
+	s := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"status": map[string]any{"const": "open"},
+			"owner": map[string]any{
+				"oneOf": []any{
+					map[string]any{"type": "string"},
+					map[string]any{"type": "null"},
+				},
+			},
+			"due": map[string]any{
+				"anyOf": []any{
+					map[string]any{"type": "string", "minLength": float64(10)},
+					map[string]any{"type": "number"},
+				},
+			},
+		},
+		"not": map[string]any{"required": []any{"deleted"}},
+	}
+
+	cases := []struct {
+		doc  map[string]any
+		want string
+	}{
+		{map[string]any{"status": "open", "owner": nil, "due": float64(3)}, ""},
+		{map[string]any{"status": "closed"}, `/status: value must be "open"`},
+		{map[string]any{"owner": float64(1)}, "/owner: value matches none of the oneOf schemas: [0] /owner: expected type"},
+		{map[string]any{"due": "soon"}, "/due: value matches none of the anyOf schemas: [0] /due: string length 4 is less than minLength 10; [1]"},
+		{map[string]any{"deleted": true}, "value must not match the not schema"},
+	}
+	for _, c := range cases {
+		err := schema.Validate(s, c.doc)
+		switch {
+		case c.want == "" && err != nil:
+			t.Errorf("%v: expected pass: %v", c.doc, err)
+		case c.want != "" && (err == nil || !strings.HasPrefix(err.Error(), c.want)):
+			t.Errorf("%v: expected error starting %q, got %v", c.doc, c.want, err)
+		}
+	}
+}
+
+func TestValidateIfThenElse(t *testing.T) {
+	s := map[string]any{
+		"if":   map[string]any{"properties": map[string]any{"kind": map[string]any{"const": "event"}}},
+		"then": map[string]any{"required": []any{"date"}},
+		"else": map[string]any{"properties": map[string]any{"date": false}},
+	}
+
+	if err := schema.Validate(s, map[string]any{"kind": "event", "date": "2024-01-15"}); err != nil {
+		t.Fatalf("expected pass: %v", err)
+	}
+	err := schema.Validate(s, map[string]any{"kind": "event"})
+	if err == nil || err.Error() != `/date: missing required field "date"` {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = schema.Validate(s, map[string]any{"kind": "task", "date": "2024-01-15"})
+	if err == nil || err.Error() != "/date: no value is allowed here" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+// TestSuite runs the cases vendored from the JSON Schema Test Suite.
+func TestSuite(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "draft7", "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no test files: %v", err)
+	}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var groups []struct {
+			Description string `json:"description"`
+			Schema      any    `json:"schema"`
+			Tests       []struct {
+				Description string `json:"description"`
+				Data        any    `json:"data"`
+				Valid       bool   `json:"valid"`
+			} `json:"tests"`
+		}
+		if err := json.Unmarshal(b, &groups); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		for _, g := range groups {
+			for _, c := range g.Tests {
+				err := schema.ValidateValue(g.Schema, c.Data)
+				if (err == nil) != c.Valid {
+					t.Errorf("%s: %s: %s: expected valid=%v, got %v", filepath.Base(file), g.Description, c.Description, c.Valid, err)
+				}
+			}
+		}
+	}
+}
+
+func TestCompileRegistryRefs(t *testing.T) {
+	registry := map[string]map[string]any{
+		"users": {
+			"type":     "object",
+			"required": []any{"name"},
+			"properties": map[string]any{
+				"name":    map[string]any{"type": "string"},
+				"address": map[string]any{"$ref": "#/$defs/address"},
+			},
+			"$defs": map[string]any{
+				"address": map[string]any{"type": "object", "required": []any{"city"}},
+			},
+		},
+	}
+	loads := 0
+	load := func(name string) (map[string]any, error) {
+		loads++
+		return registry[name], nil
+	}
+
+	s, err := schema.Compile(map[string]any{
+		"properties": map[string]any{
+			"assignee": map[string]any{"$ref": "schemas://users"},
+			"shipTo":   map[string]any{"$ref": "schemas://users#/$defs/address"},
+		},
+	}, load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loads != 1 {
+		t.Fatalf("expected users to be loaded once, got %d", loads)
+	}
+
+	if err := s.Validate(map[string]any{
+		"assignee": map[string]any{"name": "Ann", "address": map[string]any{"city": "Oslo"}},
+		"shipTo":   map[string]any{"city": "Oslo"},
+	}); err != nil {
+		t.Fatalf("expected pass: %v", err)
+	}
+	err = s.Validate(map[string]any{"assignee": map[string]any{"name": "Ann", "address": map[string]any{}}})
+	if err == nil || err.Error() != `/assignee/address/city: missing required field "city"` {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := s.Validate(map[string]any{"shipTo": map[string]any{}}); err == nil {
+		t.Fatal("expected error for invalid shipTo")
+	}
+	if loads != 1 {
+		t.Fatalf("expected validation to need no loads, got %d", loads)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	load := func(name string) (map[string]any, error) { return nil, nil }
+	cases := []struct {
+		name   string
+		schema map[string]any
+		want   string
+	}{
+		{"missing definition", map[string]any{"$ref": "#/$defs/nope"}, `$ref "#/$defs/nope": "$defs" not found`},
+		{"missing collection", map[string]any{"$ref": "schemas://users"}, `$ref "schemas://users": no schema is registered for collection "users"`},
+		{"remote", map[string]any{"$ref": "https://example.com/s.json"}, "only local"},
+		{"cycle", map[string]any{"$defs": map[string]any{
+			"a": map[string]any{"$ref": "#/$defs/b"},
+			"b": map[string]any{"anyOf": []any{map[string]any{"$ref": "#/$defs/a"}}},
+		}}, "$ref cycle"},
+		{"self", map[string]any{"allOf": []any{map[string]any{"$ref": "#"}}}, "$ref cycle"},
+	}
+	for _, c := range cases {
+		_, err := schema.Compile(c.schema, load)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: expected error containing %q, got %v", c.name, c.want, err)
+		}
+	}
+
+	// Recursion through a property consumes the document, so it terminates.
+	tree := map[string]any{
+		"properties": map[string]any{
+			"children": map[string]any{"type": "array", "items": map[string]any{"$ref": "#"}},
+			"name":     map[string]any{"type": "string"},
+		},
+	}
+	s, err := schema.Compile(tree, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := map[string]any{"children": []any{map[string]any{"children": []any{map[string]any{"name": 1.0}}}}}
+	if err := s.Validate(doc); err == nil || !strings.HasPrefix(err.Error(), "/children/0/children/0/name:") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestValidatePatternAndFormat(t *testing.T) {
+	cases := []struct {
+		format string
+		valid  []string
+		bad    []string
+	}{
+		{"date-time", []string{"2024-01-15T10:30:00Z", "2024-01-15T10:30:00.123+02:00", "2024-01-15t10:30:00z"}, []string{"2024-01-15", "2024-01-15T10:30:00", "2024-13-01T00:00:00Z"}},
+		{"date", []string{"2024-02-29"}, []string{"2023-02-29", "2024-1-5", "2024-01-15T10:30:00Z"}},
+		{"email", []string{"ann@example.com"}, []string{"ann", "Ann <ann@example.com>", "@example.com"}},
+		{"uri", []string{"https://example.com/a?b=c", "urn:isbn:0451450523"}, []string{"/relative/path", "example.com"}},
+		{"uuid", []string{"3f9a1c2e-8b4d-4e6f-9a0b-1c2d3e4f5a6b"}, []string{"3f9a1c2e8b4d4e6f9a0b1c2d3e4f5a6b", "3f9a1c2e-8b4d-4e6f-9a0b-1c2d3e4f5a6"}},
+		{"ipv4", []string{"192.168.0.1"}, []string{"256.0.0.1", "192.168.0", "::1", "01.2.3.4"}},
+		{"ipv6", []string{"::1", "2001:db8::8a2e:370:7334"}, []string{"192.168.0.1", "fe80::1%eth0", "2001:db8:::1"}},
+		{"hostname", []string{"example.com", "a-b.example", "localhost"}, []string{"-a.example.com", "a..b", "exa_mple.com", strings.Repeat("a", 64) + ".com"}},
+	}
+	for _, c := range cases {
+		s := map[string]any{"format": c.format}
+		for _, v := range c.valid {
+			if err := schema.ValidateValue(s, v); err != nil {
+				t.Errorf("%s: expected %q to pass: %v", c.format, v, err)
+			}
+		}
+		for _, v := range c.bad {
+			if err := schema.ValidateValue(s, v); err == nil {
+				t.Errorf("%s: expected %q to fail", c.format, v)
+			}
+		}
+	}
+
+	s := map[string]any{
+		"properties": map[string]any{
+			"sku":     map[string]any{"type": "string", "pattern": "^[A-Z]{3}-[0-9]+$"},
+			"contact": map[string]any{"format": "email"},
+		},
+	}
+	if err := schema.Validate(s, map[string]any{"sku": "ABC-12", "contact": "ann@example.com"}); err != nil {
+		t.Fatalf("expected pass: %v", err)
+	}
+	err := schema.Validate(s, map[string]any{"sku": "abc-12"})
+	if err == nil || err.Error() != `/sku: "abc-12" does not match pattern "^[A-Z]{3}-[0-9]+$"` {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = schema.Validate(s, map[string]any{"contact": "ann"})
+	if err == nil || err.Error() != `/contact: "ann" is not a valid email` {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if _, err := schema.Compile(map[string]any{"pattern": "(?=a)"}, nil); err == nil {
+		t.Fatal("expected an invalid pattern to fail to compile")
+	}
+}
+
+func TestRegisterFormat(t *testing.T) {
+	s := map[string]any{"format": "even-length"}
+	if err := schema.ValidateValue(s, "abc"); err != nil {
+		t.Fatalf("unknown formats should not be checked: %v", err)
+	}
+	schema.RegisterFormat("even-length", func(s string) bool { return len(s)%2 == 0 })
+	if err := schema.ValidateValue(s, "abcd"); err != nil {
+		t.Fatalf("expected pass: %v", err)
+	}
+	if err := schema.ValidateValue(s, "abc"); err == nil {
+		t.Fatal("expected error for a registered format")
+	}
+}
+
+func TestValidateCollectsErrors(t *testing.T) {
+	s := map[string]any{
+		"type":     "object",
+		"required": []any{"title", "due"},
+		"properties": map[string]any{
+			"title":    map[string]any{"type": "string", "minLength": float64(1)},
+			"priority": map[string]any{"type": "integer", "maximum": float64(5)},
+			"tags":     map[string]any{"items": map[string]any{"type": "string"}},
+			"a/b~c":    map[string]any{"type": "string"},
+		},
+		"additionalProperties": false,
+	}
+	err := schema.Validate(s, map[string]any{
+		"title":    "",
+		"priority": 7.5,
+		"tags":     []any{"ok", 3.0},
+		"a/b~c":    true,
+		"extra":    1.0,
+	})
+	var errs schema.Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected schema.Errors, got %v", err)
+	}
+	want := schema.Errors{
+		{Path: "/due", Keyword: "required", Message: `missing required field "due"`},
+		{Path: "/a~1b~0c", Keyword: "type", Message: `expected type "string", got "boolean"`},
+		{Path: "/priority", Keyword: "type", Message: `expected type "integer", got "number"`},
+		{Path: "/priority", Keyword: "maximum", Message: "7.5 is greater than maximum 5"},
+		{Path: "/tags/1", Keyword: "type", Message: `expected type "string", got "number"`},
+		{Path: "/title", Keyword: "minLength", Message: "string length 0 is less than minLength 1"},
+		{Path: "/extra", Keyword: "additionalProperties", Message: `additional property "extra" is not allowed`},
+	}
+	if !reflect.DeepEqual(errs, want) {
+		t.Fatalf("unexpected errors:\n got %v\nwant %v", errs, want)
+	}
+
+	// Compile failures are not validation errors.
+	err = schema.Validate(map[string]any{"$ref": "#/nope"}, map[string]any{})
+	if err == nil || errors.As(err, &errs) {
+		t.Fatalf("expected a plain compile error, got %#v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	valid := map[string]any{
+		"$schema":  "http://json-schema.org/draft-07/schema#",
+		"title":    "Task",
+		"type":     "object",
+		"required": []any{"title"},
+		"properties": map[string]any{
+			"title": map[string]any{"type": "string", "minLength": 1.0, "pattern": "^\\S"},
+			"done":  map[string]any{"type": "boolean", "default": false},
+			"tags":  map[string]any{"type": "array", "items": true},
+		},
+		"anyOf":     []any{map[string]any{"required": []any{"title"}}, false},
+		"x-indexes": []any{"title"},
+	}
+	if err := schema.Check(valid); err != nil {
+		t.Fatalf("expected no errors, got %v", err)
+	}
+
+	err := schema.Check(map[string]any{
+		"type":     "strng",
+		"required": "title",
+		"properties": map[string]any{
+			"title": map[string]any{"maxLenght": 5.0, "minLength": -1.0},
+			"id":    "string",
+			"email": map[string]any{"format": "emial"},
+			"hash":  map[string]any{"format": "sha256"},
+		},
+		"allOf":       []any{},
+		"pattern":     "(",
+		"uniqueItems": true,
+		"frobnicate":  true,
+	})
+	var errs schema.Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected schema.Errors, got %v", err)
+	}
+	want := schema.Errors{
+		{Path: "/allOf", Keyword: "allOf", Message: "allOf must be a non-empty array of schemas, got array"},
+		{Path: "/frobnicate", Keyword: "frobnicate", Message: `unknown keyword "frobnicate"`},
+		{Path: "/pattern", Keyword: "pattern", Message: "invalid pattern \"(\": error parsing regexp: missing closing ): `(`"},
+		{Path: "/properties/email/format", Keyword: "format", Message: `unknown format "emial" (did you mean "email"?)`},
+		{Path: "/properties/hash/format", Keyword: "format", Message: `unknown format "sha256"`},
+		{Path: "/properties/id", Keyword: "", Message: "must be a schema (an object or a boolean), got string"},
+		{Path: "/properties/title/maxLenght", Keyword: "maxLenght", Message: `unknown keyword "maxLenght" (did you mean "maxLength"?)`},
+		{Path: "/properties/title/minLength", Keyword: "minLength", Message: "minLength must be a non-negative integer, got -1"},
+		{Path: "/required", Keyword: "required", Message: "required must be an array of strings, got string"},
+		{Path: "/type", Keyword: "type", Message: `unknown type "strng"`},
+		{Path: "/uniqueItems", Keyword: "uniqueItems", Message: `keyword "uniqueItems" is not supported`},
+	}
+	if !reflect.DeepEqual(errs, want) {
+		t.Fatalf("unexpected errors:\n got %v\nwant %v", errs, want)
+	}
+}
+
+func TestCheckCompatibility(t *testing.T) {
+	current := map[string]any{
+		"type":     "object",
+		"required": []any{"title"},
+		"$defs":    map[string]any{"status": map[string]any{"enum": []any{"open", "done"}}},
+		"properties": map[string]any{
+			"title":  map[string]any{"type": "string", "maxLength": 100.0},
+			"status": map[string]any{"$ref": "#/$defs/status"},
+			"count":  map[string]any{"type": "integer"},
+		},
+	}
+	tests := []struct {
+		name string
+		next map[string]any
+		mode schema.Compatibility
+		want []string // paths of the reported changes
+	}{
+		{"unchanged", current, schema.CompatibilityFull, nil},
+		{"optional property added", merge(current, "properties", map[string]any{
+			"title":  map[string]any{"type": "string", "maxLength": 100.0},
+			"status": map[string]any{"$ref": "#/$defs/status"},
+			"count":  map[string]any{"type": "integer"},
+			"notes":  map[string]any{"type": "string"},
+		}), schema.CompatibilityBackward, []string{"/properties/notes/type"}},
+		{"relaxed", merge(current, "properties", map[string]any{
+			"title":  map[string]any{"type": "string", "maxLength": 200.0},
+			"status": map[string]any{"enum": []any{"open", "done", "blocked"}},
+			"count":  map[string]any{"type": "number"},
+		}), schema.CompatibilityBackward, nil},
+		{"relaxed, forward", merge(current, "properties", map[string]any{
+			"title":  map[string]any{"type": "string", "maxLength": 200.0},
+			"status": map[string]any{"enum": []any{"open", "done", "blocked"}},
+			"count":  map[string]any{"type": "number"},
+		}), schema.CompatibilityForward, []string{"/properties/count/type", "/properties/status/enum", "/properties/title/maxLength"}},
+		{"tightened", merge(merge(current, "required", []any{"title", "count"}), "properties", map[string]any{
+			"title":  map[string]any{"type": "string", "maxLength": 50.0},
+			"status": map[string]any{"$ref": "#/$defs/status"},
+			"count":  map[string]any{"type": "integer", "minimum": 0.0},
+		}), schema.CompatibilityBackward, []string{"/required", "/properties/count/minimum", "/properties/title/maxLength"}},
+		{"tightened through a definition", merge(current, "$defs", map[string]any{
+			"status": map[string]any{"enum": []any{"open"}},
+		}), schema.CompatibilityBackward, []string{"/properties/status/enum"}},
+		{"tightened, no policy", merge(current, "required", []any{"title", "count"}), schema.CompatibilityNone, nil},
+		{"closed", merge(current, "additionalProperties", false), schema.CompatibilityBackward, []string{"/additionalProperties"}},
+		{"composition changed", merge(current, "anyOf", []any{map[string]any{"required": []any{"count"}}}), schema.CompatibilityBackward, []string{"/anyOf"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := schema.CheckCompatibility(current, tt.next, tt.mode)
+			var errs schema.Errors
+			if err != nil && !errors.As(err, &errs) {
+				t.Fatalf("expected schema.Errors, got %v", err)
+			}
+			var got []string
+			for _, e := range errs {
+				got = append(got, e.Path)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected changes at %v, got %v", tt.want, errs)
+			}
+		})
+	}
+
+	// Adding a schema where there was none is only forward compatible.
+	if err := schema.CheckCompatibility(nil, current, schema.CompatibilityForward); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := schema.CheckCompatibility(nil, current, schema.CompatibilityBackward); err == nil {
+		t.Fatal("expected a new schema to narrow no schema")
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	s, err := schema.Compile(map[string]any{
+		"type": "object",
+		"allOf": []any{
+			map[string]any{"properties": map[string]any{"done": map[string]any{"default": false}}},
+		},
+		"properties": map[string]any{
+			"priority": map[string]any{"type": "integer", "default": 3.0},
+			"title":    map[string]any{"type": "string", "default": "Untitled"},
+			"address":  map[string]any{"$ref": "#/$defs/address"},
+			"settings": map[string]any{"type": "object", "default": map[string]any{}, "properties": map[string]any{"theme": map[string]any{"default": "dark"}}},
+			"items":    map[string]any{"type": "array", "items": map[string]any{"properties": map[string]any{"qty": map[string]any{"default": 1.0}}}},
+		},
+		"$defs": map[string]any{
+			"address": map[string]any{"properties": map[string]any{"country": map[string]any{"default": "US"}}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := map[string]any{
+		"title":   "Mine",
+		"address": map[string]any{"street": "Main St"},
+		"items":   []any{map[string]any{}, map[string]any{"qty": 5.0}},
+	}
+	s.ApplyDefaults(doc)
+	want := map[string]any{
+		"title":    "Mine",
+		"priority": 3.0,
+		"done":     false,
+		"address":  map[string]any{"street": "Main St", "country": "US"},
+		"settings": map[string]any{"theme": "dark"},
+		"items":    []any{map[string]any{"qty": 1.0}, map[string]any{"qty": 5.0}},
+	}
+	if !reflect.DeepEqual(doc, want) {
+		t.Fatalf("expected %v, got %v", want, doc)
+	}
+
+	// Defaults are copied into each document.
+	other := map[string]any{}
+	s.ApplyDefaults(other)
+	other["settings"].(map[string]any)["theme"] = "light"
+	third := map[string]any{}
+	s.ApplyDefaults(third)
+	if third["settings"].(map[string]any)["theme"] != "dark" {
+		t.Fatalf("expected documents not to share defaults, got %v", third)
+	}
+}
+
+func TestKeepReadOnly(t *testing.T) {
+	s, err := schema.Compile(map[string]any{
+		"properties": map[string]any{
+			"createdAt": map[string]any{"readOnly": true, "x-server": "createdAt"},
+			"status":    map[string]any{"readOnly": true},
+			"title":     map[string]any{"type": "string"},
+			"audit":     map[string]any{"properties": map[string]any{"by": map[string]any{"$ref": "#/$defs/stamp"}}},
+		},
+		"$defs": map[string]any{"stamp": map[string]any{"type": "string", "readOnly": true}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasReadOnly() {
+		t.Fatal("expected HasReadOnly")
+	}
+	stamp := func(p map[string]any) (any, bool) {
+		if p["x-server"] == "createdAt" {
+			return "now", true
+		}
+		return nil, false
+	}
+
+	// A new document is stamped, and other readOnly values are dropped.
+	doc := map[string]any{"title": "New", "createdAt": "then", "status": "done", "audit": map[string]any{"by": "mallory", "note": "x"}}
+	s.KeepReadOnly(doc, nil, stamp)
+	want := map[string]any{"title": "New", "createdAt": "now", "audit": map[string]any{"note": "x"}}
+	if !reflect.DeepEqual(doc, want) {
+		t.Fatalf("expected %v, got %v", want, doc)
+	}
+
+	// An update keeps the stored values, even those the client left out.
+	previous := map[string]any{"title": "Old", "createdAt": "then", "status": "open", "audit": map[string]any{"by": "alice"}}
+	doc = map[string]any{"title": "New", "status": "done", "audit": map[string]any{"by": "mallory"}}
+	s.KeepReadOnly(doc, previous, stamp)
+	want = map[string]any{"title": "New", "createdAt": "then", "status": "open", "audit": map[string]any{"by": "alice"}}
+	if !reflect.DeepEqual(doc, want) {
+		t.Fatalf("expected %v, got %v", want, doc)
+	}
+
+	if plain, _ := schema.Compile(map[string]any{"properties": map[string]any{"a": true}}, nil); plain.HasReadOnly() {
+		t.Fatal("expected no readOnly properties")
+	}
+}
+
+// merge returns a copy of s with a keyword set.
+func merge(s map[string]any, keyword string, v any) map[string]any {
+	m := make(map[string]any, len(s)+1)
+	for k, e := range s {
+		m[k] = e
+	}
+	m[keyword] = v
+	return m
+}
+
+var benchSchema = map[string]any{
+	"type":     "object",
+	"required": []any{"title", "tags"},
+	"$defs": map[string]any{
+		"tag": map[string]any{"type": "string", "pattern": "^[a-z-]+$"},
+	},
+	"properties": map[string]any{
+		"title":  map[string]any{"type": "string", "minLength": 1, "maxLength": 200},
+		"status": map[string]any{"enum": []any{"open", "done"}},
+		"due":    map[string]any{"type": "string", "format": "date"},
+		"tags":   map[string]any{"type": "array", "items": map[string]any{"$ref": "#/$defs/tag"}},
+	},
+}
+
+var benchDoc = map[string]any{
+	"title":  "Write the report",
+	"status": "open",
+	"due":    "2024-01-15",
+	"tags":   []any{"work", "writing"},
+}
+
+func BenchmarkValidate(b *testing.B) {
+	for b.Loop() {
+		if err := schema.Validate(benchSchema, benchDoc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompiledValidate(b *testing.B) {
+	s, err := schema.Compile(benchSchema, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for b.Loop() {
+		if err := s.Validate(benchDoc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
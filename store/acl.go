@@ -0,0 +1,67 @@
+package store
+
+import (
+	"slices"
+)
+
+// aclNames returns the entries of an ACL's read and write lists: the
+// subjects and "group:<name>" entries ListACLsFor finds it by.
+func aclNames(acl map[string]any) []string {
+	var names []string
+	add := func(name string) {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	for _, list := range []string{"read", "write"} {
+		switch entries := acl[list].(type) {
+		case []any:
+			for _, e := range entries {
+				if name, ok := e.(string); ok {
+					add(name)
+				}
+			}
+		case []string:
+			for _, name := range entries {
+				add(name)
+			}
+		}
+	}
+	return names
+}
+
+// aclIndex maps collection -> ACL entry -> the keys of the documents whose
+// ACL lists it, so that the ACLs granting a caller access are found without
+// reading every ACL of the collection.
+type aclIndex map[string]map[string]map[string]bool
+
+// update replaces the entries indexed for a document's ACL, old, with those
+// of acl (nil when it is removed).
+func (x aclIndex) update(collection, key string, old, acl map[string]any) {
+	for _, name := range aclNames(old) {
+		delete(x[collection][name], key)
+		if len(x[collection][name]) == 0 {
+			delete(x[collection], name)
+		}
+	}
+	for _, name := range aclNames(acl) {
+		if x[collection] == nil {
+			x[collection] = make(map[string]map[string]bool)
+		}
+		if x[collection][name] == nil {
+			x[collection][name] = make(map[string]bool)
+		}
+		x[collection][name][key] = true
+	}
+}
+
+// keys returns the keys of the documents whose ACL lists any of names.
+func (x aclIndex) keys(collection string, names []string) map[string]bool {
+	keys := make(map[string]bool)
+	for _, name := range names {
+		for key := range x[collection][name] {
+			keys[key] = true
+		}
+	}
+	return keys
+}
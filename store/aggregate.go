@@ -0,0 +1,211 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Aggregate functions.
+const (
+	AggCount = "count"
+	AggSum   = "sum"
+	AggMin   = "min"
+	AggMax   = "max"
+	AggAvg   = "avg"
+)
+
+// Metric is an aggregate function over a field path. Count ignores Field and
+// counts documents; the other functions consider numeric values only.
+type Metric struct {
+	Func  string
+	Field string
+}
+
+// Name returns the key of the metric in a Group's values, e.g. "count" or
+// "sum(amount)".
+func (m Metric) Name() string {
+	if m.Func == AggCount {
+		return AggCount
+	}
+	return m.Func + "(" + m.Field + ")"
+}
+
+// ParseMetric parses the form returned by Metric.Name.
+func ParseMetric(s string) (Metric, error) {
+	if s == AggCount {
+		return Metric{Func: AggCount}, nil
+	}
+	open := strings.Index(s, "(")
+	if open < 0 || !strings.HasSuffix(s, ")") {
+		return Metric{}, fmt.Errorf("%w: invalid metric %q (expected count or fn(field))", ErrInvalidQuery, s)
+	}
+	m := Metric{Func: s[:open], Field: s[open+1 : len(s)-1]}
+	switch m.Func {
+	case AggSum, AggMin, AggMax, AggAvg:
+	default:
+		return Metric{}, fmt.Errorf("%w: unknown aggregate function %q", ErrInvalidQuery, m.Func)
+	}
+	if _, err := ParsePath(m.Field); err != nil {
+		return Metric{}, err
+	}
+	return m, nil
+}
+
+// Aggregation describes an aggregate read of a collection.
+type Aggregation struct {
+	// Filter restricts the documents aggregated.
+	Filter *Filter
+
+	// GroupBy lists the field paths whose values form the groups. Documents
+	// lacking a field group under null. Without GroupBy there is one group.
+	GroupBy []string
+
+	Metrics []Metric
+}
+
+// Group is one row of an aggregate result.
+type Group struct {
+	// Key maps each GroupBy field to the group's value.
+	Key map[string]any `json:"key"`
+
+	// Values maps each metric name to its value. Sum is 0 and min, max and
+	// avg are null for groups without numeric values.
+	Values map[string]any `json:"values"`
+}
+
+func (a Aggregation) validate() error {
+	if len(a.Metrics) == 0 {
+		return fmt.Errorf("%w: at least one metric is required", ErrInvalidQuery)
+	}
+	for _, m := range a.Metrics {
+		if m.Func == AggCount {
+			continue
+		}
+		if _, err := ParseMetric(m.Name()); err != nil {
+			return err
+		}
+	}
+	_, err := parseFields(a.GroupBy)
+	return err
+}
+
+// accumulator gathers the numeric values of one metric within a group.
+type accumulator struct {
+	n             int
+	sum, min, max float64
+}
+
+func (acc *accumulator) add(v float64) {
+	if acc.n == 0 || v < acc.min {
+		acc.min = v
+	}
+	if acc.n == 0 || v > acc.max {
+		acc.max = v
+	}
+	acc.sum += v
+	acc.n++
+}
+
+func (acc *accumulator) value(fn string) any {
+	switch fn {
+	case AggSum:
+		return acc.sum
+	case AggMin, AggMax, AggAvg:
+		if acc.n == 0 {
+			return nil
+		}
+	}
+	switch fn {
+	case AggMin:
+		return acc.min
+	case AggMax:
+		return acc.max
+	case AggAvg:
+		return acc.sum / float64(acc.n)
+	}
+	return nil
+}
+
+// runAggregate evaluates a in process over a set of documents.
+func runAggregate(docs map[string]map[string]any, a Aggregation) ([]Group, error) {
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+	groupPaths, _ := parseFields(a.GroupBy)
+	metricPaths := make([][]string, len(a.Metrics))
+	for i, m := range a.Metrics {
+		if m.Func != AggCount {
+			metricPaths[i], _ = ParsePath(m.Field)
+		}
+	}
+
+	type state struct {
+		key   map[string]any
+		count int
+		accs  []accumulator
+	}
+	groups := make(map[string]*state)
+	for docKey, doc := range docs {
+		if !a.Filter.Match(docKey, doc) {
+			continue
+		}
+		key := make(map[string]any, len(groupPaths))
+		for i, path := range groupPaths {
+			v, _ := lookupPath(doc, path)
+			key[a.GroupBy[i]] = v
+		}
+		id := groupID(key)
+		g, ok := groups[id]
+		if !ok {
+			g = &state{key: key, accs: make([]accumulator, len(a.Metrics))}
+			groups[id] = g
+		}
+		g.count++
+		for i, path := range metricPaths {
+			if path == nil {
+				continue
+			}
+			if v, ok := lookupPath(doc, path); ok {
+				if f, ok := v.(float64); ok {
+					g.accs[i].add(f)
+				}
+			}
+		}
+	}
+
+	if len(groupPaths) == 0 && len(groups) == 0 {
+		// An ungrouped aggregate always has exactly one row.
+		groups[""] = &state{key: map[string]any{}, accs: make([]accumulator, len(a.Metrics))}
+	}
+
+	result := make([]Group, 0, len(groups))
+	for _, g := range groups {
+		values := make(map[string]any, len(a.Metrics))
+		for i, m := range a.Metrics {
+			if m.Func == AggCount {
+				values[m.Name()] = g.count
+			} else {
+				values[m.Name()] = g.accs[i].value(m.Func)
+			}
+		}
+		result = append(result, Group{Key: g.key, Values: values})
+	}
+	sortGroups(result)
+	return result, nil
+}
+
+// groupID identifies a group key. encoding/json sorts map keys, so equal
+// keys encode identically.
+func groupID(key map[string]any) string {
+	b, _ := json.Marshal(key)
+	return string(b)
+}
+
+// sortGroups orders groups by key so results are deterministic.
+func sortGroups(groups []Group) {
+	sort.Slice(groups, func(i, j int) bool {
+		return groupID(groups[i].Key) < groupID(groups[j].Key)
+	})
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Transactor is implemented by stores that can apply a group of writes
+// atomically.
+type Transactor interface {
+	// Atomically calls fn with a Store whose document and ACL writes take
+	// effect together if fn returns nil and not at all otherwise, including
+	// when fn panics. Changes to schemas, indexes and search fields made
+	// through it are not covered.
+	Atomically(fn func(tx Store) error) error
+}
+
+// Atomically runs fn against s, in a transaction if s is a Transactor.
+// Otherwise the document writes fn makes through Put, PutIfNewer,
+// CompareAndSwap and Delete are undone if it fails, by restoring the
+// documents (and ACLs) it changed; other clients may observe the writes
+// until then. The writes are undone if fn panics too, before the panic
+// continues.
+func Atomically(s Store, fn func(tx Store) error) error {
+	if t, ok := s.(Transactor); ok {
+		return t.Atomically(fn)
+	}
+	j := &journal{Store: s, saved: make(map[docRef]savedDoc)}
+	defer func() {
+		if p := recover(); p != nil {
+			j.rollback()
+			panic(p)
+		}
+	}()
+	err := fn(j)
+	if err != nil {
+		if rerr := j.rollback(); rerr != nil {
+			return errors.Join(err, fmt.Errorf("rolling back: %w", rerr))
+		}
+	}
+	return err
+}
+
+type docRef struct{ collection, key string }
+
+type savedDoc struct {
+	doc, acl map[string]any
+}
+
+// journal records each document as it was before its first write, so that
+// the writes can be undone.
+type journal struct {
+	Store
+	order []docRef
+	saved map[docRef]savedDoc
+}
+
+func (j *journal) save(collection, key string) error {
+	ref := docRef{collection, key}
+	if _, ok := j.saved[ref]; ok {
+		return nil
+	}
+	doc, err := j.Store.Get(collection, key)
+	if err != nil {
+		return err
+	}
+	acl, err := j.Store.GetACL(collection, key)
+	if err != nil {
+		return err
+	}
+	j.saved[ref] = savedDoc{doc: doc, acl: acl}
+	j.order = append(j.order, ref)
+	return nil
+}
+
+// rollback restores the saved documents, most recently touched first.
+func (j *journal) rollback() error {
+	for i := len(j.order) - 1; i >= 0; i-- {
+		ref := j.order[i]
+		saved := j.saved[ref]
+		if saved.doc == nil {
+			if _, err := j.Store.Delete(ref.collection, ref.key); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := j.Store.Put(ref.collection, ref.key, saved.doc); err != nil {
+			return err
+		}
+		if err := j.Store.PutACL(ref.collection, ref.key, saved.acl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *journal) Put(collection, key string, data map[string]any) error {
+	if err := j.save(collection, key); err != nil {
+		return err
+	}
+	return j.Store.Put(collection, key, data)
+}
+
+func (j *journal) PutIfNewer(collection, key string, data map[string]any, pre ...Precondition) (map[string]any, bool, error) {
+	if err := j.save(collection, key); err != nil {
+		return nil, false, err
+	}
+	return j.Store.PutIfNewer(collection, key, data, pre...)
+}
+
+func (j *journal) CompareAndSwap(collection, key, rev string, data map[string]any, pre ...Precondition) (bool, error) {
+	if err := j.save(collection, key); err != nil {
+		return false, err
+	}
+	return j.Store.CompareAndSwap(collection, key, rev, data, pre...)
+}
+
+func (j *journal) Delete(collection, key string, pre ...Precondition) (bool, error) {
+	if err := j.save(collection, key); err != nil {
+		return false, err
+	}
+	return j.Store.Delete(collection, key, pre...)
+}
+
+func (j *journal) PutACL(collection, key string, acl map[string]any) error {
+	if err := j.save(collection, key); err != nil {
+		return err
+	}
+	return j.Store.PutACL(collection, key, acl)
+}
@@ -0,0 +1,335 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Filter operators. OpOr combines filters rather than comparing a field.
+const (
+	OpOr     = "$or"
+	OpEq     = "$eq"
+	OpNe     = "$ne"
+	OpGt     = "$gt"
+	OpGte    = "$gte"
+	OpLt     = "$lt"
+	OpLte    = "$lte"
+	OpIn     = "$in"
+	OpExists = "$exists"
+)
+
+// KeyField is a pseudo field path that compares the document key rather
+// than a field, e.g. {"$key": {"$in": ["a", "b"]}}.
+const KeyField = "$key"
+
+// Condition compares the value found at Path in a document against Value.
+type Condition struct {
+	// Path is the field path, one element per nesting level.
+	Path  []string
+	Op    string
+	Value any
+}
+
+// Filter selects documents matching all of its conditions and, for each
+// group in Or, at least one of the group's filters.
+type Filter struct {
+	Conditions []Condition
+	Or         [][]*Filter
+}
+
+// And returns a filter matching the documents that match every non-nil
+// filter given, or nil if there are none.
+func And(filters ...*Filter) *Filter {
+	var out *Filter
+	for _, f := range filters {
+		if f == nil {
+			continue
+		}
+		if out == nil {
+			out = &Filter{}
+		}
+		out.Conditions = append(out.Conditions, f.Conditions...)
+		out.Or = append(out.Or, f.Or...)
+	}
+	return out
+}
+
+// ParseFilter parses the JSON filter syntax used by collection reads. Each
+// member of the object names a (dot-separated) field path and either a value
+// to compare for equality or an object of operators:
+//
+//	{"status": "open", "priority": {"$gte": 2, "$lt": 5},
+//	 "owner.id": {"$in": ["a", "b"]}, "dueDate": {"$exists": true}}
+//
+// "$key" stands for the document key. A "$or" member holds an array of
+// filters, at least one of which must match as well:
+//
+//	{"status": "open", "$or": [{"owner": "me"}, {"shared": true}]}
+//
+// Range operators compare numbers with numbers and strings with strings; a
+// value of any other type never matches them. $ne also matches documents
+// that lack the field.
+func ParseFilter(s string) (*Filter, error) {
+	var raw map[string]any
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, fmt.Errorf("%w: filter must be a JSON object: %v", ErrInvalidQuery, err)
+	}
+	return parseFilter(raw)
+}
+
+func parseFilter(raw map[string]any) (*Filter, error) {
+	// Sort fields so conditions (and the SQL built from them) are stable.
+	fields := make([]string, 0, len(raw))
+	for field := range raw {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	f := &Filter{}
+	for _, field := range fields {
+		if field == OpOr {
+			group, err := parseOr(raw[field])
+			if err != nil {
+				return nil, err
+			}
+			f.Or = append(f.Or, group)
+			continue
+		}
+		path, err := ParsePath(field)
+		if err != nil {
+			return nil, err
+		}
+		ops, isOps := operators(raw[field])
+		if !isOps {
+			f.Conditions = append(f.Conditions, Condition{Path: path, Op: OpEq, Value: raw[field]})
+			continue
+		}
+		names := make([]string, 0, len(ops))
+		for op := range ops {
+			names = append(names, op)
+		}
+		sort.Strings(names)
+		for _, op := range names {
+			c := Condition{Path: path, Op: op, Value: ops[op]}
+			if err := c.check(); err != nil {
+				return nil, err
+			}
+			f.Conditions = append(f.Conditions, c)
+		}
+	}
+	return f, nil
+}
+
+func parseOr(v any) ([]*Filter, error) {
+	alts, ok := v.([]any)
+	if !ok || len(alts) == 0 {
+		return nil, fmt.Errorf("%w: %s needs a non-empty array of filters", ErrInvalidQuery, OpOr)
+	}
+	group := make([]*Filter, len(alts))
+	for i, alt := range alts {
+		m, ok := alt.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s needs a non-empty array of filters", ErrInvalidQuery, OpOr)
+		}
+		f, err := parseFilter(m)
+		if err != nil {
+			return nil, err
+		}
+		group[i] = f
+	}
+	return group, nil
+}
+
+// ParsePath splits a dot-separated field path.
+func ParsePath(field string) ([]string, error) {
+	path := strings.Split(field, ".")
+	for _, seg := range path {
+		if seg == "" || strings.ContainsAny(seg, `"'`) {
+			return nil, fmt.Errorf("%w: invalid field path %q", ErrInvalidQuery, field)
+		}
+	}
+	return path, nil
+}
+
+// operators reports whether v is an operator object, i.e. a JSON object
+// whose members all start with "$".
+func operators(v any) (map[string]any, bool) {
+	m, ok := v.(map[string]any)
+	if !ok || len(m) == 0 {
+		return nil, false
+	}
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return nil, false
+		}
+	}
+	return m, true
+}
+
+func (c Condition) check() error {
+	switch c.Op {
+	case OpEq, OpNe:
+	case OpGt, OpGte, OpLt, OpLte:
+		switch c.Value.(type) {
+		case float64, string:
+		default:
+			return fmt.Errorf("%w: %s needs a number or string operand", ErrInvalidQuery, c.Op)
+		}
+	case OpIn:
+		if _, ok := c.Value.([]any); !ok {
+			return fmt.Errorf("%w: %s needs an array operand", ErrInvalidQuery, c.Op)
+		}
+	case OpExists:
+		if _, ok := c.Value.(bool); !ok {
+			return fmt.Errorf("%w: %s needs a boolean operand", ErrInvalidQuery, c.Op)
+		}
+	default:
+		return fmt.Errorf("%w: unknown filter operator %q", ErrInvalidQuery, c.Op)
+	}
+	return nil
+}
+
+// Match reports whether the document stored under key satisfies f. A nil
+// filter matches everything.
+func (f *Filter) Match(key string, doc map[string]any) bool {
+	if f == nil {
+		return true
+	}
+	for _, c := range f.Conditions {
+		if !c.Match(key, doc) {
+			return false
+		}
+	}
+	for _, group := range f.Or {
+		if !matchAny(group, key, doc) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(group []*Filter, key string, doc map[string]any) bool {
+	for _, alt := range group {
+		if alt.Match(key, doc) {
+			return true
+		}
+	}
+	return false
+}
+
+// isKeyPath reports whether path is the KeyField pseudo path.
+func isKeyPath(path []string) bool {
+	return len(path) == 1 && path[0] == KeyField
+}
+
+// Match reports whether the document stored under key satisfies c.
+func (c Condition) Match(key string, doc map[string]any) bool {
+	var v any = key
+	ok := true
+	if !isKeyPath(c.Path) {
+		v, ok = lookupPath(doc, c.Path)
+	}
+	switch c.Op {
+	case OpEq:
+		return ok && reflect.DeepEqual(v, c.Value)
+	case OpNe:
+		return !ok || !reflect.DeepEqual(v, c.Value)
+	case OpIn:
+		if !ok {
+			return false
+		}
+		for _, candidate := range c.Value.([]any) {
+			if reflect.DeepEqual(v, candidate) {
+				return true
+			}
+		}
+		return false
+	case OpExists:
+		return ok == c.Value.(bool)
+	}
+	if !ok {
+		return false
+	}
+	cmp, comparable := compareValues(v, c.Value)
+	if !comparable {
+		return false
+	}
+	switch c.Op {
+	case OpGt:
+		return cmp > 0
+	case OpGte:
+		return cmp >= 0
+	case OpLt:
+		return cmp < 0
+	case OpLte:
+		return cmp <= 0
+	}
+	return false
+}
+
+// compareValues orders two numbers or two strings.
+func compareValues(a, b any) (int, bool) {
+	switch av := a.(type) {
+	case float64:
+		bv, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av < bv:
+			return -1, true
+		case av > bv:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(av, bv), true
+	}
+	return 0, false
+}
+
+// lookupPath returns the value at path within doc.
+func lookupPath(doc map[string]any, path []string) (any, bool) {
+	var cur any = doc
+	for _, seg := range path {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		cur, ok = m[seg]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// project returns a copy of doc reduced to the given field paths, keeping
+// their nesting. Paths absent from doc are skipped.
+func project(doc map[string]any, fields [][]string) map[string]any {
+	out := make(map[string]any)
+	for _, path := range fields {
+		v, ok := lookupPath(doc, path)
+		if !ok {
+			continue
+		}
+		dst := out
+		for _, seg := range path[:len(path)-1] {
+			next, ok := dst[seg].(map[string]any)
+			if !ok {
+				next = make(map[string]any)
+				dst[seg] = next
+			}
+			dst = next
+		}
+		dst[path[len(path)-1]] = v
+	}
+	return out
+}
@@ -0,0 +1,237 @@
+package store
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// Index states reported by ListIndexes.
+const (
+	IndexBuilding = "building"
+	IndexReady    = "ready"
+)
+
+// Index describes a secondary index declared on a collection.
+type Index struct {
+	Field string `json:"field"`
+	State string `json:"state"`
+}
+
+// fieldIndex maps the JSON encoding of every scalar value found at a field
+// path to the keys of the documents holding it.
+type fieldIndex struct {
+	path    []string
+	ready   bool
+	entries map[string]map[string]struct{}
+
+	// written holds the keys written while the index is building, which
+	// install brings up to date.
+	written map[string]struct{}
+}
+
+// indexValue returns the index entry for a value, or false for objects and
+// arrays, which are not indexed.
+func indexValue(v any) (string, bool) {
+	switch v.(type) {
+	case map[string]any, []any:
+		return "", false
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+func (ix *fieldIndex) add(key string, doc map[string]any) {
+	v, ok := lookupPath(doc, ix.path)
+	if !ok {
+		return
+	}
+	entry, ok := indexValue(v)
+	if !ok {
+		return
+	}
+	keys, ok := ix.entries[entry]
+	if !ok {
+		keys = make(map[string]struct{})
+		ix.entries[entry] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+func (ix *fieldIndex) remove(key string, doc map[string]any) {
+	v, ok := lookupPath(doc, ix.path)
+	if !ok {
+		return
+	}
+	entry, ok := indexValue(v)
+	if !ok {
+		return
+	}
+	delete(ix.entries[entry], key)
+	if len(ix.entries[entry]) == 0 {
+		delete(ix.entries, entry)
+	}
+}
+
+// indexSet holds the in-process secondary indexes of every collection. It is
+// used by the backends without native indexing and is guarded by their lock.
+type indexSet map[string]map[string]*fieldIndex
+
+// declare registers an index and reports whether it is new. New indexes
+// start out building; call build to populate them.
+func (s indexSet) declare(collection, field string) bool {
+	if _, ok := s[collection][field]; ok {
+		return false
+	}
+	path, _ := ParsePath(field)
+	if s[collection] == nil {
+		s[collection] = make(map[string]*fieldIndex)
+	}
+	s[collection][field] = &fieldIndex{path: path, written: make(map[string]struct{})}
+	return true
+}
+
+// build (re)populates an index from the full contents of its collection and
+// marks it ready.
+func (s indexSet) build(collection, field string, docs map[string]map[string]any) {
+	ix, ok := s[collection][field]
+	if !ok {
+		return
+	}
+	ix.entries = make(map[string]map[string]struct{})
+	for key, doc := range docs {
+		ix.add(key, doc)
+	}
+	ix.ready, ix.written = true, nil
+}
+
+// entriesOf computes the entries of an index on path over docs. It touches
+// no indexSet, so it can run without the store lock.
+func entriesOf(path []string, docs map[string]map[string]any) map[string]map[string]struct{} {
+	ix := &fieldIndex{path: path, entries: make(map[string]map[string]struct{})}
+	for key, doc := range docs {
+		ix.add(key, doc)
+	}
+	return ix.entries
+}
+
+// install marks ready the index ix declared on field, with entries computed
+// by entriesOf from snapshot, an earlier copy of the collection. The keys
+// written since are re-indexed from docs, the collection's current
+// contents. It does nothing if the index was dropped meanwhile.
+func (s indexSet) install(collection, field string, ix *fieldIndex, entries map[string]map[string]struct{}, snapshot, docs map[string]map[string]any) {
+	if s[collection][field] != ix {
+		return
+	}
+	ix.entries = entries
+	for key := range ix.written {
+		if old, ok := snapshot[key]; ok {
+			ix.remove(key, old)
+		}
+		if doc, ok := docs[key]; ok {
+			ix.add(key, doc)
+		}
+	}
+	ix.ready, ix.written = true, nil
+}
+
+func (s indexSet) drop(collection, field string) bool {
+	if _, ok := s[collection][field]; !ok {
+		return false
+	}
+	delete(s[collection], field)
+	return true
+}
+
+func (s indexSet) list(collection string) []Index {
+	result := make([]Index, 0, len(s[collection]))
+	for field, ix := range s[collection] {
+		state := IndexBuilding
+		if ix.ready {
+			state = IndexReady
+		}
+		result = append(result, Index{Field: field, State: state})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Field < result[j].Field })
+	return result
+}
+
+// update maintains the ready indexes of a collection for a write that
+// replaced old with doc (either may be nil).
+func (s indexSet) update(collection, key string, old, doc map[string]any) {
+	for _, ix := range s[collection] {
+		if !ix.ready {
+			if ix.written != nil {
+				ix.written[key] = struct{}{}
+			}
+			continue
+		}
+		if old != nil {
+			ix.remove(key, old)
+		}
+		if doc != nil {
+			ix.add(key, doc)
+		}
+	}
+}
+
+// candidates narrows docs using the ready indexes that serve the equality
+// and $in conditions of f. It returns docs unchanged when no index applies.
+func (s indexSet) candidates(collection string, docs map[string]map[string]any, f *Filter) map[string]map[string]any {
+	if f == nil {
+		return docs
+	}
+	var keys map[string]struct{}
+	for _, c := range f.Conditions {
+		ix, ok := s[collection][strings.Join(c.Path, ".")]
+		if !ok || !ix.ready {
+			continue
+		}
+		var values []any
+		switch c.Op {
+		case OpEq:
+			values = []any{c.Value}
+		case OpIn:
+			values = c.Value.([]any)
+		default:
+			continue
+		}
+		matched := make(map[string]struct{})
+		usable := true
+		for _, v := range values {
+			entry, ok := indexValue(v)
+			if !ok {
+				usable = false
+				break
+			}
+			for k := range ix.entries[entry] {
+				matched[k] = struct{}{}
+			}
+		}
+		if !usable {
+			continue
+		}
+		if keys == nil {
+			keys = matched
+			continue
+		}
+		for k := range keys {
+			if _, ok := matched[k]; !ok {
+				delete(keys, k)
+			}
+		}
+	}
+	if keys == nil {
+		return docs
+	}
+	result := make(map[string]map[string]any, len(keys))
+	for k := range keys {
+		if doc, ok := docs[k]; ok {
+			result[k] = doc
+		}
+	}
+	return result
+}
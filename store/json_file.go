@@ -14,19 +14,72 @@ import (
 // Layout:
 //
 //	data_dir/
-//	  _schemas.json   # schema registry
-//	  notes.json      # "notes" collection
-//	  tasks.json      # "tasks" collection
+//	  _schemas.json          # schema registry
+//	  _schema_versions.json  # every version of each schema
+//	  _schema_deleted.json   # the last deleted version of each schema
+//	  _indexes.json          # declared secondary indexes
+//	  _search.json           # searchable fields per collection
+//	  _apikeys.json          # API key records
+//	  notes.json             # "notes" collection
+//	  tasks.json             # "tasks" collection
+//
+// Secondary indexes are held in memory and rebuilt in the background when
+// the store is opened. Full-text indexes are built on the first search.
+// ACLs are indexed by entry when the store is opened.
 type JsonFileStore struct {
-	mu  sync.RWMutex
-	dir string
+	mu       sync.RWMutex
+	dir      string
+	indexes  indexSet
+	search   searchSet
+	aclIndex aclIndex
 }
 
 func NewJsonFileStore(dir string) (*JsonFileStore, error) {
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return nil, err
 	}
-	return &JsonFileStore{dir: dir}, nil
+	s := &JsonFileStore{dir: dir, indexes: make(indexSet), search: make(searchSet), aclIndex: make(aclIndex)}
+	acls, err := s.loadFile(s.aclsPath())
+	if err != nil {
+		return nil, err
+	}
+	for collection, raw := range acls {
+		byKey, _ := raw.(map[string]any)
+		for key, acl := range byKey {
+			acl, _ := acl.(map[string]any)
+			s.aclIndex.update(collection, key, nil, acl)
+		}
+	}
+	searchable, err := s.loadFile(s.searchPath())
+	if err != nil {
+		return nil, err
+	}
+	for collection, raw := range searchable {
+		var fields []string
+		list, _ := raw.([]any)
+		for _, f := range list {
+			if field, ok := f.(string); ok {
+				fields = append(fields, field)
+			}
+		}
+		if err := s.search.configure(collection, fields); err != nil {
+			return nil, err
+		}
+	}
+	declared, err := s.loadFile(s.indexesPath())
+	if err != nil {
+		return nil, err
+	}
+	for collection, raw := range declared {
+		fields, _ := raw.([]any)
+		for _, f := range fields {
+			if field, ok := f.(string); ok {
+				s.indexes.declare(collection, field)
+				go s.buildIndex(collection, field)
+			}
+		}
+	}
+	return s, nil
 }
 
 func (s *JsonFileStore) collectionPath(collection string) string {
@@ -37,6 +90,30 @@ func (s *JsonFileStore) schemasPath() string {
 	return filepath.Join(s.dir, "_schemas.json")
 }
 
+func (s *JsonFileStore) schemaVersionsPath() string {
+	return filepath.Join(s.dir, "_schema_versions.json")
+}
+
+func (s *JsonFileStore) schemaDeletedPath() string {
+	return filepath.Join(s.dir, "_schema_deleted.json")
+}
+
+func (s *JsonFileStore) indexesPath() string {
+	return filepath.Join(s.dir, "_indexes.json")
+}
+
+func (s *JsonFileStore) apiKeysPath() string {
+	return filepath.Join(s.dir, "_apikeys.json")
+}
+
+func (s *JsonFileStore) aclsPath() string {
+	return filepath.Join(s.dir, "_acls.json")
+}
+
+func (s *JsonFileStore) searchPath() string {
+	return filepath.Join(s.dir, "_search.json")
+}
+
 func (s *JsonFileStore) loadFile(path string) (map[string]any, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -95,6 +172,26 @@ func (s *JsonFileStore) Get(collection, key string) (map[string]any, error) {
 	return doc, nil
 }
 
+func (s *JsonFileStore) Query(collection string, q Query) (*Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	coll, err := s.loadCollection(s.collectionPath(collection))
+	if err != nil {
+		return nil, err
+	}
+	return runQuery(s.indexes.candidates(collection, coll, q.Filter), q)
+}
+
+func (s *JsonFileStore) Aggregate(collection string, a Aggregation) ([]Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	coll, err := s.loadCollection(s.collectionPath(collection))
+	if err != nil {
+		return nil, err
+	}
+	return runAggregate(s.indexes.candidates(collection, coll, a.Filter), a)
+}
+
 func (s *JsonFileStore) Put(collection, key string, data map[string]any) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -103,11 +200,17 @@ func (s *JsonFileStore) Put(collection, key string, data map[string]any) error {
 	if err != nil {
 		return err
 	}
+	old := coll[key]
 	coll[key] = data
-	return s.saveFile(path, coll)
+	if err := s.saveFile(path, coll); err != nil {
+		return err
+	}
+	s.indexes.update(collection, key, old, data)
+	s.search.update(collection, key, data)
+	return nil
 }
 
-func (s *JsonFileStore) PutIfNewer(collection, key string, data map[string]any) (map[string]any, bool, error) {
+func (s *JsonFileStore) PutIfNewer(collection, key string, data map[string]any, pre ...Precondition) (map[string]any, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	path := s.collectionPath(collection)
@@ -115,19 +218,23 @@ func (s *JsonFileStore) PutIfNewer(collection, key string, data map[string]any)
 	if err != nil {
 		return nil, false, err
 	}
-	if existing, ok := coll[key]; ok {
-		if !IsNewer(data, existing) {
-			return existing, false, nil
-		}
+	existing, ok := coll[key]
+	if err := checkPreconditions(existing, pre); err != nil {
+		return nil, false, err
+	}
+	if ok && !IsNewer(data, existing) {
+		return existing, false, nil
 	}
 	coll[key] = data
 	if err := s.saveFile(path, coll); err != nil {
 		return nil, false, err
 	}
+	s.indexes.update(collection, key, existing, data)
+	s.search.update(collection, key, data)
 	return data, true, nil
 }
 
-func (s *JsonFileStore) Delete(collection, key string) (bool, error) {
+func (s *JsonFileStore) Delete(collection, key string, pre ...Precondition) (bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	path := s.collectionPath(collection)
@@ -135,11 +242,90 @@ func (s *JsonFileStore) Delete(collection, key string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	if _, ok := coll[key]; !ok {
+	existing, ok := coll[key]
+	if err := checkPreconditions(existing, pre); err != nil {
+		return false, err
+	}
+	if !ok {
 		return false, nil
 	}
 	delete(coll, key)
-	return true, s.saveFile(path, coll)
+	if err := s.saveFile(path, coll); err != nil {
+		return false, err
+	}
+	s.indexes.update(collection, key, existing, nil)
+	s.search.update(collection, key, nil)
+	return true, s.putACL(collection, key, nil)
+}
+
+func (s *JsonFileStore) CompareAndSwap(collection, key, rev string, data map[string]any, pre ...Precondition) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.collectionPath(collection)
+	coll, err := s.loadCollection(path)
+	if err != nil {
+		return false, err
+	}
+	existing := coll[key]
+	if err := checkPreconditions(existing, pre); err != nil {
+		return false, err
+	}
+	if Revision(existing) != rev {
+		return false, nil
+	}
+	if data == nil && existing == nil {
+		return true, nil
+	}
+	if data == nil {
+		delete(coll, key)
+	} else {
+		coll[key] = data
+	}
+	if err := s.saveFile(path, coll); err != nil {
+		return false, err
+	}
+	s.indexes.update(collection, key, existing, data)
+	s.search.update(collection, key, data)
+	if data == nil {
+		return true, s.putACL(collection, key, nil)
+	}
+	return true, nil
+}
+
+func (s *JsonFileStore) Stats(collection string) (Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	coll, err := s.loadCollection(s.collectionPath(collection))
+	if err != nil {
+		return Stats{}, err
+	}
+	return statsOf(coll), nil
+}
+
+func (s *JsonFileStore) DropCollection(collection string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(s.collectionPath(collection))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	existed := err == nil
+	if err := s.dropACLs(collection); err != nil {
+		return existed, err
+	}
+	if _, ok := s.indexes[collection]; ok {
+		delete(s.indexes, collection)
+		if err := s.saveIndexes(); err != nil {
+			return existed, err
+		}
+	}
+	if _, ok := s.search[collection]; ok {
+		delete(s.search, collection)
+		if err := s.saveSearch(); err != nil {
+			return existed, err
+		}
+	}
+	return existed, nil
 }
 
 func (s *JsonFileStore) ListCollections() ([]string, error) {
@@ -167,6 +353,97 @@ func (s *JsonFileStore) ListCollections() ([]string, error) {
 	return names, nil
 }
 
+func (s *JsonFileStore) EnsureIndex(collection, field string) error {
+	if _, err := ParsePath(field); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.indexes.declare(collection, field) {
+		return nil
+	}
+	if err := s.saveIndexes(); err != nil {
+		s.indexes.drop(collection, field)
+		return err
+	}
+	go s.buildIndex(collection, field)
+	return nil
+}
+
+// buildIndex populates a declared index from the collection file.
+func (s *JsonFileStore) buildIndex(collection, field string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	coll, err := s.loadCollection(s.collectionPath(collection))
+	if err != nil {
+		return // stays "building" until the store is reopened
+	}
+	s.indexes.build(collection, field, coll)
+}
+
+func (s *JsonFileStore) DropIndex(collection, field string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.indexes.drop(collection, field) {
+		return false, nil
+	}
+	return true, s.saveIndexes()
+}
+
+func (s *JsonFileStore) ListIndexes(collection string) ([]Index, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.indexes.list(collection), nil
+}
+
+// saveIndexes persists the index declarations.
+func (s *JsonFileStore) saveIndexes() error {
+	declared := make(map[string][]string, len(s.indexes))
+	for collection := range s.indexes {
+		for _, ix := range s.indexes.list(collection) {
+			declared[collection] = append(declared[collection], ix.Field)
+		}
+	}
+	return s.saveFile(s.indexesPath(), declared)
+}
+
+func (s *JsonFileStore) SetSearchFields(collection string, fields []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.search.configure(collection, fields); err != nil {
+		return err
+	}
+	return s.saveSearch()
+}
+
+// saveSearch persists the searchable fields of every collection.
+func (s *JsonFileStore) saveSearch() error {
+	searchable := make(map[string][]string, len(s.search))
+	for name := range s.search {
+		searchable[name] = s.search.fields(name)
+	}
+	return s.saveFile(s.searchPath(), searchable)
+}
+
+func (s *JsonFileStore) SearchFields(collection string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.search.fields(collection), nil
+}
+
+// Search takes the write lock because the first search of a collection
+// builds its index.
+func (s *JsonFileStore) Search(collection, query string, limit int) ([]SearchHit, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	coll, err := s.loadCollection(s.collectionPath(collection))
+	if err != nil {
+		return nil, err
+	}
+	s.search.build(collection, coll)
+	return s.search.search(collection, query, limit, coll)
+}
+
 func (s *JsonFileStore) GetSchema(collection string) (map[string]any, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -192,10 +469,60 @@ func (s *JsonFileStore) PutSchema(collection string, schema map[string]any) erro
 	if err != nil {
 		return err
 	}
+	all, err := s.loadFile(s.schemaVersionsPath())
+	if err != nil {
+		return err
+	}
+	all[collection] = append(s.schemaVersions(schemas, all, collection), schema)
+	if err := s.saveFile(s.schemaVersionsPath(), all); err != nil {
+		return err
+	}
 	schemas[collection] = schema
 	return s.saveFile(path, schemas)
 }
 
+func (s *JsonFileStore) SchemaVersions(collection string) (int, []map[string]any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	schemas, err := s.loadFile(s.schemasPath())
+	if err != nil {
+		return 0, nil, err
+	}
+	all, err := s.loadFile(s.schemaVersionsPath())
+	if err != nil {
+		return 0, nil, err
+	}
+	deleted, err := s.loadFile(s.schemaDeletedPath())
+	if err != nil {
+		return 0, nil, err
+	}
+	versions := []map[string]any{}
+	for _, v := range s.schemaVersions(schemas, all, collection) {
+		versions = append(versions, v.(map[string]any))
+	}
+	last, _ := deleted[collection].(float64)
+	return int(last) + 1, versions, nil
+}
+
+// schemaVersions returns the versions of a collection's schema from the
+// contents of the schema files. A schema saved before versions were kept
+// is its only version.
+func (s *JsonFileStore) schemaVersions(schemas, all map[string]any, collection string) []any {
+	var versions []any
+	list, _ := all[collection].([]any)
+	for _, v := range list {
+		if schema, ok := v.(map[string]any); ok {
+			versions = append(versions, schema)
+		}
+	}
+	if len(versions) == 0 {
+		if schema, ok := schemas[collection].(map[string]any); ok {
+			versions = append(versions, schema)
+		}
+	}
+	return versions
+}
+
 func (s *JsonFileStore) DeleteSchema(collection string) (bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -207,6 +534,25 @@ func (s *JsonFileStore) DeleteSchema(collection string) (bool, error) {
 	if _, ok := schemas[collection]; !ok {
 		return false, nil
 	}
+	all, err := s.loadFile(s.schemaVersionsPath())
+	if err != nil {
+		return false, err
+	}
+	deleted, err := s.loadFile(s.schemaDeletedPath())
+	if err != nil {
+		return false, err
+	}
+	last, _ := deleted[collection].(float64)
+	deleted[collection] = last + float64(len(s.schemaVersions(schemas, all, collection)))
+	if err := s.saveFile(s.schemaDeletedPath(), deleted); err != nil {
+		return false, err
+	}
+	if _, ok := all[collection]; ok {
+		delete(all, collection)
+		if err := s.saveFile(s.schemaVersionsPath(), all); err != nil {
+			return false, err
+		}
+	}
 	delete(schemas, collection)
 	return true, s.saveFile(path, schemas)
 }
@@ -226,3 +572,174 @@ func (s *JsonFileStore) ListSchemas() (map[string]map[string]any, error) {
 	}
 	return result, nil
 }
+
+func (s *JsonFileStore) GetAPIKey(id string) (map[string]any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys, err := s.loadFile(s.apiKeysPath())
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := keys[id]
+	if !ok {
+		return nil, nil
+	}
+	if key, ok := raw.(map[string]any); ok {
+		return key, nil
+	}
+	return nil, nil
+}
+
+func (s *JsonFileStore) PutAPIKey(id string, key map[string]any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.apiKeysPath()
+	keys, err := s.loadFile(path)
+	if err != nil {
+		return err
+	}
+	keys[id] = key
+	return s.saveFile(path, keys)
+}
+
+func (s *JsonFileStore) DeleteAPIKey(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.apiKeysPath()
+	keys, err := s.loadFile(path)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := keys[id]; !ok {
+		return false, nil
+	}
+	delete(keys, id)
+	return true, s.saveFile(path, keys)
+}
+
+func (s *JsonFileStore) ListAPIKeys() (map[string]map[string]any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	raw, err := s.loadFile(s.apiKeysPath())
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]map[string]any, len(raw))
+	for k, v := range raw {
+		if key, ok := v.(map[string]any); ok {
+			result[k] = key
+		}
+	}
+	return result, nil
+}
+
+// loadACLs reads the ACLs of a collection from the ACL file, which maps
+// collection -> key -> ACL.
+func (s *JsonFileStore) loadACLs(collection string) (map[string]any, map[string]any, error) {
+	all, err := s.loadFile(s.aclsPath())
+	if err != nil {
+		return nil, nil, err
+	}
+	acls, _ := all[collection].(map[string]any)
+	if acls == nil {
+		acls = map[string]any{}
+	}
+	return all, acls, nil
+}
+
+func (s *JsonFileStore) GetACL(collection, key string) (map[string]any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, acls, err := s.loadACLs(collection)
+	if err != nil {
+		return nil, err
+	}
+	acl, _ := acls[key].(map[string]any)
+	return acl, nil
+}
+
+func (s *JsonFileStore) PutACL(collection, key string, acl map[string]any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.putACL(collection, key, acl)
+}
+
+// putACL writes or (for nil) removes an ACL; the caller holds the lock.
+func (s *JsonFileStore) putACL(collection, key string, acl map[string]any) error {
+	all, acls, err := s.loadACLs(collection)
+	if err != nil {
+		return err
+	}
+	old, _ := acls[key].(map[string]any)
+	if acl == nil {
+		if _, ok := acls[key]; !ok {
+			return nil
+		}
+		delete(acls, key)
+	} else {
+		acls[key] = acl
+	}
+	if len(acls) == 0 {
+		delete(all, collection)
+	} else {
+		all[collection] = acls
+	}
+	if err := s.saveFile(s.aclsPath(), all); err != nil {
+		return err
+	}
+	s.aclIndex.update(collection, key, old, acl)
+	return nil
+}
+
+// dropACLs removes every ACL of a collection; the caller holds the lock.
+func (s *JsonFileStore) dropACLs(collection string) error {
+	all, err := s.loadFile(s.aclsPath())
+	if err != nil {
+		return err
+	}
+	if _, ok := all[collection]; !ok {
+		return nil
+	}
+	delete(all, collection)
+	if err := s.saveFile(s.aclsPath(), all); err != nil {
+		return err
+	}
+	delete(s.aclIndex, collection)
+	return nil
+}
+
+func (s *JsonFileStore) ListACLs(collection string) (map[string]map[string]any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, acls, err := s.loadACLs(collection)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]map[string]any, len(acls))
+	for k, v := range acls {
+		if acl, ok := v.(map[string]any); ok {
+			result[k] = acl
+		}
+	}
+	return result, nil
+}
+
+func (s *JsonFileStore) ListACLsFor(collection string, names []string) (map[string]map[string]any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make(map[string]map[string]any)
+	keys := s.aclIndex.keys(collection, names)
+	if len(keys) == 0 {
+		return result, nil
+	}
+	_, acls, err := s.loadACLs(collection)
+	if err != nil {
+		return nil, err
+	}
+	for key := range keys {
+		if acl, ok := acls[key].(map[string]any); ok {
+			result[key] = acl
+		}
+	}
+	return result, nil
+}
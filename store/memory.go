@@ -2,8 +2,11 @@ package store
 
 import (
 	"encoding/json"
+	"maps"
 	"sort"
 	"sync"
+
+	"github.com/stevemurr/simple-sync-server/internal/jsonvalue"
 )
 
 // MemoryStore keeps everything in memory. Data is lost on restart.
@@ -11,25 +14,45 @@ import (
 type MemoryStore struct {
 	mu          sync.RWMutex
 	collections map[string]map[string]map[string]any
-	schemas     map[string]map[string]any
+	schemas     map[string][]map[string]any // every version, oldest first
+	deleted     map[string]int              // the last deleted schema version
+	indexes     indexSet
+	search      searchSet
+	apiKeys     map[string]map[string]any
+	acls        map[string]map[string]map[string]any
+	aclIndex    aclIndex
 }
 
 func NewMemoryStore() *MemoryStore {
 	return &MemoryStore{
 		collections: make(map[string]map[string]map[string]any),
-		schemas:     make(map[string]map[string]any),
+		schemas:     make(map[string][]map[string]any),
+		deleted:     make(map[string]int),
+		indexes:     make(indexSet),
+		search:      make(searchSet),
+		apiKeys:     make(map[string]map[string]any),
+		acls:        make(map[string]map[string]map[string]any),
+		aclIndex:    make(aclIndex),
 	}
 }
 
-// deepCopy returns a deep copy of a document by round-tripping through JSON.
-func deepCopy(src map[string]any) map[string]any {
-	if src == nil {
+// copyDoc returns a deep copy of a stored document.
+func copyDoc(doc map[string]any) map[string]any {
+	c, _ := jsonvalue.Copy(doc).(map[string]any)
+	return c
+}
+
+// jsonCopy copies a document being written by round-tripping it through
+// JSON, so that it reads back as it would from the other backends (Go ints
+// become float64, structs become maps).
+func jsonCopy(doc map[string]any) map[string]any {
+	if doc == nil {
 		return nil
 	}
-	b, _ := json.Marshal(src)
-	var dst map[string]any
-	_ = json.Unmarshal(b, &dst)
-	return dst
+	b, _ := json.Marshal(doc)
+	var c map[string]any
+	_ = json.Unmarshal(b, &c)
+	return c
 }
 
 func (m *MemoryStore) GetAll(collection string) (map[string]map[string]any, error) {
@@ -41,7 +64,7 @@ func (m *MemoryStore) GetAll(collection string) (map[string]map[string]any, erro
 	}
 	result := make(map[string]map[string]any, len(coll))
 	for k, v := range coll {
-		result[k] = deepCopy(v)
+		result[k] = copyDoc(v)
 	}
 	return result, nil
 }
@@ -57,7 +80,35 @@ func (m *MemoryStore) Get(collection, key string) (map[string]any, error) {
 	if !ok {
 		return nil, nil
 	}
-	return deepCopy(doc), nil
+	return copyDoc(doc), nil
+}
+
+func (m *MemoryStore) Query(collection string, q Query) (*Page, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	docs := m.indexes.candidates(collection, m.collections[collection], q.Filter)
+	page, err := runQuery(docs, q)
+	if err != nil {
+		return nil, err
+	}
+	for i := range page.Items {
+		page.Items[i].Data = copyDoc(page.Items[i].Data)
+	}
+	return page, nil
+}
+
+func (m *MemoryStore) Aggregate(collection string, a Aggregation) ([]Group, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	groups, err := runAggregate(m.indexes.candidates(collection, m.collections[collection], a.Filter), a)
+	if err != nil {
+		return nil, err
+	}
+	// Group keys may reference stored objects.
+	for i := range groups {
+		groups[i].Key = copyDoc(groups[i].Key)
+	}
+	return groups, nil
 }
 
 func (m *MemoryStore) Put(collection, key string, data map[string]any) error {
@@ -66,41 +117,106 @@ func (m *MemoryStore) Put(collection, key string, data map[string]any) error {
 	if _, ok := m.collections[collection]; !ok {
 		m.collections[collection] = make(map[string]map[string]any)
 	}
-	m.collections[collection][key] = deepCopy(data)
+	doc := jsonCopy(data)
+	m.indexes.update(collection, key, m.collections[collection][key], doc)
+	m.search.update(collection, key, doc)
+	m.collections[collection][key] = doc
 	return nil
 }
 
-func (m *MemoryStore) PutIfNewer(collection, key string, data map[string]any) (map[string]any, bool, error) {
+func (m *MemoryStore) PutIfNewer(collection, key string, data map[string]any, pre ...Precondition) (map[string]any, bool, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if err := checkPreconditions(m.collections[collection][key], pre); err != nil {
+		return nil, false, err
+	}
 	coll, ok := m.collections[collection]
 	if ok {
 		if existing, exists := coll[key]; exists {
 			if !IsNewer(data, existing) {
-				return deepCopy(existing), false, nil
+				return copyDoc(existing), false, nil
 			}
 		}
 	} else {
 		m.collections[collection] = make(map[string]map[string]any)
 	}
-	m.collections[collection][key] = deepCopy(data)
-	return deepCopy(data), true, nil
+	doc := jsonCopy(data)
+	m.indexes.update(collection, key, m.collections[collection][key], doc)
+	m.search.update(collection, key, doc)
+	m.collections[collection][key] = doc
+	return copyDoc(doc), true, nil
 }
 
-func (m *MemoryStore) Delete(collection, key string) (bool, error) {
+func (m *MemoryStore) Delete(collection, key string, pre ...Precondition) (bool, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if err := checkPreconditions(m.collections[collection][key], pre); err != nil {
+		return false, err
+	}
 	coll, ok := m.collections[collection]
 	if !ok {
 		return false, nil
 	}
-	if _, exists := coll[key]; !exists {
+	existing, exists := coll[key]
+	if !exists {
 		return false, nil
 	}
+	m.indexes.update(collection, key, existing, nil)
+	m.search.update(collection, key, nil)
 	delete(coll, key)
+	m.aclIndex.update(collection, key, m.acls[collection][key], nil)
+	delete(m.acls[collection], key)
+	return true, nil
+}
+
+func (m *MemoryStore) CompareAndSwap(collection, key, rev string, data map[string]any, pre ...Precondition) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing := m.collections[collection][key]
+	if err := checkPreconditions(existing, pre); err != nil {
+		return false, err
+	}
+	if Revision(existing) != rev {
+		return false, nil
+	}
+	if data == nil {
+		if existing != nil {
+			m.indexes.update(collection, key, existing, nil)
+			m.search.update(collection, key, nil)
+			delete(m.collections[collection], key)
+			m.aclIndex.update(collection, key, m.acls[collection][key], nil)
+			delete(m.acls[collection], key)
+		}
+		return true, nil
+	}
+	if _, ok := m.collections[collection]; !ok {
+		m.collections[collection] = make(map[string]map[string]any)
+	}
+	doc := jsonCopy(data)
+	m.indexes.update(collection, key, existing, doc)
+	m.search.update(collection, key, doc)
+	m.collections[collection][key] = doc
 	return true, nil
 }
 
+func (m *MemoryStore) Stats(collection string) (Stats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return statsOf(m.collections[collection]), nil
+}
+
+func (m *MemoryStore) DropCollection(collection string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, existed := m.collections[collection]
+	delete(m.collections, collection)
+	delete(m.indexes, collection)
+	delete(m.search, collection)
+	delete(m.acls, collection)
+	delete(m.aclIndex, collection)
+	return existed, nil
+}
+
 func (m *MemoryStore) ListCollections() ([]string, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -114,29 +230,108 @@ func (m *MemoryStore) ListCollections() ([]string, error) {
 	return names, nil
 }
 
+func (m *MemoryStore) EnsureIndex(collection, field string) error {
+	if _, err := ParsePath(field); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.indexes.declare(collection, field) {
+		return nil
+	}
+	if len(m.collections[collection]) == 0 {
+		m.indexes.build(collection, field, nil)
+		return nil
+	}
+	// Build from a copy of the collection without the lock, so reads and
+	// writes go on meanwhile; install catches up with the keys they wrote.
+	ix := m.indexes[collection][field]
+	snapshot := maps.Clone(m.collections[collection])
+	go func() {
+		entries := entriesOf(ix.path, snapshot)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.indexes.install(collection, field, ix, entries, snapshot, m.collections[collection])
+	}()
+	return nil
+}
+
+func (m *MemoryStore) DropIndex(collection, field string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.indexes.drop(collection, field), nil
+}
+
+func (m *MemoryStore) ListIndexes(collection string) ([]Index, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.indexes.list(collection), nil
+}
+
+func (m *MemoryStore) SetSearchFields(collection string, fields []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.search.configure(collection, fields); err != nil {
+		return err
+	}
+	m.search.build(collection, m.collections[collection])
+	return nil
+}
+
+func (m *MemoryStore) SearchFields(collection string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.search.fields(collection), nil
+}
+
+func (m *MemoryStore) Search(collection, query string, limit int) ([]SearchHit, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	hits, err := m.search.search(collection, query, limit, m.collections[collection])
+	if err != nil {
+		return nil, err
+	}
+	for i := range hits {
+		hits[i].Data = copyDoc(hits[i].Data)
+	}
+	return hits, nil
+}
+
 func (m *MemoryStore) GetSchema(collection string) (map[string]any, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	s, ok := m.schemas[collection]
+	versions, ok := m.schemas[collection]
 	if !ok {
 		return nil, nil
 	}
-	return deepCopy(s), nil
+	return copyDoc(versions[len(versions)-1]), nil
 }
 
 func (m *MemoryStore) PutSchema(collection string, schema map[string]any) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.schemas[collection] = deepCopy(schema)
+	m.schemas[collection] = append(m.schemas[collection], jsonCopy(schema))
 	return nil
 }
 
+func (m *MemoryStore) SchemaVersions(collection string) (int, []map[string]any, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	versions := make([]map[string]any, len(m.schemas[collection]))
+	for i, v := range m.schemas[collection] {
+		versions[i] = copyDoc(v)
+	}
+	return m.deleted[collection] + 1, versions, nil
+}
+
 func (m *MemoryStore) DeleteSchema(collection string) (bool, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if _, ok := m.schemas[collection]; !ok {
+	versions, ok := m.schemas[collection]
+	if !ok {
 		return false, nil
 	}
+	m.deleted[collection] += len(versions)
 	delete(m.schemas, collection)
 	return true, nil
 }
@@ -145,8 +340,87 @@ func (m *MemoryStore) ListSchemas() (map[string]map[string]any, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	result := make(map[string]map[string]any, len(m.schemas))
-	for k, v := range m.schemas {
-		result[k] = deepCopy(v)
+	for k, versions := range m.schemas {
+		result[k] = copyDoc(versions[len(versions)-1])
+	}
+	return result, nil
+}
+
+func (m *MemoryStore) GetAPIKey(id string) (map[string]any, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	k, ok := m.apiKeys[id]
+	if !ok {
+		return nil, nil
+	}
+	return copyDoc(k), nil
+}
+
+func (m *MemoryStore) PutAPIKey(id string, key map[string]any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apiKeys[id] = jsonCopy(key)
+	return nil
+}
+
+func (m *MemoryStore) DeleteAPIKey(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.apiKeys[id]; !ok {
+		return false, nil
+	}
+	delete(m.apiKeys, id)
+	return true, nil
+}
+
+func (m *MemoryStore) ListAPIKeys() (map[string]map[string]any, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := make(map[string]map[string]any, len(m.apiKeys))
+	for k, v := range m.apiKeys {
+		result[k] = copyDoc(v)
+	}
+	return result, nil
+}
+
+func (m *MemoryStore) GetACL(collection, key string) (map[string]any, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return copyDoc(m.acls[collection][key]), nil
+}
+
+func (m *MemoryStore) PutACL(collection, key string, acl map[string]any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	acl = jsonCopy(acl)
+	m.aclIndex.update(collection, key, m.acls[collection][key], acl)
+	if acl == nil {
+		delete(m.acls[collection], key)
+		return nil
+	}
+	if m.acls[collection] == nil {
+		m.acls[collection] = make(map[string]map[string]any)
+	}
+	m.acls[collection][key] = acl
+	return nil
+}
+
+func (m *MemoryStore) ListACLs(collection string) (map[string]map[string]any, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := make(map[string]map[string]any, len(m.acls[collection]))
+	for k, v := range m.acls[collection] {
+		result[k] = copyDoc(v)
+	}
+	return result, nil
+}
+
+func (m *MemoryStore) ListACLsFor(collection string, names []string) (map[string]map[string]any, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := make(map[string]map[string]any)
+	for key := range m.aclIndex.keys(collection, names) {
+		result[key] = copyDoc(m.acls[collection][key])
 	}
 	return result, nil
 }
@@ -0,0 +1,238 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Sort orders accepted by Query.OrderBy.
+const (
+	OrderByKey       = "key"
+	OrderByUpdatedAt = "updatedAt"
+)
+
+// ErrInvalidQuery is returned (wrapped) when a Query is malformed, e.g. it has
+// an unknown sort order or a cursor that cannot be decoded.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// Query describes an ordered, optionally paginated read of a collection.
+type Query struct {
+	// Filter restricts results to documents it matches.
+	Filter *Filter
+
+	// Since restricts results to documents whose updatedAt is strictly after
+	// it. Documents without a parseable updatedAt are excluded.
+	Since *time.Time
+
+	// OrderBy is OrderByKey (the default) or OrderByUpdatedAt. Ties are
+	// broken by key so the order is always total.
+	OrderBy string
+
+	// Limit caps the number of items returned. Zero means no limit.
+	Limit int
+
+	// Cursor resumes a previous query after the last item it returned.
+	Cursor string
+
+	// Fields, if set, projects each returned document onto these
+	// dot-separated field paths.
+	Fields []string
+}
+
+// Item is a document together with its key.
+type Item struct {
+	Key  string
+	Data map[string]any
+}
+
+// Page is the result of a Query.
+type Page struct {
+	Items []Item
+
+	// NextCursor is set when more items remain after this page.
+	NextCursor string
+}
+
+// Project reduces the documents of a page to the given dot-separated field
+// paths, as Query.Fields does, for callers that change documents between
+// querying and projecting them.
+func (p *Page) Project(fields []string) error {
+	paths, err := parseFields(fields)
+	if err != nil {
+		return err
+	}
+	for i := range p.Items {
+		p.Items[i].Data = project(p.Items[i].Data, paths)
+	}
+	return nil
+}
+
+// cursor is the decoded form of Query.Cursor: the sort position of the last
+// item returned.
+type cursor struct {
+	OrderBy string `json:"o"`
+	Value   string `json:"v,omitempty"`
+	Key     string `json:"k"`
+}
+
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	var c cursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	return &c, nil
+}
+
+// normalize validates q and fills in defaults. It returns the decoded cursor,
+// or nil if q has none.
+func (q *Query) normalize() (*cursor, error) {
+	switch q.OrderBy {
+	case "":
+		q.OrderBy = OrderByKey
+	case OrderByKey, OrderByUpdatedAt:
+	default:
+		return nil, fmt.Errorf("%w: unknown orderBy %q (supported: key, updatedAt)", ErrInvalidQuery, q.OrderBy)
+	}
+	if q.Limit < 0 {
+		return nil, fmt.Errorf("%w: limit must not be negative", ErrInvalidQuery)
+	}
+	if q.Cursor == "" {
+		return nil, nil
+	}
+	c, err := decodeCursor(q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	if c.OrderBy != q.OrderBy {
+		return nil, fmt.Errorf("%w: cursor was issued for orderBy %q", ErrInvalidQuery, c.OrderBy)
+	}
+	return c, nil
+}
+
+// Validate returns the error Query would return for q if it is malformed,
+// so that callers can reject it before doing other work.
+func (q Query) Validate() error {
+	_, err := q.normalize()
+	return err
+}
+
+// updatedAtOf returns the parsed updatedAt of a document.
+func updatedAtOf(doc map[string]any) (time.Time, bool) {
+	ts, ok := doc["updatedAt"].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := ParseTimestamp(ts)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// sortValue is the position of a document in a sort order.
+type sortValue struct {
+	t   time.Time
+	key string
+}
+
+func (v sortValue) less(o sortValue, orderBy string) bool {
+	if orderBy == OrderByUpdatedAt && !v.t.Equal(o.t) {
+		return v.t.Before(o.t)
+	}
+	return v.key < o.key
+}
+
+func (v sortValue) cursor(orderBy string) cursor {
+	c := cursor{OrderBy: orderBy, Key: v.key}
+	if orderBy == OrderByUpdatedAt {
+		c.Value = v.t.UTC().Format(time.RFC3339Nano)
+	}
+	return c
+}
+
+func (c *cursor) sortValue() (sortValue, error) {
+	v := sortValue{key: c.Key}
+	if c.OrderBy == OrderByUpdatedAt && c.Value != "" {
+		t, err := time.Parse(time.RFC3339Nano, c.Value)
+		if err != nil {
+			return v, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+		}
+		v.t = t
+	}
+	return v, nil
+}
+
+// runQuery evaluates q in process over a set of documents. Backends that can
+// narrow the candidate set natively may pass a pre-filtered set; runQuery is
+// idempotent over any superset of the true result.
+func runQuery(docs map[string]map[string]any, q Query) (*Page, error) {
+	after, err := q.normalize()
+	if err != nil {
+		return nil, err
+	}
+	var fields [][]string
+	if q.Fields != nil {
+		if fields, err = parseFields(q.Fields); err != nil {
+			return nil, err
+		}
+	}
+	var afterPos *sortValue
+	if after != nil {
+		v, err := after.sortValue()
+		if err != nil {
+			return nil, err
+		}
+		afterPos = &v
+	}
+
+	type entry struct {
+		pos  sortValue
+		data map[string]any
+	}
+	entries := make([]entry, 0, len(docs))
+	for key, doc := range docs {
+		t, ok := updatedAtOf(doc)
+		if q.Since != nil && (!ok || !t.After(*q.Since)) {
+			continue
+		}
+		if !q.Filter.Match(key, doc) {
+			continue
+		}
+		pos := sortValue{t: t, key: key}
+		if afterPos != nil && !afterPos.less(pos, q.OrderBy) {
+			continue
+		}
+		entries = append(entries, entry{pos: pos, data: doc})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].pos.less(entries[j].pos, q.OrderBy)
+	})
+
+	page := &Page{}
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+		page.NextCursor = encodeCursor(entries[len(entries)-1].pos.cursor(q.OrderBy))
+	}
+	page.Items = make([]Item, len(entries))
+	for i, e := range entries {
+		data := e.data
+		if fields != nil {
+			data = project(data, fields)
+		}
+		page.Items[i] = Item{Key: e.pos.key, Data: data}
+	}
+	return page, nil
+}
@@ -0,0 +1,378 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// SearchHit is a single full-text search result.
+type SearchHit struct {
+	Key string `json:"key"`
+
+	// Score ranks the hit against the others; higher is better.
+	Score float64 `json:"score"`
+
+	// Snippet is an excerpt of the best matching field with matched terms
+	// wrapped in <mark> tags.
+	Snippet string `json:"snippet"`
+
+	Data map[string]any `json:"item"`
+}
+
+// Snippet formatting shared by all backends.
+const (
+	snippetOpen   = "<mark>"
+	snippetClose  = "</mark>"
+	snippetEllip  = "…"
+	snippetTokens = 10
+)
+
+// token is a word found in a text, with its byte offsets.
+type token struct {
+	term       string
+	start, end int
+}
+
+// tokenize splits text into lower-cased words of letters and digits.
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case word && start < 0:
+			start = i
+		case !word && start >= 0:
+			tokens = append(tokens, token{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return tokens
+}
+
+// searchTerm is one term of a parsed search query.
+type searchTerm struct {
+	text   string
+	prefix bool
+}
+
+func (t searchTerm) matches(term string) bool {
+	if t.prefix {
+		return strings.HasPrefix(term, t.text)
+	}
+	return term == t.text
+}
+
+// parseSearch parses a search query: whitespace-separated words, all of which
+// must occur in a matching document. A trailing "*" makes a word match as a
+// prefix.
+func parseSearch(q string) ([]searchTerm, error) {
+	var terms []searchTerm
+	for _, word := range strings.Fields(q) {
+		prefix := strings.HasSuffix(word, "*")
+		for _, tok := range tokenize(word) {
+			terms = append(terms, searchTerm{text: tok.term})
+		}
+		if prefix && len(terms) > 0 {
+			terms[len(terms)-1].prefix = true
+		}
+	}
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("%w: empty search query", ErrInvalidQuery)
+	}
+	return terms, nil
+}
+
+// searchText returns the text of each searchable field of doc, in field
+// order. Strings are used as is; arrays contribute their string elements.
+func searchText(doc map[string]any, fields [][]string) []string {
+	texts := make([]string, 0, len(fields))
+	for _, path := range fields {
+		v, _ := lookupPath(doc, path)
+		switch v := v.(type) {
+		case string:
+			texts = append(texts, v)
+		case []any:
+			var parts []string
+			for _, e := range v {
+				if s, ok := e.(string); ok {
+					parts = append(parts, s)
+				}
+			}
+			texts = append(texts, strings.Join(parts, " "))
+		default:
+			texts = append(texts, "")
+		}
+	}
+	return texts
+}
+
+// snippet returns an excerpt of the first text containing a query term,
+// centred on that term, with matches marked.
+func snippet(texts []string, terms []searchTerm) string {
+	for _, text := range texts {
+		tokens := tokenize(text)
+		first := -1
+		for i, tok := range tokens {
+			if matchesAny(tok.term, terms) {
+				first = i
+				break
+			}
+		}
+		if first < 0 {
+			continue
+		}
+		from := max(0, first-snippetTokens/2)
+		to := min(len(tokens), from+snippetTokens)
+		from = max(0, to-snippetTokens)
+
+		var b strings.Builder
+		if from > 0 {
+			b.WriteString(snippetEllip)
+		}
+		pos := tokens[from].start
+		for _, tok := range tokens[from:to] {
+			b.WriteString(text[pos:tok.start])
+			if matchesAny(tok.term, terms) {
+				b.WriteString(snippetOpen + text[tok.start:tok.end] + snippetClose)
+			} else {
+				b.WriteString(text[tok.start:tok.end])
+			}
+			pos = tok.end
+		}
+		if to < len(tokens) {
+			b.WriteString(snippetEllip)
+		}
+		return b.String()
+	}
+	return ""
+}
+
+func matchesAny(term string, terms []searchTerm) bool {
+	for _, t := range terms {
+		if t.matches(term) {
+			return true
+		}
+	}
+	return false
+}
+
+// textIndex is an in-process inverted index over the searchable fields of
+// one collection.
+type textIndex struct {
+	fields [][]string
+
+	// built is false until the index has been populated from the collection.
+	built bool
+
+	postings map[string]map[string]int // term -> key -> occurrences
+	docTerms map[string]map[string]int // key -> term -> occurrences
+	lengths  map[string]int            // key -> number of terms
+	total    int                       // sum of lengths
+}
+
+func newTextIndex(fields [][]string) *textIndex {
+	return &textIndex{
+		fields:   fields,
+		postings: make(map[string]map[string]int),
+		docTerms: make(map[string]map[string]int),
+		lengths:  make(map[string]int),
+	}
+}
+
+func (ix *textIndex) remove(key string) {
+	for term := range ix.docTerms[key] {
+		delete(ix.postings[term], key)
+		if len(ix.postings[term]) == 0 {
+			delete(ix.postings, term)
+		}
+	}
+	ix.total -= ix.lengths[key]
+	delete(ix.docTerms, key)
+	delete(ix.lengths, key)
+}
+
+func (ix *textIndex) add(key string, doc map[string]any) {
+	ix.remove(key)
+	counts := make(map[string]int)
+	n := 0
+	for _, text := range searchText(doc, ix.fields) {
+		for _, tok := range tokenize(text) {
+			counts[tok.term]++
+			n++
+		}
+	}
+	if n == 0 {
+		return
+	}
+	for term, c := range counts {
+		if ix.postings[term] == nil {
+			ix.postings[term] = make(map[string]int)
+		}
+		ix.postings[term][key] = c
+	}
+	ix.docTerms[key] = counts
+	ix.lengths[key] = n
+	ix.total += n
+}
+
+// BM25 parameters, matching SQLite FTS5's defaults.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// search returns the keys of documents containing every term, ranked with
+// BM25, best first.
+func (ix *textIndex) search(terms []searchTerm) []SearchHit {
+	if len(ix.lengths) == 0 {
+		return nil
+	}
+	avgLen := float64(ix.total) / float64(len(ix.lengths))
+	scores := make(map[string]float64)
+	for i, t := range terms {
+		// Occurrences of this term (or of the words it prefixes) per key.
+		tf := make(map[string]int)
+		for term, keys := range ix.postings {
+			if !t.matches(term) {
+				continue
+			}
+			for key, c := range keys {
+				tf[key] += c
+			}
+		}
+		n := float64(len(tf))
+		idf := math.Log((float64(len(ix.lengths))-n+0.5)/(n+0.5) + 1)
+		next := make(map[string]float64, len(tf))
+		for key, c := range tf {
+			prev, ok := scores[key]
+			if i > 0 && !ok {
+				continue // every term must match
+			}
+			f := float64(c)
+			norm := bm25K1 * (1 - bm25B + bm25B*float64(ix.lengths[key])/avgLen)
+			next[key] = prev + idf*f*(bm25K1+1)/(f+norm)
+		}
+		scores = next
+	}
+	hits := make([]SearchHit, 0, len(scores))
+	for key, score := range scores {
+		hits = append(hits, SearchHit{Key: key, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Key < hits[j].Key
+	})
+	return hits
+}
+
+// searchSet holds the text indexes of every searchable collection. Like
+// indexSet it is guarded by the owning store's lock.
+type searchSet map[string]*textIndex
+
+// configure sets the searchable fields of a collection, discarding any
+// existing index. An empty field list disables search.
+func (s searchSet) configure(collection string, fields []string) error {
+	if len(fields) == 0 {
+		delete(s, collection)
+		return nil
+	}
+	paths, err := parseFields(fields)
+	if err != nil {
+		return err
+	}
+	s[collection] = newTextIndex(paths)
+	return nil
+}
+
+func (s searchSet) fields(collection string) []string {
+	ix, ok := s[collection]
+	if !ok {
+		return []string{}
+	}
+	fields := make([]string, len(ix.fields))
+	for i, path := range ix.fields {
+		fields[i] = strings.Join(path, ".")
+	}
+	return fields
+}
+
+// build populates a collection's index if it has not been built yet.
+func (s searchSet) build(collection string, docs map[string]map[string]any) {
+	ix, ok := s[collection]
+	if !ok || ix.built {
+		return
+	}
+	for key, doc := range docs {
+		ix.add(key, doc)
+	}
+	ix.built = true
+}
+
+// update maintains a built index for a write of doc (nil for a delete).
+func (s searchSet) update(collection, key string, doc map[string]any) {
+	ix, ok := s[collection]
+	if !ok || !ix.built {
+		return
+	}
+	if doc == nil {
+		ix.remove(key)
+		return
+	}
+	ix.add(key, doc)
+}
+
+// search runs a query against a built index, filling in snippets and
+// documents from docs.
+func (s searchSet) search(collection, query string, limit int, docs map[string]map[string]any) ([]SearchHit, error) {
+	return s.searchWith(collection, query, limit, func(key string) (map[string]any, error) {
+		return docs[key], nil
+	})
+}
+
+// searchWith is search for stores that look up the documents of the hits
+// one by one rather than holding the whole collection.
+func (s searchSet) searchWith(collection, query string, limit int, get func(key string) (map[string]any, error)) ([]SearchHit, error) {
+	ix, ok := s[collection]
+	if !ok {
+		return nil, fmt.Errorf("%w: collection %q has no searchable fields", ErrInvalidQuery, collection)
+	}
+	terms, err := parseSearch(query)
+	if err != nil {
+		return nil, err
+	}
+	hits := ix.search(terms)
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	for i := range hits {
+		doc, err := get(hits[i].Key)
+		if err != nil {
+			return nil, err
+		}
+		hits[i].Data = doc
+		hits[i].Snippet = snippet(searchText(doc, ix.fields), terms)
+	}
+	return hits, nil
+}
+
+// parseFields parses a list of dot-separated field paths.
+func parseFields(fields []string) ([][]string, error) {
+	paths := make([][]string, 0, len(fields))
+	for _, field := range fields {
+		path, err := ParsePath(field)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
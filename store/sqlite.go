@@ -1,10 +1,16 @@
 package store
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 )
 
@@ -12,148 +18,1243 @@ import (
 //
 // Tables:
 //
-//	documents(collection, key, data)  PRIMARY KEY (collection, key)
-//	schemas(collection, schema)       PRIMARY KEY (collection)
+//	documents(collection, key, data)   PRIMARY KEY (collection, key)
+//	schemas(collection, schema)        PRIMARY KEY (collection)
+//	indexes(collection, field, state)  PRIMARY KEY (collection, field)
+//	search_fields(collection, fields)  PRIMARY KEY (collection)
+//	search_keys(id, collection, key)   UNIQUE (collection, key)
+//	search_docs(content)               FTS5, rowid = search_keys.id
+//	api_keys(id, key)                  PRIMARY KEY (id)
+//	acls(collection, key, acl)         PRIMARY KEY (collection, key)
+//	acl_entries(collection, name, key) PRIMARY KEY (collection, name, key)
+//
+// Each declared secondary index is backed by an SQLite expression index on
+// (collection, json_extract(data, field)), shared by all collections that
+// index the same field, so the filters built by Query can use it.
+//
+// Full-text search uses FTS5 when the driver is built with it (go build
+// -tags sqlite_fts5). Otherwise search_docs is not created and searches
+// fall back to an in-process index built on first use.
+//
+// Atomically runs writes in an SQLite transaction.
 type SqliteStore struct {
-	mu sync.RWMutex
-	db *sql.DB
+	mu     sync.RWMutex
+	conn   *sql.DB
+	db     sqlConn // conn, or the transaction of a store passed to Atomically
+	fts    bool
+	search searchSet
+
+	// touched records the documents written in a transaction, whose
+	// in-process search entries must be restored if it rolls back.
+	touched map[docRef]bool
+}
+
+// sqlConn is the part of *sql.DB and *sql.Tx that SqliteStore uses.
+type sqlConn interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+var sqliteTables = []string{
+	`CREATE TABLE IF NOT EXISTS documents (
+		collection TEXT NOT NULL,
+		key TEXT NOT NULL,
+		data TEXT NOT NULL,
+		PRIMARY KEY (collection, key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS schemas (
+		collection TEXT PRIMARY KEY,
+		schema TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS schema_versions (
+		collection TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		schema TEXT NOT NULL,
+		PRIMARY KEY (collection, version)
+	)`,
+	`CREATE TABLE IF NOT EXISTS schema_deleted (
+		collection TEXT PRIMARY KEY,
+		version INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS indexes (
+		collection TEXT NOT NULL,
+		field TEXT NOT NULL,
+		state TEXT NOT NULL,
+		PRIMARY KEY (collection, field)
+	)`,
+	`CREATE TABLE IF NOT EXISTS search_fields (
+		collection TEXT PRIMARY KEY,
+		fields TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS search_keys (
+		id INTEGER PRIMARY KEY,
+		collection TEXT NOT NULL,
+		key TEXT NOT NULL,
+		UNIQUE (collection, key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id TEXT PRIMARY KEY,
+		key TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS acls (
+		collection TEXT NOT NULL,
+		key TEXT NOT NULL,
+		acl TEXT NOT NULL,
+		PRIMARY KEY (collection, key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS acl_entries (
+		collection TEXT NOT NULL,
+		name TEXT NOT NULL,
+		key TEXT NOT NULL,
+		PRIMARY KEY (collection, name, key)
+	)`,
+	`CREATE INDEX IF NOT EXISTS acl_entries_key ON acl_entries (collection, key)`,
+	// Index the entries of ACLs written before acl_entries existed.
+	`INSERT OR IGNORE INTO acl_entries (collection, name, key)
+		SELECT a.collection, e.value, a.key
+		FROM acls a, json_each(a.acl, '$.read') e WHERE e.type = 'text'
+		UNION
+		SELECT a.collection, e.value, a.key
+		FROM acls a, json_each(a.acl, '$.write') e WHERE e.type = 'text'`,
+}
+
+func NewSqliteStore(dbPath string) (*SqliteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0o755); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, stmt := range sqliteTables {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	s := &SqliteStore{conn: db, db: db, search: make(searchSet)}
+	_, err = db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS search_docs USING fts5(content)")
+	s.fts = err == nil
+	if err := s.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load restores the in-memory state kept alongside the database: the search
+// configuration, and index builds interrupted by a shutdown.
+func (s *SqliteStore) load() error {
+	rows, err := s.db.Query("SELECT collection, fields FROM search_fields")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var collection, raw string
+		if err := rows.Scan(&collection, &raw); err != nil {
+			return err
+		}
+		var fields []string
+		if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+			return err
+		}
+		if err := s.search.configure(collection, fields); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = s.db.Query("SELECT collection, field FROM indexes WHERE state = ?", IndexBuilding)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var collection, field string
+		if err := rows.Scan(&collection, &field); err != nil {
+			return err
+		}
+		go s.buildIndex(collection, field)
+	}
+	return rows.Err()
+}
+
+func (s *SqliteStore) Close() error {
+	return s.conn.Close()
+}
+
+// Atomically runs fn in a transaction. Other callers wait until it ends.
+func (s *SqliteStore) Atomically(fn func(tx Store) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return err
+	}
+	// Also roll back if fn panics, or the transaction would keep its
+	// connection and the write lock. After Commit or Rollback this fails
+	// with sql.ErrTxDone.
+	defer tx.Rollback()
+	txs := &SqliteStore{conn: s.conn, db: tx, fts: s.fts, search: s.search, touched: make(map[docRef]bool)}
+	if err := fn(txs); err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return errors.Join(err, fmt.Errorf("rolling back: %w", rerr))
+		}
+		if rerr := s.restoreSearch(txs.touched); rerr != nil {
+			return errors.Join(err, rerr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// inTx runs fn, which writes through s.db, in a transaction of its own
+// unless s is already the store of one, so that a document and the rows
+// kept alongside it (its ACL, its full-text entry) change together.
+// Callers hold s.mu.
+func (s *SqliteStore) inTx(fn func() error) error {
+	if s.touched != nil {
+		return fn()
+	}
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	s.db, s.touched = tx, make(map[docRef]bool)
+	err = fn()
+	touched := s.touched
+	s.db, s.touched = s.conn, nil
+	if err == nil {
+		if err = tx.Commit(); err == nil {
+			return nil
+		}
+	}
+	if rerr := tx.Rollback(); rerr != nil && !errors.Is(rerr, sql.ErrTxDone) {
+		err = errors.Join(err, fmt.Errorf("rolling back: %w", rerr))
+	}
+	if rerr := s.restoreSearch(touched); rerr != nil {
+		return errors.Join(err, rerr)
+	}
+	return err
+}
+
+// restoreSearch brings the in-process search entries of the documents a
+// rolled back transaction wrote back in line with the stored ones.
+func (s *SqliteStore) restoreSearch(touched map[docRef]bool) error {
+	for ref := range touched {
+		doc, err := s.get(ref.collection, ref.key)
+		if err != nil {
+			return err
+		}
+		s.search.update(ref.collection, ref.key, doc)
+	}
+	return nil
+}
+
+func (s *SqliteStore) GetAll(collection string) (map[string]map[string]any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getAll(collection)
+}
+
+func (s *SqliteStore) getAll(collection string) (map[string]map[string]any, error) {
+	rows, err := s.db.Query("SELECT key, data FROM documents WHERE collection = ?", collection)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]map[string]any)
+	for rows.Next() {
+		var key, raw string
+		if err := rows.Scan(&key, &raw); err != nil {
+			return nil, err
+		}
+		var doc map[string]any
+		if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+			continue
+		}
+		result[key] = doc
+	}
+	return result, rows.Err()
+}
+
+func (s *SqliteStore) Get(collection, key string) (map[string]any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.get(collection, key)
+}
+
+// get reads a document; the caller holds the lock.
+func (s *SqliteStore) get(collection, key string) (map[string]any, error) {
+	var raw string
+	err := s.db.QueryRow(
+		"SELECT data FROM documents WHERE collection = ? AND key = ?",
+		collection, key,
+	).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (s *SqliteStore) Query(collection string, q Query) (*Page, error) {
+	after, err := q.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	// Filter conditions are translated to json_extract predicates. Key order
+	// without any predicate left to evaluate in process maps directly onto
+	// the primary key, so the cursor and limit can be pushed down too.
+	// Whatever cannot be expressed in SQL is finished by runQuery.
+	sqlText := "SELECT key, data FROM documents WHERE collection = ?"
+	args := []any{collection}
+	where, whereArgs, complete := filterSQL(q.Filter)
+	if where != "" {
+		sqlText += " AND " + where
+		args = append(args, whereArgs...)
+	}
+	if q.OrderBy == OrderByKey && q.Since == nil && complete {
+		if after != nil {
+			sqlText += " AND key > ?"
+			args = append(args, after.Key)
+		}
+		sqlText += " ORDER BY key"
+		if q.Limit > 0 {
+			sqlText += " LIMIT ?"
+			args = append(args, q.Limit+1)
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	docs, err := s.queryDocs(sqlText, args...)
+	if err != nil {
+		return nil, err
+	}
+	return runQuery(docs, q)
+}
+
+// jsonPathSQL renders a field path as an SQLite JSON path literal such as
+// '$."owner"."id"'. Paths are inlined rather than bound so that expression
+// indexes over the same path remain usable. ParsePath rejects quotes, so
+// the segments need no escaping.
+func jsonPathSQL(path []string) string {
+	var b strings.Builder
+	b.WriteString("'$")
+	for _, seg := range path {
+		b.WriteString(`."` + seg + `"`)
+	}
+	b.WriteString("'")
+	return b.String()
+}
+
+// filterSQL translates f into an SQL predicate over the data column. complete
+// reports whether every condition was translated; conditions that were not
+// are left for runQuery.
+func filterSQL(f *Filter) (where string, args []any, complete bool) {
+	if f == nil {
+		return "", nil, true
+	}
+	complete = true
+	var parts []string
+	for _, c := range f.Conditions {
+		part, partArgs, ok := conditionSQL(c)
+		if !ok {
+			complete = false
+			continue
+		}
+		parts = append(parts, part)
+		args = append(args, partArgs...)
+	}
+	// An $or group becomes a disjunction of its filters. An incomplete
+	// filter translates to a looser predicate, so the disjunction still
+	// selects every matching document.
+	for _, group := range f.Or {
+		alts := make([]string, len(group))
+		for i, alt := range group {
+			where, altArgs, ok := filterSQL(alt)
+			if !ok {
+				complete = false
+			}
+			if where == "" {
+				where = "1"
+			}
+			alts[i] = "(" + where + ")"
+			args = append(args, altArgs...)
+		}
+		parts = append(parts, "("+strings.Join(alts, " OR ")+")")
+	}
+	return strings.Join(parts, " AND "), args, complete
+}
+
+// conditionSQL translates a single condition. The json_type guards keep the
+// SQL semantics identical to Condition.Match, which never compares values of
+// different JSON types.
+func conditionSQL(c Condition) (string, []any, bool) {
+	path := jsonPathSQL(c.Path)
+	typ := "json_type(data, " + path + ")"
+	val := "json_extract(data, " + path + ")"
+	if isKeyPath(c.Path) {
+		typ, val = "'text'", "key"
+	}
+	switch c.Op {
+	case OpEq:
+		return eqSQL(typ, val, c.Value)
+	case OpNe:
+		eq, args, ok := eqSQL(typ, val, c.Value)
+		if !ok {
+			return "", nil, false
+		}
+		return "NOT COALESCE(" + eq + ", 0)", args, true
+	case OpIn:
+		candidates := c.Value.([]any)
+		if len(candidates) == 0 {
+			return "0", nil, true
+		}
+		var parts []string
+		var args []any
+		for _, v := range candidates {
+			eq, eqArgs, ok := eqSQL(typ, val, v)
+			if !ok {
+				return "", nil, false
+			}
+			parts = append(parts, "("+eq+")")
+			args = append(args, eqArgs...)
+		}
+		return "(" + strings.Join(parts, " OR ") + ")", args, true
+	case OpExists:
+		if c.Value.(bool) {
+			return typ + " IS NOT NULL", nil, true
+		}
+		return typ + " IS NULL", nil, true
+	}
+
+	var sym string
+	switch c.Op {
+	case OpGt:
+		sym = ">"
+	case OpGte:
+		sym = ">="
+	case OpLt:
+		sym = "<"
+	case OpLte:
+		sym = "<="
+	default:
+		return "", nil, false
+	}
+	switch c.Value.(type) {
+	case float64:
+		return typ + " IN ('integer', 'real') AND " + val + " " + sym + " ?", []any{c.Value}, true
+	case string:
+		return typ + " = 'text' AND " + val + " " + sym + " ?", []any{c.Value}, true
+	}
+	return "", nil, false
+}
+
+// eqSQL renders an equality test against a scalar JSON value. Objects and
+// arrays are not translated.
+func eqSQL(typ, val string, v any) (string, []any, bool) {
+	switch v := v.(type) {
+	case nil:
+		return typ + " = 'null'", nil, true
+	case bool:
+		if v {
+			return typ + " = 'true'", nil, true
+		}
+		return typ + " = 'false'", nil, true
+	case float64:
+		return typ + " IN ('integer', 'real') AND " + val + " = ?", []any{v}, true
+	case string:
+		return typ + " = 'text' AND " + val + " = ?", []any{v}, true
+	}
+	return "", nil, false
+}
+
+func (s *SqliteStore) Aggregate(collection string, a Aggregation) ([]Group, error) {
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+	where, args, complete := filterSQL(a.Filter)
+	if where != "" {
+		where = " AND " + where
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !complete {
+		// Part of the filter needs evaluating in process, and so does the
+		// aggregation that follows it.
+		docs, err := s.queryDocs("SELECT key, data FROM documents WHERE collection = ?"+where, append([]any{collection}, args...)...)
+		if err != nil {
+			return nil, err
+		}
+		return runAggregate(docs, a)
+	}
+
+	// Values group by JSON type and value, with integers and reals treated
+	// alike, as numbers are in process.
+	var cols, groupBy []string
+	for _, field := range a.GroupBy {
+		path, _ := ParsePath(field)
+		p := jsonPathSQL(path)
+		typ := "json_type(data, " + p + ")"
+		cols = append(cols, typ, "json_extract(data, "+p+")")
+		groupBy = append(groupBy,
+			"CASE WHEN "+typ+" IN ('integer', 'real') THEN 'number' ELSE "+typ+" END",
+			"json_extract(data, "+p+")")
+	}
+	for _, m := range a.Metrics {
+		if m.Func == AggCount {
+			cols = append(cols, "COUNT(*)")
+			continue
+		}
+		path, _ := ParsePath(m.Field)
+		p := jsonPathSQL(path)
+		num := "CASE WHEN json_type(data, " + p + ") IN ('integer', 'real') THEN json_extract(data, " + p + ") END"
+		fn := map[string]string{AggSum: "TOTAL", AggMin: "MIN", AggMax: "MAX", AggAvg: "AVG"}[m.Func]
+		cols = append(cols, fn+"("+num+")")
+	}
+	sqlText := "SELECT " + strings.Join(cols, ", ") + " FROM documents WHERE collection = ?" + where
+	if len(groupBy) > 0 {
+		sqlText += " GROUP BY " + strings.Join(groupBy, ", ")
+	}
+	rows, err := s.db.Query(sqlText, append([]any{collection}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []Group{}
+	for rows.Next() {
+		dest := make([]any, len(cols))
+		for i := range dest {
+			dest[i] = new(any)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		g := Group{Key: make(map[string]any, len(a.GroupBy)), Values: make(map[string]any, len(a.Metrics))}
+		for i, field := range a.GroupBy {
+			typ, _ := (*dest[2*i].(*any)).(string)
+			v, err := sqlJSONValue(typ, *dest[2*i+1].(*any))
+			if err != nil {
+				return nil, err
+			}
+			g.Key[field] = v
+		}
+		for i, m := range a.Metrics {
+			v := *dest[2*len(a.GroupBy)+i].(*any)
+			switch n := v.(type) {
+			case int64:
+				if m.Func == AggCount {
+					g.Values[m.Name()] = int(n)
+				} else {
+					g.Values[m.Name()] = float64(n)
+				}
+			default:
+				g.Values[m.Name()] = v
+			}
+		}
+		groups = append(groups, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortGroups(groups)
+	return groups, nil
+}
+
+// sqlJSONValue converts a json_extract result back to the value
+// encoding/json would produce, given its json_type.
+func sqlJSONValue(typ string, v any) (any, error) {
+	switch typ {
+	case "", "null":
+		return nil, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "integer":
+		n, _ := v.(int64)
+		return float64(n), nil
+	case "real":
+		f, _ := v.(float64)
+		return f, nil
+	case "text":
+		switch s := v.(type) {
+		case string:
+			return s, nil
+		case []byte:
+			return string(s), nil
+		}
+		return nil, nil
+	}
+	var raw string
+	switch s := v.(type) {
+	case string:
+		raw = s
+	case []byte:
+		raw = string(s)
+	}
+	var out any
+	if err := json.Unmarshal([]byte(raw), &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// queryDocs runs a query selecting (key, data) rows and decodes them.
+// Callers hold s.mu.
+func (s *SqliteStore) queryDocs(query string, args ...any) (map[string]map[string]any, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	docs := make(map[string]map[string]any)
+	for rows.Next() {
+		var key, raw string
+		if err := rows.Scan(&key, &raw); err != nil {
+			return nil, err
+		}
+		var doc map[string]any
+		if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+			continue
+		}
+		docs[key] = doc
+	}
+	return docs, rows.Err()
+}
+
+func (s *SqliteStore) Put(collection, key string, data map[string]any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.putDoc(collection, key, data)
+}
+
+// putDoc stores a document and its full-text entry together. Callers hold
+// s.mu.
+func (s *SqliteStore) putDoc(collection, key string, data map[string]any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return s.inTx(func() error {
+		_, err := s.db.Exec(
+			`INSERT INTO documents (collection, key, data) VALUES (?, ?, ?)
+			 ON CONFLICT(collection, key) DO UPDATE SET data = excluded.data`,
+			collection, key, string(b),
+		)
+		if err != nil {
+			return err
+		}
+		return s.indexText(collection, key, data)
+	})
+}
+
+// deleteDoc removes a document with its ACL and full-text entry, reporting
+// whether it existed. Callers hold s.mu.
+func (s *SqliteStore) deleteDoc(collection, key string) (bool, error) {
+	existed := false
+	err := s.inTx(func() error {
+		res, err := s.db.Exec("DELETE FROM documents WHERE collection = ? AND key = ?", collection, key)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return nil
+		}
+		existed = true
+		if err := s.putACL(collection, key, nil); err != nil {
+			return err
+		}
+		return s.indexText(collection, key, nil)
+	})
+	return existed && err == nil, err
+}
+
+func (s *SqliteStore) PutIfNewer(collection, key string, data map[string]any, pre ...Precondition) (map[string]any, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Read existing within the same lock
+	existing, err := s.get(collection, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := checkPreconditions(existing, pre); err != nil {
+		return nil, false, err
+	}
+	if existing != nil && !IsNewer(data, existing) {
+		return existing, false, nil
+	}
+	if err := s.putDoc(collection, key, data); err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func (s *SqliteStore) Delete(collection, key string, pre ...Precondition) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(pre) > 0 {
+		existing, err := s.get(collection, key)
+		if err != nil {
+			return false, err
+		}
+		if err := checkPreconditions(existing, pre); err != nil {
+			return false, err
+		}
+	}
+	return s.deleteDoc(collection, key)
+}
+
+func (s *SqliteStore) DropCollection(collection string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res, err := s.db.Exec("DELETE FROM documents WHERE collection = ?", collection)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	existed := n > 0
+	if _, err := s.db.Exec("DELETE FROM acls WHERE collection = ?", collection); err != nil {
+		return existed, err
+	}
+	if _, err := s.db.Exec("DELETE FROM acl_entries WHERE collection = ?", collection); err != nil {
+		return existed, err
+	}
+
+	fields, err := s.indexedFields(collection)
+	if err != nil {
+		return existed, err
+	}
+	for _, field := range fields {
+		if _, err := s.dropIndex(collection, field); err != nil {
+			return existed, err
+		}
+	}
+
+	delete(s.search, collection)
+	if _, err := s.db.Exec("DELETE FROM search_fields WHERE collection = ?", collection); err != nil {
+		return existed, err
+	}
+	if s.fts {
+		if _, err := s.db.Exec(
+			"DELETE FROM search_docs WHERE rowid IN (SELECT id FROM search_keys WHERE collection = ?)",
+			collection,
+		); err != nil {
+			return existed, err
+		}
+		if _, err := s.db.Exec("DELETE FROM search_keys WHERE collection = ?", collection); err != nil {
+			return existed, err
+		}
+	}
+	return existed, nil
+}
+
+// indexedFields returns the fields indexed on a collection; the caller
+// holds the lock.
+func (s *SqliteStore) indexedFields(collection string) ([]string, error) {
+	rows, err := s.db.Query("SELECT field FROM indexes WHERE collection = ?", collection)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var fields []string
+	for rows.Next() {
+		var field string
+		if err := rows.Scan(&field); err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	return fields, rows.Err()
+}
+
+func (s *SqliteStore) CompareAndSwap(collection, key, rev string, data map[string]any, pre ...Precondition) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, err := s.get(collection, key)
+	if err != nil {
+		return false, err
+	}
+	if err := checkPreconditions(existing, pre); err != nil {
+		return false, err
+	}
+	if Revision(existing) != rev {
+		return false, nil
+	}
+	if data == nil {
+		if existing == nil {
+			return true, nil
+		}
+		_, err := s.deleteDoc(collection, key)
+		return err == nil, err
+	}
+	if err := s.putDoc(collection, key, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *SqliteStore) Stats(collection string) (Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var st Stats
+	err := s.db.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(LENGTH(CAST(data AS BLOB))), 0) FROM documents WHERE collection = ?",
+		collection,
+	).Scan(&st.Documents, &st.Bytes)
+	return st, err
+}
+
+func (s *SqliteStore) ListCollections() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, err := s.db.Query("SELECT DISTINCT collection FROM documents ORDER BY collection")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// sqlIndexName returns the name of the SQLite index backing a field.
+func sqlIndexName(field string) string {
+	sum := sha256.Sum256([]byte(field))
+	return "idx_field_" + hex.EncodeToString(sum[:8])
+}
+
+func (s *SqliteStore) EnsureIndex(collection, field string) error {
+	if _, err := ParsePath(field); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res, err := s.db.Exec(
+		"INSERT INTO indexes (collection, field, state) VALUES (?, ?, ?) ON CONFLICT DO NOTHING",
+		collection, field, IndexBuilding,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		go s.buildIndex(collection, field)
+	}
+	return nil
+}
+
+// buildIndex creates the SQLite index backing a field and marks the
+// collection's declaration ready. It runs without holding s.mu so reads
+// continue while a large table is indexed, and checks the declaration under
+// the lock before and after: an index dropped during the build is removed
+// again rather than left behind.
+func (s *SqliteStore) buildIndex(collection, field string) {
+	declared, err := s.indexDeclared(collection, field)
+	if err != nil || !declared {
+		return
+	}
+	// s.db is only stable under the lock; build on the connection.
+	path, _ := ParsePath(field)
+	_, err = s.conn.Exec(fmt.Sprintf(
+		"CREATE INDEX IF NOT EXISTS %s ON documents (collection, json_extract(data, %s))",
+		sqlIndexName(field), jsonPathSQL(path),
+	))
+	if err != nil {
+		log.Printf("sqlite: building index on %s.%s: %v", collection, field, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.db.Exec(
+		"UPDATE indexes SET state = ? WHERE collection = ? AND field = ?",
+		IndexReady, collection, field,
+	)
+	var others int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM indexes WHERE field = ?", field).Scan(&others); err != nil {
+		log.Printf("sqlite: building index on %s.%s: %v", collection, field, err)
+		return
+	}
+	if others == 0 {
+		s.db.Exec("DROP INDEX IF EXISTS " + sqlIndexName(field))
+	}
+}
+
+// indexDeclared reports whether a collection still declares an index on
+// field.
+func (s *SqliteStore) indexDeclared(collection, field string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM indexes WHERE collection = ? AND field = ?", collection, field).Scan(&n)
+	return n > 0, err
+}
+
+func (s *SqliteStore) DropIndex(collection, field string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropIndex(collection, field)
+}
+
+// dropIndex removes an index declaration, and the SQLite index once no
+// collection declares the field; the caller holds the lock.
+func (s *SqliteStore) dropIndex(collection, field string) (bool, error) {
+	res, err := s.db.Exec("DELETE FROM indexes WHERE collection = ? AND field = ?", collection, field)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	var others int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM indexes WHERE field = ?", field).Scan(&others); err != nil {
+		return true, err
+	}
+	if others == 0 {
+		if _, err := s.db.Exec("DROP INDEX IF EXISTS " + sqlIndexName(field)); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+func (s *SqliteStore) ListIndexes(collection string) ([]Index, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, err := s.db.Query("SELECT field, state FROM indexes WHERE collection = ? ORDER BY field", collection)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []Index{}
+	for rows.Next() {
+		var ix Index
+		if err := rows.Scan(&ix.Field, &ix.State); err != nil {
+			return nil, err
+		}
+		result = append(result, ix)
+	}
+	return result, rows.Err()
 }
 
-func NewSqliteStore(dbPath string) (*SqliteStore, error) {
-	if err := os.MkdirAll(filepath.Dir(dbPath), 0o755); err != nil {
-		return nil, err
+// indexText maintains the full-text index of a searchable collection for a
+// write of doc (nil for a delete). Callers hold s.mu.
+func (s *SqliteStore) indexText(collection, key string, doc map[string]any) error {
+	ix, ok := s.search[collection]
+	if !ok {
+		return nil
 	}
-	db, err := sql.Open("sqlite3", dbPath)
+	if !s.fts {
+		if s.touched != nil {
+			s.touched[docRef{collection, key}] = true
+		}
+		s.search.update(collection, key, doc)
+		return nil
+	}
+	if doc == nil {
+		if _, err := s.db.Exec(
+			"DELETE FROM search_docs WHERE rowid = (SELECT id FROM search_keys WHERE collection = ? AND key = ?)",
+			collection, key,
+		); err != nil {
+			return err
+		}
+		_, err := s.db.Exec("DELETE FROM search_keys WHERE collection = ? AND key = ?", collection, key)
+		return err
+	}
+	var id int64
+	if err := s.db.QueryRow(
+		`INSERT INTO search_keys (collection, key) VALUES (?, ?)
+		 ON CONFLICT(collection, key) DO UPDATE SET key = excluded.key
+		 RETURNING id`,
+		collection, key,
+	).Scan(&id); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec("DELETE FROM search_docs WHERE rowid = ?", id); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(
+		"INSERT INTO search_docs (rowid, content) VALUES (?, ?)",
+		id, strings.Join(searchText(doc, ix.fields), "\n"),
+	)
+	return err
+}
+
+func (s *SqliteStore) SetSearchFields(collection string, fields []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.search.configure(collection, fields); err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		if _, err := s.db.Exec("DELETE FROM search_fields WHERE collection = ?", collection); err != nil {
+			return err
+		}
+	} else {
+		b, _ := json.Marshal(fields)
+		if _, err := s.db.Exec(
+			`INSERT INTO search_fields (collection, fields) VALUES (?, ?)
+			 ON CONFLICT(collection) DO UPDATE SET fields = excluded.fields`,
+			collection, string(b),
+		); err != nil {
+			return err
+		}
+	}
+	if !s.fts {
+		return nil
+	}
+
+	// Reindex the collection under the new field list.
+	if _, err := s.db.Exec(
+		"DELETE FROM search_docs WHERE rowid IN (SELECT id FROM search_keys WHERE collection = ?)",
+		collection,
+	); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec("DELETE FROM search_keys WHERE collection = ?", collection); err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	docs, err := s.getAll(collection)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
-		db.Close()
-		return nil, err
+	for key, doc := range docs {
+		if err := s.indexText(collection, key, doc); err != nil {
+			return err
+		}
 	}
-	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS documents (
-		collection TEXT NOT NULL,
-		key TEXT NOT NULL,
-		data TEXT NOT NULL,
-		PRIMARY KEY (collection, key)
-	)`); err != nil {
-		db.Close()
-		return nil, err
+	return nil
+}
+
+// buildSearch populates the in-process search index of a collection unless
+// it is already built, taking the write lock only when it is not.
+func (s *SqliteStore) buildSearch(collection string) error {
+	s.mu.RLock()
+	ix, ok := s.search[collection]
+	built := ok && ix.built
+	s.mu.RUnlock()
+	if !ok || built {
+		return nil
 	}
-	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schemas (
-		collection TEXT PRIMARY KEY,
-		schema TEXT NOT NULL
-	)`); err != nil {
-		db.Close()
-		return nil, err
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ix, ok := s.search[collection]; !ok || ix.built {
+		return nil
+	}
+	docs, err := s.getAll(collection)
+	if err != nil {
+		return err
 	}
-	return &SqliteStore{db: db}, nil
+	s.search.build(collection, docs)
+	return nil
 }
 
-func (s *SqliteStore) Close() error {
-	return s.db.Close()
+func (s *SqliteStore) SearchFields(collection string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.search.fields(collection), nil
 }
 
-func (s *SqliteStore) GetAll(collection string) (map[string]map[string]any, error) {
+func (s *SqliteStore) Search(collection, query string, limit int) ([]SearchHit, error) {
+	if !s.fts {
+		// The in-process fallback builds its index on the first search and
+		// keeps it up to date on writes after that.
+		if err := s.buildSearch(collection); err != nil {
+			return nil, err
+		}
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.search.searchWith(collection, query, limit, func(key string) (map[string]any, error) {
+			return s.get(collection, key)
+		})
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	rows, err := s.db.Query("SELECT key, data FROM documents WHERE collection = ?", collection)
+	if _, ok := s.search[collection]; !ok {
+		return nil, fmt.Errorf("%w: collection %q has no searchable fields", ErrInvalidQuery, collection)
+	}
+	terms, err := parseSearch(query)
+	if err != nil {
+		return nil, err
+	}
+	match := make([]string, len(terms))
+	for i, t := range terms {
+		match[i] = `"` + t.text + `"`
+		if t.prefix {
+			match[i] += "*"
+		}
+	}
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.Query(
+		`SELECT k.key, d.data, -bm25(search_docs),
+		        snippet(search_docs, 0, ?, ?, ?, ?)
+		 FROM search_docs
+		 JOIN search_keys k ON k.id = search_docs.rowid
+		 JOIN documents d ON d.collection = k.collection AND d.key = k.key
+		 WHERE search_docs MATCH ? AND k.collection = ?
+		 ORDER BY bm25(search_docs), k.key
+		 LIMIT ?`,
+		snippetOpen, snippetClose, snippetEllip, snippetTokens,
+		strings.Join(match, " "), collection, limit,
+	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	result := make(map[string]map[string]any)
+	hits := []SearchHit{}
 	for rows.Next() {
-		var key, raw string
-		if err := rows.Scan(&key, &raw); err != nil {
+		var hit SearchHit
+		var raw string
+		if err := rows.Scan(&hit.Key, &raw, &hit.Score, &hit.Snippet); err != nil {
 			return nil, err
 		}
-		var doc map[string]any
-		if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+		if err := json.Unmarshal([]byte(raw), &hit.Data); err != nil {
 			continue
 		}
-		result[key] = doc
+		hits = append(hits, hit)
 	}
-	return result, rows.Err()
+	return hits, rows.Err()
 }
 
-func (s *SqliteStore) Get(collection, key string) (map[string]any, error) {
+func (s *SqliteStore) GetSchema(collection string) (map[string]any, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	var raw string
-	err := s.db.QueryRow(
-		"SELECT data FROM documents WHERE collection = ? AND key = ?",
-		collection, key,
-	).Scan(&raw)
+	err := s.db.QueryRow("SELECT schema FROM schemas WHERE collection = ?", collection).Scan(&raw)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	var doc map[string]any
-	if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+	var schema map[string]any
+	if err := json.Unmarshal([]byte(raw), &schema); err != nil {
 		return nil, err
 	}
-	return doc, nil
+	return schema, nil
 }
 
-func (s *SqliteStore) Put(collection, key string, data map[string]any) error {
+func (s *SqliteStore) PutSchema(collection string, schema map[string]any) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	b, err := json.Marshal(data)
+	b, err := json.Marshal(schema)
 	if err != nil {
 		return err
 	}
+	// A schema saved before versions were kept becomes version 1.
+	if _, err := s.db.Exec(
+		`INSERT INTO schema_versions (collection, version, schema)
+		 SELECT collection, 1, schema FROM schemas WHERE collection = ?
+		 AND NOT EXISTS (SELECT 1 FROM schema_versions WHERE collection = ?)`,
+		collection, collection,
+	); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(
+		`INSERT INTO schema_versions (collection, version, schema)
+		 SELECT ?, COALESCE(MAX(version), (SELECT version FROM schema_deleted WHERE collection = ?), 0) + 1, ?
+		 FROM schema_versions WHERE collection = ?`,
+		collection, collection, string(b), collection,
+	); err != nil {
+		return err
+	}
 	_, err = s.db.Exec(
-		`INSERT INTO documents (collection, key, data) VALUES (?, ?, ?)
-		 ON CONFLICT(collection, key) DO UPDATE SET data = excluded.data`,
-		collection, key, string(b),
+		`INSERT INTO schemas (collection, schema) VALUES (?, ?)
+		 ON CONFLICT(collection) DO UPDATE SET schema = excluded.schema`,
+		collection, string(b),
 	)
 	return err
 }
 
-func (s *SqliteStore) PutIfNewer(collection, key string, data map[string]any) (map[string]any, bool, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	// Read existing within the same lock
-	var raw string
-	err := s.db.QueryRow(
-		"SELECT data FROM documents WHERE collection = ? AND key = ?",
-		collection, key,
-	).Scan(&raw)
-	if err == nil {
-		var existing map[string]any
-		if jsonErr := json.Unmarshal([]byte(raw), &existing); jsonErr == nil {
-			if !IsNewer(data, existing) {
-				return existing, false, nil
-			}
-		}
-	}
-
-	b, err := json.Marshal(data)
-	if err != nil {
-		return nil, false, err
+func (s *SqliteStore) SchemaVersions(collection string) (int, []map[string]any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	first := 1
+	err := s.db.QueryRow("SELECT version + 1 FROM schema_deleted WHERE collection = ?", collection).Scan(&first)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, nil, err
 	}
-	_, err = s.db.Exec(
-		`INSERT INTO documents (collection, key, data) VALUES (?, ?, ?)
-		 ON CONFLICT(collection, key) DO UPDATE SET data = excluded.data`,
-		collection, key, string(b),
+	rows, err := s.db.Query(
+		`SELECT version, schema FROM schema_versions WHERE collection = ?
+		 UNION ALL
+		 SELECT 1, schema FROM schemas WHERE collection = ?
+		 AND NOT EXISTS (SELECT 1 FROM schema_versions WHERE collection = ?)
+		 ORDER BY 1`,
+		collection, collection, collection,
 	)
 	if err != nil {
-		return nil, false, err
+		return 0, nil, err
 	}
-	return data, true, nil
+	defer rows.Close()
+	versions := []map[string]any{}
+	for rows.Next() {
+		var version int
+		var raw string
+		if err := rows.Scan(&version, &raw); err != nil {
+			return 0, nil, err
+		}
+		var schema map[string]any
+		if err := json.Unmarshal([]byte(raw), &schema); err != nil {
+			return 0, nil, err
+		}
+		if len(versions) == 0 {
+			first = version
+		}
+		versions = append(versions, schema)
+	}
+	return first, versions, rows.Err()
 }
 
-func (s *SqliteStore) Delete(collection, key string) (bool, error) {
+func (s *SqliteStore) DeleteSchema(collection string) (bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	res, err := s.db.Exec(
-		"DELETE FROM documents WHERE collection = ? AND key = ?",
-		collection, key,
-	)
+	// Remember the last version, counting a schema saved before versions
+	// were kept as version 1.
+	if _, err := s.db.Exec(
+		`INSERT INTO schema_deleted (collection, version)
+		 SELECT ?, COALESCE((SELECT MAX(version) FROM schema_versions WHERE collection = ?), 1)
+		 WHERE EXISTS (SELECT 1 FROM schemas WHERE collection = ?)
+		 ON CONFLICT(collection) DO UPDATE SET version = excluded.version`,
+		collection, collection, collection,
+	); err != nil {
+		return false, err
+	}
+	if _, err := s.db.Exec("DELETE FROM schema_versions WHERE collection = ?", collection); err != nil {
+		return false, err
+	}
+	res, err := s.db.Exec("DELETE FROM schemas WHERE collection = ?", collection)
 	if err != nil {
 		return false, err
 	}
@@ -161,62 +1262,66 @@ func (s *SqliteStore) Delete(collection, key string) (bool, error) {
 	return n > 0, nil
 }
 
-func (s *SqliteStore) ListCollections() ([]string, error) {
+func (s *SqliteStore) ListSchemas() (map[string]map[string]any, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	rows, err := s.db.Query("SELECT DISTINCT collection FROM documents ORDER BY collection")
+	rows, err := s.db.Query("SELECT collection, schema FROM schemas")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var names []string
+	result := make(map[string]map[string]any)
 	for rows.Next() {
-		var name string
-		if err := rows.Scan(&name); err != nil {
+		var name, raw string
+		if err := rows.Scan(&name, &raw); err != nil {
 			return nil, err
 		}
-		names = append(names, name)
+		var schema map[string]any
+		if err := json.Unmarshal([]byte(raw), &schema); err != nil {
+			continue
+		}
+		result[name] = schema
 	}
-	return names, rows.Err()
+	return result, rows.Err()
 }
 
-func (s *SqliteStore) GetSchema(collection string) (map[string]any, error) {
+func (s *SqliteStore) GetAPIKey(id string) (map[string]any, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	var raw string
-	err := s.db.QueryRow("SELECT schema FROM schemas WHERE collection = ?", collection).Scan(&raw)
+	err := s.db.QueryRow("SELECT key FROM api_keys WHERE id = ?", id).Scan(&raw)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	var schema map[string]any
-	if err := json.Unmarshal([]byte(raw), &schema); err != nil {
+	var key map[string]any
+	if err := json.Unmarshal([]byte(raw), &key); err != nil {
 		return nil, err
 	}
-	return schema, nil
+	return key, nil
 }
 
-func (s *SqliteStore) PutSchema(collection string, schema map[string]any) error {
+func (s *SqliteStore) PutAPIKey(id string, key map[string]any) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	b, err := json.Marshal(schema)
+	b, err := json.Marshal(key)
 	if err != nil {
 		return err
 	}
 	_, err = s.db.Exec(
-		`INSERT INTO schemas (collection, schema) VALUES (?, ?)
-		 ON CONFLICT(collection) DO UPDATE SET schema = excluded.schema`,
-		collection, string(b),
+		`INSERT INTO api_keys (id, key) VALUES (?, ?)
+		 ON CONFLICT(id) DO UPDATE SET key = excluded.key`,
+		id, string(b),
 	)
 	return err
 }
 
-func (s *SqliteStore) DeleteSchema(collection string) (bool, error) {
+func (s *SqliteStore) DeleteAPIKey(id string) (bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	res, err := s.db.Exec("DELETE FROM schemas WHERE collection = ?", collection)
+	res, err := s.db.Exec("DELETE FROM api_keys WHERE id = ?", id)
 	if err != nil {
 		return false, err
 	}
@@ -224,25 +1329,135 @@ func (s *SqliteStore) DeleteSchema(collection string) (bool, error) {
 	return n > 0, nil
 }
 
-func (s *SqliteStore) ListSchemas() (map[string]map[string]any, error) {
+func (s *SqliteStore) ListAPIKeys() (map[string]map[string]any, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	rows, err := s.db.Query("SELECT collection, schema FROM schemas")
+	rows, err := s.db.Query("SELECT id, key FROM api_keys")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	result := make(map[string]map[string]any)
 	for rows.Next() {
-		var name, raw string
-		if err := rows.Scan(&name, &raw); err != nil {
+		var id, raw string
+		if err := rows.Scan(&id, &raw); err != nil {
 			return nil, err
 		}
-		var schema map[string]any
-		if err := json.Unmarshal([]byte(raw), &schema); err != nil {
+		var key map[string]any
+		if err := json.Unmarshal([]byte(raw), &key); err != nil {
 			continue
 		}
-		result[name] = schema
+		result[id] = key
+	}
+	return result, rows.Err()
+}
+
+func (s *SqliteStore) GetACL(collection, key string) (map[string]any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var raw string
+	err := s.db.QueryRow("SELECT acl FROM acls WHERE collection = ? AND key = ?", collection, key).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var acl map[string]any
+	if err := json.Unmarshal([]byte(raw), &acl); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func (s *SqliteStore) PutACL(collection, key string, acl map[string]any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.putACL(collection, key, acl)
+}
+
+// putACL writes or (for nil) removes an ACL and its entries; the caller
+// holds the lock.
+func (s *SqliteStore) putACL(collection, key string, acl map[string]any) error {
+	if _, err := s.db.Exec("DELETE FROM acl_entries WHERE collection = ? AND key = ?", collection, key); err != nil {
+		return err
+	}
+	if acl == nil {
+		_, err := s.db.Exec("DELETE FROM acls WHERE collection = ? AND key = ?", collection, key)
+		return err
+	}
+	b, err := json.Marshal(acl)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(
+		`INSERT INTO acls (collection, key, acl) VALUES (?, ?, ?)
+		 ON CONFLICT(collection, key) DO UPDATE SET acl = excluded.acl`,
+		collection, key, string(b),
+	); err != nil {
+		return err
+	}
+	for _, name := range aclNames(acl) {
+		if _, err := s.db.Exec("INSERT INTO acl_entries (collection, name, key) VALUES (?, ?, ?)", collection, name, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SqliteStore) ListACLs(collection string) (map[string]map[string]any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, err := s.db.Query("SELECT key, acl FROM acls WHERE collection = ?", collection)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]map[string]any)
+	for rows.Next() {
+		var key, raw string
+		if err := rows.Scan(&key, &raw); err != nil {
+			return nil, err
+		}
+		var acl map[string]any
+		if err := json.Unmarshal([]byte(raw), &acl); err != nil {
+			continue
+		}
+		result[key] = acl
+	}
+	return result, rows.Err()
+}
+
+func (s *SqliteStore) ListACLsFor(collection string, names []string) (map[string]map[string]any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make(map[string]map[string]any)
+	if len(names) == 0 {
+		return result, nil
+	}
+	args := []any{collection, collection}
+	for _, name := range names {
+		args = append(args, name)
+	}
+	rows, err := s.db.Query(
+		`SELECT key, acl FROM acls WHERE collection = ? AND key IN (
+			SELECT key FROM acl_entries WHERE collection = ? AND name IN (?`+strings.Repeat(", ?", len(names)-1)+`))`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, raw string
+		if err := rows.Scan(&key, &raw); err != nil {
+			return nil, err
+		}
+		var acl map[string]any
+		if err := json.Unmarshal([]byte(raw), &acl); err != nil {
+			continue
+		}
+		result[key] = acl
 	}
 	return result, rows.Err()
 }
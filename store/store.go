@@ -2,11 +2,60 @@
 package store
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
 )
 
+// Precondition inspects the current version of a document (nil if there is
+// none) before a conditional write and returns an error to abort it.
+type Precondition func(existing map[string]any) error
+
+// checkPreconditions returns the error of the first failing precondition.
+func checkPreconditions(existing map[string]any, pre []Precondition) error {
+	for _, p := range pre {
+		if err := p(existing); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Revision identifies the content of a document, for use as an ETag. It is
+// "" for a missing (nil) document.
+func Revision(doc map[string]any) string {
+	if doc == nil {
+		return ""
+	}
+	b, _ := json.Marshal(doc) // map keys are sorted, so the encoding is canonical
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:16])
+}
+
+// Stats describes how much a collection holds.
+type Stats struct {
+	Documents int   `json:"documents"`
+	Bytes     int64 `json:"bytes"` // total size of the documents' JSON encoding
+}
+
+// DocSize returns the size of a document as counted by Stats.
+func DocSize(doc map[string]any) int64 {
+	b, _ := json.Marshal(doc)
+	return int64(len(b))
+}
+
+// statsOf computes Stats for a set of documents.
+func statsOf(docs map[string]map[string]any) Stats {
+	st := Stats{Documents: len(docs)}
+	for _, doc := range docs {
+		st.Bytes += DocSize(doc)
+	}
+	return st
+}
+
 // Store is the interface that all backing stores must implement.
 // It operates on named collections, where each collection contains
 // documents keyed by a string identifier.
@@ -17,32 +66,121 @@ type Store interface {
 	// Get returns a single document by key, or nil if not found.
 	Get(collection, key string) (map[string]any, error)
 
+	// Query returns the documents of a collection that match q, in q's order,
+	// one page at a time.
+	Query(collection string, q Query) (*Page, error)
+
+	// Aggregate computes metrics over the documents of a collection that
+	// match a.Filter, per group of a.GroupBy values, ordered by group key.
+	Aggregate(collection string, a Aggregation) ([]Group, error)
+
 	// Put inserts or replaces a document.
 	Put(collection, key string, data map[string]any) error
 
 	// PutIfNewer atomically writes data only if its updatedAt is newer than the
 	// existing document's updatedAt. Returns the stored document (either the
 	// incoming data if written or the existing data if not) and whether a write
-	// occurred.
-	PutIfNewer(collection, key string, data map[string]any) (stored map[string]any, written bool, err error)
+	// occurred. Any preconditions are checked first, in the same atomic step;
+	// the first to fail aborts the write and its error is returned.
+	PutIfNewer(collection, key string, data map[string]any, pre ...Precondition) (stored map[string]any, written bool, err error)
+
+	// Delete removes a document. Returns true if it existed. Preconditions
+	// are checked as for PutIfNewer.
+	Delete(collection, key string, pre ...Precondition) (bool, error)
 
-	// Delete removes a document. Returns true if it existed.
-	Delete(collection, key string) (bool, error)
+	// CompareAndSwap atomically replaces a document with data, or deletes it
+	// if data is nil, only if its current Revision is rev ("" meaning that
+	// it must not exist). It reports whether the swap happened. Any
+	// preconditions are checked first, as for PutIfNewer. Timestamps are not
+	// compared.
+	CompareAndSwap(collection, key, rev string, data map[string]any, pre ...Precondition) (bool, error)
+
+	// GetACL returns the access control list attached to a document, or nil
+	// if it has none.
+	GetACL(collection, key string) (map[string]any, error)
+
+	// PutACL attaches an access control list to a document, replacing any
+	// previous one; nil removes it. ACLs are removed along with their
+	// document or collection.
+	PutACL(collection, key string, acl map[string]any) error
+
+	// ListACLs returns the access control lists of a collection by key.
+	ListACLs(collection string) (map[string]map[string]any, error)
+
+	// ListACLsFor returns, by key, the access control lists of a collection
+	// whose "read" or "write" entries include any of names. ACLs are indexed
+	// by entry, so the lookup does not read the collection's other ACLs.
+	ListACLsFor(collection string, names []string) (map[string]map[string]any, error)
 
 	// ListCollections returns the names of all collections that contain data.
 	ListCollections() ([]string, error)
 
+	// Stats returns the number and total size of a collection's documents.
+	Stats(collection string) (Stats, error)
+
+	// DropCollection removes every document of a collection together with
+	// its secondary indexes and search configuration. Its schema is kept.
+	// Returns true if the collection held any data.
+	DropCollection(collection string) (bool, error)
+
+	// EnsureIndex declares a secondary index on a (dot-separated) field path
+	// of a collection. It is a no-op if the index exists. Indexes on populated
+	// collections are built in the background and are used by Query once
+	// ready; from then on every write maintains them.
+	EnsureIndex(collection, field string) error
+
+	// DropIndex removes a secondary index. Returns true if it existed.
+	DropIndex(collection, field string) (bool, error)
+
+	// ListIndexes returns the secondary indexes declared on a collection.
+	ListIndexes(collection string) ([]Index, error)
+
+	// SetSearchFields sets the (dot-separated) field paths of a collection
+	// that are indexed for full-text search and reindexes the collection.
+	// An empty list disables search.
+	SetSearchFields(collection string, fields []string) error
+
+	// SearchFields returns the searchable fields of a collection.
+	SearchFields(collection string) ([]string, error)
+
+	// Search returns the documents whose searchable fields contain every word
+	// of query, best match first. A word ending in "*" matches as a prefix.
+	// A limit of zero means no limit.
+	Search(collection, query string, limit int) ([]SearchHit, error)
+
 	// GetSchema returns the JSON Schema for a collection, or nil.
 	GetSchema(collection string) (map[string]any, error)
 
-	// PutSchema stores a JSON Schema for a collection.
+	// PutSchema stores a JSON Schema for a collection as its next version.
 	PutSchema(collection string, schema map[string]any) error
 
-	// DeleteSchema removes the schema for a collection. Returns true if it existed.
+	// SchemaVersions returns every schema stored for a collection, oldest
+	// first, and the version number of the first (or, if there are none, of
+	// the next one stored): version first+i is element i, and GetSchema
+	// returns the last.
+	SchemaVersions(collection string) (first int, versions []map[string]any, err error)
+
+	// DeleteSchema removes the schema for a collection, with all its
+	// versions. Returns true if it existed. Version numbers are not reused:
+	// the next schema stored continues from the last deleted version, so
+	// documents that record a deleted version are not taken for newer ones.
 	DeleteSchema(collection string) (bool, error)
 
 	// ListSchemas returns all schemas as collection_name -> schema.
 	ListSchemas() (map[string]map[string]any, error)
+
+	// GetAPIKey returns the stored record of an API key, or nil.
+	GetAPIKey(id string) (map[string]any, error)
+
+	// PutAPIKey stores an API key record. Records hold a hash of the secret,
+	// never the secret itself.
+	PutAPIKey(id string, key map[string]any) error
+
+	// DeleteAPIKey removes an API key record. Returns true if it existed.
+	DeleteAPIKey(id string) (bool, error)
+
+	// ListAPIKeys returns all API key records as id -> record.
+	ListAPIKeys() (map[string]map[string]any, error)
 }
 
 // ParseTimestamp parses an ISO 8601 timestamp string, trying RFC3339Nano first.
@@ -1,9 +1,14 @@
 package store_test
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/stevemurr/simple-sync-server/store"
@@ -123,6 +128,326 @@ func runStoreTests(t *testing.T, s store.Store) {
 		}
 	})
 
+	t.Run("Query pages in key order", func(t *testing.T) {
+		for _, k := range []string{"p3", "p1", "p2"} {
+			if err := s.Put("paged", k, map[string]any{"n": k}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var keys []string
+		cursor := ""
+		for {
+			page, err := s.Query("paged", store.Query{Limit: 2, Cursor: cursor})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, item := range page.Items {
+				keys = append(keys, item.Key)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			cursor = page.NextCursor
+		}
+		if strings.Join(keys, ",") != "p1,p2,p3" {
+			t.Fatalf("expected p1,p2,p3, got %v", keys)
+		}
+	})
+
+	t.Run("Query orders by updatedAt and filters since", func(t *testing.T) {
+		s.Put("timed", "a", map[string]any{"updatedAt": "2024-03-01T00:00:00Z"})
+		s.Put("timed", "b", map[string]any{"updatedAt": "2024-01-01T00:00:00Z"})
+		s.Put("timed", "c", map[string]any{"updatedAt": "2024-02-01T00:00:00+01:00"})
+		s.Put("timed", "d", map[string]any{"title": "no timestamp"})
+
+		since, _ := store.ParseTimestamp("2024-01-15T00:00:00Z")
+		page, err := s.Query("timed", store.Query{OrderBy: store.OrderByUpdatedAt, Since: &since, Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Items) != 1 || page.Items[0].Key != "c" {
+			t.Fatalf("expected [c], got %v", page.Items)
+		}
+		page, err = s.Query("timed", store.Query{OrderBy: store.OrderByUpdatedAt, Since: &since, Limit: 1, Cursor: page.NextCursor})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Items) != 1 || page.Items[0].Key != "a" || page.NextCursor != "" {
+			t.Fatalf("expected final page [a], got %v (next=%q)", page.Items, page.NextCursor)
+		}
+	})
+
+	t.Run("Query filters and projects", func(t *testing.T) {
+		docs := map[string]map[string]any{
+			"f1": {"status": "open", "priority": float64(1), "done": false, "owner": map[string]any{"id": "u1"}},
+			"f2": {"status": "open", "priority": float64(3), "done": true, "owner": map[string]any{"id": "u2"}},
+			"f3": {"status": "closed", "priority": "high", "due": nil},
+			"f4": {"status": "closed", "priority": float64(5)},
+		}
+		for k, doc := range docs {
+			if err := s.Put("filtered", k, doc); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			filter string
+			want   string
+		}{
+			{`{"status": "open"}`, "f1,f2"},
+			{`{"status": {"$ne": "open"}}`, "f3,f4"},
+			{`{"priority": {"$gte": 3}}`, "f2,f4"},
+			{`{"priority": {"$gt": 1, "$lt": 5}}`, "f2"},
+			{`{"priority": {"$gt": "a"}}`, "f3"},
+			{`{"status": {"$in": ["closed", "archived"]}, "priority": {"$lte": 10}}`, "f4"},
+			{`{"done": true}`, "f2"},
+			{`{"due": {"$exists": true}}`, "f3"},
+			{`{"due": null}`, "f3"},
+			{`{"owner.id": "u2"}`, "f2"},
+			{`{"owner": {"id": "u1"}}`, "f1"},
+			{`{"owner.id": {"$exists": false}}`, "f3,f4"},
+			{`{"$or": [{"done": true}, {"priority": "high"}]}`, "f2,f3"},
+			{`{"status": "open", "$or": [{"done": true}, {"priority": {"$lt": 1}}]}`, "f2"},
+			{`{"$or": [{"owner": {"id": "u1"}}, {"priority": 5}]}`, "f1,f4"},
+			{`{"$key": {"$in": ["f2", "f3", "f9"]}}`, "f2,f3"},
+			{`{"$or": [{"$key": "f1"}, {"done": true}]}`, "f1,f2"},
+		}
+		for _, tc := range tests {
+			f, err := store.ParseFilter(tc.filter)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.filter, err)
+			}
+			page, err := s.Query("filtered", store.Query{Filter: f})
+			if err != nil {
+				t.Fatalf("%s: %v", tc.filter, err)
+			}
+			var keys []string
+			for _, item := range page.Items {
+				keys = append(keys, item.Key)
+			}
+			if got := strings.Join(keys, ","); got != tc.want {
+				t.Errorf("%s: expected %s, got %s", tc.filter, tc.want, got)
+			}
+		}
+
+		page, err := s.Query("filtered", store.Query{Fields: []string{"status", "owner.id"}, Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := page.Items[0].Data
+		if len(got) != 2 || got["status"] != "open" || got["owner"].(map[string]any)["id"] != "u1" {
+			t.Fatalf("unexpected projection %v", got)
+		}
+	})
+
+	t.Run("Secondary indexes", func(t *testing.T) {
+		if err := s.EnsureIndex("filtered", "owner.id"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.EnsureIndex("filtered", "owner.id"); err != nil {
+			t.Fatalf("EnsureIndex should be idempotent: %v", err)
+		}
+		waitIndexReady(t, s, "filtered", "owner.id")
+
+		s.Put("filtered", "f5", map[string]any{"owner": map[string]any{"id": "u2"}})
+		s.Delete("filtered", "f2")
+		f, _ := store.ParseFilter(`{"owner.id": {"$in": ["u1", "u2"]}}`)
+		page, err := s.Query("filtered", store.Query{Filter: f})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Items) != 2 || page.Items[0].Key != "f1" || page.Items[1].Key != "f5" {
+			t.Fatalf("expected [f1 f5], got %v", page.Items)
+		}
+
+		existed, err := s.DropIndex("filtered", "owner.id")
+		if err != nil || !existed {
+			t.Fatalf("expected drop to succeed, got %v, %v", existed, err)
+		}
+		indexes, _ := s.ListIndexes("filtered")
+		if len(indexes) != 0 {
+			t.Fatalf("expected no indexes, got %v", indexes)
+		}
+		if err := s.EnsureIndex("filtered", "bad..path"); !errors.Is(err, store.ErrInvalidQuery) {
+			t.Fatalf("expected ErrInvalidQuery for invalid field path, got %v", err)
+		}
+	})
+
+	t.Run("Index built during writes", func(t *testing.T) {
+		for i := range 500 {
+			s.Put("building", fmt.Sprintf("k%03d", i), map[string]any{"n": float64(i % 5)})
+		}
+		if err := s.EnsureIndex("building", "n"); err != nil {
+			t.Fatal(err)
+		}
+		// Writes racing the build must be reflected once it is ready.
+		s.Put("building", "k000", map[string]any{"n": float64(9)})
+		s.Delete("building", "k005")
+		s.Put("building", "new", map[string]any{"n": float64(0)})
+		waitIndexReady(t, s, "building", "n")
+
+		f, _ := store.ParseFilter(`{"n": 0}`)
+		page, err := s.Query("building", store.Query{Filter: f, Limit: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Items) != 99 || page.Items[0].Key != "k010" || page.Items[98].Key != "new" {
+			t.Fatalf("expected k010..k495 and new, got %d items", len(page.Items))
+		}
+		f, _ = store.ParseFilter(`{"n": 9}`)
+		page, _ = s.Query("building", store.Query{Filter: f})
+		if len(page.Items) != 1 || page.Items[0].Key != "k000" {
+			t.Fatalf("expected [k000], got %v", page.Items)
+		}
+	})
+
+	t.Run("Full-text search", func(t *testing.T) {
+		s.Put("notes", "n1", map[string]any{"title": "Groceries", "body": "Buy milk and eggs on the way home"})
+		s.Put("notes", "n2", map[string]any{"title": "Milk", "body": "Milk, milk, milk: the dairy aisle"})
+		if err := s.SetSearchFields("notes", []string{"title", "body"}); err != nil {
+			t.Fatal(err)
+		}
+		s.Put("notes", "n3", map[string]any{"title": "Garden", "body": "Plant tomatoes"})
+		s.Put("notes", "n4", map[string]any{"title": "Milkshake recipe", "body": "blend"})
+
+		fields, err := s.SearchFields("notes")
+		if err != nil || strings.Join(fields, ",") != "title,body" {
+			t.Fatalf("expected title,body, got %v (%v)", fields, err)
+		}
+
+		hits, err := s.Search("notes", "milk", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != 2 || hits[0].Key != "n2" || hits[1].Key != "n1" {
+			t.Fatalf("expected [n2 n1] ranked by relevance, got %v", hits)
+		}
+		if !strings.Contains(hits[1].Snippet, "<mark>milk</mark>") || hits[1].Data["title"] != "Groceries" {
+			t.Fatalf("unexpected hit %+v", hits[1])
+		}
+
+		hits, _ = s.Search("notes", "milk eggs", 0)
+		if len(hits) != 1 || hits[0].Key != "n1" {
+			t.Fatalf("expected every word to be required, got %v", hits)
+		}
+		hits, _ = s.Search("notes", "milk*", 1)
+		if len(hits) != 1 {
+			t.Fatalf("expected limit of 1, got %v", hits)
+		}
+		hits, _ = s.Search("notes", "tomatoes", 0)
+		if len(hits) != 1 || hits[0].Key != "n3" {
+			t.Fatalf("expected writes after configuration to be indexed, got %v", hits)
+		}
+		s.Delete("notes", "n3")
+		hits, _ = s.Search("notes", "tomatoes", 0)
+		if len(hits) != 0 {
+			t.Fatalf("expected deleted document to be gone, got %v", hits)
+		}
+
+		if _, err := s.Search("col1", "milk", 0); !errors.Is(err, store.ErrInvalidQuery) {
+			t.Fatalf("expected ErrInvalidQuery without searchable fields, got %v", err)
+		}
+	})
+
+	t.Run("Aggregate", func(t *testing.T) {
+		for k, doc := range map[string]map[string]any{
+			"s1": {"status": "open", "amount": float64(10), "region": map[string]any{"code": "eu"}},
+			"s2": {"status": "open", "amount": float64(5.5), "region": map[string]any{"code": "us"}},
+			"s3": {"status": "closed", "amount": float64(2), "region": map[string]any{"code": "eu"}},
+			"s4": {"status": "closed", "amount": "n/a"},
+			"s5": {"amount": float64(1)},
+		} {
+			s.Put("sales", k, doc)
+		}
+		metrics := []store.Metric{
+			{Func: store.AggCount},
+			{Func: store.AggSum, Field: "amount"},
+			{Func: store.AggMin, Field: "amount"},
+			{Func: store.AggMax, Field: "amount"},
+			{Func: store.AggAvg, Field: "amount"},
+		}
+
+		groups, err := s.Aggregate("sales", store.Aggregation{GroupBy: []string{"status"}, Metrics: metrics})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := json.Marshal(groups)
+		want := `[` +
+			`{"key":{"status":"closed"},"values":{"avg(amount)":2,"count":2,"max(amount)":2,"min(amount)":2,"sum(amount)":2}},` +
+			`{"key":{"status":"open"},"values":{"avg(amount)":7.75,"count":2,"max(amount)":10,"min(amount)":5.5,"sum(amount)":15.5}},` +
+			`{"key":{"status":null},"values":{"avg(amount)":1,"count":1,"max(amount)":1,"min(amount)":1,"sum(amount)":1}}]`
+		if string(got) != want {
+			t.Fatalf("unexpected groups:\n got %s\nwant %s", got, want)
+		}
+
+		f, _ := store.ParseFilter(`{"region.code": "eu"}`)
+		groups, err = s.Aggregate("sales", store.Aggregation{Filter: f, Metrics: metrics[:2]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ = json.Marshal(groups)
+		if string(got) != `[{"key":{},"values":{"count":2,"sum(amount)":12}}]` {
+			t.Fatalf("unexpected filtered aggregate %s", got)
+		}
+
+		f, _ = store.ParseFilter(`{"status": "archived"}`)
+		groups, _ = s.Aggregate("sales", store.Aggregation{Filter: f, Metrics: metrics})
+		got, _ = json.Marshal(groups)
+		if string(got) != `[{"key":{},"values":{"avg(amount)":null,"count":0,"max(amount)":null,"min(amount)":null,"sum(amount)":0}}]` {
+			t.Fatalf("unexpected empty aggregate %s", got)
+		}
+
+		if _, err := s.Aggregate("sales", store.Aggregation{}); !errors.Is(err, store.ErrInvalidQuery) {
+			t.Fatalf("expected ErrInvalidQuery without metrics, got %v", err)
+		}
+	})
+
+	t.Run("Preconditions", func(t *testing.T) {
+		errDenied := errors.New("denied")
+		owned := func(existing map[string]any) error {
+			if existing != nil && existing["owner"] != "a" {
+				return errDenied
+			}
+			return nil
+		}
+		doc := map[string]any{"owner": "b", "updatedAt": "2024-01-01T00:00:00Z"}
+		if _, _, err := s.PutIfNewer("guarded", "k", doc, owned); err != nil {
+			t.Fatalf("expected write to a new key, got %v", err)
+		}
+		newer := map[string]any{"owner": "a", "updatedAt": "2024-02-01T00:00:00Z"}
+		if _, _, err := s.PutIfNewer("guarded", "k", newer, owned); !errors.Is(err, errDenied) {
+			t.Fatalf("expected errDenied, got %v", err)
+		}
+		older := map[string]any{"owner": "a", "updatedAt": "2023-01-01T00:00:00Z"}
+		if stored, _, err := s.PutIfNewer("guarded", "k", older, owned); !errors.Is(err, errDenied) || stored != nil {
+			t.Fatalf("expected errDenied without the stored doc, got %v, %v", stored, err)
+		}
+		if _, err := s.Delete("guarded", "k", owned); !errors.Is(err, errDenied) {
+			t.Fatalf("expected errDenied on delete, got %v", err)
+		}
+		got, _ := s.Get("guarded", "k")
+		if got["owner"] != "b" {
+			t.Fatalf("expected untouched doc, got %v", got)
+		}
+		if existed, err := s.Delete("guarded", "k"); err != nil || !existed {
+			t.Fatalf("expected unconditional delete, got %v, %v", existed, err)
+		}
+	})
+
+	t.Run("Query rejects bad input", func(t *testing.T) {
+		if _, err := s.Query("paged", store.Query{OrderBy: "size"}); !errors.Is(err, store.ErrInvalidQuery) {
+			t.Fatalf("expected ErrInvalidQuery for orderBy, got %v", err)
+		}
+		if _, err := s.Query("paged", store.Query{Cursor: "!!"}); !errors.Is(err, store.ErrInvalidQuery) {
+			t.Fatalf("expected ErrInvalidQuery for cursor, got %v", err)
+		}
+		for _, f := range []string{`{"$or": []}`, `{"$or": {"a": 1}}`, `{"$or": [1]}`} {
+			if _, err := store.ParseFilter(f); !errors.Is(err, store.ErrInvalidQuery) {
+				t.Fatalf("%s: expected ErrInvalidQuery, got %v", f, err)
+			}
+		}
+	})
+
 	// Schema tests
 	t.Run("GetSchema missing", func(t *testing.T) {
 		sch, err := s.GetSchema("nope")
@@ -167,6 +492,25 @@ func runStoreTests(t *testing.T, s store.Store) {
 		}
 	})
 
+	t.Run("SchemaVersions", func(t *testing.T) {
+		if err := s.PutSchema("users", map[string]any{"type": "object", "title": "v2"}); err != nil {
+			t.Fatal(err)
+		}
+		first, versions, err := s.SchemaVersions("users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != 1 || len(versions) != 2 || versions[0]["required"] == nil || versions[1]["title"] != "v2" {
+			t.Fatalf("expected both versions oldest first, got %v", versions)
+		}
+		if got, _ := s.GetSchema("users"); got["title"] != "v2" {
+			t.Fatalf("expected the latest version, got %v", got)
+		}
+		if first, versions, _ := s.SchemaVersions("nope"); first != 1 || len(versions) != 0 {
+			t.Fatalf("expected no versions, got %v", versions)
+		}
+	})
+
 	t.Run("DeleteSchema", func(t *testing.T) {
 		existed, err := s.DeleteSchema("users")
 		if err != nil {
@@ -182,7 +526,335 @@ func runStoreTests(t *testing.T, s store.Store) {
 		if got != nil {
 			t.Fatal("expected nil after delete")
 		}
+		if _, versions, _ := s.SchemaVersions("users"); len(versions) != 0 {
+			t.Fatalf("expected versions to be deleted, got %v", versions)
+		}
+		// Version numbers continue after a delete.
+		if err := s.PutSchema("users", map[string]any{"title": "v3"}); err != nil {
+			t.Fatal(err)
+		}
+		if first, versions, _ := s.SchemaVersions("users"); first != 3 || len(versions) != 1 || versions[0]["title"] != "v3" {
+			t.Fatalf("expected version 3 alone, got %d %v", first, versions)
+		}
+		if existed, err := s.DeleteSchema("users"); err != nil || !existed {
+			t.Fatalf("expected the schema to be deleted, got %v %v", existed, err)
+		}
+		if first, _, _ := s.SchemaVersions("users"); first != 4 {
+			t.Fatalf("expected the next version to be 4, got %d", first)
+		}
+	})
+
+	t.Run("Tenants", func(t *testing.T) {
+		acme := store.ForTenant(s, "acme")
+		globex := store.ForTenant(s, "globex")
+		if err := acme.Put("shared-name", "k", map[string]any{"v": "acme"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := globex.Put("shared-name", "k", map[string]any{"v": "globex"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := acme.PutSchema("shared-name", map[string]any{"type": "object"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := acme.SetSearchFields("shared-name", []string{"v"}); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := globex.Get("shared-name", "k")
+		if got["v"] != "globex" {
+			t.Fatalf("expected globex's document, got %v", got)
+		}
+		if sch, _ := globex.GetSchema("shared-name"); sch != nil {
+			t.Fatalf("schema leaked across tenants: %v", sch)
+		}
+		names, _ := acme.ListCollections()
+		if len(names) != 1 || names[0] != "shared-name" {
+			t.Fatalf("expected [shared-name], got %v", names)
+		}
+		defaults, _ := store.ForTenant(s, "").ListCollections()
+		for _, name := range defaults {
+			if strings.Contains(name, store.TenantSeparator) {
+				t.Fatalf("default namespace lists tenant collection %q", name)
+			}
+		}
+		if _, err := acme.Get("globex~shared-name", "k"); !errors.Is(err, store.ErrInvalidQuery) {
+			t.Fatalf("expected ErrInvalidQuery for a prefixed name, got %v", err)
+		}
+		tenants, _ := store.Tenants(s)
+		if strings.Join(tenants, ",") != "acme,globex" {
+			t.Fatalf("expected acme,globex, got %v", tenants)
+		}
+
+		existed, err := acme.DropCollection("shared-name")
+		if err != nil || !existed {
+			t.Fatalf("expected drop of existing collection, got %v, %v", existed, err)
+		}
+		if docs, _ := acme.GetAll("shared-name"); len(docs) != 0 {
+			t.Fatalf("expected no documents after drop, got %v", docs)
+		}
+		if fields, _ := acme.SearchFields("shared-name"); len(fields) != 0 {
+			t.Fatalf("expected search fields dropped, got %v", fields)
+		}
+		if sch, _ := acme.GetSchema("shared-name"); sch == nil {
+			t.Fatal("expected schema to survive drop")
+		}
+		if got, _ := globex.Get("shared-name", "k"); got == nil {
+			t.Fatal("drop removed another tenant's data")
+		}
+		acme.DeleteSchema("shared-name")
+		globex.DropCollection("shared-name")
 	})
+
+	// API key tests
+	t.Run("CompareAndSwap", func(t *testing.T) {
+		v1 := map[string]any{"v": 1.0}
+		if ok, err := s.CompareAndSwap("cas", "a", "x", v1); err != nil || ok {
+			t.Fatalf("expected no swap for a wrong revision, got %v %v", ok, err)
+		}
+		if ok, err := s.CompareAndSwap("cas", "a", "", v1); err != nil || !ok {
+			t.Fatalf("expected create with an empty revision, got %v %v", ok, err)
+		}
+		if ok, _ := s.CompareAndSwap("cas", "a", "", v1); ok {
+			t.Fatal("expected an empty revision to fail once the document exists")
+		}
+		got, _ := s.Get("cas", "a")
+		rev := store.Revision(got)
+		if rev != store.Revision(v1) {
+			t.Fatalf("revision changed in storage: %s != %s", rev, store.Revision(v1))
+		}
+
+		// Preconditions run first; timestamps are ignored.
+		fail := errors.New("nope")
+		if _, err := s.CompareAndSwap("cas", "a", rev, map[string]any{"v": 2.0}, func(map[string]any) error { return fail }); err != fail {
+			t.Fatalf("expected the precondition error, got %v", err)
+		}
+		v2 := map[string]any{"v": 2.0, "updatedAt": "2000-01-01T00:00:00Z"}
+		if ok, err := s.CompareAndSwap("cas", "a", rev, v2); err != nil || !ok {
+			t.Fatalf("expected swap, got %v %v", ok, err)
+		}
+		if ok, _ := s.CompareAndSwap("cas", "a", rev, nil); ok {
+			t.Fatal("expected a stale revision to fail")
+		}
+		if ok, err := s.CompareAndSwap("cas", "a", store.Revision(v2), nil); err != nil || !ok {
+			t.Fatalf("expected delete, got %v %v", ok, err)
+		}
+		if got, _ := s.Get("cas", "a"); got != nil {
+			t.Fatalf("expected document to be deleted, got %v", got)
+		}
+	})
+
+	t.Run("Atomically", func(t *testing.T) {
+		s.Put("atomic", "keep", map[string]any{"v": 1.0})
+		s.Put("atomic", "gone", map[string]any{"v": 1.0})
+		s.PutACL("atomic", "gone", map[string]any{"read": []any{"bob"}})
+
+		fail := errors.New("abort")
+		err := store.Atomically(s, func(tx store.Store) error {
+			tx.Put("atomic", "keep", map[string]any{"v": 2.0})
+			tx.Put("atomic", "new", map[string]any{"v": 1.0})
+			tx.Delete("atomic", "gone")
+			if doc, _ := tx.Get("atomic", "keep"); doc["v"] != 2.0 {
+				t.Errorf("expected the transaction to see its own write, got %v", doc)
+			}
+			return fail
+		})
+		if err != fail {
+			t.Fatalf("expected the error of fn, got %v", err)
+		}
+		if doc, _ := s.Get("atomic", "keep"); doc["v"] != 1.0 {
+			t.Fatalf("expected update to be undone, got %v", doc)
+		}
+		if doc, _ := s.Get("atomic", "new"); doc != nil {
+			t.Fatalf("expected insert to be undone, got %v", doc)
+		}
+		if doc, _ := s.Get("atomic", "gone"); doc == nil {
+			t.Fatal("expected delete to be undone")
+		}
+		if acl, _ := s.GetACL("atomic", "gone"); acl == nil {
+			t.Fatal("expected the ACL of a deleted document to be restored")
+		}
+
+		// A panic in fn undoes the writes and leaves the store usable.
+		func() {
+			defer func() { recover() }()
+			store.Atomically(s, func(tx store.Store) error {
+				tx.Put("atomic", "panicked", map[string]any{"v": 1.0})
+				panic("boom")
+			})
+		}()
+		if doc, _ := s.Get("atomic", "panicked"); doc != nil {
+			t.Fatalf("expected the write before the panic to be undone, got %v", doc)
+		}
+		if err := s.Put("atomic", "after", map[string]any{"v": 1.0}); err != nil {
+			t.Fatalf("expected writes to work after a panic, got %v", err)
+		}
+
+		err = store.Atomically(s, func(tx store.Store) error {
+			_, err := tx.CompareAndSwap("atomic", "new", "", map[string]any{"v": 3.0})
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc, _ := s.Get("atomic", "new"); doc["v"] != 3.0 {
+			t.Fatalf("expected committed write, got %v", doc)
+		}
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		st, err := s.Stats("sized")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st != (store.Stats{}) {
+			t.Fatalf("expected empty stats, got %+v", st)
+		}
+		a := map[string]any{"text": "hello"}
+		b := map[string]any{"n": 1.0}
+		s.Put("sized", "a", a)
+		s.Put("sized", "b", b)
+		st, err = s.Stats("sized")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := store.Stats{Documents: 2, Bytes: store.DocSize(a) + store.DocSize(b)}
+		if st != want {
+			t.Fatalf("expected %+v, got %+v", want, st)
+		}
+	})
+
+	t.Run("ACLs", func(t *testing.T) {
+		got, err := s.GetACL("shared", "d1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != nil {
+			t.Fatalf("expected nil, got %v", got)
+		}
+		s.Put("shared", "d1", map[string]any{"x": 1.0})
+		s.Put("shared", "d2", map[string]any{"x": 2.0})
+		if err := s.PutACL("shared", "d1", map[string]any{"read": []any{"bob"}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutACL("shared", "d2", map[string]any{"write": []any{"group:team"}}); err != nil {
+			t.Fatal(err)
+		}
+		got, err = s.GetACL("shared", "d1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read, _ := got["read"].([]any); len(read) != 1 || read[0] != "bob" {
+			t.Fatalf("expected read=[bob], got %v", got)
+		}
+		all, err := s.ListACLs("shared")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 2 {
+			t.Fatalf("expected 2 ACLs, got %v", all)
+		}
+		for names, want := range map[string]int{"bob": 1, "group:team": 1, "bob group:team": 2, "carol": 0} {
+			got, err := s.ListACLsFor("shared", strings.Fields(names))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != want {
+				t.Fatalf("ListACLsFor(%s): expected %d ACLs, got %v", names, want, got)
+			}
+		}
+		s.PutACL("shared", "d1", map[string]any{"read": []any{"carol"}})
+		if got, _ := s.ListACLsFor("shared", []string{"bob"}); len(got) != 0 {
+			t.Fatalf("expected replacing an ACL to unindex its entries, got %v", got)
+		}
+
+		// ACLs go away with their document, or when set to nil.
+		if _, err := s.Delete("shared", "d1"); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := s.GetACL("shared", "d1"); got != nil {
+			t.Fatalf("expected ACL to be deleted with its document, got %v", got)
+		}
+		if got, _ := s.ListACLsFor("shared", []string{"carol"}); len(got) != 0 {
+			t.Fatalf("expected ACL entries to be deleted with their document, got %v", got)
+		}
+		if err := s.PutACL("shared", "d2", nil); err != nil {
+			t.Fatal(err)
+		}
+		if all, _ := s.ListACLs("shared"); len(all) != 0 {
+			t.Fatalf("expected no ACLs, got %v", all)
+		}
+
+		s.PutACL("shared", "d2", map[string]any{"read": []any{"bob"}})
+		if _, err := s.DropCollection("shared"); err != nil {
+			t.Fatal(err)
+		}
+		if all, _ := s.ListACLs("shared"); len(all) != 0 {
+			t.Fatalf("expected DropCollection to remove ACLs, got %v", all)
+		}
+		if got, _ := s.ListACLsFor("shared", []string{"bob"}); len(got) != 0 {
+			t.Fatalf("expected DropCollection to remove ACL entries, got %v", got)
+		}
+	})
+
+	t.Run("API keys", func(t *testing.T) {
+		got, err := s.GetAPIKey("k1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != nil {
+			t.Fatalf("expected nil, got %v", got)
+		}
+		key := map[string]any{"id": "k1", "hash": "abc", "grants": []any{}}
+		if err := s.PutAPIKey("k1", key); err != nil {
+			t.Fatal(err)
+		}
+		got, err = s.GetAPIKey("k1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got["hash"] != "abc" {
+			t.Fatalf("expected hash=abc, got %v", got)
+		}
+		keys, err := s.ListAPIKeys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := keys["k1"]; !ok || len(keys) != 1 {
+			t.Fatalf("expected only k1, got %v", keys)
+		}
+		existed, err := s.DeleteAPIKey("k1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !existed {
+			t.Fatal("expected existed=true")
+		}
+		existed, err = s.DeleteAPIKey("k1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if existed {
+			t.Fatal("expected existed=false on second delete")
+		}
+	})
+}
+
+// waitIndexReady polls until an index has finished building.
+func waitIndexReady(t *testing.T, s store.Store, collection, field string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		indexes, err := s.ListIndexes(collection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ix := range indexes {
+			if ix.Field == field && ix.State == store.IndexReady {
+				return
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("index %s.%s not ready", collection, field)
 }
 
 func TestMemoryStore(t *testing.T) {
@@ -0,0 +1,300 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// TenantSeparator joins a tenant and a collection name in the names kept by
+// a backend, e.g. "acme~tasks". Collection names may not contain it.
+const TenantSeparator = "~"
+
+var tenantName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ValidTenant reports whether name can be used as a tenant: 1 to 64
+// letters, digits, '-' or '_'.
+func ValidTenant(name string) bool {
+	return tenantName.MatchString(name)
+}
+
+// tenantStore confines a Store to one tenant's namespace by prefixing every
+// collection name. API keys are not per tenant and pass straight through.
+type tenantStore struct {
+	Store
+	prefix string
+}
+
+// ForTenant returns a view of s holding only the collections, schemas,
+// indexes and search settings of a tenant. The empty tenant is the default
+// namespace of unprefixed names, which excludes every other tenant's data.
+func ForTenant(s Store, tenant string) Store {
+	if tenant == "" {
+		return &tenantStore{Store: s}
+	}
+	return &tenantStore{Store: s, prefix: tenant + TenantSeparator}
+}
+
+// Tenants returns the tenants holding collections or schemas in s.
+func Tenants(s Store) ([]string, error) {
+	names, err := s.ListCollections()
+	if err != nil {
+		return nil, err
+	}
+	schemas, err := s.ListSchemas()
+	if err != nil {
+		return nil, err
+	}
+	for name := range schemas {
+		names = append(names, name)
+	}
+	seen := make(map[string]bool)
+	tenants := []string{}
+	for _, name := range names {
+		tenant, _, ok := strings.Cut(name, TenantSeparator)
+		if ok && !seen[tenant] {
+			seen[tenant] = true
+			tenants = append(tenants, tenant)
+		}
+	}
+	sort.Strings(tenants)
+	return tenants, nil
+}
+
+// name maps a collection to its name in the underlying store.
+func (t *tenantStore) name(collection string) (string, error) {
+	if strings.Contains(collection, TenantSeparator) {
+		return "", fmt.Errorf("%w: collection names may not contain %q", ErrInvalidQuery, TenantSeparator)
+	}
+	return t.prefix + collection, nil
+}
+
+// own reports whether a name in the underlying store belongs to the tenant
+// and returns the collection name within it.
+func (t *tenantStore) own(name string) (string, bool) {
+	if t.prefix == "" {
+		return name, !strings.Contains(name, TenantSeparator)
+	}
+	return strings.CutPrefix(name, t.prefix)
+}
+
+func (t *tenantStore) GetAll(collection string) (map[string]map[string]any, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return nil, err
+	}
+	return t.Store.GetAll(name)
+}
+
+func (t *tenantStore) Get(collection, key string) (map[string]any, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return nil, err
+	}
+	return t.Store.Get(name, key)
+}
+
+func (t *tenantStore) Query(collection string, q Query) (*Page, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return nil, err
+	}
+	return t.Store.Query(name, q)
+}
+
+func (t *tenantStore) Aggregate(collection string, a Aggregation) ([]Group, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return nil, err
+	}
+	return t.Store.Aggregate(name, a)
+}
+
+func (t *tenantStore) Put(collection, key string, data map[string]any) error {
+	name, err := t.name(collection)
+	if err != nil {
+		return err
+	}
+	return t.Store.Put(name, key, data)
+}
+
+func (t *tenantStore) PutIfNewer(collection, key string, data map[string]any, pre ...Precondition) (map[string]any, bool, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return nil, false, err
+	}
+	return t.Store.PutIfNewer(name, key, data, pre...)
+}
+
+func (t *tenantStore) Delete(collection, key string, pre ...Precondition) (bool, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return false, err
+	}
+	return t.Store.Delete(name, key, pre...)
+}
+
+func (t *tenantStore) CompareAndSwap(collection, key, rev string, data map[string]any, pre ...Precondition) (bool, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return false, err
+	}
+	return t.Store.CompareAndSwap(name, key, rev, data, pre...)
+}
+
+func (t *tenantStore) GetACL(collection, key string) (map[string]any, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return nil, err
+	}
+	return t.Store.GetACL(name, key)
+}
+
+func (t *tenantStore) PutACL(collection, key string, acl map[string]any) error {
+	name, err := t.name(collection)
+	if err != nil {
+		return err
+	}
+	return t.Store.PutACL(name, key, acl)
+}
+
+func (t *tenantStore) ListACLs(collection string) (map[string]map[string]any, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return nil, err
+	}
+	return t.Store.ListACLs(name)
+}
+
+func (t *tenantStore) ListACLsFor(collection string, names []string) (map[string]map[string]any, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return nil, err
+	}
+	return t.Store.ListACLsFor(name, names)
+}
+
+func (t *tenantStore) Stats(collection string) (Stats, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return Stats{}, err
+	}
+	return t.Store.Stats(name)
+}
+
+func (t *tenantStore) ListCollections() ([]string, error) {
+	names, err := t.Store.ListCollections()
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, name := range names {
+		if collection, ok := t.own(name); ok {
+			result = append(result, collection)
+		}
+	}
+	return result, nil
+}
+
+func (t *tenantStore) DropCollection(collection string) (bool, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return false, err
+	}
+	return t.Store.DropCollection(name)
+}
+
+func (t *tenantStore) EnsureIndex(collection, field string) error {
+	name, err := t.name(collection)
+	if err != nil {
+		return err
+	}
+	return t.Store.EnsureIndex(name, field)
+}
+
+func (t *tenantStore) DropIndex(collection, field string) (bool, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return false, err
+	}
+	return t.Store.DropIndex(name, field)
+}
+
+func (t *tenantStore) ListIndexes(collection string) ([]Index, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return nil, err
+	}
+	return t.Store.ListIndexes(name)
+}
+
+func (t *tenantStore) SetSearchFields(collection string, fields []string) error {
+	name, err := t.name(collection)
+	if err != nil {
+		return err
+	}
+	return t.Store.SetSearchFields(name, fields)
+}
+
+func (t *tenantStore) SearchFields(collection string) ([]string, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return nil, err
+	}
+	return t.Store.SearchFields(name)
+}
+
+func (t *tenantStore) Search(collection, query string, limit int) ([]SearchHit, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return nil, err
+	}
+	return t.Store.Search(name, query, limit)
+}
+
+func (t *tenantStore) GetSchema(collection string) (map[string]any, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return nil, err
+	}
+	return t.Store.GetSchema(name)
+}
+
+func (t *tenantStore) PutSchema(collection string, schema map[string]any) error {
+	name, err := t.name(collection)
+	if err != nil {
+		return err
+	}
+	return t.Store.PutSchema(name, schema)
+}
+
+func (t *tenantStore) SchemaVersions(collection string) (int, []map[string]any, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return 0, nil, err
+	}
+	return t.Store.SchemaVersions(name)
+}
+
+func (t *tenantStore) DeleteSchema(collection string) (bool, error) {
+	name, err := t.name(collection)
+	if err != nil {
+		return false, err
+	}
+	return t.Store.DeleteSchema(name)
+}
+
+func (t *tenantStore) ListSchemas() (map[string]map[string]any, error) {
+	schemas, err := t.Store.ListSchemas()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]map[string]any)
+	for name, schema := range schemas {
+		if collection, ok := t.own(name); ok {
+			result[collection] = schema
+		}
+	}
+	return result, nil
+}